@@ -6,8 +6,10 @@ require (
 	github.com/cznic/mathutil v0.0.0-20181122101859-297441e03548
 	github.com/frankban/quicktest v1.11.3 // indirect
 	github.com/golang/protobuf v1.3.4
+	github.com/golang/snappy v0.0.2-0.20190904063534-ff6b7dc882cf
 	github.com/gorilla/websocket v1.4.1 // indirect
 	github.com/grpc-ecosystem/grpc-gateway v1.14.3 // indirect
+	github.com/ncw/directio v1.0.4
 	github.com/onsi/ginkgo v1.9.0 // indirect
 	github.com/onsi/gomega v1.6.0 // indirect
 	github.com/pierrec/lz4 v2.5.2+incompatible
@@ -16,12 +18,14 @@ require (
 	github.com/pingcap/kvproto v0.0.0-20210308063835-39b884695fb8
 	github.com/pingcap/log v0.0.0-20210317133921-96f4fcab92a4
 	github.com/pingcap/tidb v1.1.0-beta.0.20210407104700-3d8084e972d1
+	github.com/prometheus/client_golang v1.5.1
 	github.com/shirou/gopsutil v3.21.2+incompatible
 	github.com/spaolacci/murmur3 v1.1.0 // indirect
 	github.com/stretchr/testify v1.6.1
 	github.com/uber-go/atomic v1.4.0
 	github.com/zhangjinpeng1987/raft v0.0.0-20200819064223-df31bb68a018
 	go.etcd.io/bbolt v1.3.4 // indirect
+	go.etcd.io/etcd v0.5.0-alpha.5.0.20200824191128-ae9734ed278b
 	go.uber.org/zap v1.16.0
 	golang.org/x/lint v0.0.0-20200302205851-738671d3881b // indirect
 	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
@@ -336,8 +336,16 @@ func (ac *applyContext) commitOpt(d *applier, persistent bool) {
 // Writes all the changes into badger.
 func (ac *applyContext) writeToDB() {
 	if ac.wb.size != 0 {
-		if err := ac.wb.WriteToKV(ac.engines.kv); err != nil {
-			panic(err)
+		for {
+			err := ac.engines.WriteKV(ac.wb)
+			if stall, ok := err.(*ErrWriteStall); ok {
+				log.S().Warnf("%s, retry the apply write", stall)
+				continue
+			}
+			if err != nil {
+				panic(err)
+			}
+			break
 		}
 		ac.wb.Reset()
 		ac.wbLastBytes = 0
@@ -618,8 +626,7 @@ func (a *applier) updateMetrics(aCtx *applyContext) {
 }
 
 func (a *applier) writeApplyState(wb *WriteBatch) {
-	applyStateKey := y.KeyWithTs(ApplyStateKey(a.region.Id), KvTS)
-	wb.Set(applyStateKey, a.applyState.Marshal())
+	setApplyState(wb, a.region.Id, a.applyState)
 }
 
 func (a *applier) handleRaftEntryNormal(aCtx *applyContext, entry *eraftpb.Entry) applyResult {
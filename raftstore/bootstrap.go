@@ -137,7 +137,7 @@ func writeInitialApplyState(kvWB *WriteBatch, regionID uint64) {
 		truncatedIndex: RaftInitLogIndex,
 		truncatedTerm:  RaftInitLogTerm,
 	}
-	kvWB.Set(y.KeyWithTs(ApplyStateKey(regionID), KvTS), applyState.Marshal())
+	setApplyState(kvWB, regionID, applyState)
 }
 
 func writeInitialRaftState(raftWB *WriteBatch, regionID uint64) {
@@ -0,0 +1,155 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"time"
+
+	"github.com/pingcap/badger"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/store/mockstore/unistore/lockstore"
+	"github.com/pingcap/tidb/store/mockstore/unistore/metrics"
+)
+
+// defaultBulkWriteTxnSize is the size threshold of a kv transaction written by BulkWriter.
+const defaultBulkWriteTxnSize = 4 * 1024 * 1024
+
+// BulkWriter stages multiple WriteBatches and writes them to the kv engine together. It follows the ordering
+// of WriteToKV: the entries of all the batches are written to badger first, in transactions bounded by the
+// transaction size, then the lock store is updated in one pass under MemStoreMu, so the lock store is never
+// newer than the DB and MemStoreMu is locked once per flush instead of once per batch.
+type BulkWriter struct {
+	en         *Engines
+	txnSize    int
+	txnEntries int
+	batches    []*WriteBatch
+}
+
+// NewBulkWriter creates a BulkWriter of the kv engine, txnSize bounds the size of a kv transaction,
+// 0 means the default 4MB. The number of entries in a transaction is bounded by the max batch entries of
+// the Engines. A batch exceeding either limit is written in its own transaction.
+func (en *Engines) NewBulkWriter(txnSize int) *BulkWriter {
+	if txnSize <= 0 {
+		txnSize = defaultBulkWriteTxnSize
+	}
+	return &BulkWriter{en: en, txnSize: txnSize, txnEntries: en.maxBatchEntries}
+}
+
+// Add stages the batch, it must not be modified or reset before Flush returns.
+func (bw *BulkWriter) Add(wb *WriteBatch) {
+	bw.batches = append(bw.batches, wb)
+}
+
+// Len returns the number of the staged batches.
+func (bw *BulkWriter) Len() int {
+	return len(bw.batches)
+}
+
+// Flush writes all the staged batches. If a transaction fails, the batches written by the former transactions
+// are still applied to the lock store and removed from the BulkWriter, Flush can be called again to write the
+// rest of them.
+func (bw *BulkWriter) Flush() error {
+	if err := bw.en.checkWritable(); err != nil {
+		return err
+	}
+	kvWriteMu.RLock()
+	defer kvWriteMu.RUnlock()
+	var hasCAS bool
+	for _, wb := range bw.batches {
+		hasCAS = hasCAS || len(wb.casEntries) > 0
+	}
+	if hasCAS {
+		casMu.Lock()
+		defer casMu.Unlock()
+	}
+	var written int
+	var err error
+	for written < len(bw.batches) {
+		var n int
+		if n, err = bw.writeTxn(bw.batches[written:]); err != nil {
+			break
+		}
+		written += n
+	}
+	bw.updateLockStore(bw.batches[:written])
+	for _, wb := range bw.batches[:written] {
+		wb.committed()
+		bw.en.observeWrite(wb)
+	}
+	rest := copy(bw.batches, bw.batches[written:])
+	for i := rest; i < len(bw.batches); i++ {
+		bw.batches[i] = nil
+	}
+	bw.batches = bw.batches[:rest]
+	return err
+}
+
+// writeTxn writes the leading batches within the transaction size in one transaction and returns the number
+// of the written batches.
+func (bw *BulkWriter) writeTxn(batches []*WriteBatch) (int, error) {
+	var n, size, numEntries int
+	for n < len(batches) && (n == 0 || bw.fitTxn(size, numEntries, batches[n])) {
+		size += batches[n].size
+		numEntries += len(batches[n].entries)
+		n++
+	}
+	if numEntries == 0 {
+		return n, nil
+	}
+	bundle := bw.en.kv
+	start := time.Now()
+	err := bundle.DB.Update(func(txn *badger.Txn) error {
+		for _, wb := range batches[:n] {
+			if err := wb.setEntries(txn, bundle); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	metrics.KVDBUpdate.Observe(time.Since(start).Seconds())
+	if err == badger.ErrTxnTooBig {
+		return 0, &ErrBatchTooLarge{NumEntries: numEntries, Size: size}
+	}
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	return n, nil
+}
+
+// fitTxn returns whether the batch can be added to the transaction of the size and the number of entries.
+func (bw *BulkWriter) fitTxn(size, numEntries int, wb *WriteBatch) bool {
+	if size+wb.size > bw.txnSize {
+		return false
+	}
+	return bw.txnEntries <= 0 || numEntries+len(wb.entries) <= bw.txnEntries
+}
+
+func (bw *BulkWriter) updateLockStore(batches []*WriteBatch) {
+	var hasLocks bool
+	for _, wb := range batches {
+		hasLocks = hasLocks || len(wb.lockEntries) > 0
+	}
+	if !hasLocks {
+		return
+	}
+	start := time.Now()
+	bundle := bw.en.kv
+	hint := new(lockstore.Hint)
+	bundle.MemStoreMu.Lock()
+	for _, wb := range batches {
+		wb.applyLockEntries(bundle, hint)
+	}
+	bundle.MemStoreMu.Unlock()
+	metrics.LockUpdate.Observe(time.Since(start).Seconds())
+}
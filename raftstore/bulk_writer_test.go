@@ -0,0 +1,179 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBulkWriter(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	var versions []uint64
+	bw := engines.NewBulkWriter(64)
+	for i := 0; i < 10; i++ {
+		wb := new(WriteBatch)
+		key := []byte(fmt.Sprintf("k%d", i))
+		wb.Set(y.KeyWithTs(key, KvTS), make([]byte, 20))
+		wb.SetLock(key, []byte("lock"))
+		wb.OnCommit(func(version uint64) {
+			versions = append(versions, version)
+		})
+		bw.Add(wb)
+	}
+	// Only the locks.
+	wb := new(WriteBatch)
+	wb.SetLock([]byte("l"), []byte("lock"))
+	bw.Add(wb)
+	require.Equal(t, 11, bw.Len())
+	require.Nil(t, bw.Flush())
+	require.Equal(t, 0, bw.Len())
+	require.Len(t, versions, 10)
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("k%d", i))
+		val, err := getValue(engines.kv.DB, key)
+		require.Nil(t, err)
+		require.Len(t, val, 20)
+		require.Equal(t, []byte("lock"), engines.kv.LockStore.Get(key, nil))
+		if i > 0 {
+			require.True(t, versions[i] > versions[i-1])
+		}
+	}
+	require.Equal(t, []byte("lock"), engines.kv.LockStore.Get([]byte("l"), nil))
+
+	// The failed batch and the ones after it are kept for the next flush, the first batch fills a transaction.
+	wb = new(WriteBatch)
+	wb.Set(y.KeyWithTs([]byte("m"), KvTS), make([]byte, 64))
+	wb.SetLock([]byte("m"), []byte("lock"))
+	bw.Add(wb)
+	wb = new(WriteBatch)
+	wb.CompareAndSet(y.KeyWithTs([]byte("n"), KvTS), []byte("x"), []byte("v"))
+	bw.Add(wb)
+	err := bw.Flush()
+	_, ok := errors.Cause(err).(*ErrCASMismatch)
+	require.True(t, ok, "%v", err)
+	require.Equal(t, 1, bw.Len())
+	require.Equal(t, []byte("lock"), engines.kv.LockStore.Get([]byte("m"), nil))
+}
+
+func TestBulkWriterMaxBatchEntries(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	defaultEngines := NewEngines(engines.kv, engines.raft, engines.kvPath, engines.raftPath)
+	require.Equal(t, BadgerMaxBatchEntries(badger.DefaultOptions.MaxMemTableSize), defaultEngines.maxBatchEntries)
+
+	// The tiny batches fit a transaction in size, they're split by the entry count.
+	engines.SetMaxBatchEntries(5)
+	bw := engines.NewBulkWriter(0)
+	var batches []*WriteBatch
+	for i := 0; i < 4; i++ {
+		wb := new(WriteBatch)
+		wb.Set(y.KeyWithTs([]byte(fmt.Sprintf("a%d", i)), KvTS), []byte("v"))
+		wb.Set(y.KeyWithTs([]byte(fmt.Sprintf("b%d", i)), KvTS), []byte("v"))
+		batches = append(batches, wb)
+	}
+	n, err := bw.writeTxn(batches)
+	require.Nil(t, err)
+	require.Equal(t, 2, n)
+	// A batch exceeding the limit is written in its own transaction.
+	large := new(WriteBatch)
+	for i := 0; i < 6; i++ {
+		large.Set(y.KeyWithTs([]byte(fmt.Sprintf("c%d", i)), KvTS), []byte("v"))
+	}
+	n, err = bw.writeTxn([]*WriteBatch{large, batches[2]})
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+
+	for _, wb := range batches {
+		bw.Add(wb)
+	}
+	require.Nil(t, bw.Flush())
+	require.Equal(t, 0, bw.Len())
+	val, err := getValue(engines.kv.DB, []byte("b3"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("v"), val)
+}
+
+func BenchmarkBulkWriter(b *testing.B) {
+	const numBatches = 64
+	newBatches := func() []*WriteBatch {
+		batches := make([]*WriteBatch, numBatches)
+		for i := range batches {
+			wb := new(WriteBatch)
+			for j := 0; j < 16; j++ {
+				key := []byte(fmt.Sprintf("k%03d%03d", i, j))
+				wb.Set(y.KeyWithTs(key, KvTS), key)
+				wb.SetLock(key, key)
+			}
+			batches[i] = wb
+		}
+		return batches
+	}
+	bench := func(b *testing.B, locksPerOp float64, write func(en *Engines, batches []*WriteBatch) error) {
+		engines, cleanup, err := NewInMemoryEngines()
+		require.Nil(b, err)
+		defer cleanup()
+		// The readers contend on MemStoreMu with the writer.
+		var stop int64
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for atomic.LoadInt64(&stop) == 0 {
+					engines.kv.MemStoreMu.Lock()
+					engines.kv.MemStoreMu.Unlock()
+				}
+			}()
+		}
+		batches := newBatches()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err = write(engines, batches); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+		b.ReportMetric(locksPerOp, "locks/op")
+		atomic.StoreInt64(&stop, 1)
+		wg.Wait()
+	}
+	b.Run("WriteBatch", func(b *testing.B) {
+		bench(b, numBatches, func(en *Engines, batches []*WriteBatch) error {
+			for _, wb := range batches {
+				if err := en.WriteKV(wb); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	b.Run("BulkWriter", func(b *testing.B) {
+		bench(b, 1, func(en *Engines, batches []*WriteBatch) error {
+			bw := en.NewBulkWriter(0)
+			for _, wb := range batches {
+				bw.Add(wb)
+			}
+			return bw.Flush()
+		})
+	})
+}
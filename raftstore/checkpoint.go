@@ -0,0 +1,192 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/ngaut/unistore/util"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/protos"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/store/mockstore/unistore/lockstore"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
+)
+
+const (
+	checkpointMetaFileName = "CHECKPOINT"
+	checkpointKVFileName   = "kv.backup"
+	checkpointMetaSize     = 16
+)
+
+// checkpointBeforeBackup is called by Checkpoint after the kv writes resume and before the backup is read, it's
+// only set by the tests.
+var checkpointBeforeBackup func()
+
+// Checkpoint writes a consistent backup of the kv engine into dir, the lock store is dumped to the same
+// directory. The StateTS and the raft vlog offset at checkpoint time are recorded in the meta file, the
+// locks newer than the dump can be restored from raft log with RestoreLockStore. The kv writes only wait
+// while the read ts is captured and the lock store is dumped, the backup is read at the captured ts after
+// the writes resume.
+func (en *Engines) Checkpoint(dir string) error {
+	if util.DirExists(dir) {
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		if len(fis) > 0 {
+			return errors.Errorf("checkpoint dir %s is not empty", dir)
+		}
+	} else if err := os.MkdirAll(dir, 0700); err != nil {
+		return errors.WithStack(err)
+	}
+
+	// The read ts is not older than any version written so far, and StateTS is advanced to it, so the KvTS
+	// entries written after the checkpoint, the apply states included, are newer than the read ts. The data
+	// versions written by the concurrent writes may still be not newer than it, they're in the backup while
+	// their apply states are not, so they're applied again on recovery.
+	kvWriteMu.Lock()
+	readTS := atomic.LoadUint64(&kvMaxVersion)
+	stateTS := atomic.LoadUint64(&en.kv.StateTS)
+	if stateTS < readTS {
+		stateTS = readTS
+		atomic.StoreUint64(&en.kv.StateTS, stateTS)
+	} else {
+		readTS = stateTS
+	}
+	vlogOffset := en.raft.GetVLogOffset()
+	lockMeta := make([]byte, 8)
+	binary.LittleEndian.PutUint64(lockMeta, vlogOffset)
+	en.kv.MemStoreMu.Lock()
+	err := dumpLockStore(en.kv, dir, lockMeta)
+	en.kv.MemStoreMu.Unlock()
+	txn := en.kv.DB.NewTransaction(false)
+	if en.kv.DB.IsManaged() {
+		txn.SetReadTS(readTS)
+	}
+	kvWriteMu.Unlock()
+	if checkpointBeforeBackup != nil {
+		checkpointBeforeBackup()
+	}
+	if err == nil {
+		err = backupTxn(txn, filepath.Join(dir, checkpointKVFileName))
+	}
+	txn.Discard()
+	if err != nil {
+		return err
+	}
+	meta := make([]byte, checkpointMetaSize)
+	binary.LittleEndian.PutUint64(meta, stateTS)
+	binary.LittleEndian.PutUint64(meta[8:], vlogOffset)
+	metaPath := filepath.Join(dir, checkpointMetaFileName)
+	// The meta file is written last, a checkpoint without it is incomplete.
+	if err = ioutil.WriteFile(metaPath+tmpFileSuffix, meta, 0600); err != nil {
+		return errors.WithStack(err)
+	}
+	if err = os.Rename(metaPath+tmpFileSuffix, metaPath); err != nil {
+		return errors.WithStack(err)
+	}
+	return syncDir(dir)
+}
+
+// backupTxn writes all the versions visible to the txn into path in the format of badger.DB.Backup, so it's loaded
+// by badger.DB.Load.
+func backupTxn(txn *badger.Txn, path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	opts := badger.DefaultIteratorOptions
+	opts.AllVersions = true
+	it := txn.NewIterator(opts)
+	defer it.Close()
+	var sizeBuf [8]byte
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		val, err := item.Value()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		pair := &protos.KVPair{
+			Key:      item.KeyCopy(nil),
+			Value:    y.SafeCopy(nil, val),
+			UserMeta: y.SafeCopy(nil, item.UserMeta()),
+			Version:  item.Version(),
+		}
+		buf, err := pair.Marshal()
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		binary.LittleEndian.PutUint64(sizeBuf[:], uint64(len(buf)))
+		if _, err = w.Write(sizeBuf[:]); err != nil {
+			return errors.WithStack(err)
+		}
+		if _, err = w.Write(buf); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+	if err = w.Flush(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(f.Sync())
+}
+
+// RestoreFromCheckpoint opens a kv engine at kvOpts.Dir, loads the checkpoint in dir into it and returns
+// the Engines built with the raft engine. The kv engine directory must be empty.
+func RestoreFromCheckpoint(dir string, kvOpts badger.Options, raftEngine *badger.DB, raftPath string) (*Engines, error) {
+	meta, err := ioutil.ReadFile(filepath.Join(dir, checkpointMetaFileName))
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if len(meta) != checkpointMetaSize {
+		return nil, errors.Errorf("invalid checkpoint meta length %d", len(meta))
+	}
+	db, err := badger.Open(kvOpts)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	bundle := &mvcc.DBBundle{
+		DB:        db,
+		LockStore: lockstore.NewMemStore(8 << 20),
+		StateTS:   binary.LittleEndian.Uint64(meta),
+	}
+	err = loadBackup(db, filepath.Join(dir, checkpointKVFileName))
+	if err == nil {
+		_, err = bundle.LockStore.LoadFromFile(filepath.Join(dir, LockstoreFileName))
+	}
+	if err != nil {
+		if closeErr := db.Close(); closeErr != nil {
+			return nil, errors.WithStack(closeErr)
+		}
+		return nil, err
+	}
+	return NewEngines(bundle, raftEngine, kvOpts.Dir, raftPath), nil
+}
+
+func loadBackup(db *badger.DB, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+	return errors.WithStack(db.Load(f))
+}
@@ -0,0 +1,158 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/y"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpointRestore(t *testing.T) {
+	engines, cleanup, err := NewInMemoryEngines()
+	require.Nil(t, err)
+	defer cleanup()
+	wb := new(WriteBatch)
+	wb.Set(y.KeyWithTs([]byte("ta"), KvTS), []byte("v"))
+	wb.SetLock([]byte("tb"), []byte("lock"))
+	require.Nil(t, engines.WriteKV(wb))
+
+	// Each batch writes a key and its lock, the checkpoint has both or neither.
+	stop, done := make(chan struct{}), make(chan struct{})
+	var written int32
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			key := []byte(fmt.Sprintf("tk%06d", i))
+			wb := new(WriteBatch)
+			wb.Set(y.KeyWithTs(key, KvTS), key)
+			wb.SetLock(key, key)
+			if err := engines.WriteKV(wb); err != nil {
+				t.Error(err)
+				return
+			}
+			atomic.StoreInt32(&written, int32(i+1))
+		}
+	}()
+	for atomic.LoadInt32(&written) < 100 {
+		time.Sleep(time.Millisecond)
+	}
+	dir, err := ioutil.TempDir("", "checkpoint")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	cpDir := filepath.Join(dir, "cp")
+	require.Nil(t, engines.Checkpoint(cpDir))
+	close(stop)
+	<-done
+	// The checkpoint dir must be empty.
+	require.NotNil(t, engines.Checkpoint(cpDir))
+
+	kvOpts := badger.DefaultOptions
+	kvOpts.Dir = filepath.Join(dir, "kv")
+	kvOpts.ValueDir = kvOpts.Dir
+	kvOpts.ManagedTxns = true
+	restored, err := RestoreFromCheckpoint(cpDir, kvOpts, engines.raft, engines.raftPath)
+	require.Nil(t, err)
+	defer restored.kv.DB.Close()
+
+	val, err := getValue(restored.kv.DB, []byte("ta"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("v"), val)
+	require.Equal(t, []byte("lock"), restored.kv.LockStore.Get([]byte("tb"), nil))
+	var keys, maxVersion uint64
+	err = restored.kv.DB.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.AllVersions = true
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			if item.Version() > maxVersion {
+				maxVersion = item.Version()
+			}
+			key := item.Key()
+			if len(key) > 2 && string(key[:2]) == "tk" {
+				keys++
+				require.Equal(t, key, restored.kv.LockStore.Get(key, nil))
+			}
+		}
+		return nil
+	})
+	require.Nil(t, err)
+	require.True(t, keys >= 100)
+	for i := keys; i < uint64(atomic.LoadInt32(&written)); i++ {
+		require.Nil(t, restored.kv.LockStore.Get([]byte(fmt.Sprintf("tk%06d", i)), nil))
+	}
+	// The new state writes of the restored engines are newer than the restored data.
+	require.True(t, restored.kv.StateTS >= maxVersion)
+}
+
+func TestCheckpointNotBlockWrites(t *testing.T) {
+	engines, cleanup, err := NewInMemoryEngines()
+	require.Nil(t, err)
+	defer cleanup()
+	engines.SetWriteStallTimeout(time.Second)
+	wb := new(WriteBatch)
+	wb.Set(y.KeyWithTs([]byte("ta"), KvTS), []byte("v1"))
+	require.Nil(t, engines.WriteKV(wb))
+
+	// The writes during the backup don't wait for it, and they are not in the backup.
+	checkpointBeforeBackup = func() {
+		wb := new(WriteBatch)
+		wb.Set(y.KeyWithTs([]byte("ta"), KvTS), []byte("v2"))
+		wb.Set(y.KeyWithTs([]byte("tb"), KvTS), []byte("v2"))
+		wb.SetLock([]byte("tc"), []byte("lock"))
+		require.Nil(t, engines.WriteKV(wb))
+	}
+	defer func() {
+		checkpointBeforeBackup = nil
+	}()
+	dir, err := ioutil.TempDir("", "checkpoint")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	cpDir := filepath.Join(dir, "cp")
+	require.Nil(t, engines.Checkpoint(cpDir))
+	val, err := getValue(engines.kv.DB, []byte("ta"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("v2"), val)
+
+	kvOpts := badger.DefaultOptions
+	kvOpts.Dir = filepath.Join(dir, "kv")
+	kvOpts.ValueDir = kvOpts.Dir
+	kvOpts.ManagedTxns = true
+	restored, err := RestoreFromCheckpoint(cpDir, kvOpts, engines.raft, engines.raftPath)
+	require.Nil(t, err)
+	defer restored.kv.DB.Close()
+	val, err = getValue(restored.kv.DB, []byte("ta"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("v1"), val)
+	_, err = getValue(restored.kv.DB, []byte("tb"))
+	require.Equal(t, badger.ErrKeyNotFound, err)
+	require.Nil(t, restored.kv.LockStore.Get([]byte("tc"), nil))
+	// The versions written after the checkpoint are newer than the restored state ts.
+	require.True(t, engines.CurrentStateTS() > restored.kv.StateTS)
+}
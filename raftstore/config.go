@@ -106,6 +106,11 @@ type Config struct {
 	LeaderTransferMaxLogLag uint64
 
 	SnapApplyBatchSize uint64
+	// The number of keys deleted in a batch when the range of a region is cleaned up. Smaller batches keep the
+	// transactions of the wide keys under the size limit, larger ones reduce the overhead of the small keys.
+	DeleteRangeBatchSize uint64
+	// Delete the range of a region from the end key backward, the keys not deleted yet stay a prefix of the range.
+	DeleteRangeReverse bool
 
 	// Interval (ms) to check region whether the data is consistent.
 	ConsistencyCheckInterval time.Duration
@@ -133,14 +138,36 @@ type Config struct {
 
 	StoreMaxBatchSize uint64
 
+	// Drop the received raft messages instead of waiting if the mailbox of the peer is full, so a slow region can't
+	// block the raft transport of the others. The dropped messages are resent by raft.
+	RaftMsgNonBlocking bool
+	// The max number of the raft messages pending in the mailbox of a peer in the non-blocking mode.
+	RaftMsgPeerMailboxSize uint64
+
+	// The max number of the snapshots being sent and received concurrently, the snapshots beyond the limits
+	// are rejected.
 	ConcurrentSendSnapLimit uint64
 	ConcurrentRecvSnapLimit uint64
+	// The capacity of the snap worker task queue, snapshot requests are rejected when it's full.
+	SnapWorkerQueueSize uint64
+	// The size of the data chunks to send snapshot, it's sent to the receiver in the stream header.
+	SnapChunkSize uint64
+	// The max number of raft logs in a delta snapshot, the followers further behind need a full snapshot.
+	// 0 disables the delta snapshot.
+	MaxDeltaSnapshotEntries uint64
 
 	GrpcInitialWindowSize uint64
 	GrpcKeepAliveTime     time.Duration
 	GrpcKeepAliveTimeout  time.Duration
 	GrpcRaftConnNum       uint64
 
+	// The max number of raft messages kept for resending after a transport failure, 0 disables resending.
+	RaftMsgResendQueueSize uint64
+	// Raft messages older than it are dropped instead of being resent.
+	RaftMsgResendTTL time.Duration
+	// The max backoff between reconnections.
+	RaftMsgResendMaxBackoff time.Duration
+
 	Addr          string
 	AdvertiseAddr string
 	Labels        []StoreLabel
@@ -222,6 +249,7 @@ func NewDefaultConfig() *Config {
 		PeerStaleStateCheckInterval:      5 * time.Minute,
 		LeaderTransferMaxLogLag:          10,
 		SnapApplyBatchSize:               10 * MB,
+		DeleteRangeBatchSize:             4096,
 		// Disable consistency check by default as it will hurt performance.
 		// We should turn on this only in our tests.
 		ConsistencyCheckInterval: 0,
@@ -235,12 +263,19 @@ func NewDefaultConfig() *Config {
 		ApplyMaxBatchSize:        1024,
 		ApplyPoolSize:            2,
 		StoreMaxBatchSize:        1024,
+		RaftMsgPeerMailboxSize:   256,
 		ConcurrentSendSnapLimit:  32,
 		ConcurrentRecvSnapLimit:  32,
+		SnapWorkerQueueSize:      128,
+		SnapChunkSize:            1 * MB,
+		MaxDeltaSnapshotEntries:  4096,
 		GrpcInitialWindowSize:    2 * 1024 * 1024,
 		GrpcKeepAliveTime:        3 * time.Second,
 		GrpcKeepAliveTimeout:     60 * time.Second,
 		GrpcRaftConnNum:          1,
+		RaftMsgResendQueueSize:   1024,
+		RaftMsgResendTTL:         2 * time.Second,
+		RaftMsgResendMaxBackoff:  time.Second,
 		Addr:                     "127.0.0.1:20160",
 		SplitCheck:               newDefaultSplitCheckConfig(),
 	}
@@ -350,5 +385,23 @@ func (c *Config) Validate() error {
 	if c.StoreMaxBatchSize == 0 {
 		return fmt.Errorf("store-max-batch-size should be greater than 0")
 	}
+	if c.RaftMsgNonBlocking && c.RaftMsgPeerMailboxSize == 0 {
+		return fmt.Errorf("raft-msg-peer-mailbox-size should be greater than 0")
+	}
+	if c.ConcurrentSendSnapLimit == 0 {
+		return fmt.Errorf("concurrent-send-snap-limit should be greater than 0")
+	}
+	if c.ConcurrentRecvSnapLimit == 0 {
+		return fmt.Errorf("concurrent-recv-snap-limit should be greater than 0")
+	}
+	if c.DeleteRangeBatchSize == 0 {
+		return fmt.Errorf("delete-range-batch-size should be greater than 0")
+	}
+	if c.SnapWorkerQueueSize == 0 {
+		return fmt.Errorf("snap-worker-queue-size should be greater than 0")
+	}
+	if err := validateSnapChunkSize(c.SnapChunkSize); err != nil {
+		return err
+	}
 	return nil
 }
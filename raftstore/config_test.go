@@ -89,4 +89,10 @@ func TestConfigValidate(t *testing.T) {
 	cfg = NewDefaultConfig()
 	cfg.ApplyPoolSize = 0
 	require.NotNil(t, cfg.Validate())
+
+	cfg = NewDefaultConfig()
+	cfg.SnapChunkSize = 1
+	require.NotNil(t, cfg.Validate())
+	cfg.SnapChunkSize = 64 * MB
+	require.NotNil(t, cfg.Validate())
 }
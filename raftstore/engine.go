@@ -15,20 +15,31 @@ package raftstore
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
 	"math"
+	"os"
+	"path/filepath"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/cznic/mathutil"
 	"github.com/golang/protobuf/proto"
 	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/table/memtable"
 	"github.com/pingcap/badger/y"
 	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/tidb/kv"
 	"github.com/pingcap/tidb/store/mockstore/unistore/lockstore"
 	"github.com/pingcap/tidb/store/mockstore/unistore/metrics"
 	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/dbreader"
 	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
+	"github.com/zhangjinpeng1987/raft"
 )
 
 type regionSnapshot struct {
@@ -41,16 +52,10 @@ type regionSnapshot struct {
 
 func (rs *regionSnapshot) redoLocks(raft *badger.DB, redoIdx uint64) error {
 	regionID := rs.regionState.Region.Id
-	item, err := rs.txn.Get(ApplyStateKey(regionID))
+	applyState, err := getApplyStateTxn(rs.txn, regionID)
 	if err != nil {
 		return err
 	}
-	val, err := item.Value()
-	if err != nil {
-		return err
-	}
-	var applyState applyState
-	applyState.Unmarshal(val)
 	appliedIdx := applyState.appliedIndex
 	entries, _, err := fetchEntriesTo(raft, regionID, redoIdx, appliedIdx+1, math.MaxUint64, nil)
 	if err != nil {
@@ -71,18 +76,246 @@ type Engines struct {
 	kvPath   string
 	raft     *badger.DB
 	raftPath string
+
+	// lockStoreDumpOffset is the raft vlog offset recorded in the last lock store dump.
+	lockStoreDumpOffset uint64
+
+	deleteRangeProgressInterval int
+	deleteRangeProgress         ProgressFunc
+
+	writeStallTimeout time.Duration
+
+	writeObserver WriteObserver
+
+	// maxBatchEntries bounds the number of entries in a kv transaction written by BulkWriter.
+	maxBatchEntries int
+
+	// truncateMu serializes TruncateRaftLog.
+	truncateMu sync.Mutex
+
+	// readOnly is set for the Engines opened by OpenReadOnlyEngines, all the writes are rejected.
+	readOnly bool
+}
+
+// SetDeleteRangeProgress sets the callback to report the progress of the range deletes every interval keys,
+// it must be set before the Engines is used by the raftstore.
+func (en *Engines) SetDeleteRangeProgress(interval int, fn ProgressFunc) {
+	en.deleteRangeProgressInterval = interval
+	en.deleteRangeProgress = fn
+}
+
+// SetWriteStallTimeout bounds how long WriteKV waits for the kv update to start, 0 means waiting until it starts.
+// It must be set before the Engines is used by the raftstore.
+func (en *Engines) SetWriteStallTimeout(timeout time.Duration) {
+	en.writeStallTimeout = timeout
+}
+
+// BadgerMaxBatchEntries returns the max batch entry count badger derives for the kv engine opened with
+// maxMemTableSize, the memtable reserves the room of that many entries for a write.
+func BadgerMaxBatchEntries(maxMemTableSize int64) int {
+	return int(maxMemTableSize * 15 / 100 / int64(memtable.MaxNodeSize))
+}
+
+// SetMaxBatchEntries bounds the number of entries in a kv transaction written by BulkWriter, the staged batches
+// are split into transactions on both the size and the entry count, 0 means no limit. It defaults to the limit
+// of badger opened with the default options, the limit of the kv engine returned by BadgerMaxBatchEntries should
+// be set otherwise.
+// It must be set before the Engines is used by the raftstore.
+func (en *Engines) SetMaxBatchEntries(n int) {
+	en.maxBatchEntries = n
+}
+
+// WriteObserver is invoked with every WriteBatch written to the kv engine successfully and the version assigned to
+// its KvTS entries, the version is 0 if the batch has no entry other than locks.
+type WriteObserver func(wb *WriteBatch, committedVersion uint64)
+
+// SetWriteObserver sets the observer of the kv writes made through the Engines, it's invoked synchronously after
+// the batch is committed and the lock store is updated, before the write returns, so the batches are observed in
+// the order they're committed by each writer. The batch must not be retained after the observer returns.
+// It must be set before the Engines is used by the raftstore.
+func (en *Engines) SetWriteObserver(observer WriteObserver) {
+	en.writeObserver = observer
+}
+
+func (en *Engines) observeWrite(wb *WriteBatch) {
+	if en.writeObserver != nil {
+		en.writeObserver(wb, wb.commitVersion)
+	}
+}
+
+func (en *Engines) newDeleteRangeProgress() *progressReporter {
+	return newProgressReporter(en.deleteRangeProgressInterval, en.deleteRangeProgress)
+}
+
+// VLogOffsets returns the current raft vlog offset and the offset recorded in the last lock store dump,
+// the locks written after the dumped offset are only recoverable from the raft log.
+func (en *Engines) VLogOffsets() (current, lastDumped uint64) {
+	return en.raft.GetVLogOffset(), atomic.LoadUint64(&en.lockStoreDumpOffset)
+}
+
+// CurrentStateTS returns the latest version allocated to the kv writes, it's advanced by every non-empty kv write.
+func (en *Engines) CurrentStateTS() uint64 {
+	return atomic.LoadUint64(&en.kv.StateTS)
+}
+
+// VLogPosition returns the current raft vlog offset and the number of the vlog file it's in.
+func (en *Engines) VLogPosition() (offset uint64, fileNum uint32) {
+	offset = en.raft.GetVLogOffset()
+	return offset, vlogFileNum(offset)
+}
+
+// vlogFileNum decodes the vlog file number from a vlog offset, the file number is in the high 32 bits.
+func vlogFileNum(offset uint64) uint32 {
+	return uint32(offset >> 32)
 }
 
 // NewEngines creates a new Engines.
 func NewEngines(kvEngine *mvcc.DBBundle, raftEngine *badger.DB, kvPath, raftPath string) *Engines {
 	return &Engines{
-		kv:       kvEngine,
-		kvPath:   kvPath,
-		raft:     raftEngine,
-		raftPath: raftPath,
+		kv:              kvEngine,
+		kvPath:          kvPath,
+		raft:            raftEngine,
+		raftPath:        raftPath,
+		maxBatchEntries: BadgerMaxBatchEntries(badger.DefaultOptions.MaxMemTableSize),
 	}
 }
 
+// ErrEnginesReadOnly is returned by the writes to the Engines opened by OpenReadOnlyEngines.
+var ErrEnginesReadOnly = errors.New("engines are opened in read-only mode")
+
+// OpenReadOnlyEngines opens the kv and raft engines of a stopped store in read-only mode for inspecting the data,
+// all the WriteBatch flushes through the returned Engines fail with ErrEnginesReadOnly. The lock store is loaded
+// from the last dump and restored from the raft log. badger refuses to open an engine read-only if it was not
+// closed cleanly and has vlog data to replay, or if another process has opened it for writing.
+// The returned Engines must be closed with Close.
+func OpenReadOnlyEngines(kvPath, raftPath string) (*Engines, error) {
+	kvOpts := badger.DefaultOptions
+	kvOpts.Dir = kvPath
+	kvOpts.ValueDir = kvPath
+	kvOpts.ManagedTxns = true
+	kvOpts.ReadOnly = true
+	kvDB, err := badger.Open(kvOpts)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	raftOpts := badger.DefaultOptions
+	raftOpts.Dir = raftPath
+	raftOpts.ValueDir = raftPath
+	raftOpts.ReadOnly = true
+	raftDB, err := badger.Open(raftOpts)
+	if err != nil {
+		_ = kvDB.Close()
+		return nil, errors.WithStack(err)
+	}
+	kv := &mvcc.DBBundle{
+		DB:        kvDB,
+		LockStore: lockstore.NewMemStore(8 << 20),
+	}
+	meta, err := kv.LockStore.LoadFromFile(filepath.Join(kvPath, LockstoreFileName))
+	if err == nil {
+		var offset uint64
+		if meta != nil {
+			offset = binary.LittleEndian.Uint64(meta)
+		}
+		err = RestoreLockStore(offset, kv, raftDB)
+	}
+	if err != nil {
+		_ = kvDB.Close()
+		_ = raftDB.Close()
+		return nil, err
+	}
+	en := NewEngines(kv, raftDB, kvPath, raftPath)
+	en.readOnly = true
+	return en, nil
+}
+
+// ReadOnly returns whether the Engines is opened by OpenReadOnlyEngines.
+func (en *Engines) ReadOnly() bool {
+	return en.readOnly
+}
+
+// Close closes the kv and raft engines, it's only used for the Engines opened by OpenReadOnlyEngines, the
+// engines of a running store are closed by the server.
+func (en *Engines) Close() error {
+	kvErr := en.kv.DB.Close()
+	if err := en.raft.Close(); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(kvErr)
+}
+
+func (en *Engines) checkWritable() error {
+	if en.readOnly {
+		return ErrEnginesReadOnly
+	}
+	return nil
+}
+
+// NewInMemoryEngines creates an Engines for tests and benchmarks. The kv engine runs in the volatile mode which
+// doesn't write the vlog, the raft engine is a normal one because the raft log is read back from its vlog.
+// The engines are opened with the same transaction and compaction filter options as the server.
+// Both engines are in temporary directories, the returned cleanup function closes the engines and removes them.
+func NewInMemoryEngines() (*Engines, func(), error) {
+	kvPath, err := ioutil.TempDir("", "unistore_kv")
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	raftPath, err := ioutil.TempDir("", "unistore_raft")
+	if err != nil {
+		_ = os.RemoveAll(kvPath)
+		return nil, nil, errors.WithStack(err)
+	}
+	removeDirs := func() {
+		_ = os.RemoveAll(kvPath)
+		_ = os.RemoveAll(raftPath)
+	}
+	kvOpts := badger.DefaultOptions
+	kvOpts.Dir = kvPath
+	kvOpts.ValueDir = kvPath
+	kvOpts.VolatileMode = true
+	kvOpts.ManagedTxns = true
+	kvDB, err := badger.Open(kvOpts)
+	if err != nil {
+		removeDirs()
+		return nil, nil, errors.WithStack(err)
+	}
+	raftOpts := badger.DefaultOptions
+	raftOpts.Dir = raftPath
+	raftOpts.ValueDir = raftPath
+	raftOpts.ValueThreshold = 0
+	raftOpts.CompactionFilterFactory = CreateRaftLogCompactionFilter
+	raftDB, err := badger.Open(raftOpts)
+	if err != nil {
+		_ = kvDB.Close()
+		removeDirs()
+		return nil, nil, errors.WithStack(err)
+	}
+	kv := &mvcc.DBBundle{
+		DB:        kvDB,
+		LockStore: lockstore.NewMemStore(8 << 20),
+	}
+	cleanup := func() {
+		_ = kvDB.Close()
+		_ = raftDB.Close()
+		removeDirs()
+	}
+	return NewEngines(kv, raftDB, kvPath, raftPath), cleanup, nil
+}
+
+// checkRegionEpochUnchanged returns ErrRegionEpochChanged if the region epoch in the two states are different.
+// Both the version and the conf version are compared, a conf change alters the peers without bumping the version.
+func checkRegionEpochUnchanged(before, after *raft_serverpb.RegionLocalState) error {
+	oldEpoch, newEpoch := before.Region.RegionEpoch, after.Region.RegionEpoch
+	if oldEpoch.Version != newEpoch.Version || oldEpoch.ConfVer != newEpoch.ConfVer {
+		return &ErrRegionEpochChanged{
+			RegionID: before.Region.Id,
+			OldEpoch: oldEpoch,
+			NewEpoch: newEpoch,
+		}
+	}
+	return nil
+}
+
 func (en *Engines) newRegionSnapshot(regionID, redoIdx uint64) (snap *regionSnapshot, err error) {
 	// We need to get the old region state out of the snapshot transaction to fetch data in lockStore.
 	// The lockStore data must be fetch before we start the snapshot transaction to make sure there is no newer data
@@ -115,8 +348,8 @@ func (en *Engines) newRegionSnapshot(regionID, redoIdx uint64) (snap *regionSnap
 	if err != nil {
 		return nil, err
 	}
-	if regionState.Region.RegionEpoch.Version != oldRegionState.Region.RegionEpoch.Version {
-		return nil, errors.New("region changed during newRegionSnapshot")
+	if err = checkRegionEpochUnchanged(oldRegionState, regionState); err != nil {
+		return nil, err
 	}
 
 	index, term, err := getAppliedIdxTermForSnapshot(en.raft, txn, regionID)
@@ -137,16 +370,98 @@ func (en *Engines) newRegionSnapshot(regionID, redoIdx uint64) (snap *regionSnap
 	return snap, nil
 }
 
-// WriteKV flushes the WriteBatch to the kv.
+// WriteKV flushes the WriteBatch to the kv. If the write stall timeout is set and the update can't start in time,
+// ErrWriteStall is returned without writing anything, the caller should write the batch again later.
 func (en *Engines) WriteKV(wb *WriteBatch) error {
-	return wb.WriteToKV(en.kv)
+	if err := en.checkWritable(); err != nil {
+		return err
+	}
+	if err := wb.writeToKV(en.kv, en.writeStallTimeout); err != nil {
+		return err
+	}
+	en.observeWrite(wb)
+	return nil
 }
 
 // WriteRaft flushes the WriteBatch to the raft.
 func (en *Engines) WriteRaft(wb *WriteBatch) error {
+	if err := en.checkWritable(); err != nil {
+		return err
+	}
 	return wb.WriteToRaft(en.raft)
 }
 
+// ApplyCommitted writes the batches of the applied entries in the required order:
+// 	1. Write wb to the kv DB, then update the lock store, so the lock store is never newer than the DB.
+// 	2. Sync the kv wal.
+// 	3. Write raftWb to the raft DB and sync the raft wal.
+// If it fails in the middle, the raft DB never holds the state newer than the kv DB, the entries applied to the kv
+// DB are applied again on recovery. Either of the batches can be nil.
+func (en *Engines) ApplyCommitted(wb, raftWb *WriteBatch) error {
+	if err := en.checkWritable(); err != nil {
+		return err
+	}
+	if wb != nil {
+		if err := wb.WriteToKV(en.kv); err != nil {
+			return err
+		}
+		en.observeWrite(wb)
+		if err := en.SyncKVWAL(); err != nil {
+			return err
+		}
+	}
+	if raftWb != nil {
+		return raftWb.WriteToRaftSync(en)
+	}
+	return nil
+}
+
+// CheckLockConflict checks the keys written by the WriteBatch in the region against the lock store,
+// ErrLockConflict is returned for the first key locked by another transaction. A data key conflicts with its lock
+// unless the batch also deletes the lock, e.g. the commit of the lock, and a lock conflicts with the existing lock
+// of a different start ts.
+func (en *Engines) CheckLockConflict(region *metapb.Region, wb *WriteBatch) error {
+	startKey, endKey := RawStartKey(region), RawEndKey(region)
+	inRegion := func(key []byte) bool {
+		return bytes.Compare(key, startKey) >= 0 && !exceedEndKey(key, endKey)
+	}
+	// The last lock entry of each key decides whether the batch releases the existing lock.
+	lockDeleted := make(map[string]bool, len(wb.lockEntries))
+	for _, entry := range wb.lockEntries {
+		lockDeleted[string(entry.Key.UserKey)] = entry.UserMeta[0] == mvcc.LockUserMetaDeleteByte
+	}
+	var buf []byte
+	check := func(key []byte, startTS uint64) error {
+		buf = en.kv.LockStore.Get(key, buf[:0])
+		if len(buf) == 0 {
+			return nil
+		}
+		lock := mvcc.DecodeLock(buf)
+		if lock.StartTS == startTS {
+			return nil
+		}
+		return &ErrLockConflict{Key: y.SafeCopy(nil, key), StartTS: lock.StartTS}
+	}
+	for _, entry := range wb.lockEntries {
+		if entry.UserMeta[0] == mvcc.LockUserMetaDeleteByte || !inRegion(entry.Key.UserKey) {
+			continue
+		}
+		if err := check(entry.Key.UserKey, mvcc.DecodeLock(entry.Value).StartTS); err != nil {
+			return err
+		}
+	}
+	for _, entry := range wb.entries {
+		if lockDeleted[string(entry.Key.UserKey)] || !inRegion(entry.Key.UserKey) {
+			continue
+		}
+		// No lock has the start ts 0, so any lock of the key conflicts.
+		if err := check(entry.Key.UserKey, 0); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // SyncKVWAL syncs the kv wal.
 func (en *Engines) SyncKVWAL() error {
 	// TODO: implement
@@ -154,20 +469,404 @@ func (en *Engines) SyncKVWAL() error {
 }
 
 // SyncRaftWAL syncs the raft wal.
+// The raft engine writes the wal into the vlog files, so it syncs the vlog file currently written.
 func (en *Engines) SyncRaftWAL() error {
-	// TODO: implement
+	_, fid := en.VLogPosition()
+	f, err := os.Open(filepath.Join(en.raftPath, fmt.Sprintf("%06d.vlog", fid)))
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	defer f.Close()
+	return errors.WithStack(f.Sync())
+}
+
+// RaftTruncatedState returns the truncated index and term of the region, it's the newer one of the truncated state
+// in the apply state and the one written by TruncateRaftLog. The raft logs not greater than the truncated index can
+// be deleted. ErrRegionNotFound is returned if the region has no state.
+func (en *Engines) RaftTruncatedState(regionID uint64) (index, term uint64, err error) {
+	state, err := en.loadTruncatedState(regionID)
+	if err != nil {
+		return 0, 0, err
+	}
+	return state.truncatedIndex, state.truncatedTerm, nil
+}
+
+// loadTruncatedState loads the apply state of the region with the truncated state replaced by the one written by
+// TruncateRaftLog if it's newer.
+func (en *Engines) loadTruncatedState(regionID uint64) (applyState, error) {
+	state, err := en.loadApplyState(regionID)
+	if err != nil {
+		return state, err
+	}
+	err = mergeRaftTruncatedState(en.raft, regionID, &state)
+	return state, err
+}
+
+// mergeRaftTruncatedState replaces the truncated state in the apply state by the one written by TruncateRaftLog in
+// the raft engine if it's newer.
+func mergeRaftTruncatedState(raftEngine *badger.DB, regionID uint64, state *applyState) error {
+	val, err := getValue(raftEngine, RaftTruncatedStateKey(regionID))
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var truncated raftTruncatedState
+	truncated.Unmarshal(val)
+	if truncated.index > state.truncatedIndex {
+		state.truncatedIndex, state.truncatedTerm = truncated.index, truncated.term
+	}
 	return nil
 }
 
+// TruncateRaftLog compacts the raft log of the region to compactIndex, the entries not greater than compactIndex are
+// deleted and the truncated state is written in the raft engine. compactIndex must be greater than the truncated
+// index and not greater than the applied index. The apply state is only read, so the applied index written by the
+// applier concurrently is never overwritten, and the calls are serialized so the truncated state never goes back.
+// The truncated state is written before the entries are deleted, so a crash in between only leaves the stale
+// entries, and the entries appended beyond compactIndex concurrently are never touched. The truncated state is
+// loaded into the apply state by the PeerStorage created after it's written.
+func (en *Engines) TruncateRaftLog(regionID, compactIndex, compactTerm uint64) error {
+	en.truncateMu.Lock()
+	defer en.truncateMu.Unlock()
+	state, err := en.loadTruncatedState(regionID)
+	if err != nil {
+		return err
+	}
+	if err = CompactRaftLog(fmt.Sprintf("[region %d]", regionID), &state, compactIndex, compactTerm); err != nil {
+		return err
+	}
+	entry, err := en.GetRaftEntry(regionID, compactIndex)
+	if err == nil && entry.Term != compactTerm {
+		return errors.Errorf("term of the raft log %d is %d, not the compact term %d", compactIndex, entry.Term,
+			compactTerm)
+	}
+	if _, ok := err.(*ErrRaftEntryNotFound); err != nil && !ok {
+		return err
+	}
+	wb := new(WriteBatch)
+	truncated := raftTruncatedState{index: compactIndex, term: compactTerm}
+	wb.Set(y.KeyWithTs(RaftTruncatedStateKey(regionID), RaftTS), truncated.Marshal())
+	if err = en.WriteRaft(wb); err != nil {
+		return err
+	}
+	_, err = new(raftLogGCTaskHandler).gcRaftLog(en.raft, regionID, 0, compactIndex+1)
+	return err
+}
+
+// GetApplyState returns the applied index of the region and the term of the applied entry, ErrRegionNotFound is
+// returned if the region has no apply state.
+func (en *Engines) GetApplyState(regionID uint64) (appliedIndex, appliedTerm uint64, err error) {
+	txn := en.kv.DB.NewTransaction(false)
+	defer txn.Discard()
+	return getAppliedIdxTermForSnapshot(en.raft, txn, regionID)
+}
+
+// PutApplyState writes the apply state of the region into the kv engine.
+func (en *Engines) PutApplyState(regionID, appliedIndex, truncatedIndex, truncatedTerm uint64) error {
+	wb := new(WriteBatch)
+	setApplyState(wb, regionID, applyState{
+		appliedIndex:   appliedIndex,
+		truncatedIndex: truncatedIndex,
+		truncatedTerm:  truncatedTerm,
+	})
+	return en.WriteKV(wb)
+}
+
+func (en *Engines) loadApplyState(regionID uint64) (applyState, error) {
+	txn := en.kv.DB.NewTransaction(false)
+	defer txn.Discard()
+	return getApplyStateTxn(txn, regionID)
+}
+
+func getApplyStateTxn(txn *badger.Txn, regionID uint64) (applyState, error) {
+	var state applyState
+	val, err := getValueTxn(txn, ApplyStateKey(regionID))
+	if err == badger.ErrKeyNotFound {
+		return state, &ErrRegionNotFound{RegionID: regionID}
+	}
+	if err != nil {
+		return state, errors.WithStack(err)
+	}
+	state.Unmarshal(val)
+	return state, nil
+}
+
+func setApplyState(wb *WriteBatch, regionID uint64, state applyState) {
+	wb.Set(y.KeyWithTs(ApplyStateKey(regionID), KvTS), state.Marshal())
+}
+
+// FirstRaftLogIndex returns the index of the first raft log of the region in the raft engine, ErrRegionNotFound is
+// returned if the region has no raft log.
+func (en *Engines) FirstRaftLogIndex(regionID uint64) (uint64, error) {
+	return firstRaftLogIndex(en.raft, regionID)
+}
+
+// GetRaftEntry reads the raft log entry at the index of the region, ErrRaftEntryNotFound is returned if the entry
+// is compacted or not appended yet.
+func (en *Engines) GetRaftEntry(regionID, index uint64) (eraftpb.Entry, error) {
+	entries, _, err := fetchEntriesTo(en.raft, regionID, index, index+1, math.MaxUint64, nil)
+	if err == raft.ErrUnavailable {
+		return eraftpb.Entry{}, &ErrRaftEntryNotFound{RegionID: regionID, Index: index}
+	}
+	if err != nil {
+		return eraftpb.Entry{}, err
+	}
+	return entries[0], nil
+}
+
+// ListRegions returns the regions stored in the kv engine ordered by region id, the tombstone regions are skipped.
+func (en *Engines) ListRegions() ([]*metapb.Region, error) {
+	var regions []*metapb.Region
+	err := en.kv.DB.View(func(txn *badger.Txn) error {
+		it := dbreader.NewIterator(txn, false, RegionMetaMinKey, RegionMetaMaxKey)
+		defer it.Close()
+		for it.Seek(RegionMetaMinKey); it.Valid(); it.Next() {
+			item := it.Item()
+			if bytes.Compare(item.Key(), RegionMetaMaxKey) >= 0 {
+				break
+			}
+			_, suffix, err := decodeRegionMetaKey(item.Key())
+			if err != nil {
+				return err
+			}
+			if suffix != RegionStateSuffix {
+				continue
+			}
+			val, err := item.Value()
+			if err != nil {
+				return errors.WithStack(err)
+			}
+			state := new(raft_serverpb.RegionLocalState)
+			if err = state.Unmarshal(val); err != nil {
+				return errors.WithStack(err)
+			}
+			if state.State != raft_serverpb.PeerState_Tombstone {
+				regions = append(regions, state.Region)
+			}
+		}
+		return nil
+	})
+	return regions, err
+}
+
+func firstRaftLogIndex(raftDB *badger.DB, regionID uint64) (uint64, error) {
+	var index uint64
+	err := raftDB.View(func(txn *badger.Txn) error {
+		prefix := makeRaftRegionPrefix(regionID, RaftLogSuffix)
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		if it.Seek(prefix); !it.ValidForPrefix(prefix) {
+			return &ErrRegionNotFound{RegionID: regionID}
+		}
+		var err error
+		index, err = RaftLogIndex(it.Item().Key())
+		return err
+	})
+	return index, err
+}
+
 // WriteBatch writes a batch of entries.
 type WriteBatch struct {
 	entries       []*badger.Entry
 	lockEntries   []*badger.Entry
+	casEntries    []casEntry
 	size          int
 	safePoint     int
 	safePointLock int
 	safePointSize int
 	safePointUndo int
+	safePointCAS  int
+
+	// entrySizes is the size added to size by every entry, Dedup subtracts it when the entry is removed.
+	entrySizes []int
+
+	// deleted is the set of the entries added by Delete, the delete mark of badger.Entry can't be read back.
+	deleted map[*badger.Entry]struct{}
+
+	onCommit      func(version uint64)
+	commitVersion uint64
+}
+
+// OnCommit sets the callback invoked with the version assigned to the KvTS entries after the batch is written to
+// the kv engine successfully. It's not invoked if the batch has no entry other than locks. Reset clears it.
+func (wb *WriteBatch) OnCommit(fn func(version uint64)) {
+	wb.onCommit = fn
+}
+
+func (wb *WriteBatch) committed() {
+	if wb.onCommit != nil && wb.commitVersion != 0 {
+		wb.onCommit(wb.commitVersion)
+	}
+}
+
+// casEntry is the condition of a CompareAndSet, the batch is written only if the current value of the key
+// equals to expected.
+type casEntry struct {
+	key      []byte
+	expected []byte
+}
+
+// casMu serializes the writes of the batches with CompareAndSet, so the values read are not changed by another
+// batch before they are written.
+var casMu = newTimedMutex()
+
+// kvWriteMu is held for reading by a kv write from the DB update to the lock store update, Checkpoint holds it for
+// writing so the DB and the lock store are copied at the same point. It must be locked before casMu.
+var kvWriteMu = newTimedRWMutex()
+
+// kvMaxVersion is the max version written to the kv engines, Checkpoint reads the backup at it.
+var kvMaxVersion uint64
+
+// observeKVVersion advances kvMaxVersion to the version if it's newer.
+func observeKVVersion(version uint64) {
+	for {
+		old := atomic.LoadUint64(&kvMaxVersion)
+		if version <= old || atomic.CompareAndSwapUint64(&kvMaxVersion, old, version) {
+			return
+		}
+	}
+}
+
+// stallTimer bounds how long a kv write waits to start, the timer is only created when the write has to wait.
+type stallTimer struct {
+	timeout time.Duration
+	timer   *time.Timer
+}
+
+// C returns the channel fired when the timeout passes, it's nil if there's no timeout.
+func (st *stallTimer) C() <-chan time.Time {
+	if st.timeout <= 0 {
+		return nil
+	}
+	if st.timer == nil {
+		st.timer = time.NewTimer(st.timeout)
+	}
+	return st.timer.C
+}
+
+func (st *stallTimer) stop() {
+	if st.timer != nil {
+		st.timer.Stop()
+	}
+}
+
+// stalled counts the stall and returns the ErrWriteStall.
+func (st *stallTimer) stalled() error {
+	kvWriteStalls.Inc()
+	return &ErrWriteStall{Timeout: st.timeout}
+}
+
+// timedMutex is a mutex which can be locked with a timeout.
+type timedMutex struct {
+	ch chan struct{}
+}
+
+func newTimedMutex() *timedMutex {
+	return &timedMutex{ch: make(chan struct{}, 1)}
+}
+
+func (m *timedMutex) Lock() {
+	m.ch <- struct{}{}
+}
+
+func (m *timedMutex) Unlock() {
+	<-m.ch
+}
+
+// lockWithin locks the mutex, false is returned if the stall timer fires first.
+func (m *timedMutex) lockWithin(st *stallTimer) bool {
+	select {
+	case m.ch <- struct{}{}:
+		return true
+	default:
+	}
+	select {
+	case m.ch <- struct{}{}:
+		return true
+	case <-st.C():
+		return false
+	}
+}
+
+// timedRWMutex is a readers-writer mutex whose read lock can be acquired with a timeout. A writer waiting for the
+// readers blocks the new readers, so it's not starved by the kv writes.
+type timedRWMutex struct {
+	mu      sync.Mutex
+	readers int
+	writer  bool
+	// released is closed and replaced whenever a lock is released.
+	released chan struct{}
+}
+
+func newTimedRWMutex() *timedRWMutex {
+	return &timedRWMutex{released: make(chan struct{})}
+}
+
+// rlockWithin acquires the read lock, false is returned if the stall timer fires first.
+func (m *timedRWMutex) rlockWithin(st *stallTimer) bool {
+	for {
+		m.mu.Lock()
+		if !m.writer {
+			m.readers++
+			m.mu.Unlock()
+			return true
+		}
+		released := m.released
+		m.mu.Unlock()
+		select {
+		case <-released:
+		case <-st.C():
+			return false
+		}
+	}
+}
+
+func (m *timedRWMutex) RLock() {
+	m.rlockWithin(&stallTimer{})
+}
+
+func (m *timedRWMutex) RUnlock() {
+	m.mu.Lock()
+	m.readers--
+	if m.readers == 0 {
+		m.release()
+	}
+	m.mu.Unlock()
+}
+
+func (m *timedRWMutex) Lock() {
+	m.mu.Lock()
+	for m.writer {
+		m.wait()
+	}
+	m.writer = true
+	for m.readers > 0 {
+		m.wait()
+	}
+	m.mu.Unlock()
+}
+
+func (m *timedRWMutex) Unlock() {
+	m.mu.Lock()
+	m.writer = false
+	m.release()
+	m.mu.Unlock()
+}
+
+// wait waits for a lock to be released, m.mu must be held.
+func (m *timedRWMutex) wait() {
+	released := m.released
+	m.mu.Unlock()
+	<-released
+	m.mu.Lock()
+}
+
+// release wakes up the waiters, m.mu must be held.
+func (m *timedRWMutex) release() {
+	close(m.released)
+	m.released = make(chan struct{})
 }
 
 // Len returns the length of the WriteBatch.
@@ -175,13 +874,34 @@ func (wb *WriteBatch) Len() int {
 	return len(wb.entries) + len(wb.lockEntries)
 }
 
+// NumEntries returns the number of the entries, excluding the lock entries.
+func (wb *WriteBatch) NumEntries() int {
+	return len(wb.entries)
+}
+
+// NumLockEntries returns the number of the lock entries.
+func (wb *WriteBatch) NumLockEntries() int {
+	return len(wb.lockEntries)
+}
+
+// Bytes returns the accumulated size of the entries.
+func (wb *WriteBatch) Bytes() int {
+	return wb.size
+}
+
 // Set adds the key-value pair to the entries.
 func (wb *WriteBatch) Set(key y.Key, val []byte) {
-	wb.entries = append(wb.entries, &badger.Entry{
+	wb.appendEntry(&badger.Entry{
 		Key:   key,
 		Value: val,
-	})
-	wb.size += key.Len() + len(val)
+	}, key.Len()+len(val))
+}
+
+// appendEntry appends the entry to the entries and adds its size to the batch size.
+func (wb *WriteBatch) appendEntry(e *badger.Entry, size int) {
+	wb.entries = append(wb.entries, e)
+	wb.entrySizes = append(wb.entrySizes, size)
+	wb.size += size
 }
 
 // SetLock adds the key-value pair to the lockEntries.
@@ -204,20 +924,19 @@ func (wb *WriteBatch) DeleteLock(key []byte) {
 // Rollback rolls back the key.
 func (wb *WriteBatch) Rollback(key y.Key) {
 	rollbackKey := mvcc.EncodeExtraTxnStatusKey(key.UserKey, key.Version)
-	wb.entries = append(wb.entries, &badger.Entry{
+	wb.appendEntry(&badger.Entry{
 		Key:      y.KeyWithTs(rollbackKey, key.Version),
 		UserMeta: mvcc.NewDBUserMeta(key.Version, 0),
-	})
+	}, 0)
 }
 
 // SetWithUserMeta adds the key-value pair with the user meta.
 func (wb *WriteBatch) SetWithUserMeta(key y.Key, val, userMeta []byte) {
-	wb.entries = append(wb.entries, &badger.Entry{
+	wb.appendEntry(&badger.Entry{
 		Key:      key,
 		Value:    val,
 		UserMeta: userMeta,
-	})
-	wb.size += key.Len() + len(val) + len(userMeta)
+	}, key.Len()+len(val)+len(userMeta))
 }
 
 // SetOpLock adds an op lock entry to the entries.
@@ -228,16 +947,50 @@ func (wb *WriteBatch) SetOpLock(key y.Key, userMeta []byte) {
 		Key:      opLockKey,
 		UserMeta: userMeta,
 	}
-	wb.entries = append(wb.entries, e)
-	wb.size += key.Len() + len(userMeta)
+	wb.appendEntry(e, key.Len()+len(userMeta))
 }
 
-// Delete deletes the key from the entries.
+// Delete deletes the key from the entries. The entry is marked as deleted explicitly, so an entry set with an empty
+// value is kept as an empty value by the kv engine, the raft engine still deletes the keys set with empty values.
 func (wb *WriteBatch) Delete(key y.Key) {
-	wb.entries = append(wb.entries, &badger.Entry{
+	e := &badger.Entry{
 		Key: key,
-	})
-	wb.size += key.Len()
+	}
+	e.SetDelete()
+	if wb.deleted == nil {
+		wb.deleted = make(map[*badger.Entry]struct{})
+	}
+	wb.deleted[e] = struct{}{}
+	wb.appendEntry(e, key.Len())
+}
+
+// Get returns the value of the last staged entry of the key with the same version, so the pending writes of the
+// batch can be read before it's written. A staged delete returns a nil value and true, a staged empty value is
+// returned as a non-nil empty slice. False is returned if the key is not staged, the entries rolled back by
+// RollbackToSafePoint are not staged. The lock entries are not visited.
+func (wb *WriteBatch) Get(key y.Key) ([]byte, bool) {
+	for i := len(wb.entries) - 1; i >= 0; i-- {
+		entry := wb.entries[i]
+		if entry.Key.Version != key.Version || !bytes.Equal(entry.Key.UserKey, key.UserKey) {
+			continue
+		}
+		if _, ok := wb.deleted[entry]; ok {
+			return nil, true
+		}
+		if entry.Value == nil {
+			return []byte{}, true
+		}
+		return entry.Value, true
+	}
+	return nil, false
+}
+
+// CompareAndSet sets the key to newVal if its current value equals to expected, a nil expected matches
+// a missing key. If any of the conditions in the batch doesn't match, the whole batch is aborted by WriteToKV
+// with ErrCASMismatch. The keys must be only updated by CompareAndSet to be safe with concurrent writers.
+func (wb *WriteBatch) CompareAndSet(key y.Key, expected, newVal []byte) {
+	wb.casEntries = append(wb.casEntries, casEntry{key: key.UserKey, expected: expected})
+	wb.Set(key, newVal)
 }
 
 // SetMsg adds the y.Key and proto.Message to the entries..
@@ -255,60 +1008,244 @@ func (wb *WriteBatch) SetSafePoint() {
 	wb.safePoint = len(wb.entries)
 	wb.safePointLock = len(wb.lockEntries)
 	wb.safePointSize = wb.size
+	wb.safePointCAS = len(wb.casEntries)
 }
 
 // RollbackToSafePoint rolls back to the safe point.
 func (wb *WriteBatch) RollbackToSafePoint() {
+	for _, e := range wb.entries[wb.safePoint:] {
+		delete(wb.deleted, e)
+	}
 	wb.entries = wb.entries[:wb.safePoint]
+	wb.entrySizes = wb.entrySizes[:wb.safePoint]
 	wb.lockEntries = wb.lockEntries[:wb.safePointLock]
+	wb.casEntries = wb.casEntries[:wb.safePointCAS]
 	wb.size = wb.safePointSize
 }
 
+// IterateLocks calls fn for the staged lock entries in order, the data entries are not visited.
+// isDelete is true if the entry deletes the lock, iteration stops at the first error returned by fn.
+func (wb *WriteBatch) IterateLocks(fn func(key, val []byte, isDelete bool) error) error {
+	for _, entry := range wb.lockEntries {
+		isDelete := entry.UserMeta[0] == mvcc.LockUserMetaDeleteByte
+		if err := fn(entry.Key.UserKey, entry.Value, isDelete); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Count returns the number of the staged entries of the key with the same version, the lock entries are not
+// counted.
+func (wb *WriteBatch) Count(key y.Key) int {
+	var n int
+	for _, entry := range wb.entries {
+		if entry.Key.Version == key.Version && bytes.Equal(entry.Key.UserKey, key.UserKey) {
+			n++
+		}
+	}
+	return n
+}
+
+// Dedup collapses the entries of the same key and version, only the last one is kept, so a delete supersedes an
+// earlier set of the key and vice versa. The remaining entries keep their order. The lock entries are collapsed by
+// key the same way. The safe point is cleared, SetSafePoint must be called again before RollbackToSafePoint.
+func (wb *WriteBatch) Dedup() {
+	var removed int
+	wb.entries, removed = dedupEntries(wb.entries, wb.entrySizes)
+	wb.entrySizes = wb.entrySizes[:len(wb.entries)]
+	wb.size -= removed
+	if len(wb.deleted) > 0 {
+		kept := make(map[*badger.Entry]struct{}, len(wb.deleted))
+		for _, e := range wb.entries {
+			if _, ok := wb.deleted[e]; ok {
+				kept[e] = struct{}{}
+			}
+		}
+		wb.deleted = kept
+	}
+	wb.lockEntries, _ = dedupEntries(wb.lockEntries, nil)
+	wb.safePoint = 0
+	wb.safePointLock = 0
+	wb.safePointSize = 0
+	wb.safePointCAS = 0
+}
+
+// dedupEntries removes the entries overwritten by a later entry of the same key and version in place, sizes is
+// compacted along with them if it's not nil. The sum of the sizes of the removed entries is returned.
+func dedupEntries(entries []*badger.Entry, sizes []int) ([]*badger.Entry, int) {
+	if len(entries) < 2 {
+		return entries, 0
+	}
+	var buf []byte
+	encode := func(key y.Key) []byte {
+		buf = append(buf[:0], key.UserKey...)
+		var ver [8]byte
+		binary.BigEndian.PutUint64(ver[:], key.Version)
+		return append(buf, ver[:]...)
+	}
+	last := make(map[string]int, len(entries))
+	for i, entry := range entries {
+		last[string(encode(entry.Key))] = i
+	}
+	if len(last) == len(entries) {
+		return entries, 0
+	}
+	var n, removed int
+	for i, entry := range entries {
+		if last[string(encode(entry.Key))] == i {
+			entries[n] = entry
+			if sizes != nil {
+				sizes[n] = sizes[i]
+			}
+			n++
+		} else if sizes != nil {
+			removed += sizes[i]
+		}
+	}
+	for i := n; i < len(entries); i++ {
+		entries[i] = nil
+	}
+	return entries[:n], removed
+}
+
 // WriteToKV flushes WriteBatch to DB by two steps:
 // 	1. Write entries to badger. After save ApplyState to badger, subsequent regionSnapshot will start at new raft index.
 //	2. Update lockStore, the date in lockStore may be older than the DB, so we need to restore then entries from raft log.
 func (wb *WriteBatch) WriteToKV(bundle *mvcc.DBBundle) error {
-	if len(wb.entries) > 0 {
-		start := time.Now()
-		keyVersion := atomic.AddUint64(&bundle.StateTS, 1)
-		err := bundle.DB.Update(func(txn *badger.Txn) error {
-			for _, entry := range wb.entries {
-				if len(entry.UserMeta) == 0 && len(entry.Value) == 0 {
-					entry.SetDelete()
-				}
-				if entry.Key.Version == KvTS {
-					entry.Key.Version = keyVersion
-				}
-				err1 := txn.SetEntry(entry)
-				if err1 != nil {
-					return err1
-				}
-			}
-			return nil
-		})
-		metrics.KVDBUpdate.Observe(time.Since(start).Seconds())
+	return wb.writeToKV(bundle, 0)
+}
+
+// writeToKV is WriteToKV with a timeout, 0 means no timeout. If the kv update can't start within the timeout,
+// because a Checkpoint or another CompareAndSet batch holds the locks, ErrWriteStall is returned and nothing is
+// written. The update isn't bounded once it has started.
+func (wb *WriteBatch) writeToKV(bundle *mvcc.DBBundle, timeout time.Duration) error {
+	st := &stallTimer{timeout: timeout}
+	defer st.stop()
+	if err := wb.updateKVAndLockStore(bundle, st); err != nil {
+		return err
+	}
+	wb.committed()
+	return nil
+}
+
+// updateKVAndLockStore writes the entries to the DB, then updates the lock store if it succeeds, so the lock store
+// is never newer than the DB.
+func (wb *WriteBatch) updateKVAndLockStore(bundle *mvcc.DBBundle, st *stallTimer) error {
+	if !kvWriteMu.rlockWithin(st) {
+		return st.stalled()
+	}
+	defer kvWriteMu.RUnlock()
+	if err := wb.updateKV(bundle, st); err != nil {
+		return err
+	}
+	wb.updateLockStore(bundle)
+	return nil
+}
+
+func (wb *WriteBatch) updateKV(bundle *mvcc.DBBundle, st *stallTimer) error {
+	if len(wb.entries) == 0 {
+		return nil
+	}
+	if len(wb.casEntries) > 0 {
+		if !casMu.lockWithin(st) {
+			return st.stalled()
+		}
+		defer casMu.Unlock()
+	}
+	start := time.Now()
+	err := bundle.DB.Update(func(txn *badger.Txn) error {
+		return wb.setEntries(txn, bundle)
+	})
+	metrics.KVDBUpdate.Observe(time.Since(start).Seconds())
+	if err == badger.ErrTxnTooBig {
+		return &ErrBatchTooLarge{NumEntries: len(wb.entries), Size: wb.size}
+	}
+	return errors.WithStack(err)
+}
+
+// WriteToKVTxn sets the entries into the caller-provided txn, and returns a function to update the lockStore.
+// It follows the same ordering as WriteToKV: the caller must commit the txn first and call the returned function
+// only after the commit succeeds, so the lockStore is never newer than the DB. The WriteBatch must not be reset
+// before the returned function is called. The caller-provided txn is not synchronized with Checkpoint, so the
+// checkpoint taken between the commit and the lockStore update misses the lock changes.
+func (wb *WriteBatch) WriteToKVTxn(txn *badger.Txn, bundle *mvcc.DBBundle) (func(), error) {
+	if err := wb.setEntries(txn, bundle); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return func() {
+		wb.updateLockStore(bundle)
+		wb.committed()
+	}, nil
+}
+
+func (wb *WriteBatch) setEntries(txn *badger.Txn, bundle *mvcc.DBBundle) error {
+	if len(wb.entries) == 0 {
+		return nil
+	}
+	for _, cas := range wb.casEntries {
+		if err := checkCAS(txn, cas); err != nil {
+			return err
+		}
+	}
+	keyVersion := atomic.AddUint64(&bundle.StateTS, 1)
+	stateTSAllocated.Inc()
+	wb.commitVersion = keyVersion
+	maxVersion := keyVersion
+	for _, entry := range wb.entries {
+		if entry.Key.Version == KvTS {
+			entry.Key.Version = keyVersion
+		} else if entry.Key.Version > maxVersion {
+			maxVersion = entry.Key.Version
+		}
+		err := txn.SetEntry(entry)
 		if err != nil {
-			return errors.WithStack(err)
+			return err
 		}
 	}
-	if len(wb.lockEntries) > 0 {
-		start := time.Now()
-		hint := new(lockstore.Hint)
-		bundle.MemStoreMu.Lock()
-		for _, entry := range wb.lockEntries {
-			switch entry.UserMeta[0] {
-			case mvcc.LockUserMetaDeleteByte:
-				bundle.LockStore.DeleteWithHint(entry.Key.UserKey, hint)
-			default:
-				bundle.LockStore.PutWithHint(entry.Key.UserKey, entry.Value, hint)
-			}
+	observeKVVersion(maxVersion)
+	return nil
+}
+
+func checkCAS(txn *badger.Txn, cas casEntry) error {
+	var current []byte
+	item, err := txn.Get(cas.key)
+	if err == nil {
+		if current, err = item.Value(); err != nil {
+			return err
 		}
-		bundle.MemStoreMu.Unlock()
-		metrics.LockUpdate.Observe(time.Since(start).Seconds())
+	} else if err != badger.ErrKeyNotFound {
+		return err
+	}
+	if !bytes.Equal(current, cas.expected) {
+		return &ErrCASMismatch{Key: cas.key}
 	}
 	return nil
 }
 
+func (wb *WriteBatch) updateLockStore(bundle *mvcc.DBBundle) {
+	if len(wb.lockEntries) == 0 {
+		return
+	}
+	start := time.Now()
+	bundle.MemStoreMu.Lock()
+	wb.applyLockEntries(bundle, new(lockstore.Hint))
+	bundle.MemStoreMu.Unlock()
+	metrics.LockUpdate.Observe(time.Since(start).Seconds())
+}
+
+// applyLockEntries updates the lock store with the lock entries, the caller must hold MemStoreMu.
+func (wb *WriteBatch) applyLockEntries(bundle *mvcc.DBBundle, hint *lockstore.Hint) {
+	for _, entry := range wb.lockEntries {
+		switch entry.UserMeta[0] {
+		case mvcc.LockUserMetaDeleteByte:
+			bundle.LockStore.DeleteWithHint(entry.Key.UserKey, hint)
+		default:
+			bundle.LockStore.PutWithHint(entry.Key.UserKey, entry.Value, hint)
+		}
+	}
+}
+
 // WriteToRaft flushes WriteBatch to raft.
 func (wb *WriteBatch) WriteToRaft(db *badger.DB) error {
 	if len(wb.entries) > 0 {
@@ -333,6 +1270,23 @@ func (wb *WriteBatch) WriteToRaft(db *badger.DB) error {
 	return nil
 }
 
+// WriteToRaftSync flushes WriteBatch to raft and syncs the raft wal.
+// WriteToRaft returns once the entries are written to the OS, which is faster but the entries may be lost
+// on power failure. WriteToRaftSync must be used when the entries are required to be persisted, e.g.
+// raft requires the entries and the hard state to be persisted before sending messages.
+func (wb *WriteBatch) WriteToRaftSync(en *Engines) error {
+	if len(wb.entries) == 0 {
+		return nil
+	}
+	if err := en.checkWritable(); err != nil {
+		return err
+	}
+	if err := wb.WriteToRaft(en.raft); err != nil {
+		return err
+	}
+	return en.SyncRaftWAL()
+}
+
 // MustWriteToKV wraps WriteToKV and will panic if error is not nil.
 func (wb *WriteBatch) MustWriteToKV(db *mvcc.DBBundle) {
 	err := wb.WriteToKV(db)
@@ -355,47 +1309,143 @@ func (wb *WriteBatch) Reset() {
 		wb.entries[i] = nil
 	}
 	wb.entries = wb.entries[:0]
+	wb.entrySizes = wb.entrySizes[:0]
 	for i := range wb.lockEntries {
 		wb.lockEntries[i] = nil
 	}
 	wb.lockEntries = wb.lockEntries[:0]
+	for i := range wb.casEntries {
+		wb.casEntries[i] = casEntry{}
+	}
+	wb.casEntries = wb.casEntries[:0]
+	for e := range wb.deleted {
+		delete(wb.deleted, e)
+	}
 	wb.size = 0
 	wb.safePoint = 0
 	wb.safePointLock = 0
 	wb.safePointSize = 0
 	wb.safePointUndo = 0
+	wb.safePointCAS = 0
+	wb.onCommit = nil
+	wb.commitVersion = 0
+}
+
+var writeBatchPool = sync.Pool{
+	New: func() interface{} { return new(WriteBatch) },
+}
+
+// GetWriteBatch gets an empty WriteBatch from the pool.
+func GetWriteBatch() *WriteBatch {
+	return writeBatchPool.Get().(*WriteBatch)
+}
+
+// PutWriteBatch resets the WriteBatch and puts it back to the pool, it must not be used after put.
+func PutWriteBatch(wb *WriteBatch) {
+	wb.Reset()
+	writeBatchPool.Put(wb)
 }
 
 // Todo, the following code redundant to unistore/tikv/worker.go, just as a place holder now.
 
+// delRangeBatchSize is the default number of keys deleted in a batch by deleteRange.
 const delRangeBatchSize = 4096
 
-func deleteRange(db *mvcc.DBBundle, startKey, endKey []byte) error {
+// deleteRange deletes the keys and the locks in the range, batchSize keys are deleted in a batch, the default
+// delRangeBatchSize is used if it's not positive. If reverse is set, the keys are deleted from the end of the range
+// backward, so the remaining part of a partially deleted range is always a prefix of it.
+func deleteRange(db *mvcc.DBBundle, startKey, endKey []byte, batchSize int, reverse bool,
+	progress *progressReporter) error {
+	if batchSize <= 0 {
+		batchSize = delRangeBatchSize
+	}
 	// Delete keys first.
-	keys := make([]y.Key, 0, delRangeBatchSize)
+	keys := make([]y.Key, 0, batchSize)
 	txn := db.DB.NewTransaction(false)
-	reader := dbreader.NewDBReader(startKey, endKey, txn)
-	keys = collectRangeKeys(reader.GetIter(), startKey, endKey, keys)
-	reader.Close()
-	if err := deleteKeysInBatch(db, keys, delRangeBatchSize); err != nil {
+	if reverse {
+		it := dbreader.NewIterator(txn, true, startKey, endKey)
+		keys = collectRangeKeysReverse(it, startKey, endKey, keys)
+		it.Close()
+		txn.Discard()
+	} else {
+		keys = collectRangeKeys(txn, startKey, endKey, newRangeHint(startKey, endKey), keys)
+		txn.Discard()
+	}
+	if err := deleteKeysInBatch(db, keys, batchSize, progress); err != nil {
 		return err
 	}
 
 	// Delete lock
 	lockIte := db.LockStore.NewIterator()
 	keys = keys[:0]
-	keys = collectLockRangeKeys(lockIte, startKey, endKey, keys)
-	return deleteLocksInBatch(db, keys, delRangeBatchSize)
+	if reverse {
+		keys = collectLockRangeKeysReverse(lockIte, startKey, endKey, keys)
+	} else {
+		keys = collectLockRangeKeys(lockIte, startKey, endKey, keys)
+	}
+	if err := deleteLocksInBatch(db, keys, batchSize, progress); err != nil {
+		return err
+	}
+	progress.finish()
+	return nil
 }
 
-func collectRangeKeys(it *badger.Iterator, startKey, endKey []byte, keys []y.Key) []y.Key {
-	if len(endKey) == 0 {
-		panic("invalid end key")
+// rangePrefix returns the common prefix of the keys in [startKey, endKey) if the range covers exactly
+// all the keys with the prefix startKey, otherwise it returns nil.
+func rangePrefix(startKey, endKey []byte) []byte {
+	if len(startKey) == 0 || !bytes.Equal(kv.Key(startKey).PrefixNext(), endKey) {
+		return nil
+	}
+	return startKey
+}
+
+// rangeHint is the hint of iterating the keys of a range.
+type rangeHint struct {
+	// prefix is set if the range covers exactly all the keys with the prefix.
+	prefix []byte
+	// upperBound is the exclusive upper bound of the keys, an empty upperBound means no upper bound.
+	upperBound []byte
+}
+
+// newRangeHint returns the hint of the range [startKey, endKey).
+func newRangeHint(startKey, endKey []byte) rangeHint {
+	return rangeHint{prefix: rangePrefix(startKey, endKey), upperBound: endKey}
+}
+
+// iterOptions returns the options of the iterator seeking to startKey, the tables not overlapping the hinted range
+// are pruned. Only the latest version of every key is read, deleting it at a newer version hides all the older ones.
+// Badger doesn't prefetch the values, they're only read by Item.Value.
+func (h rangeHint) iterOptions(startKey []byte) badger.IteratorOptions {
+	opts := badger.IteratorOptions{AllVersions: false}
+	if len(h.prefix) > 0 {
+		startKey = h.prefix
+	}
+	if len(startKey) > 0 {
+		opts.StartKey = y.KeyWithTs(startKey, math.MaxUint64)
+	}
+	if len(h.upperBound) > 0 {
+		opts.EndKey = y.KeyWithTs(h.upperBound, math.MaxUint64)
+	}
+	return opts
+}
+
+// collectRangeKeys collects the latest version of the keys in [startKey, endKey), an empty endKey means no upper
+// bound. If the hint has a prefix, the range is known to be prefix aligned, so the iteration only checks the prefix
+// instead of comparing every key with the end key.
+func collectRangeKeys(txn *badger.Txn, startKey, endKey []byte, hint rangeHint, keys []y.Key) []y.Key {
+	it := txn.NewIterator(hint.iterOptions(startKey))
+	defer it.Close()
+	if len(hint.prefix) > 0 {
+		for it.Seek(hint.prefix); it.ValidForPrefix(hint.prefix); it.Next() {
+			item := it.Item()
+			keys = append(keys, y.KeyWithTs(item.KeyCopy(nil), item.Version()))
+		}
+		return keys
 	}
 	for it.Seek(startKey); it.Valid(); it.Next() {
 		item := it.Item()
 		key := item.KeyCopy(nil)
-		if exceedEndKey(key, endKey) {
+		if len(endKey) > 0 && exceedEndKey(key, endKey) {
 			break
 		}
 		keys = append(keys, y.KeyWithTs(key, item.Version()))
@@ -403,13 +1453,46 @@ func collectRangeKeys(it *badger.Iterator, startKey, endKey []byte, keys []y.Key
 	return keys
 }
 
-func collectLockRangeKeys(it *lockstore.Iterator, startKey, endKey []byte, keys []y.Key) []y.Key {
+// collectRangeKeysReverse collects the keys in [startKey, endKey) in descending order, the iterator must be a reverse
+// one. An empty endKey means no upper bound, the iteration starts from the last key of the store.
+func collectRangeKeysReverse(it *badger.Iterator, startKey, endKey []byte, keys []y.Key) []y.Key {
+	for it.Seek(endKey); it.Valid(); it.Next() {
+		item := it.Item()
+		if bytes.Compare(item.Key(), startKey) < 0 {
+			break
+		}
+		// The reverse seek lands on the end key itself if it exists.
+		if len(endKey) > 0 && exceedEndKey(item.Key(), endKey) {
+			continue
+		}
+		keys = append(keys, y.KeyWithTs(item.KeyCopy(nil), item.Version()))
+	}
+	return keys
+}
+
+// collectLockRangeKeysReverse collects the lock keys in [startKey, endKey) in descending order, an empty endKey means
+// no upper bound.
+func collectLockRangeKeysReverse(it *lockstore.Iterator, startKey, endKey []byte, keys []y.Key) []y.Key {
 	if len(endKey) == 0 {
-		panic("invalid end key")
+		it.SeekToLast()
+	} else {
+		it.SeekForExclusivePrev(endKey)
 	}
+	for ; it.Valid(); it.Prev() {
+		key := safeCopy(it.Key())
+		if bytes.Compare(key, startKey) < 0 {
+			break
+		}
+		keys = append(keys, y.KeyWithTs(key, 0))
+	}
+	return keys
+}
+
+// collectLockRangeKeys collects the lock keys in [startKey, endKey), an empty endKey means no upper bound.
+func collectLockRangeKeys(it *lockstore.Iterator, startKey, endKey []byte, keys []y.Key) []y.Key {
 	for it.Seek(startKey); it.Valid(); it.Next() {
 		key := safeCopy(it.Key())
-		if exceedEndKey(key, endKey) {
+		if len(endKey) > 0 && exceedEndKey(key, endKey) {
 			break
 		}
 		keys = append(keys, y.KeyWithTs(key, 0))
@@ -417,7 +1500,7 @@ func collectLockRangeKeys(it *lockstore.Iterator, startKey, endKey []byte, keys
 	return keys
 }
 
-func deleteKeysInBatch(db *mvcc.DBBundle, keys []y.Key, batchSize int) error {
+func deleteKeysInBatch(db *mvcc.DBBundle, keys []y.Key, batchSize int, progress *progressReporter) error {
 	for len(keys) > 0 {
 		batchSize := mathutil.Min(len(keys), batchSize)
 		batchKeys := keys[:batchSize]
@@ -430,31 +1513,78 @@ func deleteKeysInBatch(db *mvcc.DBBundle, keys []y.Key, batchSize int) error {
 		if err := dbBatch.WriteToKV(db); err != nil {
 			return err
 		}
+		progress.add(len(batchKeys), dbBatch.Bytes())
 	}
 	return nil
 }
 
-func deleteLocksInBatch(db *mvcc.DBBundle, keys []y.Key, batchSize int) error {
+func deleteLocksInBatch(db *mvcc.DBBundle, keys []y.Key, batchSize int, progress *progressReporter) error {
 	for len(keys) > 0 {
 		batchSize := mathutil.Min(len(keys), batchSize)
 		batchKeys := keys[:batchSize]
 		keys = keys[batchSize:]
 		dbBatch := new(WriteBatch)
+		var batchBytes int
 		for _, key := range batchKeys {
 			dbBatch.DeleteLock(key.UserKey)
+			batchBytes += len(key.UserKey)
 		}
 		if err := dbBatch.WriteToKV(db); err != nil {
 			return err
 		}
+		progress.add(len(batchKeys), batchBytes)
 	}
 	return nil
 }
 
 type raftLogFilter struct {
+	// liveRegions is the set of live regions when the filter is created, the local states of the other regions
+	// are dropped except the tombstone region states. It's nil if the local states are never dropped.
+	liveRegions map[uint64]struct{}
 }
 
 func (r *raftLogFilter) Filter(key, val, userMeta []byte) badger.Decision {
-	return badger.DecisionKeep
+	if r.liveRegions == nil {
+		return badger.DecisionKeep
+	}
+	regionID, ok := decodeRegionLocalStateKey(key)
+	if !ok {
+		return badger.DecisionKeep
+	}
+	if _, ok = r.liveRegions[regionID]; ok {
+		return badger.DecisionKeep
+	}
+	// The tombstone region state outlives the region, it's used to reject the stale messages to the destroyed peer.
+	if key[1] == RegionMetaPrefix {
+		state := new(raft_serverpb.RegionLocalState)
+		if err := state.Unmarshal(val); err != nil || state.State == raft_serverpb.PeerState_Tombstone {
+			return badger.DecisionKeep
+		}
+	}
+	// Leave a tombstone so the older versions in the lower levels are not exposed.
+	return badger.DecisionMarkTombstone
+}
+
+// decodeRegionLocalStateKey returns the region id if the key is a local state key of the region.
+func decodeRegionLocalStateKey(key []byte) (uint64, bool) {
+	if len(key) != 11 || key[0] != LocalPrefix {
+		return 0, false
+	}
+	suffix := key[10]
+	switch key[1] {
+	case RegionRaftPrefix:
+		if suffix != RaftStateSuffix && suffix != ApplyStateSuffix && suffix != SnapshotRaftStateSuffix &&
+			suffix != RaftTruncatedStateSuffix {
+			return 0, false
+		}
+	case RegionMetaPrefix:
+		if suffix != RegionStateSuffix {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(key[2:]), true
 }
 
 var raftLogGuard = badger.Guard{
@@ -473,3 +1603,100 @@ func (r *raftLogFilter) Guards() []badger.Guard {
 func CreateRaftLogCompactionFilter(targetLevel int, startKey, endKey []byte) badger.CompactionFilter {
 	return &raftLogFilter{}
 }
+
+// ttlUserMetaLen is the length of the user meta carrying a TTL, it's the mvcc.DBUserMeta followed by the
+// little endian expire ts.
+const ttlUserMetaLen = 24
+
+// NewTTLUserMeta creates the user meta of an entry which expires at expireTS, it's a mvcc.DBUserMeta with
+// the expire ts appended, so CommitTS and StartTS still work on it.
+func NewTTLUserMeta(startTS, commitTS, expireTS uint64) mvcc.DBUserMeta {
+	m := make(mvcc.DBUserMeta, ttlUserMetaLen)
+	copy(m, mvcc.NewDBUserMeta(startTS, commitTS))
+	binary.LittleEndian.PutUint64(m[16:], expireTS)
+	return m
+}
+
+// decodeExpireTS returns the expire ts in the user meta, false is returned if the entry has no TTL.
+func decodeExpireTS(userMeta []byte) (uint64, bool) {
+	if len(userMeta) != ttlUserMetaLen {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(userMeta[16:]), true
+}
+
+type ttlFilter struct {
+	now uint64
+}
+
+func (f *ttlFilter) Filter(key, val, userMeta []byte) badger.Decision {
+	expireTS, ok := decodeExpireTS(userMeta)
+	if !ok || expireTS > f.now {
+		return badger.DecisionKeep
+	}
+	// Leave a tombstone so the older versions in the lower levels are not exposed.
+	return badger.DecisionMarkTombstone
+}
+
+func (f *ttlFilter) Guards() []badger.Guard {
+	return nil
+}
+
+// CreateTTLCompactionFilter returns a compaction filter factory whose filters drop the entries written with
+// NewTTLUserMeta which are expired at now, the entries without TTL are kept. now is in the same unit as the
+// expire ts and is fixed when the factory is created.
+func CreateTTLCompactionFilter(now uint64) CompactionFilterFactory {
+	return func(targetLevel int, startKey, endKey []byte) badger.CompactionFilter {
+		return &ttlFilter{now: now}
+	}
+}
+
+// NewRegionStateCompactionFilterFactory returns a compaction filter factory whose filters also drop the local
+// states of the regions not in the set returned by liveRegions. liveRegions is called once for every filter,
+// so the set is consistent within one compaction. It must include the regions being created, and the regions
+// being destroyed until their region states are written as tombstone. The region states in the tombstone state
+// are always kept, the undecodable ones too.
+func NewRegionStateCompactionFilterFactory(liveRegions func() map[uint64]struct{}) CompactionFilterFactory {
+	return func(targetLevel int, startKey, endKey []byte) badger.CompactionFilter {
+		return &raftLogFilter{liveRegions: liveRegions()}
+	}
+}
+
+// CompactionFilterFactory creates the badger.CompactionFilter for a compaction with the target level and the key range.
+type CompactionFilterFactory func(targetLevel int, startKey, endKey []byte) badger.CompactionFilter
+
+// ChainCompactionFilterFactories returns a factory whose filters run the filters of all the factories in order,
+// the first decision which is not DecisionKeep is used. The guards of all the filters are combined.
+func ChainCompactionFilterFactories(factories ...CompactionFilterFactory) CompactionFilterFactory {
+	if len(factories) == 1 {
+		return factories[0]
+	}
+	return func(targetLevel int, startKey, endKey []byte) badger.CompactionFilter {
+		filters := make(chainedCompactionFilter, 0, len(factories))
+		for _, factory := range factories {
+			if filter := factory(targetLevel, startKey, endKey); filter != nil {
+				filters = append(filters, filter)
+			}
+		}
+		return filters
+	}
+}
+
+type chainedCompactionFilter []badger.CompactionFilter
+
+func (filters chainedCompactionFilter) Filter(key, val, userMeta []byte) badger.Decision {
+	for _, filter := range filters {
+		if decision := filter.Filter(key, val, userMeta); decision != badger.DecisionKeep {
+			return decision
+		}
+	}
+	return badger.DecisionKeep
+}
+
+func (filters chainedCompactionFilter) Guards() []badger.Guard {
+	var guards []badger.Guard
+	for _, filter := range filters {
+		guards = append(guards, filter.Guards()...)
+	}
+	return guards
+}
@@ -0,0 +1,1160 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ngaut/unistore/util"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/tidb/store/mockstore/unistore/lockstore"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/dbreader"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteBatchPool(t *testing.T) {
+	wb := GetWriteBatch()
+	wb.Set(y.KeyWithTs([]byte("k"), KvTS), []byte("v"))
+	wb.SetLock([]byte("l"), []byte("v"))
+	PutWriteBatch(wb)
+	require.Equal(t, 0, wb.Len())
+	require.Equal(t, 0, wb.Bytes())
+	require.Equal(t, 0, GetWriteBatch().Len())
+}
+
+var benchApplyKeys = func() [][]byte {
+	keys := make([][]byte, 16)
+	for i := range keys {
+		keys[i] = []byte{'t', byte('a' + i)}
+	}
+	return keys
+}()
+
+func applyBenchCmd(wb *WriteBatch) {
+	for _, key := range benchApplyKeys {
+		wb.Set(y.KeyWithTs(key, KvTS), key)
+	}
+}
+
+func BenchmarkApplyNewWriteBatch(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		wb := new(WriteBatch)
+		applyBenchCmd(wb)
+	}
+}
+
+func BenchmarkApplyPooledWriteBatch(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		wb := GetWriteBatch()
+		applyBenchCmd(wb)
+		PutWriteBatch(wb)
+	}
+}
+
+func BenchmarkWriteBatchDedup(b *testing.B) {
+	keys := make([]y.Key, 1024)
+	for i := range keys {
+		keys[i] = y.KeyWithTs([]byte(fmt.Sprintf("key%d", i%64)), KvTS)
+	}
+	wb := new(WriteBatch)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, key := range keys {
+			wb.Set(key, key.UserKey)
+		}
+		wb.Dedup()
+		wb.Reset()
+	}
+}
+
+func TestWriteBatchDedup(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	key := func(k string) y.Key { return y.KeyWithTs([]byte(k), KvTS) }
+	wb := new(WriteBatch)
+	wb.Set(key("a"), []byte("1"))
+	wb.Set(key("b"), []byte("2"))
+	wb.Delete(key("a"))
+	wb.Set(key("c"), []byte("3"))
+	wb.Set(key("b"), []byte("4"))
+	// The same key with another version is kept.
+	wb.Set(y.KeyWithTs([]byte("c"), 100), []byte("5"))
+	wb.SetLock([]byte("l"), []byte("lock"))
+	wb.DeleteLock([]byte("l"))
+	require.Equal(t, 2, wb.Count(key("a")))
+	require.Equal(t, 1, wb.Count(key("c")))
+	require.Equal(t, 0, wb.Count(key("d")))
+
+	wb.Dedup()
+	require.Equal(t, 4, wb.NumEntries())
+	require.Equal(t, 1, wb.NumLockEntries())
+	require.Equal(t, 1, wb.Count(key("a")))
+	require.Equal(t, 1, wb.Count(key("b")))
+	var keys []string
+	for _, e := range wb.entries {
+		keys = append(keys, string(e.Key.UserKey))
+	}
+	require.Equal(t, []string{"a", "c", "b", "c"}, keys)
+	require.Equal(t, len("a")+len("c")+len("b")+len("c")+4*8+3, wb.Bytes())
+
+	engines.kv.LockStore.Put([]byte("l"), []byte("lock"))
+	require.Nil(t, engines.WriteKV(wb))
+	_, err := getValue(engines.kv.DB, []byte("a"))
+	require.Equal(t, badger.ErrKeyNotFound, err)
+	val, err := getValue(engines.kv.DB, []byte("b"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("4"), val)
+	require.Len(t, engines.kv.LockStore.Get([]byte("l"), nil), 0)
+}
+
+func TestWriteBatchDedupSize(t *testing.T) {
+	wb := new(WriteBatch)
+	wb.Set(y.KeyWithTs([]byte("a"), KvTS), []byte("1"))
+	size := wb.Bytes()
+	// The rollback adds nothing to the size, the op lock adds the size of the original key.
+	rollbackKey := y.KeyWithTs([]byte("b"), 10)
+	wb.Rollback(rollbackKey)
+	wb.Rollback(rollbackKey)
+	require.Equal(t, size, wb.Bytes())
+	opLockKey := y.KeyWithTs([]byte("c"), 10)
+	userMeta := mvcc.NewDBUserMeta(10, 0)
+	wb.SetOpLock(opLockKey, userMeta)
+	wb.SetOpLock(opLockKey, userMeta)
+	opLockSize := opLockKey.Len() + len(userMeta)
+	require.Equal(t, size+2*opLockSize, wb.Bytes())
+
+	wb.Dedup()
+	require.Equal(t, 3, wb.NumEntries())
+	require.Equal(t, size+opLockSize, wb.Bytes())
+	// Dedup again removes nothing.
+	wb.Dedup()
+	require.Equal(t, size+opLockSize, wb.Bytes())
+	wb.Reset()
+	require.Equal(t, 0, wb.Bytes())
+	require.Empty(t, wb.entrySizes)
+}
+
+func TestWriteBatchGet(t *testing.T) {
+	key := func(k string) y.Key { return y.KeyWithTs([]byte(k), KvTS) }
+	wb := new(WriteBatch)
+	_, ok := wb.Get(key("a"))
+	require.False(t, ok)
+
+	// The last staged entry of the key is returned.
+	wb.Set(key("a"), []byte("1"))
+	wb.Set(key("a"), []byte("2"))
+	wb.Set(key("empty"), nil)
+	val, ok := wb.Get(key("a"))
+	require.True(t, ok)
+	require.Equal(t, []byte("2"), val)
+	val, ok = wb.Get(key("empty"))
+	require.True(t, ok)
+	require.NotNil(t, val)
+	require.Len(t, val, 0)
+	// Another version of the key and the locks are not visited.
+	_, ok = wb.Get(y.KeyWithTs([]byte("a"), 100))
+	require.False(t, ok)
+	wb.SetLock([]byte("l"), []byte("lock"))
+	_, ok = wb.Get(key("l"))
+	require.False(t, ok)
+
+	wb.Delete(key("a"))
+	val, ok = wb.Get(key("a"))
+	require.True(t, ok)
+	require.Nil(t, val)
+	wb.Set(key("a"), []byte("3"))
+	val, ok = wb.Get(key("a"))
+	require.True(t, ok)
+	require.Equal(t, []byte("3"), val)
+
+	// The entries after the safe point are invisible once rolled back.
+	wb.SetSafePoint()
+	wb.Set(key("b"), []byte("4"))
+	wb.Delete(key("a"))
+	require.Len(t, wb.deleted, 2)
+	wb.RollbackToSafePoint()
+	require.Len(t, wb.deleted, 1)
+	_, ok = wb.Get(key("b"))
+	require.False(t, ok)
+	val, ok = wb.Get(key("a"))
+	require.True(t, ok)
+	require.Equal(t, []byte("3"), val)
+
+	wb.Dedup()
+	require.Len(t, wb.deleted, 0)
+	val, ok = wb.Get(key("a"))
+	require.True(t, ok)
+	require.Equal(t, []byte("3"), val)
+	wb.Reset()
+	_, ok = wb.Get(key("a"))
+	require.False(t, ok)
+}
+
+func TestWriteBatchIterateLocks(t *testing.T) {
+	wb := new(WriteBatch)
+	wb.Set(y.KeyWithTs([]byte("k"), KvTS), []byte("v"))
+	wb.SetLock([]byte("a"), []byte("1"))
+	wb.DeleteLock([]byte("b"))
+	wb.SetSafePoint()
+	wb.SetLock([]byte("c"), []byte("3"))
+
+	type lockEntry struct {
+		key, val string
+		isDelete bool
+	}
+	collect := func() []lockEntry {
+		var locks []lockEntry
+		err := wb.IterateLocks(func(key, val []byte, isDelete bool) error {
+			locks = append(locks, lockEntry{string(key), string(val), isDelete})
+			return nil
+		})
+		require.Nil(t, err)
+		return locks
+	}
+	require.Equal(t, []lockEntry{{"a", "1", false}, {"b", "", true}, {"c", "3", false}}, collect())
+	wb.RollbackToSafePoint()
+	require.Equal(t, []lockEntry{{"a", "1", false}, {"b", "", true}}, collect())
+
+	errStop := errors.New("stop")
+	var visited int
+	err := wb.IterateLocks(func(key, val []byte, isDelete bool) error {
+		visited++
+		return errStop
+	})
+	require.Equal(t, errStop, err)
+	require.Equal(t, 1, visited)
+}
+
+func TestWriteToKVBatchTooLarge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "unistore_kv")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	opts := badger.DefaultOptions
+	opts.Dir = dir
+	opts.ValueDir = dir
+	opts.MaxMemTableSize = 1 << 20
+	db, err := badger.Open(opts)
+	require.Nil(t, err)
+	defer db.Close()
+	bundle := &mvcc.DBBundle{DB: db, LockStore: lockstore.NewMemStore(16 * 1024)}
+
+	wb := new(WriteBatch)
+	wb.Set(y.KeyWithTs([]byte("k"), KvTS), make([]byte, opts.MaxMemTableSize))
+	err = wb.WriteToKV(bundle)
+	tooLarge, ok := err.(*ErrBatchTooLarge)
+	require.True(t, ok, "%v", err)
+	require.Equal(t, 1, tooLarge.NumEntries)
+	require.Equal(t, wb.Bytes(), tooLarge.Size)
+}
+
+func TestDeleteRangeProgress(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	wb := new(WriteBatch)
+	for _, key := range []string{"ta", "tb", "tc"} {
+		wb.Set(y.KeyWithTs([]byte(key), KvTS), []byte("v"))
+	}
+	wb.SetLock([]byte("td"), []byte("v"))
+	require.Nil(t, wb.WriteToKV(engines.kv))
+
+	var reported []int
+	engines.SetDeleteRangeProgress(1, func(keys, bytes int) {
+		reported = append(reported, keys)
+	})
+	require.Nil(t, deleteRange(engines.kv, []byte("t"), []byte("u"), 0, false, engines.newDeleteRangeProgress()))
+	require.Equal(t, []int{3, 4}, reported)
+	_, err := getValue(engines.kv.DB, []byte("ta"))
+	require.Equal(t, badger.ErrKeyNotFound, err)
+
+	// The progress is reported after every batch.
+	wb = new(WriteBatch)
+	for _, key := range []string{"ta", "tb", "tc"} {
+		wb.Set(y.KeyWithTs([]byte(key), KvTS), []byte("v"))
+	}
+	require.Nil(t, wb.WriteToKV(engines.kv))
+	reported = reported[:0]
+	require.Nil(t, deleteRange(engines.kv, []byte("t"), []byte("u"), 2, false, engines.newDeleteRangeProgress()))
+	require.Equal(t, []int{2, 3}, reported)
+}
+
+func TestDeleteRangeEmptyEndKey(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	wb := new(WriteBatch)
+	wb.Set(y.KeyWithTs([]byte("ta"), KvTS), []byte("v"))
+	wb.Set(y.KeyWithTs([]byte("tz"), KvTS), []byte("v"))
+	wb.SetLock([]byte("ta"), []byte("v"))
+	wb.SetLock([]byte("tz"), []byte("v"))
+	require.Nil(t, wb.WriteToKV(engines.kv))
+
+	// The last region has an empty end key.
+	require.Nil(t, deleteRange(engines.kv, []byte("tb"), nil, 0, false, nil))
+	_, err := getValue(engines.kv.DB, []byte("ta"))
+	require.Nil(t, err)
+	_, err = getValue(engines.kv.DB, []byte("tz"))
+	require.Equal(t, badger.ErrKeyNotFound, err)
+	require.NotNil(t, engines.kv.LockStore.Get([]byte("ta"), nil))
+	require.Nil(t, engines.kv.LockStore.Get([]byte("tz"), nil))
+}
+
+func TestApplyCommitted(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	wb := new(WriteBatch)
+	wb.Set(y.KeyWithTs([]byte("ta"), KvTS), []byte("v"))
+	wb.SetLock([]byte("tb"), []byte("l"))
+	raftWb := new(WriteBatch)
+	raftWb.Set(y.KeyWithTs(RaftLogKey(1, 1), KvTS), []byte("e"))
+	require.Nil(t, engines.ApplyCommitted(wb, raftWb))
+
+	val, err := getValue(engines.kv.DB, []byte("ta"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("v"), val)
+	require.Equal(t, []byte("l"), engines.kv.LockStore.Get([]byte("tb"), nil))
+	val, err = getValue(engines.raft, RaftLogKey(1, 1))
+	require.Nil(t, err)
+	require.Equal(t, []byte("e"), val)
+
+	require.Nil(t, engines.ApplyCommitted(nil, nil))
+}
+
+func TestCheckRegionEpochUnchanged(t *testing.T) {
+	newState := func(version, confVer uint64) *raft_serverpb.RegionLocalState {
+		return &raft_serverpb.RegionLocalState{Region: &metapb.Region{
+			Id:          1,
+			RegionEpoch: &metapb.RegionEpoch{Version: version, ConfVer: confVer},
+		}}
+	}
+	require.Nil(t, checkRegionEpochUnchanged(newState(1, 1), newState(1, 1)))
+	for _, after := range []*raft_serverpb.RegionLocalState{newState(2, 1), newState(1, 2)} {
+		err := checkRegionEpochUnchanged(newState(1, 1), after)
+		epochErr, ok := err.(*ErrRegionEpochChanged)
+		require.True(t, ok)
+		require.Equal(t, uint64(1), epochErr.RegionID)
+		require.Equal(t, after.Region.RegionEpoch, epochErr.NewEpoch)
+	}
+}
+
+func TestNewInMemoryEngines(t *testing.T) {
+	engines, cleanup, err := NewInMemoryEngines()
+	require.Nil(t, err)
+	wb := new(WriteBatch)
+	wb.Set(y.KeyWithTs([]byte("ta"), KvTS), []byte("v"))
+	var version uint64
+	wb.OnCommit(func(v uint64) { version = v })
+	raftWb := new(WriteBatch)
+	raftWb.Set(y.KeyWithTs(RaftLogKey(1, 1), KvTS), []byte("e"))
+	require.Nil(t, engines.ApplyCommitted(wb, raftWb))
+	val, err := getValue(engines.kv.DB, []byte("ta"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("v"), val)
+
+	// The kv engine uses managed transactions, so the reads at an older ts don't see the newer versions.
+	region := genTestRegion(1, 1, 1)
+	reader := engines.NewRegionReader(region, version-1)
+	reader.Rewind()
+	require.False(t, reader.Valid())
+	reader.Close()
+	reader = engines.NewRegionReader(region, version)
+	reader.Rewind()
+	require.True(t, reader.Valid())
+	require.Equal(t, []byte("ta"), reader.Key())
+	reader.Close()
+
+	cleanup()
+	require.False(t, util.DirExists(engines.kvPath))
+	require.False(t, util.DirExists(engines.raftPath))
+}
+
+type testCompactionFilter struct {
+	drop  []byte
+	guard badger.Guard
+}
+
+func (f *testCompactionFilter) Filter(key, val, userMeta []byte) badger.Decision {
+	if bytes.Equal(key, f.drop) {
+		return badger.DecisionDrop
+	}
+	return badger.DecisionKeep
+}
+
+func (f *testCompactionFilter) Guards() []badger.Guard {
+	return []badger.Guard{f.guard}
+}
+
+func TestChainCompactionFilterFactories(t *testing.T) {
+	newFactory := func(drop string) CompactionFilterFactory {
+		return func(targetLevel int, startKey, endKey []byte) badger.CompactionFilter {
+			return &testCompactionFilter{drop: []byte(drop), guard: badger.Guard{Prefix: []byte(drop)}}
+		}
+	}
+	filter := ChainCompactionFilterFactories(newFactory("a"), newFactory("b"))(1, nil, nil)
+	require.Equal(t, badger.DecisionDrop, filter.Filter([]byte("a"), nil, nil))
+	require.Equal(t, badger.DecisionDrop, filter.Filter([]byte("b"), nil, nil))
+	require.Equal(t, badger.DecisionKeep, filter.Filter([]byte("c"), nil, nil))
+	require.Len(t, filter.Guards(), 2)
+}
+
+func TestWriteBatchCompareAndSet(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	key := y.KeyWithTs([]byte("meta"), KvTS)
+	wb := new(WriteBatch)
+	wb.CompareAndSet(key, nil, []byte("v1"))
+	require.Nil(t, wb.WriteToKV(engines.kv))
+
+	// The mismatch aborts the whole batch.
+	wb = new(WriteBatch)
+	wb.Set(y.KeyWithTs([]byte("other"), KvTS), []byte("x"))
+	wb.SetLock([]byte("lock"), []byte("l"))
+	wb.CompareAndSet(key, []byte("v0"), []byte("v2"))
+	err := wb.WriteToKV(engines.kv)
+	mismatch, ok := errors.Cause(err).(*ErrCASMismatch)
+	require.True(t, ok, "%v", err)
+	require.Equal(t, []byte("meta"), mismatch.Key)
+	val, err := getValue(engines.kv.DB, []byte("meta"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("v1"), val)
+	_, err = getValue(engines.kv.DB, []byte("other"))
+	require.Equal(t, badger.ErrKeyNotFound, err)
+	require.Nil(t, engines.kv.LockStore.Get([]byte("lock"), nil))
+
+	wb = new(WriteBatch)
+	wb.CompareAndSet(key, []byte("v1"), []byte("v2"))
+	require.Nil(t, wb.WriteToKV(engines.kv))
+	val, err = getValue(engines.kv.DB, []byte("meta"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("v2"), val)
+}
+
+func TestWriteKVStallTimeout(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	engines.SetWriteStallTimeout(50 * time.Millisecond)
+	var observed int
+	engines.SetWriteObserver(func(wb *WriteBatch, committedVersion uint64) {
+		observed++
+	})
+
+	// Block the update by holding the CompareAndSet mutex.
+	casMu.Lock()
+	wb := new(WriteBatch)
+	wb.CompareAndSet(y.KeyWithTs([]byte("meta"), KvTS), nil, []byte("v1"))
+	wb.SetLock([]byte("lock"), []byte("l"))
+	err := engines.WriteKV(wb)
+	_, ok := err.(*ErrWriteStall)
+	require.True(t, ok, "%v", err)
+	// Nothing is written by the stalled write.
+	_, err = getValue(engines.kv.DB, []byte("meta"))
+	require.Equal(t, badger.ErrKeyNotFound, err)
+	require.Nil(t, engines.kv.LockStore.Get([]byte("lock"), nil))
+	require.Equal(t, 0, observed)
+
+	// The retry writes the batch and notifies the observer.
+	casMu.Unlock()
+	require.Nil(t, engines.WriteKV(wb))
+	val, err := getValue(engines.kv.DB, []byte("meta"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("v1"), val)
+	require.NotNil(t, engines.kv.LockStore.Get([]byte("lock"), nil))
+	require.Equal(t, 1, observed)
+
+	// The write waiting for the checkpoint lock stalls too, the batches without entries other than locks included.
+	kvWriteMu.Lock()
+	wb = new(WriteBatch)
+	wb.DeleteLock([]byte("lock"))
+	err = engines.WriteKV(wb)
+	_, ok = err.(*ErrWriteStall)
+	require.True(t, ok, "%v", err)
+	require.NotNil(t, engines.kv.LockStore.Get([]byte("lock"), nil))
+	kvWriteMu.Unlock()
+	require.Nil(t, engines.WriteKV(wb))
+	require.Nil(t, engines.kv.LockStore.Get([]byte("lock"), nil))
+	require.Equal(t, 2, observed)
+}
+
+func TestTimedRWMutex(t *testing.T) {
+	m := newTimedRWMutex()
+	m.RLock()
+	locked := make(chan struct{})
+	go func() {
+		m.Lock()
+		close(locked)
+	}()
+	// The waiting writer blocks the new readers.
+	for {
+		m.mu.Lock()
+		writer := m.writer
+		m.mu.Unlock()
+		if writer {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	require.False(t, m.rlockWithin(&stallTimer{timeout: 10 * time.Millisecond}))
+	select {
+	case <-locked:
+		t.Fatal("the writer doesn't wait for the reader")
+	default:
+	}
+	m.RUnlock()
+	<-locked
+	m.Unlock()
+	require.True(t, m.rlockWithin(&stallTimer{timeout: 10 * time.Millisecond}))
+	m.RUnlock()
+}
+
+func TestWriteBatchEmptyValue(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	wb := new(WriteBatch)
+	wb.Set(y.KeyWithTs([]byte("empty"), KvTS), nil)
+	wb.Set(y.KeyWithTs([]byte("deleted"), KvTS), []byte("v"))
+	require.Nil(t, engines.WriteKV(wb))
+	wb.Reset()
+	wb.Delete(y.KeyWithTs([]byte("deleted"), KvTS))
+	require.Nil(t, engines.WriteKV(wb))
+
+	val, err := getValue(engines.kv.DB, []byte("empty"))
+	require.Nil(t, err)
+	require.Len(t, val, 0)
+	_, err = getValue(engines.kv.DB, []byte("deleted"))
+	require.Equal(t, badger.ErrKeyNotFound, err)
+
+	// The raft engine still treats the empty values as deletes.
+	raftWB := new(WriteBatch)
+	raftWB.Set(y.KeyWithTs([]byte("empty"), RaftTS), []byte("v"))
+	raftWB.Set(y.KeyWithTs([]byte("deleted"), RaftTS), []byte("v"))
+	require.Nil(t, engines.WriteRaft(raftWB))
+	raftWB.Reset()
+	raftWB.Set(y.KeyWithTs([]byte("empty"), RaftTS), nil)
+	raftWB.Delete(y.KeyWithTs([]byte("deleted"), RaftTS))
+	require.Nil(t, engines.WriteRaft(raftWB))
+	for _, key := range []string{"empty", "deleted"} {
+		_, err = getValue(engines.raft, []byte(key))
+		require.Equal(t, badger.ErrKeyNotFound, err)
+	}
+}
+
+func TestRaftTruncatedState(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	_, _, err := engines.RaftTruncatedState(1)
+	_, ok := err.(*ErrRegionNotFound)
+	require.True(t, ok, "%v", err)
+	_, err = engines.FirstRaftLogIndex(1)
+	_, ok = err.(*ErrRegionNotFound)
+	require.True(t, ok, "%v", err)
+
+	kvWB := new(WriteBatch)
+	kvWB.Set(y.KeyWithTs(ApplyStateKey(1), KvTS), applyState{appliedIndex: 20, truncatedIndex: 10, truncatedTerm: 3}.Marshal())
+	require.Nil(t, engines.WriteKV(kvWB))
+	raftWB := new(WriteBatch)
+	for i := uint64(11); i <= 20; i++ {
+		raftWB.Set(y.KeyWithTs(RaftLogKey(1, i), RaftTS), []byte("entry"))
+	}
+	// The logs of the next region are not counted.
+	raftWB.Set(y.KeyWithTs(RaftLogKey(2, 5), RaftTS), []byte("entry"))
+	require.Nil(t, engines.WriteRaft(raftWB))
+
+	index, term, err := engines.RaftTruncatedState(1)
+	require.Nil(t, err)
+	require.Equal(t, uint64(10), index)
+	require.Equal(t, uint64(3), term)
+	first, err := engines.FirstRaftLogIndex(1)
+	require.Nil(t, err)
+	require.Equal(t, uint64(11), first)
+	first, err = engines.FirstRaftLogIndex(2)
+	require.Nil(t, err)
+	require.Equal(t, uint64(5), first)
+	_, err = engines.FirstRaftLogIndex(3)
+	_, ok = err.(*ErrRegionNotFound)
+	require.True(t, ok, "%v", err)
+}
+
+func TestApplyState(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	_, _, err := engines.GetApplyState(1)
+	_, ok := err.(*ErrRegionNotFound)
+	require.True(t, ok, "%v", err)
+
+	// The applied term is the truncated term if all the applied logs are truncated.
+	require.Nil(t, engines.PutApplyState(1, 10, 10, 3))
+	index, term, err := engines.GetApplyState(1)
+	require.Nil(t, err)
+	require.Equal(t, uint64(10), index)
+	require.Equal(t, uint64(3), term)
+
+	raftWB := new(WriteBatch)
+	require.Nil(t, raftWB.SetMsg(y.KeyWithTs(RaftLogKey(1, 12), RaftTS), &eraftpb.Entry{Index: 12, Term: 4}))
+	require.Nil(t, engines.WriteRaft(raftWB))
+	require.Nil(t, engines.PutApplyState(1, 12, 10, 3))
+	index, term, err = engines.GetApplyState(1)
+	require.Nil(t, err)
+	require.Equal(t, uint64(12), index)
+	require.Equal(t, uint64(4), term)
+	truncatedIndex, truncatedTerm, err := engines.RaftTruncatedState(1)
+	require.Nil(t, err)
+	require.Equal(t, uint64(10), truncatedIndex)
+	require.Equal(t, uint64(3), truncatedTerm)
+}
+
+func TestWriteBatchOnCommit(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	var version uint64
+	wb := new(WriteBatch)
+	wb.OnCommit(func(v uint64) { version = v })
+	wb.Set(y.KeyWithTs([]byte("k"), KvTS), []byte("v"))
+	require.Nil(t, engines.WriteKV(wb))
+	require.NotEqual(t, uint64(0), version)
+	require.Nil(t, engines.kv.DB.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("k"))
+		require.Nil(t, err)
+		require.Equal(t, version, item.Version())
+		return nil
+	}))
+
+	// The failed write doesn't invoke the callback.
+	version = 0
+	wb.Reset()
+	wb.OnCommit(func(v uint64) { version = v })
+	wb.CompareAndSet(y.KeyWithTs([]byte("k"), KvTS), []byte("x"), []byte("v2"))
+	require.NotNil(t, engines.WriteKV(wb))
+	require.Equal(t, uint64(0), version)
+
+	// The callback is cleared by Reset, and not invoked for the lock only batch.
+	wb.Reset()
+	wb.SetLock([]byte("k"), []byte("l"))
+	require.Nil(t, engines.WriteKV(wb))
+	wb.OnCommit(func(v uint64) { version = v })
+	require.Nil(t, engines.WriteKV(wb))
+	require.Equal(t, uint64(0), version)
+}
+
+func TestWriteToKVTxn(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	var version uint64
+	wb := new(WriteBatch)
+	wb.Set(y.KeyWithTs([]byte("ta"), KvTS), []byte("v"))
+	wb.SetLock([]byte("tb"), []byte("lock"))
+	wb.OnCommit(func(v uint64) { version = v })
+	txn := engines.kv.DB.NewTransaction(true)
+	updateLockStore, err := wb.WriteToKVTxn(txn, engines.kv)
+	require.Nil(t, err)
+	// Nothing is visible before the txn commits.
+	_, err = getValue(engines.kv.DB, []byte("ta"))
+	require.Equal(t, badger.ErrKeyNotFound, err)
+	require.Nil(t, engines.kv.LockStore.Get([]byte("tb"), nil))
+	require.Nil(t, txn.Commit())
+	// The lock store is only updated by the returned function after the commit.
+	val, err := getValue(engines.kv.DB, []byte("ta"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("v"), val)
+	require.Nil(t, engines.kv.LockStore.Get([]byte("tb"), nil))
+	require.Equal(t, uint64(0), version)
+	updateLockStore()
+	require.Equal(t, []byte("lock"), engines.kv.LockStore.Get([]byte("tb"), nil))
+	require.Equal(t, engines.CurrentStateTS(), version)
+
+	// The rolled back txn leaves the DB and the lock store untouched.
+	version = 0
+	wb = new(WriteBatch)
+	wb.Set(y.KeyWithTs([]byte("tc"), KvTS), []byte("v"))
+	wb.DeleteLock([]byte("tb"))
+	wb.OnCommit(func(v uint64) { version = v })
+	txn = engines.kv.DB.NewTransaction(true)
+	_, err = wb.WriteToKVTxn(txn, engines.kv)
+	require.Nil(t, err)
+	txn.Discard()
+	_, err = getValue(engines.kv.DB, []byte("tc"))
+	require.Equal(t, badger.ErrKeyNotFound, err)
+	require.Equal(t, []byte("lock"), engines.kv.LockStore.Get([]byte("tb"), nil))
+	require.Equal(t, uint64(0), version)
+}
+
+func TestOpenReadOnlyEngines(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	require.Nil(t, engines.kv.DB.Close())
+	kvOpts := badger.DefaultOptions
+	kvOpts.Dir = engines.kvPath
+	kvOpts.ValueDir = engines.kvPath
+	kvOpts.ManagedTxns = true
+	var err error
+	engines.kv.DB, err = badger.Open(kvOpts)
+	require.Nil(t, err)
+
+	wb := new(WriteBatch)
+	wb.SetWithUserMeta(y.KeyWithTs([]byte("ta"), 10), []byte("a10"), mvcc.NewDBUserMeta(9, 10))
+	lock := &mvcc.Lock{
+		LockHdr: mvcc.LockHdr{StartTS: 12, Op: uint8(kvrpcpb.Op_Put), PrimaryLen: 2},
+		Primary: []byte("ta"),
+	}
+	wb.SetLock([]byte("ta"), lock.MarshalBinary())
+	require.Nil(t, engines.WriteKV(wb))
+	meta := make([]byte, 8)
+	binary.LittleEndian.PutUint64(meta, engines.raft.GetVLogOffset())
+	require.Nil(t, dumpLockStore(engines.kv, engines.kvPath, meta))
+	require.Nil(t, engines.kv.DB.Close())
+	require.Nil(t, engines.raft.Close())
+
+	roEngines, err := OpenReadOnlyEngines(engines.kvPath, engines.raftPath)
+	require.Nil(t, err)
+	defer func() {
+		require.Nil(t, roEngines.Close())
+	}()
+	require.True(t, roEngines.ReadOnly())
+	reader := roEngines.NewRegionReader(genTestRegion(1, 1, 1), 20)
+	reader.Rewind()
+	require.True(t, reader.Valid())
+	require.Equal(t, []byte("ta"), reader.Key())
+	val, err := reader.Value()
+	require.Nil(t, err)
+	require.Equal(t, []byte("a10"), val)
+	require.NotNil(t, reader.Lock())
+	require.Equal(t, uint64(12), reader.Lock().StartTS)
+	reader.Close()
+
+	wb = new(WriteBatch)
+	wb.Set(y.KeyWithTs([]byte("tb"), KvTS), []byte("b"))
+	require.Equal(t, ErrEnginesReadOnly, roEngines.WriteKV(wb))
+	require.Equal(t, ErrEnginesReadOnly, roEngines.WriteRaft(wb))
+	require.Equal(t, ErrEnginesReadOnly, roEngines.ApplyCommitted(wb, nil))
+	require.Equal(t, ErrEnginesReadOnly, wb.WriteToRaftSync(roEngines))
+}
+
+func TestTTLCompactionFilter(t *testing.T) {
+	filter := CreateTTLCompactionFilter(100)(1, nil, nil)
+	require.Empty(t, filter.Guards())
+	require.Equal(t, badger.DecisionMarkTombstone, filter.Filter([]byte("a"), nil, NewTTLUserMeta(1, 2, 99)))
+	require.Equal(t, badger.DecisionMarkTombstone, filter.Filter([]byte("a"), nil, NewTTLUserMeta(1, 2, 100)))
+	require.Equal(t, badger.DecisionKeep, filter.Filter([]byte("a"), nil, NewTTLUserMeta(1, 2, 101)))
+	// The entries without TTL are never dropped.
+	require.Equal(t, badger.DecisionKeep, filter.Filter([]byte("a"), nil, mvcc.NewDBUserMeta(1, 2)))
+	require.Equal(t, badger.DecisionKeep, filter.Filter([]byte("a"), nil, nil))
+
+	meta := NewTTLUserMeta(1, 2, 99)
+	require.Equal(t, uint64(1), meta.StartTS())
+	require.Equal(t, uint64(2), meta.CommitTS())
+}
+
+func TestRegionStateCompactionFilter(t *testing.T) {
+	filter := NewRegionStateCompactionFilterFactory(func() map[uint64]struct{} {
+		return map[uint64]struct{}{1: {}}
+	})(1, nil, nil)
+	marshalState := func(state raft_serverpb.PeerState) []byte {
+		val, err := (&raft_serverpb.RegionLocalState{State: state, Region: &metapb.Region{Id: 2}}).Marshal()
+		require.Nil(t, err)
+		return val
+	}
+	// The local states of the live regions are kept.
+	require.Equal(t, badger.DecisionKeep, filter.Filter(ApplyStateKey(1), nil, nil))
+	require.Equal(t, badger.DecisionKeep,
+		filter.Filter(RegionStateKey(1), marshalState(raft_serverpb.PeerState_Normal), nil))
+	// The local states of the other regions are dropped, except the tombstone region states.
+	require.Equal(t, badger.DecisionMarkTombstone, filter.Filter(ApplyStateKey(2), nil, nil))
+	require.Equal(t, badger.DecisionMarkTombstone, filter.Filter(RaftStateKey(2), nil, nil))
+	require.Equal(t, badger.DecisionMarkTombstone,
+		filter.Filter(RegionStateKey(2), marshalState(raft_serverpb.PeerState_Normal), nil))
+	require.Equal(t, badger.DecisionKeep,
+		filter.Filter(RegionStateKey(2), marshalState(raft_serverpb.PeerState_Tombstone), nil))
+	require.Equal(t, badger.DecisionKeep, filter.Filter(RegionStateKey(2), []byte("invalid"), nil))
+	// The other keys are kept.
+	require.Equal(t, badger.DecisionKeep, filter.Filter(RaftLogKey(2, 1), nil, nil))
+	require.Equal(t, badger.DecisionKeep, filter.Filter([]byte("ta"), nil, nil))
+
+	// The filter without the live regions never drops the local states.
+	require.Equal(t, badger.DecisionKeep, CreateRaftLogCompactionFilter(1, nil, nil).Filter(ApplyStateKey(2), nil, nil))
+}
+
+func TestCheckLockConflict(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	newLock := func(key string, startTS uint64) []byte {
+		lock := &mvcc.Lock{
+			LockHdr: mvcc.LockHdr{StartTS: startTS, Op: uint8(kvrpcpb.Op_Put), PrimaryLen: uint16(len(key))},
+			Primary: []byte(key),
+		}
+		return lock.MarshalBinary()
+	}
+	wb := new(WriteBatch)
+	wb.SetLock([]byte("tb"), newLock("tb", 10))
+	wb.SetLock([]byte("u"), newLock("u", 10))
+	require.Nil(t, engines.WriteKV(wb))
+	region := genTestRegion(1, 1, 1)
+
+	// The commit of the lock deletes it in the same batch.
+	wb = new(WriteBatch)
+	wb.SetWithUserMeta(y.KeyWithTs([]byte("tb"), 11), []byte("v"), mvcc.NewDBUserMeta(10, 11))
+	wb.DeleteLock([]byte("tb"))
+	wb.SetWithUserMeta(y.KeyWithTs([]byte("tc"), 11), []byte("v"), mvcc.NewDBUserMeta(10, 11))
+	// The key out of the region is not checked.
+	wb.SetWithUserMeta(y.KeyWithTs([]byte("u"), 11), []byte("v"), mvcc.NewDBUserMeta(10, 11))
+	// The lock of the same transaction is overwritten.
+	wb.SetLock([]byte("tb"), newLock("tb", 10))
+	wb.DeleteLock([]byte("tb"))
+	require.Nil(t, engines.CheckLockConflict(region, wb))
+
+	wb = new(WriteBatch)
+	wb.SetWithUserMeta(y.KeyWithTs([]byte("tb"), 21), []byte("v"), mvcc.NewDBUserMeta(20, 21))
+	err := engines.CheckLockConflict(region, wb)
+	conflict, ok := err.(*ErrLockConflict)
+	require.True(t, ok, "%v", err)
+	require.Equal(t, []byte("tb"), conflict.Key)
+	require.Equal(t, uint64(10), conflict.StartTS)
+
+	wb = new(WriteBatch)
+	wb.SetLock([]byte("tb"), newLock("tb", 20))
+	err = engines.CheckLockConflict(region, wb)
+	conflict, ok = err.(*ErrLockConflict)
+	require.True(t, ok, "%v", err)
+	require.Equal(t, uint64(10), conflict.StartTS)
+	require.Contains(t, err.Error(), "start ts 10")
+}
+
+func TestGetRaftEntry(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	writeTestRaftLogs(t, engines, 1, 5, 8, 2)
+
+	entry, err := engines.GetRaftEntry(1, 6)
+	require.Nil(t, err)
+	require.Equal(t, uint64(6), entry.Index)
+	require.Equal(t, uint64(2), entry.Term)
+	require.Equal(t, []byte{2}, entry.Data)
+
+	for _, idx := range []uint64{4, 9} {
+		_, err = engines.GetRaftEntry(1, idx)
+		notFound, ok := err.(*ErrRaftEntryNotFound)
+		require.True(t, ok, "%v", err)
+		require.Equal(t, idx, notFound.Index)
+		require.Equal(t, uint64(1), notFound.RegionID)
+	}
+	_, err = engines.GetRaftEntry(2, 6)
+	_, ok := err.(*ErrRaftEntryNotFound)
+	require.True(t, ok, "%v", err)
+}
+
+func TestTruncateRaftLog(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	_, ok := errors.Cause(engines.TruncateRaftLog(1, 12, 3)).(*ErrRegionNotFound)
+	require.True(t, ok)
+	require.Nil(t, engines.PutApplyState(1, 15, 10, 2))
+	writeTestRaftLogs(t, engines, 1, 11, 20, 3)
+
+	// The compact index must be in (truncated index, applied index] and match the term of the entry.
+	require.NotNil(t, engines.TruncateRaftLog(1, 10, 2))
+	require.NotNil(t, engines.TruncateRaftLog(1, 16, 3))
+	require.NotNil(t, engines.TruncateRaftLog(1, 12, 2))
+
+	require.Nil(t, engines.TruncateRaftLog(1, 12, 3))
+	index, term, err := engines.RaftTruncatedState(1)
+	require.Nil(t, err)
+	require.Equal(t, uint64(12), index)
+	require.Equal(t, uint64(3), term)
+	appliedIndex, _, err := engines.GetApplyState(1)
+	require.Nil(t, err)
+	require.Equal(t, uint64(15), appliedIndex)
+	first, err := engines.FirstRaftLogIndex(1)
+	require.Nil(t, err)
+	require.Equal(t, uint64(13), first)
+	// The entries beyond the compact index are kept.
+	for i := uint64(13); i <= 20; i++ {
+		_, err = engines.GetRaftEntry(1, i)
+		require.Nil(t, err)
+	}
+	require.NotNil(t, engines.TruncateRaftLog(1, 12, 3))
+}
+
+func TestTruncateRaftLogConcurrentApply(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	require.Nil(t, engines.PutApplyState(1, 15, 10, 2))
+	writeTestRaftLogs(t, engines, 1, 11, 100, 3)
+
+	// The applier keeps advancing the applied index while the raft log is truncated.
+	const lastApplied = 100
+	done := make(chan error, 1)
+	go func() {
+		for i := uint64(16); i <= lastApplied; i++ {
+			if err := engines.PutApplyState(1, i, 10, 2); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	var wg sync.WaitGroup
+	for i := uint64(11); i <= 15; i++ {
+		wg.Add(1)
+		go func(idx uint64) {
+			defer wg.Done()
+			// The calls with the index not greater than the truncated one fail.
+			_ = engines.TruncateRaftLog(1, idx, 3)
+		}(i)
+	}
+	wg.Wait()
+	require.Nil(t, <-done)
+
+	state, err := engines.loadApplyState(1)
+	require.Nil(t, err)
+	require.Equal(t, uint64(lastApplied), state.appliedIndex)
+	index, term, err := engines.RaftTruncatedState(1)
+	require.Nil(t, err)
+	require.Equal(t, uint64(15), index)
+	require.Equal(t, uint64(3), term)
+	first, err := engines.FirstRaftLogIndex(1)
+	require.Nil(t, err)
+	require.Equal(t, uint64(16), first)
+}
+
+func TestVLogOffsets(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	// Reopen the raft engine with the smallest vlog file size to rotate the vlog files quickly.
+	require.Nil(t, engines.raft.Close())
+	raftOpts := badger.DefaultOptions
+	raftOpts.Dir = engines.raftPath
+	raftOpts.ValueDir = engines.raftPath
+	raftOpts.ValueThreshold = 256
+	raftOpts.ValueLogFileSize = 1 << 20
+	var err error
+	engines.raft, err = badger.Open(raftOpts)
+	require.Nil(t, err)
+	defer engines.raft.Close()
+
+	writeLogs := func(startIndex uint64, num, size int) {
+		wb := new(WriteBatch)
+		for i := 0; i < num; i++ {
+			wb.Set(y.KeyWithTs(RaftLogKey(1, startIndex+uint64(i)), RaftTS), make([]byte, size))
+		}
+		require.Nil(t, engines.WriteRaft(wb))
+	}
+	start, lastDumped := engines.VLogOffsets()
+	require.Zero(t, lastDumped)
+	writeLogs(1, 10, 1024)
+	current, _ := engines.VLogOffsets()
+	// The values are appended to the same vlog file, the offset in the file is advanced by at least their size.
+	require.Equal(t, uint32(start>>32), uint32(current>>32))
+	require.True(t, uint32(current)-uint32(start) >= 10*1024, "%x %x", start, current)
+
+	// Write more than a vlog file, the file id in the high 32 bits is advanced.
+	for i := 0; i < 12; i++ {
+		writeLogs(uint64(100+i*10), 10, 10*1024)
+	}
+	rotated, _ := engines.VLogOffsets()
+	require.True(t, vlogFileNum(rotated) > vlogFileNum(current), "%x %x", current, rotated)
+	require.True(t, uint32(rotated) < uint32(raftOpts.ValueLogFileSize), "%x", rotated)
+
+	atomic.StoreUint64(&engines.lockStoreDumpOffset, current)
+	_, lastDumped = engines.VLogOffsets()
+	require.Equal(t, current, lastDumped)
+}
+
+func TestCurrentStateTS(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	before := engines.CurrentStateTS()
+	allocated := testutil.ToFloat64(stateTSAllocated)
+	for i := 0; i < 3; i++ {
+		wb := new(WriteBatch)
+		wb.Set(y.KeyWithTs([]byte(fmt.Sprintf("k%d", i)), KvTS), []byte("v"))
+		require.Nil(t, engines.WriteKV(wb))
+	}
+	// A batch with only locks doesn't allocate a version.
+	wb := new(WriteBatch)
+	wb.SetLock([]byte("lock"), []byte("l"))
+	require.Nil(t, engines.WriteKV(wb))
+	require.Equal(t, before+3, engines.CurrentStateTS())
+	require.Equal(t, allocated+3, testutil.ToFloat64(stateTSAllocated))
+}
+
+func TestSetWriteObserver(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	var observed []uint64
+	engines.SetWriteObserver(func(wb *WriteBatch, committedVersion uint64) {
+		// The lock store is updated before the batch is observed.
+		if wb.NumLockEntries() > 0 {
+			require.NotNil(t, engines.kv.LockStore.Get([]byte("lock"), nil))
+		}
+		observed = append(observed, committedVersion)
+	})
+	wb := new(WriteBatch)
+	wb.Set(y.KeyWithTs([]byte("k"), KvTS), []byte("v"))
+	require.Nil(t, engines.WriteKV(wb))
+	require.Equal(t, []uint64{engines.CurrentStateTS()}, observed)
+
+	wb = new(WriteBatch)
+	wb.SetLock([]byte("lock"), []byte("l"))
+	require.Nil(t, engines.ApplyCommitted(wb, nil))
+	require.Equal(t, uint64(0), observed[1])
+
+	// The failed writes are not observed.
+	wb = new(WriteBatch)
+	wb.CompareAndSet(y.KeyWithTs([]byte("k"), KvTS), []byte("other"), []byte("v2"))
+	require.NotNil(t, engines.WriteKV(wb))
+	require.Len(t, observed, 2)
+}
+
+func TestListRegions(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	regions, err := engines.ListRegions()
+	require.Nil(t, err)
+	require.Len(t, regions, 0)
+
+	wb := new(WriteBatch)
+	for id := uint64(1); id <= 3; id++ {
+		region := genTestRegion(id, 1, id)
+		region.RegionEpoch = &metapb.RegionEpoch{ConfVer: id, Version: id}
+		state := raft_serverpb.PeerState_Normal
+		if id == 2 {
+			state = raft_serverpb.PeerState_Tombstone
+		}
+		WritePeerState(wb, region, state, nil)
+		// The other region meta keys are not regions.
+		setApplyState(wb, id, applyState{appliedIndex: 5})
+	}
+	require.Nil(t, engines.WriteKV(wb))
+
+	regions, err = engines.ListRegions()
+	require.Nil(t, err)
+	require.Len(t, regions, 2)
+	for i, id := range []uint64{1, 3} {
+		require.Equal(t, id, regions[i].Id)
+		require.Equal(t, id, regions[i].RegionEpoch.Version)
+		require.Equal(t, genTestRegion(id, 1, id).StartKey, regions[i].StartKey)
+	}
+}
+
+func TestDeleteRangeReverse(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	wb := new(WriteBatch)
+	for _, key := range []string{"ta", "tb", "tc", "td", "u"} {
+		wb.Set(y.KeyWithTs([]byte(key), KvTS), []byte("v"))
+		wb.SetLock([]byte(key), []byte("v"))
+	}
+	require.Nil(t, wb.WriteToKV(engines.kv))
+
+	txn := engines.kv.DB.NewTransaction(false)
+	it := dbreader.NewIterator(txn, true, []byte("tb"), []byte("td"))
+	var keys []string
+	for _, key := range collectRangeKeysReverse(it, []byte("tb"), []byte("td"), nil) {
+		keys = append(keys, string(key.UserKey))
+	}
+	it.Close()
+	txn.Discard()
+	require.Equal(t, []string{"tc", "tb"}, keys)
+	keys = keys[:0]
+	for _, key := range collectLockRangeKeysReverse(engines.kv.LockStore.NewIterator(), []byte("tb"), nil, nil) {
+		keys = append(keys, string(key.UserKey))
+	}
+	require.Equal(t, []string{"u", "td", "tc", "tb"}, keys)
+
+	// The last region has an empty end key.
+	require.Nil(t, deleteRange(engines.kv, []byte("tb"), nil, 2, true, nil))
+	_, err := getValue(engines.kv.DB, []byte("ta"))
+	require.Nil(t, err)
+	require.NotNil(t, engines.kv.LockStore.Get([]byte("ta"), nil))
+	for _, key := range []string{"tb", "tc", "td", "u"} {
+		_, err = getValue(engines.kv.DB, []byte(key))
+		require.Equal(t, badger.ErrKeyNotFound, err)
+		require.Nil(t, engines.kv.LockStore.Get([]byte(key), nil))
+	}
+}
+
+func TestCollectRangeKeysHint(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	wb := new(WriteBatch)
+	for _, key := range []string{"s", "ta", "tb", "tc", "u"} {
+		wb.Set(y.KeyWithTs([]byte(key), KvTS), []byte("v"))
+	}
+	require.Nil(t, wb.WriteToKV(engines.kv))
+	wb = new(WriteBatch)
+	wb.Set(y.KeyWithTs([]byte("ta"), KvTS), []byte("v2"))
+	require.Nil(t, wb.WriteToKV(engines.kv))
+
+	collect := func(startKey, endKey []byte) []string {
+		txn := engines.kv.DB.NewTransaction(false)
+		defer txn.Discard()
+		var keys []string
+		for _, key := range collectRangeKeys(txn, startKey, endKey, newRangeHint(startKey, endKey), nil) {
+			keys = append(keys, string(key.UserKey))
+		}
+		return keys
+	}
+	// The prefix aligned range only reads the latest versions of the keys with the prefix.
+	hint := newRangeHint([]byte("t"), []byte("u"))
+	require.Equal(t, []byte("t"), hint.prefix)
+	opts := hint.iterOptions([]byte("t"))
+	require.False(t, opts.AllVersions)
+	require.Equal(t, y.KeyWithTs([]byte("t"), math.MaxUint64), opts.StartKey)
+	require.Equal(t, y.KeyWithTs([]byte("u"), math.MaxUint64), opts.EndKey)
+	require.Equal(t, []string{"ta", "tb", "tc"}, collect([]byte("t"), []byte("u")))
+
+	// The other ranges fall back to comparing the keys with the end key.
+	hint = newRangeHint([]byte("ta"), []byte("tc"))
+	require.Nil(t, hint.prefix)
+	opts = hint.iterOptions([]byte("ta"))
+	require.Equal(t, y.KeyWithTs([]byte("ta"), math.MaxUint64), opts.StartKey)
+	require.Equal(t, y.KeyWithTs([]byte("tc"), math.MaxUint64), opts.EndKey)
+	require.Equal(t, []string{"ta", "tb"}, collect([]byte("ta"), []byte("tc")))
+	opts = newRangeHint([]byte("tb"), nil).iterOptions([]byte("tb"))
+	require.True(t, opts.EndKey.IsEmpty())
+	require.Equal(t, []string{"tb", "tc", "u"}, collect([]byte("tb"), nil))
+}
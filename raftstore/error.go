@@ -15,10 +15,15 @@ package raftstore
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
 	"github.com/pingcap/kvproto/pkg/errorpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/log"
+	"go.uber.org/zap"
 )
 
 // ErrNotLeader is returned when this region is not Leader.
@@ -97,6 +102,50 @@ func (e *ErrRaftEntryTooLarge) Error() string {
 	return fmt.Sprintf("raft entry too large, region_id: %v, len: %v", e.RegionID, e.EntrySize)
 }
 
+// ErrRegionEpochChanged is returned when the region epoch is changed during taking the region snapshot,
+// it's safe to retry.
+type ErrRegionEpochChanged struct {
+	RegionID uint64
+	OldEpoch *metapb.RegionEpoch
+	NewEpoch *metapb.RegionEpoch
+}
+
+func (e *ErrRegionEpochChanged) Error() string {
+	return fmt.Sprintf("region %v epoch changed from %v to %v", e.RegionID, e.OldEpoch, e.NewEpoch)
+}
+
+// ErrBatchTooLarge is returned when the WriteBatch is too large to fit into one kv engine transaction,
+// the caller can split the batch into smaller ones and retry.
+type ErrBatchTooLarge struct {
+	NumEntries int
+	Size       int
+}
+
+func (e *ErrBatchTooLarge) Error() string {
+	return fmt.Sprintf("write batch too large, entries: %v, size: %v", e.NumEntries, e.Size)
+}
+
+// ErrCASMismatch is returned when the current value of the key doesn't match the expected value of
+// a CompareAndSet, the whole WriteBatch is not written.
+type ErrCASMismatch struct {
+	Key []byte
+}
+
+func (e *ErrCASMismatch) Error() string {
+	return fmt.Sprintf("compare and set mismatch, key: %q", e.Key)
+}
+
+// ErrLockConflict is returned by CheckLockConflict when a key written by the WriteBatch is locked by another
+// transaction.
+type ErrLockConflict struct {
+	Key     []byte
+	StartTS uint64
+}
+
+func (e *ErrLockConflict) Error() string {
+	return fmt.Sprintf("key %q is locked by the transaction of start ts %d", e.Key, e.StartTS)
+}
+
 // ErrToPbError converts error to *errorpb.Error.
 func ErrToPbError(e error) *errorpb.Error {
 	ret := new(errorpb.Error)
@@ -123,3 +172,82 @@ func ErrToPbError(e error) *errorpb.Error {
 	}
 	return ret
 }
+
+// ErrWriteStall is returned when the kv update of a WriteBatch can't start within the write stall timeout.
+// It's retriable, nothing of the WriteBatch is written.
+type ErrWriteStall struct {
+	Timeout time.Duration
+}
+
+func (e *ErrWriteStall) Error() string {
+	return fmt.Sprintf("kv write stalled for more than %v", e.Timeout)
+}
+
+// ErrDeltaSnapshotUnavailable is returned when the follower can't catch up with a delta snapshot, the raft logs
+// after the base index are truncated or there are too many of them. A full snapshot should be sent instead.
+type ErrDeltaSnapshotUnavailable struct {
+	RegionID  uint64
+	BaseIndex uint64
+}
+
+func (e *ErrDeltaSnapshotUnavailable) Error() string {
+	return fmt.Sprintf("region %v delta snapshot from index %v is unavailable", e.RegionID, e.BaseIndex)
+}
+
+// ErrRaftEntryNotFound is returned when the raft log entry doesn't exist, it's compacted or not appended yet.
+type ErrRaftEntryNotFound struct {
+	RegionID uint64
+	Index    uint64
+}
+
+func (e *ErrRaftEntryNotFound) Error() string {
+	return fmt.Sprintf("raft entry %v of region %v not found", e.Index, e.RegionID)
+}
+
+// ErrRaftMessage is returned when a raft message can't be routed, it carries the context of the message.
+type ErrRaftMessage struct {
+	RegionID   uint64
+	FromPeerID uint64
+	ToPeerID   uint64
+	MsgType    eraftpb.MessageType
+	Err        error
+}
+
+func newRaftMessageError(msg *raft_serverpb.RaftMessage, err error) *ErrRaftMessage {
+	return &ErrRaftMessage{
+		RegionID:   msg.GetRegionId(),
+		FromPeerID: msg.GetFromPeer().GetId(),
+		ToPeerID:   msg.GetToPeer().GetId(),
+		MsgType:    msg.GetMessage().GetMsgType(),
+		Err:        err,
+	}
+}
+
+func (e *ErrRaftMessage) Error() string {
+	return fmt.Sprintf("region %v %v from peer %v to peer %v: %v", e.RegionID, e.MsgType, e.FromPeerID, e.ToPeerID, e.Err)
+}
+
+// Cause returns the underlying error.
+func (e *ErrRaftMessage) Cause() error {
+	return e.Err
+}
+
+// logFields returns the context of the message as zap fields.
+func (e *ErrRaftMessage) logFields() []zap.Field {
+	return []zap.Field{
+		zap.Uint64("region id", e.RegionID),
+		zap.Uint64("from peer", e.FromPeerID),
+		zap.Uint64("to peer", e.ToPeerID),
+		zap.Stringer("msg type", e.MsgType),
+		zap.Error(e.Err),
+	}
+}
+
+// logRaftMessageError logs the error returned by sendRaftMessage with the context of the message.
+func logRaftMessageError(err error) {
+	if e, ok := err.(*ErrRaftMessage); ok {
+		log.Error("failed to send raft message", e.logFields()...)
+		return
+	}
+	log.Error("failed to send raft message", zap.Error(err))
+}
@@ -16,7 +16,10 @@ package raftstore
 import (
 	"testing"
 
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -72,3 +75,32 @@ func TestRaftstoreErrToPbError(t *testing.T) {
 	assert.Equal(t, pbErr.RaftEntryTooLarge.RegionId, regionID)
 	assert.Equal(t, pbErr.RaftEntryTooLarge.EntrySize, entrySize)
 }
+
+func TestSendRaftMessageError(t *testing.T) {
+	pr := newRouter(make(chan Msg, 1), nil)
+	msg := &rspb.RaftMessage{
+		RegionId: 1,
+		FromPeer: &metapb.Peer{Id: 2},
+		ToPeer:   &metapb.Peer{Id: 3},
+	}
+	err := pr.sendRaftMessage(msg)
+	e, ok := err.(*ErrRaftMessage)
+	require.True(t, ok, "%v", err)
+	assert.Equal(t, uint64(1), e.RegionID)
+	assert.Equal(t, uint64(2), e.FromPeerID)
+	assert.Equal(t, uint64(3), e.ToPeerID)
+	require.NotNil(t, errors.Cause(err))
+	assert.NotEqual(t, err, errors.Cause(err))
+
+	msg.Message = &eraftpb.Message{MsgType: eraftpb.MessageType_MsgAppend}
+	msg.ToPeer = nil
+	err = pr.sendRaftMessage(msg)
+	e, ok = err.(*ErrRaftMessage)
+	require.True(t, ok, "%v", err)
+	assert.Equal(t, eraftpb.MessageType_MsgAppend, e.MsgType)
+	assert.Contains(t, err.Error(), "MsgAppend")
+
+	// The message of an unknown region goes to the store.
+	msg.ToPeer = &metapb.Peer{Id: 3}
+	require.Nil(t, pr.sendRaftMessage(msg))
+}
@@ -15,6 +15,7 @@ package raftstore
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"sync"
 	"sync/atomic"
@@ -110,6 +111,7 @@ type RaftContext struct {
 	ReadyRes     []*ReadyICPair
 	kvWB         *WriteBatch
 	raftWB       *WriteBatch
+	syncLog      bool
 	pendingCount int
 	hasReady     bool
 	queuedSnaps  map[uint64]struct{}
@@ -368,9 +370,18 @@ type raftBatchSystem struct {
 	closeCh   chan struct{}
 	wg        *sync.WaitGroup
 	globalCfg *config.Config
+
+	// running is set after the batch system is started and cleared when it's shutting down.
+	running int32
+}
+
+// isRunning returns whether the batch system is running, it's safe to be called concurrently.
+func (bs *raftBatchSystem) isRunning() bool {
+	return atomic.LoadInt32(&bs.running) == 1
 }
 
 func (bs *raftBatchSystem) start(
+	ctx context.Context,
 	meta *metapb.Store,
 	cfg *Config,
 	engines *Engines,
@@ -425,11 +436,13 @@ func (bs *raftBatchSystem) start(
 	for _, peer := range regionPeers {
 		bs.router.register(peer)
 	}
-	bs.startWorkers(regionPeers)
+	bs.startWorkers(ctx, regionPeers)
+	atomic.StoreInt32(&bs.running, 1)
 	return nil
 }
 
-func (bs *raftBatchSystem) startWorkers(peers []*peerFsm) {
+// startWorkers starts the workers, the pd rpcs use pdCtx which is cancelled when the server stops.
+func (bs *raftBatchSystem) startWorkers(pdCtx context.Context, peers []*peerFsm) {
 	ctx := bs.ctx
 	workers := bs.workers
 	router := bs.router
@@ -452,10 +465,13 @@ func (bs *raftBatchSystem) startWorkers(peers []*peerFsm) {
 	engines := ctx.engine
 	cfg := ctx.cfg
 	workers.splitCheckWorker.start(newSplitCheckRunner(engines.kv.DB, router, cfg.SplitCheck))
-	workers.regionWorker.start(newRegionTaskHandler(bs.globalCfg, engines, ctx.snapMgr, cfg.SnapApplyBatchSize, cfg.CleanStalePeerDelay))
+	regionTaskHandler := newRegionTaskHandler(bs.globalCfg, engines, ctx.snapMgr, cfg.SnapApplyBatchSize, cfg.CleanStalePeerDelay)
+	regionTaskHandler.ctx.delRangeBatchSize = int(cfg.DeleteRangeBatchSize)
+	regionTaskHandler.ctx.delRangeReverse = cfg.DeleteRangeReverse
+	workers.regionWorker.start(regionTaskHandler)
 	workers.raftLogGCWorker.start(&raftLogGCTaskHandler{})
 	workers.compactWorker.start(&compactTaskHandler{engine: engines.kv.DB})
-	workers.pdWorker.start(newPDTaskHandler(ctx.store.Id, ctx.pdClient, bs.router))
+	workers.pdWorker.start(newPDTaskHandler(pdCtx, ctx.store.Id, ctx.pdClient, bs.router))
 	workers.computeHashWorker.start(&computeHashTaskHandler{router: bs.router})
 }
 
@@ -463,6 +479,7 @@ func (bs *raftBatchSystem) shutDown() {
 	if bs.workers == nil {
 		return
 	}
+	atomic.StoreInt32(&bs.running, 0)
 	close(bs.closeCh)
 	bs.wg.Wait()
 	workers := bs.workers
@@ -480,6 +497,8 @@ func (bs *raftBatchSystem) shutDown() {
 func createRaftBatchSystem(globalCfg *config.Config, raftCfg *Config) (*router, *raftBatchSystem) {
 	storeSender, storeFsm := newStoreFsm(raftCfg)
 	router := newRouter(storeSender, storeFsm)
+	router.nonBlockingRaftMsg = raftCfg.RaftMsgNonBlocking
+	router.peerMailboxSize = int64(raftCfg.RaftMsgPeerMailboxSize)
 	raftBatchSystem := &raftBatchSystem{
 		router:    router,
 		closeCh:   make(chan struct{}),
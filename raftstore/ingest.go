@@ -0,0 +1,140 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/ngaut/unistore/rocksdb"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+)
+
+// ingestBatchSize is the size threshold to flush the write batch during ingesting.
+const ingestBatchSize = 4 * 1024 * 1024
+
+type ingestOptions struct {
+	oldPrefix []byte
+	newPrefix []byte
+	rewrite   bool
+
+	progressInterval int
+	progress         ProgressFunc
+
+	atomic bool
+}
+
+// IngestOption configures how IngestSST writes the keys.
+type IngestOption func(opts *ingestOptions)
+
+// RewritePrefix replaces the leading oldPrefix of every key with newPrefix before writing it,
+// the keys don't have oldPrefix are rejected.
+func RewritePrefix(oldPrefix, newPrefix []byte) IngestOption {
+	return func(opts *ingestOptions) {
+		opts.oldPrefix = oldPrefix
+		opts.newPrefix = newPrefix
+		opts.rewrite = true
+	}
+}
+
+// IngestProgress reports the number of ingested keys and bytes every interval keys.
+func IngestProgress(interval int, fn ProgressFunc) IngestOption {
+	return func(opts *ingestOptions) {
+		opts.progressInterval = interval
+		opts.progress = fn
+	}
+}
+
+// AtomicIngest makes IngestSST write all the keys in one kv transaction, so a failed ingest leaves the kv engine
+// untouched and the keys become visible at the same time. All the keys are buffered in memory before written.
+func AtomicIngest() IngestOption {
+	return func(opts *ingestOptions) {
+		opts.atomic = true
+	}
+}
+
+func (opts *ingestOptions) rewriteKey(key []byte) ([]byte, error) {
+	if !opts.rewrite {
+		return key, nil
+	}
+	if !bytes.HasPrefix(key, opts.oldPrefix) {
+		return nil, errors.Errorf("key %q doesn't have the prefix %q to rewrite", key, opts.oldPrefix)
+	}
+	newKey := make([]byte, 0, len(opts.newPrefix)+len(key)-len(opts.oldPrefix))
+	newKey = append(newKey, opts.newPrefix...)
+	return append(newKey, key[len(opts.oldPrefix):]...), nil
+}
+
+// IngestSST writes all the keys in the sst file into the kv engine and returns the number of
+// ingested keys. Only the latest version of a key is written, the deletions and the single deletions delete the key,
+// the other value types like merges, range deletions and blob indexes are rejected. If any key is rejected, no more
+// keys are written and the error is returned, the keys are written in batches, so the keys before the rejected one
+// may be written unless AtomicIngest is used.
+func (en *Engines) IngestSST(path string, opts ...IngestOption) (int, error) {
+	var ingestOpts ingestOptions
+	for _, opt := range opts {
+		opt(&ingestOpts)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	defer f.Close()
+	it, err := rocksdb.NewSstFileIterator(f)
+	if err != nil {
+		return 0, err
+	}
+	progress := newProgressReporter(ingestOpts.progressInterval, ingestOpts.progress)
+	wb := new(WriteBatch)
+	var count int
+	var lastKey []byte
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		ikey := it.Key()
+		// The versions of a user key are ordered by the sequence number descending, only the latest one is written.
+		if lastKey != nil && bytes.Equal(lastKey, ikey.UserKey) {
+			continue
+		}
+		lastKey = y.SafeCopy(lastKey, ikey.UserKey)
+		key, err := ingestOpts.rewriteKey(ikey.UserKey)
+		if err != nil {
+			return count, err
+		}
+		switch {
+		case ikey.IsDeletion():
+			wb.Delete(y.KeyWithTs(key, KvTS))
+		case ikey.IsValue():
+			wb.Set(y.KeyWithTs(key, KvTS), y.SafeCopy(nil, it.Value()))
+		default:
+			return count, errors.Errorf("key %q has the value type %d which can't be ingested", ikey.UserKey,
+				ikey.ValueType)
+		}
+		progress.add(1, len(key)+len(it.Value()))
+		if !ingestOpts.atomic && wb.Bytes() >= ingestBatchSize {
+			if err = en.WriteKV(wb); err != nil {
+				return count, err
+			}
+			count += wb.Len()
+			wb.Reset()
+		}
+	}
+	if err = it.Err(); err != nil {
+		return count, err
+	}
+	if err = en.WriteKV(wb); err != nil {
+		return count, err
+	}
+	progress.finish()
+	return count + wb.Len(), nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/ngaut/unistore/rocksdb"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/y"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSstFile(t *testing.T, keys ...string) string {
+	f, err := ioutil.TempFile("", "unistore-ingest.*.sst")
+	require.Nil(t, err)
+	w := rocksdb.NewSstFileWriter(f, rocksdb.NewDefaultBlockBasedTableOptions(bytes.Compare))
+	for _, key := range keys {
+		require.Nil(t, w.Put([]byte(key), []byte("v"+key)))
+	}
+	require.Nil(t, w.Finish())
+	require.Nil(t, w.Close())
+	return f.Name()
+}
+
+func TestIngestSSTRewritePrefix(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	path := newTestSstFile(t, "t1_a", "t1_b", "t1_c")
+	defer os.Remove(path)
+	n, err := engines.IngestSST(path, RewritePrefix([]byte("t1_"), []byte("t22_")))
+	require.Nil(t, err)
+	require.Equal(t, 3, n)
+	for _, key := range []string{"a", "b", "c"} {
+		val, err := getValue(engines.kv.DB, []byte("t22_"+key))
+		require.Nil(t, err)
+		require.Equal(t, "vt1_"+key, string(val))
+		_, err = getValue(engines.kv.DB, []byte("t1_"+key))
+		require.Equal(t, badger.ErrKeyNotFound, err)
+	}
+
+	path2 := newTestSstFile(t, "t1_d", "t2_e")
+	defer os.Remove(path2)
+	_, err = engines.IngestSST(path2, RewritePrefix([]byte("t1_"), []byte("t22_")))
+	require.NotNil(t, err)
+	_, err = getValue(engines.kv.DB, []byte("t22_d"))
+	require.Equal(t, badger.ErrKeyNotFound, err)
+}
+
+func TestIngestSSTProgress(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	path := newTestSstFile(t, "ta", "tb", "tc", "td", "te")
+	defer os.Remove(path)
+	var reported []int
+	var lastBytes int
+	n, err := engines.IngestSST(path, IngestProgress(2, func(keys, bytes int) {
+		reported = append(reported, keys)
+		lastBytes = bytes
+	}))
+	require.Nil(t, err)
+	require.Equal(t, 5, n)
+	require.Equal(t, []int{2, 4, 5}, reported)
+	// Every key is 2 bytes and every value is 3 bytes.
+	require.Equal(t, 25, lastBytes)
+}
+
+func TestAtomicIngestSST(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	f, err := ioutil.TempFile("", "unistore-ingest.*.sst")
+	require.Nil(t, err)
+	defer os.Remove(f.Name())
+	w := rocksdb.NewSstFileWriter(f, rocksdb.NewDefaultBlockBasedTableOptions(bytes.Compare))
+	// The keys before the rejected one exceed the batch size.
+	val := make([]byte, ingestBatchSize/2)
+	for _, key := range []string{"t1_a", "t1_b", "t1_c"} {
+		require.Nil(t, w.Put([]byte(key), val))
+	}
+	require.Nil(t, w.Put([]byte("t2_d"), val))
+	require.Nil(t, w.Finish())
+	require.Nil(t, w.Close())
+
+	rewrite := RewritePrefix([]byte("t1_"), []byte("t3_"))
+	n, err := engines.IngestSST(f.Name(), rewrite, AtomicIngest())
+	require.NotNil(t, err)
+	require.Equal(t, 0, n)
+	_, err = getValue(engines.kv.DB, []byte("t3_a"))
+	require.Equal(t, badger.ErrKeyNotFound, err)
+
+	n, err = engines.IngestSST(f.Name(), rewrite)
+	require.NotNil(t, err)
+	require.Equal(t, 2, n)
+	_, err = getValue(engines.kv.DB, []byte("t3_a"))
+	require.Nil(t, err)
+}
+
+func TestIngestSSTValueTypes(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	writeSst := func(entries ...rocksdb.InternalKey) string {
+		f, err := ioutil.TempFile("", "unistore-ingest.*.sst")
+		require.Nil(t, err)
+		w := rocksdb.NewSstFileWriter(f, rocksdb.NewDefaultBlockBasedTableOptions(bytes.Compare))
+		for _, ikey := range entries {
+			require.Nil(t, w.Add(ikey, []byte(fmt.Sprintf("%s%d", ikey.UserKey, ikey.SequenceNumber))))
+		}
+		require.Nil(t, w.Finish())
+		require.Nil(t, w.Close())
+		return f.Name()
+	}
+	wb := new(WriteBatch)
+	wb.Set(y.KeyWithTs([]byte("tb"), KvTS), []byte("old"))
+	require.Nil(t, engines.WriteKV(wb))
+
+	// Only the latest version of a key is ingested.
+	path := writeSst(
+		rocksdb.InternalKey{UserKey: []byte("ta"), SequenceNumber: 3, ValueType: rocksdb.TypeValue},
+		rocksdb.InternalKey{UserKey: []byte("ta"), SequenceNumber: 2, ValueType: rocksdb.TypeValue},
+		rocksdb.InternalKey{UserKey: []byte("tb"), SequenceNumber: 5, ValueType: rocksdb.TypeDeletion},
+		rocksdb.InternalKey{UserKey: []byte("tb"), SequenceNumber: 4, ValueType: rocksdb.TypeValue},
+		rocksdb.InternalKey{UserKey: []byte("tc"), SequenceNumber: 1, ValueType: rocksdb.TypeValue},
+	)
+	defer os.Remove(path)
+	count, err := engines.IngestSST(path)
+	require.Nil(t, err)
+	require.Equal(t, 3, count)
+	val, err := getValue(engines.kv.DB, []byte("ta"))
+	require.Nil(t, err)
+	require.Equal(t, "ta3", string(val))
+	_, err = getValue(engines.kv.DB, []byte("tb"))
+	require.Equal(t, badger.ErrKeyNotFound, err)
+	val, err = getValue(engines.kv.DB, []byte("tc"))
+	require.Nil(t, err)
+	require.Equal(t, "tc1", string(val))
+
+	// The merges can't be ingested.
+	path = writeSst(rocksdb.InternalKey{UserKey: []byte("td"), SequenceNumber: 1, ValueType: rocksdb.TypeMerge})
+	defer os.Remove(path)
+	_, err = engines.IngestSST(path)
+	require.NotNil(t, err)
+	_, err = getValue(engines.kv.DB, []byte("td"))
+	require.Equal(t, badger.ErrKeyNotFound, err)
+}
@@ -33,17 +33,21 @@ const (
 	// with different prefixes.
 	RegionRaftPrefix byte = 0x02
 	RegionMetaPrefix byte = 0x03
-	RegionRaftLogLen      = 19 // REGION_RAFT_PREFIX_KEY + region_id + suffix + index
+	// RegionStagingPrefix is the prefix of the region data staged by StageAndSwapRegion.
+	RegionStagingPrefix byte = 0x04
+	RegionRaftLogLen         = 19 // REGION_RAFT_PREFIX_KEY + region_id + suffix + index
 
 	// Following are the suffix after the local prefix.
 	// For region id
-	RaftLogSuffix           byte = 0x01
-	RaftStateSuffix         byte = 0x02
-	ApplyStateSuffix        byte = 0x03
-	SnapshotRaftStateSuffix byte = 0x04
+	RaftLogSuffix            byte = 0x01
+	RaftStateSuffix          byte = 0x02
+	ApplyStateSuffix         byte = 0x03
+	SnapshotRaftStateSuffix  byte = 0x04
+	RaftTruncatedStateSuffix byte = 0x05
 
 	// For region meta
-	RegionStateSuffix byte = 0x01
+	RegionStateSuffix         byte = 0x01
+	RangeDeleteProgressSuffix byte = 0x02
 )
 
 // keys
@@ -112,6 +116,11 @@ func SnapshotRaftStateKey(regionID uint64) []byte {
 	return makeRaftRegionPrefix(regionID, SnapshotRaftStateSuffix)
 }
 
+// RaftTruncatedStateKey makes the key of the truncated state written by TruncateRaftLog in the raft engine.
+func RaftTruncatedStateKey(regionID uint64) []byte {
+	return makeRaftRegionPrefix(regionID, RaftTruncatedStateSuffix)
+}
+
 func decodeRegionMetaKey(key []byte) (uint64, byte, error) {
 	if len(RegionMetaMinKey)+8+1 != len(key) {
 		return 0, 0, errors.Errorf("invalid region meta key length for key %v", key)
@@ -132,6 +141,16 @@ func RegionMetaPrefixKey(regionID uint64) []byte {
 	return key
 }
 
+// RegionStagingPrefixKey returns the prefix of the keys staged for the region with the given region id, a staged
+// key is the prefix followed by the data key.
+func RegionStagingPrefixKey(regionID uint64) []byte {
+	key := make([]byte, 10)
+	key[0] = LocalPrefix
+	key[1] = RegionStagingPrefix
+	binary.BigEndian.PutUint64(key[2:], regionID)
+	return key
+}
+
 // RegionStateKey returns the region state key with the given region id.
 func RegionStateKey(regionID uint64) []byte {
 	key := make([]byte, 11)
@@ -142,6 +161,16 @@ func RegionStateKey(regionID uint64) []byte {
 	return key
 }
 
+// RangeDeleteProgressKey returns the key to record the range delete progress of the given region id.
+func RangeDeleteProgressKey(regionID uint64) []byte {
+	key := make([]byte, 11)
+	key[0] = LocalPrefix
+	key[1] = RegionMetaPrefix
+	binary.BigEndian.PutUint64(key[2:], regionID)
+	key[10] = RangeDeleteProgressSuffix
+	return key
+}
+
 // RawStartKey gets the `start_key` of current region in encoded form.
 func RawStartKey(region *metapb.Region) []byte {
 	// only initialized region's start_key can be encoded, otherwise there must be bugs
@@ -0,0 +1,122 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "unistore"
+	metricsSubsystem = "raftstore"
+)
+
+// Raftstore metrics.
+var (
+	workerPendingTasks = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "worker_pending_tasks",
+			Help:      "Number of tasks queued in the worker.",
+		}, []string{"name"})
+
+	lockStoreEntries = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "lock_store_entries",
+			Help:      "Number of locks in the lock store.",
+		})
+
+	lockStoreBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "lock_store_bytes",
+			Help:      "Approximate size of the keys and values in the lock store.",
+		})
+
+	snapshotsInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "snapshots_in_flight",
+			Help:      "Number of the snapshots being sent or received.",
+		}, []string{"type"})
+
+	snapshotTransferDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "snapshot_transfer_duration_seconds",
+			Help:      "Bucketed histogram of the time spent on sending or receiving a snapshot.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 16),
+		}, []string{"type", "result"})
+
+	snapshotRecvSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "snapshot_recv_size_bytes",
+			Help:      "Bucketed histogram of the bytes received for a snapshot by the Snapshot handler.",
+			Buckets:   prometheus.ExponentialBuckets(4096, 4, 12),
+		}, []string{"result"})
+
+	snapshotRecvDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "snapshot_recv_duration_seconds",
+			Help:      "Bucketed histogram of the time spent on receiving a snapshot by the Snapshot handler.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 16),
+		}, []string{"result"})
+
+	raftMessagesDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "raft_messages_dropped_total",
+			Help:      "Total number of the raft messages dropped because the peer mailbox or the store sender is full.",
+		}, []string{"sender", "region_bucket"})
+
+	kvWriteStalls = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "kv_write_stalls_total",
+			Help:      "Total number of the kv writes which can't start within the write stall timeout.",
+		})
+
+	stateTSAllocated = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Subsystem: metricsSubsystem,
+			Name:      "state_ts_allocated_total",
+			Help:      "Total number of the versions allocated to the kv writes from StateTS.",
+		})
+)
+
+func init() {
+	prometheus.MustRegister(workerPendingTasks)
+	prometheus.MustRegister(lockStoreEntries)
+	prometheus.MustRegister(lockStoreBytes)
+	prometheus.MustRegister(snapshotsInFlight)
+	prometheus.MustRegister(snapshotTransferDuration)
+	prometheus.MustRegister(snapshotRecvSize)
+	prometheus.MustRegister(snapshotRecvDuration)
+	prometheus.MustRegister(raftMessagesDropped)
+	prometheus.MustRegister(kvWriteStalls)
+	prometheus.MustRegister(stateTSAllocated)
+}
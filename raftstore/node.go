@@ -94,7 +94,7 @@ func (n *Node) Start(ctx context.Context, engines *Engines, trans Transport, sna
 	if err != nil {
 		return err
 	}
-	if err = n.startNode(engines, trans, snapMgr, pdWorker); err != nil {
+	if err = n.startNode(ctx, engines, trans, snapMgr, pdWorker); err != nil {
 		return err
 	}
 
@@ -252,9 +252,10 @@ func (n *Node) BootstrapCluster(ctx context.Context, engines *Engines, firstRegi
 	return false, errors.New("bootstrap cluster failed")
 }
 
-func (n *Node) startNode(engines *Engines, trans Transport, snapMgr *SnapManager, pdWorker *worker) error {
+func (n *Node) startNode(ctx context.Context, engines *Engines, trans Transport, snapMgr *SnapManager,
+	pdWorker *worker) error {
 	log.S().Infof("start raft store node, storeID: %d", n.store.GetId())
-	return n.system.start(n.store, n.cfg, engines, trans, n.pdClient, snapMgr, pdWorker, n.observer)
+	return n.system.start(ctx, n.store, n.cfg, engines, trans, n.pdClient, snapMgr, pdWorker, n.observer)
 }
 
 func (n *Node) stopNode(storeID uint64) {
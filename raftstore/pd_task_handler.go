@@ -28,6 +28,8 @@ import (
 )
 
 type pdTaskHandler struct {
+	// ctx is the context of the pd rpcs, it's cancelled when the server stops.
+	ctx      context.Context
 	storeID  uint64
 	pdClient pd.Client
 	router   *router
@@ -37,8 +39,9 @@ type pdTaskHandler struct {
 	peerStats  map[uint64]*peerStatistics
 }
 
-func newPDTaskHandler(storeID uint64, pdClient pd.Client, router *router) *pdTaskHandler {
+func newPDTaskHandler(ctx context.Context, storeID uint64, pdClient pd.Client, router *router) *pdTaskHandler {
 	return &pdTaskHandler{
+		ctx:       ctx,
 		storeID:   storeID,
 		pdClient:  pdClient,
 		router:    router,
@@ -110,7 +113,7 @@ func (r *pdTaskHandler) onRegionHeartbeatResponse(resp *pdpb.RegionHeartbeatResp
 }
 
 func (r *pdTaskHandler) onAskSplit(t *pdAskSplitTask) {
-	resp, err := r.pdClient.AskSplit(context.TODO(), t.region)
+	resp, err := r.pdClient.AskSplit(r.ctx, t.region)
 	if err != nil {
 		log.S().Error(err)
 		return
@@ -128,7 +131,7 @@ func (r *pdTaskHandler) onAskSplit(t *pdAskSplitTask) {
 }
 
 func (r *pdTaskHandler) onAskBatchSplit(t *pdAskBatchSplitTask) {
-	resp, err := r.pdClient.AskBatchSplit(context.TODO(), t.region, len(t.splitKeys))
+	resp, err := r.pdClient.AskBatchSplit(r.ctx, t.region, len(t.splitKeys))
 	if err != nil {
 		log.S().Error(err)
 		return
@@ -225,19 +228,19 @@ func (r *pdTaskHandler) onStoreHeartbeat(t *pdStoreHeartbeatTask) {
 	r.storeStats.lastTotalReadKeys = r.storeStats.totalReadKeys
 	r.storeStats.lastReport = time.Now()
 
-	if err := r.pdClient.StoreHeartbeat(context.TODO(), t.stats); err != nil {
+	if err := r.pdClient.StoreHeartbeat(r.ctx, t.stats); err != nil {
 		log.S().Error(err)
 	}
 }
 
 func (r *pdTaskHandler) onReportBatchSplit(t *pdReportBatchSplitTask) {
-	if err := r.pdClient.ReportBatchSplit(context.TODO(), t.regions); err != nil {
+	if err := r.pdClient.ReportBatchSplit(r.ctx, t.regions); err != nil {
 		log.S().Error(err)
 	}
 }
 
 func (r *pdTaskHandler) onValidatePeer(t *pdValidatePeerTask) {
-	resp, err := r.pdClient.GetRegionByID(context.TODO(), t.region.GetId())
+	resp, err := r.pdClient.GetRegionByID(r.ctx, t.region.GetId())
 	if err != nil {
 		log.S().Error("get region failed:", err)
 		return
@@ -211,8 +211,7 @@ func (ic *InvokeContext) saveRaftStateTo(wb *WriteBatch) {
 }
 
 func (ic *InvokeContext) saveApplyStateTo(wb *WriteBatch) {
-	key := y.KeyWithTs(ApplyStateKey(ic.RegionID), KvTS)
-	wb.Set(key, ic.ApplyState.Marshal())
+	setApplyState(wb, ic.RegionID, ic.ApplyState)
 }
 
 func (ic *InvokeContext) saveSnapshotRaftStateTo(snapshotIdx uint64, wb *WriteBatch) {
@@ -283,7 +282,7 @@ func NewPeerStorage(engines *Engines, region *metapb.Region, regionSched chan<-
 	if err != nil {
 		return nil, err
 	}
-	applyState, err := initApplyState(engines.kv.DB, region)
+	applyState, err := initApplyState(engines.kv.DB, engines.raft, region)
 	if err != nil {
 		return nil, err
 	}
@@ -397,7 +396,9 @@ func initRaftState(raftEngine *badger.DB, region *metapb.Region) (raftState, err
 	return raftState, nil
 }
 
-func initApplyState(kvEngine *badger.DB, region *metapb.Region) (applyState, error) {
+// initApplyState loads the apply state of the region, the truncated state is the newer one of the apply state and
+// the one written by TruncateRaftLog.
+func initApplyState(kvEngine, raftEngine *badger.DB, region *metapb.Region) (applyState, error) {
 	key := ApplyStateKey(region.Id)
 	applyState := applyState{}
 	val, err := getValue(kvEngine, key)
@@ -413,6 +414,9 @@ func initApplyState(kvEngine *badger.DB, region *metapb.Region) (applyState, err
 	} else {
 		y.AssertTruef(len(val) == 24, "apply state val %v", val)
 		applyState.Unmarshal(val)
+		if err = mergeRaftTruncatedState(raftEngine, region.Id, &applyState); err != nil {
+			return applyState, err
+		}
 	}
 	return applyState, nil
 }
@@ -838,6 +842,7 @@ func ClearMeta(engines *Engines, kvWB, raftWB *WriteBatch, regionID uint64, last
 		raftWB.Delete(y.KeyWithTs(RaftLogKey(regionID, i), RaftTS))
 	}
 	raftWB.Delete(y.KeyWithTs(RaftStateKey(regionID), RaftTS))
+	raftWB.Delete(y.KeyWithTs(RaftTruncatedStateKey(regionID), RaftTS))
 	log.S().Infof(
 		"[region %d] clear peer 1 meta key 1 apply key 1 raft key and %d raft logs, takes %v",
 		regionID,
@@ -1053,28 +1058,24 @@ func createAndInitSnapshot(snap *regionSnapshot, key SnapKey, mgr *SnapManager)
 			ConfState: &confState,
 		},
 	}
-	s, err := mgr.GetSnapshotForBuilding(key)
+	manifest, err := mgr.BuildSnapDir(key, snap, region)
 	if err != nil {
 		return nil, err
 	}
 	// Set snapshot data
-	snapshotData := &rspb.RaftSnapshotData{Region: region}
-	snapshotStatics := SnapStatistics{}
-	err = s.Build(snap, region, snapshotData, &snapshotStatics, mgr)
-	if err != nil {
-		return nil, err
+	snapshotData := &rspb.RaftSnapshotData{Region: region, Version: snapshotVersion, Meta: manifest.Meta}
+	for _, cfFile := range manifest.Meta.CfFiles {
+		snapshotData.FileSize += cfFile.Size_
 	}
 	snapshot.Data, err = snapshotData.Marshal()
 	return snapshot, err
 }
 
 func getAppliedIdxTermForSnapshot(raft *badger.DB, kv *badger.Txn, regionID uint64) (uint64, uint64, error) {
-	applyState := applyState{}
-	val, err := getValueTxn(kv, ApplyStateKey(regionID))
+	applyState, err := getApplyStateTxn(kv, regionID)
 	if err != nil {
 		return 0, 0, err
 	}
-	applyState.Unmarshal(val)
 
 	idx := applyState.appliedIndex
 	var term uint64
@@ -19,6 +19,7 @@ import (
 	"testing"
 
 	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/y"
 	"github.com/pingcap/kvproto/pkg/eraftpb"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -225,6 +226,47 @@ func TestPeerStorageCompact(t *testing.T) {
 	}
 }
 
+func TestPeerStorageRaftTruncatedState(t *testing.T) {
+	peerStore := newTestPeerStorageFromEnts(t, []eraftpb.Entry{
+		newTestEntry(3, 3), newTestEntry(4, 4), newTestEntry(5, 5), newTestEntry(6, 6),
+	})
+	defer cleanUpTestData(peerStore)
+	raftWB := new(WriteBatch)
+	raftWB.Set(y.KeyWithTs(RaftStateKey(peerStore.region.Id), RaftTS), peerStore.raftState.Marshal())
+	require.Nil(t, peerStore.Engines.WriteRaft(raftWB))
+	region := peerStore.region
+
+	require.Nil(t, peerStore.Engines.TruncateRaftLog(region.Id, 5, 5))
+	engines := reopenTestEngines(t, peerStore.Engines)
+	ps, err := NewPeerStorage(engines, region, nil, 1, "")
+	require.Nil(t, err)
+	first, err := ps.FirstIndex()
+	require.Nil(t, err)
+	require.Equal(t, uint64(6), first)
+	term, err := ps.Term(5)
+	require.Nil(t, err)
+	require.Equal(t, uint64(5), term)
+	_, err = ps.Term(4)
+	require.Equal(t, raft.ErrCompacted, err)
+	ents, err := ps.Entries(6, 7, math.MaxUint64)
+	require.Nil(t, err)
+	require.Equal(t, []eraftpb.Entry{newTestEntry(6, 6)}, ents)
+	require.Equal(t, uint64(6), ps.AppliedIndex())
+
+	// All the raft logs are truncated, the last term is the truncated term.
+	require.Nil(t, engines.TruncateRaftLog(region.Id, 6, 6))
+	engines = reopenTestEngines(t, engines)
+	ps, err = NewPeerStorage(engines, region, nil, 1, "")
+	require.Nil(t, err)
+	first, err = ps.FirstIndex()
+	require.Nil(t, err)
+	require.Equal(t, uint64(7), first)
+	term, err = ps.Term(6)
+	require.Nil(t, err)
+	require.Equal(t, uint64(6), term)
+	require.Equal(t, uint64(6), ps.lastTerm)
+}
+
 func TestPeerStorageAppend(t *testing.T) {
 	ents := []eraftpb.Entry{
 		newTestEntry(3, 3), newTestEntry(4, 4), newTestEntry(5, 5)}
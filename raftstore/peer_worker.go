@@ -24,9 +24,11 @@ import (
 // peerState contains the peer states that needs to run raft command and apply command.
 // It binds to a worker to make sure the commands are always executed on a same goroutine.
 type peerState struct {
-	closed uint32
-	peer   *peerFsm
-	apply  *applier
+	// pendingMsgs is the number of the messages sent to the peer and not received by the raft worker yet.
+	pendingMsgs int64
+	closed      uint32
+	peer        *peerFsm
+	apply       *applier
 }
 
 type applyBatch struct {
@@ -98,6 +100,7 @@ func (rw *raftWorker) run(closeCh <-chan struct{}, wg *sync.WaitGroup) {
 			rw.applyCh <- nil
 			return
 		case msg := <-rw.raftCh:
+			rw.pr.received(msg)
 			msgs = append(msgs, msg)
 		case msg := <-rw.applyResCh:
 			msgs = append(msgs, msg)
@@ -109,7 +112,9 @@ func (rw *raftWorker) run(closeCh <-chan struct{}, wg *sync.WaitGroup) {
 		}
 		pending := len(rw.raftCh)
 		for i := 0; i < pending; i++ {
-			msgs = append(msgs, <-rw.raftCh)
+			msg := <-rw.raftCh
+			rw.pr.received(msg)
+			msgs = append(msgs, msg)
 		}
 		resLen := len(rw.applyResCh)
 		for i := 0; i < resLen; i++ {
@@ -179,12 +184,18 @@ func (rw *raftWorker) handleRaftReady(peers map[uint64]*peerState, batch *applyB
 	}
 	raftWB := rw.raftCtx.raftWB
 	if len(raftWB.entries) > 0 {
-		err := raftWB.WriteToRaft(rw.raftCtx.engine.raft)
+		var err error
+		if rw.raftCtx.syncLog {
+			err = raftWB.WriteToRaftSync(rw.raftCtx.engine)
+		} else {
+			err = raftWB.WriteToRaft(rw.raftCtx.engine.raft)
+		}
 		if err != nil {
 			panic(err)
 		}
 		raftWB.Reset()
 	}
+	rw.raftCtx.syncLog = false
 	readyRes := rw.raftCtx.ReadyRes
 	rw.raftCtx.ReadyRes = nil
 	if len(readyRes) > 0 {
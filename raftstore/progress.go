@@ -0,0 +1,61 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+// ProgressFunc reports the number of keys and bytes processed so far. It's called on the working
+// goroutine without holding any locks, the work is blocked until it returns, so it must be cheap.
+type ProgressFunc func(keys, bytes int)
+
+// progressReporter calls the ProgressFunc once at least interval keys are processed since the last call.
+// A nil progressReporter reports nothing.
+type progressReporter struct {
+	interval     int
+	fn           ProgressFunc
+	keys         int
+	bytes        int
+	reportedKeys int
+}
+
+func newProgressReporter(interval int, fn ProgressFunc) *progressReporter {
+	if fn == nil {
+		return nil
+	}
+	if interval <= 0 {
+		interval = 1
+	}
+	return &progressReporter{interval: interval, fn: fn}
+}
+
+func (r *progressReporter) add(keys, bytes int) {
+	if r == nil {
+		return
+	}
+	r.keys += keys
+	r.bytes += bytes
+	if r.keys-r.reportedKeys >= r.interval {
+		r.report()
+	}
+}
+
+// finish reports the final counts if they are not reported yet.
+func (r *progressReporter) finish() {
+	if r != nil && (r.keys != r.reportedKeys || r.keys == 0) {
+		r.report()
+	}
+}
+
+func (r *progressReporter) report() {
+	r.reportedKeys = r.keys
+	r.fn(r.keys, r.bytes)
+}
@@ -16,6 +16,7 @@ package raftstore
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pingcap/errors"
@@ -43,6 +44,19 @@ type raftConn struct {
 	batch        *tikvpb.BatchRaftMessage
 	stream       tikvpb.Tikv_BatchRaftClient
 	streamCancel context.CancelFunc
+
+	// resendQueue holds the messages failed to send, they are resent ahead of the new messages after reconnection,
+	// or every resendCheckInterval if no new message arrives.
+	resendQueue []pendingRaftMsg
+	backoff     time.Duration
+
+	// connected is set if the stream is created and the last send on it succeeded, it's read by RaftClient.connStats.
+	connected int32
+}
+
+type pendingRaftMsg struct {
+	msg      *raft_serverpb.RaftMessage
+	deadline time.Time
 }
 
 func newRaftConn(storeID uint64, cfg *Config, pdCli pd.Client) *raftConn {
@@ -62,11 +76,18 @@ func newRaftConn(storeID uint64, cfg *Config, pdCli pd.Client) *raftConn {
 
 const maxBatchSize = 128
 
+// resendCheckInterval is the interval of resending the queued messages when no new message arrives.
+const resendCheckInterval = 100 * time.Millisecond
+
 func (c *raftConn) runSender() {
+	ticker := time.NewTicker(resendCheckInterval)
+	defer ticker.Stop()
 	for {
 		select {
 		case msg := <-c.msgCh:
 			c.senderHandleMsg(msg)
+		case <-ticker.C:
+			c.retryResend()
 		case <-c.ctx.Done():
 			log.Info("raftConn done")
 			return
@@ -82,26 +103,111 @@ func (c *raftConn) senderHandleMsg(msg *raft_serverpb.RaftMessage) {
 	for i := 0; i < chLen && len(batch.Msgs) < maxBatchSize; i++ {
 		batch.Msgs = append(batch.Msgs, <-c.msgCh)
 	}
-	var err error
-	if c.stream == nil {
-		if time.Now().Before(c.nextRetryTime) {
-			// drop the messages directly.
-			return
-		}
-		err = c.newStream()
-		if err != nil {
-			c.nextRetryTime = time.Now().Add(time.Second)
-			log.Warn("failed to create raft stream", zap.Error(err))
-			return
-		}
-		log.Info("new raft stream")
+	// The queued messages are sent ahead of the new ones, the new ones are queued after them if any of them fails.
+	if !c.ensureStream() || !c.flushResend() || c.send(batch) != nil {
+		c.pushResend(batch.Msgs)
+	}
+}
+
+// retryResend resends the queued messages if the backoff has passed, so they're not left until a new message arrives.
+func (c *raftConn) retryResend() {
+	if len(c.resendQueue) > 0 && c.ensureStream() {
+		c.flushResend()
+	}
+}
+
+// ensureStream creates the stream if there's none and the backoff has passed, it returns whether the stream is ready.
+func (c *raftConn) ensureStream() bool {
+	if c.stream != nil {
+		return true
+	}
+	if time.Now().Before(c.nextRetryTime) {
+		return false
+	}
+	if err := c.newStream(); err != nil {
+		c.nextRetryTime = time.Now().Add(c.nextBackoff())
+		log.Warn("failed to create raft stream", zap.Error(err))
+		return false
 	}
-	err = c.stream.Send(batch)
+	c.backoff = 0
+	atomic.StoreInt32(&c.connected, 1)
+	log.Info("new raft stream")
+	return true
+}
+
+// send sends the batch on the stream, the stream is dropped if it fails, so it's recreated by the next send.
+func (c *raftConn) send(batch *tikvpb.BatchRaftMessage) error {
+	err := c.stream.Send(batch)
 	if err != nil {
 		c.streamCancel()
 		c.stream = nil
+		atomic.StoreInt32(&c.connected, 0)
 		log.Warn("failed to send batch raft message", zap.Error(err))
 	}
+	return err
+}
+
+// pushResend queues the messages for resending, the oldest messages are dropped when the queue is full.
+func (c *raftConn) pushResend(msgs []*raft_serverpb.RaftMessage) {
+	limit := int(c.cfg.RaftMsgResendQueueSize)
+	if limit == 0 {
+		return
+	}
+	deadline := time.Now().Add(c.cfg.RaftMsgResendTTL)
+	for _, msg := range msgs {
+		c.resendQueue = append(c.resendQueue, pendingRaftMsg{msg: msg, deadline: deadline})
+	}
+	if overflow := len(c.resendQueue) - limit; overflow > 0 {
+		log.Warn("raft message resend queue is full, drop the oldest messages",
+			zap.Uint64("storeID", c.storeID), zap.Int("dropped", overflow))
+		c.popResend(overflow)
+	}
+}
+
+// flushResend sends the queued messages in batches of at most maxBatchSize messages, the expired messages are
+// dropped. It returns false if a batch fails, the batch and the ones after it are kept queued with their original
+// deadlines.
+func (c *raftConn) flushResend() bool {
+	for len(c.resendQueue) > 0 {
+		n := len(c.resendQueue)
+		if n > maxBatchSize {
+			n = maxBatchSize
+		}
+		now := time.Now()
+		batch := &tikvpb.BatchRaftMessage{Msgs: make([]*raft_serverpb.RaftMessage, 0, n)}
+		for _, pending := range c.resendQueue[:n] {
+			if now.Before(pending.deadline) {
+				batch.Msgs = append(batch.Msgs, pending.msg)
+			}
+		}
+		if len(batch.Msgs) > 0 && c.send(batch) != nil {
+			return false
+		}
+		c.popResend(n)
+	}
+	return true
+}
+
+// popResend removes the first n messages of the resend queue.
+func (c *raftConn) popResend(n int) {
+	for i := 0; i < n; i++ {
+		c.resendQueue[i].msg = nil
+	}
+	c.resendQueue = append(c.resendQueue[:0], c.resendQueue[n:]...)
+}
+
+const initialReconnectBackoff = 100 * time.Millisecond
+
+func (c *raftConn) nextBackoff() time.Duration {
+	if c.backoff == 0 {
+		c.backoff = initialReconnectBackoff
+	} else {
+		c.backoff *= 2
+	}
+	if c.backoff > c.cfg.RaftMsgResendMaxBackoff {
+		c.backoff = c.cfg.RaftMsgResendMaxBackoff
+	}
+	return c.backoff
 }
 
 func (c *raftConn) resetBatchRaftMsg() {
@@ -117,7 +223,7 @@ func (c *raftConn) resolveAddr() (string, error) {
 	if c.addr != "" && time.Since(c.lastResolveTime) < resolveRefreshInterval {
 		return c.addr, nil
 	}
-	addr, err := getStoreAddr(c.storeID, c.pdCli)
+	addr, err := getStoreAddr(c.ctx, c.storeID, c.pdCli)
 	if err != nil {
 		return "", err
 	}
@@ -207,6 +313,18 @@ func (c *RaftClient) Send(msg *raft_serverpb.RaftMessage) {
 	}
 }
 
+// connStats returns the number of the connections and the ones connected to their stores.
+func (c *RaftClient) connStats() (total, connected int) {
+	c.RLock()
+	defer c.RUnlock()
+	for _, conn := range c.conns {
+		if atomic.LoadInt32(&conn.connected) == 1 {
+			connected++
+		}
+	}
+	return len(c.conns), connected
+}
+
 // Flush flushes the RaftClient.
 func (c *RaftClient) Flush() {
 	// Not support BufferHint
@@ -222,8 +340,8 @@ func (c *RaftClient) Stop() {
 	}
 }
 
-func getStoreAddr(id uint64, pdCli pd.Client) (string, error) {
-	store, err := pdCli.GetStore(context.TODO(), id)
+func getStoreAddr(ctx context.Context, id uint64, pdCli pd.Client) (string, error) {
+	store, err := pdCli.GetStore(ctx, id)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,167 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/kvproto/pkg/tikvpb"
+	"github.com/pingcap/tidb/store/mockstore/unistore/pd"
+	"github.com/stretchr/testify/require"
+)
+
+type mockBatchRaftClient struct {
+	tikvpb.Tikv_BatchRaftClient
+	sent [][]uint64
+	err  error
+}
+
+func (c *mockBatchRaftClient) Send(batch *tikvpb.BatchRaftMessage) error {
+	if c.err != nil {
+		return c.err
+	}
+	var regionIDs []uint64
+	for _, msg := range batch.Msgs {
+		regionIDs = append(regionIDs, msg.RegionId)
+	}
+	c.sent = append(c.sent, regionIDs)
+	return nil
+}
+
+type mockStorePDClient struct {
+	pd.Client
+	calls int
+}
+
+func (c *mockStorePDClient) GetStore(ctx context.Context, storeID uint64) (*metapb.Store, error) {
+	c.calls++
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("store not found")
+}
+
+func newTestRaftConn(cfg *Config, stream *mockBatchRaftClient) *raftConn {
+	c := &raftConn{
+		ctx:          context.Background(),
+		storeID:      2,
+		cfg:          cfg,
+		batch:        new(tikvpb.BatchRaftMessage),
+		streamCancel: func() {},
+	}
+	if stream != nil {
+		c.stream = stream
+		c.connected = 1
+	}
+	return c
+}
+
+func newTestRaftMsgs(start, end uint64) []*raft_serverpb.RaftMessage {
+	var msgs []*raft_serverpb.RaftMessage
+	for id := start; id < end; id++ {
+		msgs = append(msgs, &raft_serverpb.RaftMessage{RegionId: id})
+	}
+	return msgs
+}
+
+func TestRaftConnResend(t *testing.T) {
+	stream := new(mockBatchRaftClient)
+	c := newTestRaftConn(NewDefaultConfig(), stream)
+	c.pushResend(newTestRaftMsgs(1, maxBatchSize+2))
+
+	// The queued messages are sent in capped batches ahead of the new one.
+	c.senderHandleMsg(&raft_serverpb.RaftMessage{RegionId: 1000})
+	require.Len(t, stream.sent, 3)
+	require.Len(t, stream.sent[0], maxBatchSize)
+	require.Equal(t, []uint64{maxBatchSize + 1}, stream.sent[1])
+	require.Equal(t, []uint64{1000}, stream.sent[2])
+	require.Empty(t, c.resendQueue)
+
+	// The failed batch is queued, and resent by the ticker without a new message.
+	stream.err = errors.New("broken stream")
+	c.senderHandleMsg(&raft_serverpb.RaftMessage{RegionId: 1001})
+	require.Nil(t, c.stream)
+	require.Equal(t, int32(0), c.connected)
+	require.Len(t, c.resendQueue, 1)
+	stream.err = nil
+	c.stream = stream
+	c.retryResend()
+	require.Equal(t, []uint64{1001}, stream.sent[3])
+	require.Empty(t, c.resendQueue)
+}
+
+func TestRaftConnResendTTL(t *testing.T) {
+	stream := new(mockBatchRaftClient)
+	cfg := NewDefaultConfig()
+	cfg.RaftMsgResendQueueSize = 2
+	c := newTestRaftConn(cfg, stream)
+
+	// The oldest messages are dropped when the queue is full.
+	c.pushResend(newTestRaftMsgs(1, 4))
+	require.Len(t, c.resendQueue, 2)
+	require.Equal(t, uint64(2), c.resendQueue[0].msg.RegionId)
+
+	// The expired messages are dropped instead of being resent.
+	c.resendQueue[0].deadline = time.Now().Add(-time.Second)
+	c.retryResend()
+	require.Equal(t, [][]uint64{{3}}, stream.sent)
+	require.Empty(t, c.resendQueue)
+
+	// Nothing is queued if the queue is disabled.
+	cfg.RaftMsgResendQueueSize = 0
+	c.pushResend(newTestRaftMsgs(1, 2))
+	require.Empty(t, c.resendQueue)
+}
+
+func TestRaftConnReconnectBackoff(t *testing.T) {
+	cfg := NewDefaultConfig()
+	cfg.RaftMsgResendMaxBackoff = 300 * time.Millisecond
+	pdCli := new(mockStorePDClient)
+	c := newTestRaftConn(cfg, nil)
+	c.pdCli = pdCli
+
+	// The messages are queued if the stream can't be created, the next retry waits for the backoff.
+	c.senderHandleMsg(&raft_serverpb.RaftMessage{RegionId: 1})
+	require.Equal(t, 1, pdCli.calls)
+	require.Equal(t, initialReconnectBackoff, c.backoff)
+	require.True(t, c.nextRetryTime.After(time.Now()))
+	require.Len(t, c.resendQueue, 1)
+	c.senderHandleMsg(&raft_serverpb.RaftMessage{RegionId: 2})
+	c.retryResend()
+	require.Equal(t, 1, pdCli.calls)
+	require.Len(t, c.resendQueue, 2)
+
+	// The backoff doubles until the max backoff.
+	c.nextRetryTime = time.Time{}
+	c.retryResend()
+	require.Equal(t, 2, pdCli.calls)
+	require.Equal(t, 2*initialReconnectBackoff, c.backoff)
+	require.Equal(t, 300*time.Millisecond, c.nextBackoff())
+	require.Equal(t, 300*time.Millisecond, c.nextBackoff())
+}
+
+func TestRaftConnResolveAddrCancelled(t *testing.T) {
+	c := newTestRaftConn(NewDefaultConfig(), nil)
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	c.pdCli = new(mockStorePDClient)
+	c.Stop()
+	// The pd lookup is cancelled once the connection is stopped.
+	_, err := c.resolveAddr()
+	require.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,199 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+
+	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/dbreader"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
+)
+
+// rangeDeleteCFs are the column families cleared by DeleteRegionRange in order.
+// The default and write column families are stored together in the kv DB, so CFDefault covers both.
+var rangeDeleteCFs = []CFName{CFDefault, CFLock}
+
+// rangeDeleteProgress is the position a range delete continues from, the keys before nextKey
+// in the column family rangeDeleteCFs[cfIdx] and all the keys of the former column families are deleted.
+type rangeDeleteProgress struct {
+	cfIdx   int
+	nextKey []byte
+}
+
+func (p *rangeDeleteProgress) marshal() []byte {
+	buf := make([]byte, 0, 1+len(p.nextKey))
+	buf = append(buf, byte(p.cfIdx))
+	return append(buf, p.nextKey...)
+}
+
+func (p *rangeDeleteProgress) unmarshal(data []byte) error {
+	if len(data) == 0 || int(data[0]) >= len(rangeDeleteCFs) {
+		return errors.Errorf("invalid range delete progress %v", data)
+	}
+	p.cfIdx = int(data[0])
+	p.nextKey = append(p.nextKey[:0], data[1:]...)
+	return nil
+}
+
+// DeleteCFRange adds the deletes of at most limit keys in [startKey, endKey) of the column family into the write batch,
+// an empty endKey means no upper bound.
+// It returns the key to continue from, or nil if all the keys in the range are added.
+func (wb *WriteBatch) DeleteCFRange(db *mvcc.DBBundle, cf CFName, startKey, endKey []byte, limit int) ([]byte, error) {
+	return wb.deleteCFRange(db, cf, startKey, endKey, rangePrefix(startKey, endKey), limit)
+}
+
+func (wb *WriteBatch) deleteCFRange(db *mvcc.DBBundle, cf CFName, startKey, endKey, prefix []byte, limit int) ([]byte, error) {
+	switch cf {
+	case CFDefault, CFWrite:
+		txn := db.DB.NewTransaction(false)
+		reader := dbreader.NewDBReader(startKey, endKey, txn)
+		defer reader.Close()
+		it := reader.GetIter()
+		for it.Seek(startKey); it.Valid(); it.Next() {
+			item := it.Item()
+			if len(prefix) > 0 {
+				if !bytes.HasPrefix(item.Key(), prefix) {
+					break
+				}
+			} else if len(endKey) > 0 && exceedEndKey(item.Key(), endKey) {
+				break
+			}
+			if limit == 0 {
+				return item.KeyCopy(nil), nil
+			}
+			wb.Delete(y.KeyWithTs(item.KeyCopy(nil), item.Version()+1))
+			limit--
+		}
+	case CFLock:
+		it := db.LockStore.NewIterator()
+		for it.Seek(startKey); it.Valid(); it.Next() {
+			if len(endKey) > 0 && exceedEndKey(it.Key(), endKey) {
+				break
+			}
+			if limit == 0 {
+				return safeCopy(it.Key()), nil
+			}
+			wb.DeleteLock(safeCopy(it.Key()))
+			limit--
+		}
+	default:
+		return nil, errors.Errorf("unknown cf %s", cf)
+	}
+	return nil, nil
+}
+
+// DeleteRegionRange deletes the keys of all the column families in the range of the region. The progress is
+// recorded with every batch, so an interrupted delete resumes from where it stopped when it is called again.
+func (en *Engines) DeleteRegionRange(region *metapb.Region) error {
+	_, err := en.deleteRegionRange(region, delRangeBatchSize, -1)
+	return err
+}
+
+// deleteRegionRange writes at most maxBatches batches, a negative maxBatches means no limit.
+// It returns whether the range is completely deleted.
+func (en *Engines) deleteRegionRange(region *metapb.Region, batchSize, maxBatches int) (bool, error) {
+	startKey, endKey := RawStartKey(region), RawEndKey(region)
+	prefix := rangePrefix(startKey, endKey)
+	progressKey := RangeDeleteProgressKey(region.Id)
+	progress := &rangeDeleteProgress{nextKey: startKey}
+	val, err := getValue(en.kv.DB, progressKey)
+	if err == nil {
+		if err = progress.unmarshal(val); err != nil {
+			return false, err
+		}
+	} else if err != badger.ErrKeyNotFound {
+		return false, errors.WithStack(err)
+	}
+	for ; maxBatches != 0; maxBatches-- {
+		wb := new(WriteBatch)
+		nextKey, err := wb.deleteCFRange(en.kv, rangeDeleteCFs[progress.cfIdx], progress.nextKey, endKey, prefix, batchSize)
+		if err != nil {
+			return false, err
+		}
+		done := false
+		if nextKey != nil {
+			progress.nextKey = nextKey
+		} else if progress.cfIdx+1 < len(rangeDeleteCFs) {
+			progress.cfIdx++
+			progress.nextKey = startKey
+		} else {
+			done = true
+		}
+		if done {
+			wb.Delete(y.KeyWithTs(progressKey, KvTS))
+		} else {
+			wb.Set(y.KeyWithTs(progressKey, KvTS), progress.marshal())
+		}
+		if err = en.checkWritable(); err != nil {
+			return false, err
+		}
+		if err = wb.WriteToKV(en.kv); err != nil {
+			return false, err
+		}
+		if done {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// DeleteRegion removes all the data and the state of the region: the keys in the region range, the raft log and
+// the raft state in the raft engine, and the region local state, the apply state and the snapshot raft state in the
+// kv engine. The region state is deleted last, so an interrupted delete can be retried until the state is gone,
+// deleting a region which is already deleted is a no-op.
+func (en *Engines) DeleteRegion(region *metapb.Region) error {
+	if err := en.DeleteRegionRange(region); err != nil {
+		return err
+	}
+	if err := deleteRaftData(en.raft, region.Id); err != nil {
+		return err
+	}
+	wb := new(WriteBatch)
+	wb.Delete(y.KeyWithTs(ApplyStateKey(region.Id), KvTS))
+	wb.Delete(y.KeyWithTs(SnapshotRaftStateKey(region.Id), KvTS))
+	wb.Delete(y.KeyWithTs(RegionStateKey(region.Id), KvTS))
+	return en.WriteKV(wb)
+}
+
+// deleteRaftData deletes all the keys of the region in the raft engine in batches.
+func deleteRaftData(raftDB *badger.DB, regionID uint64) error {
+	prefix := RegionRaftPrefixKey(regionID)
+	var keys [][]byte
+	err := raftDB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	raftWB := new(WriteBatch)
+	for _, key := range keys {
+		raftWB.Delete(y.KeyWithTs(key, RaftTS))
+		if raftWB.size >= MaxDeleteBatchSize {
+			if err = raftWB.WriteToRaft(raftDB); err != nil {
+				return err
+			}
+			raftWB.Reset()
+		}
+	}
+	return raftWB.WriteToRaft(raftDB)
+}
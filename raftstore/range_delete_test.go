@@ -0,0 +1,116 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeleteRegionRangeResume(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	region := genTestRegion(1, 1, 1)
+	var keys [][]byte
+	wb := new(WriteBatch)
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("tb%02d", i))
+		keys = append(keys, key)
+		wb.Set(y.KeyWithTs(key, KvTS), []byte("value"))
+		wb.SetLock(key, []byte("lock"))
+	}
+	// The key out of the region should be kept.
+	wb.Set(y.KeyWithTs([]byte("u"), KvTS), []byte("value"))
+	require.Nil(t, engines.WriteKV(wb))
+
+	// Interrupt after the data keys are deleted and the locks are partially deleted.
+	done, err := engines.deleteRegionRange(region, 3, 6)
+	require.Nil(t, err)
+	require.False(t, done)
+	val, err := getValue(engines.kv.DB, RangeDeleteProgressKey(region.Id))
+	require.Nil(t, err)
+	progress := new(rangeDeleteProgress)
+	require.Nil(t, progress.unmarshal(val))
+	require.Equal(t, CFLock, rangeDeleteCFs[progress.cfIdx])
+	require.Equal(t, keys[6], progress.nextKey)
+	for i, key := range keys {
+		_, err = getValue(engines.kv.DB, key)
+		require.Equal(t, badger.ErrKeyNotFound, err)
+		require.Equal(t, i >= 6, engines.kv.LockStore.Get(key, nil) != nil)
+	}
+
+	require.Nil(t, engines.DeleteRegionRange(region))
+	for _, key := range keys {
+		require.Nil(t, engines.kv.LockStore.Get(key, nil))
+	}
+	_, err = getValue(engines.kv.DB, RangeDeleteProgressKey(region.Id))
+	require.Equal(t, badger.ErrKeyNotFound, err)
+	_, err = getValue(engines.kv.DB, []byte("u"))
+	require.Nil(t, err)
+}
+
+func TestDeleteRegion(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	region := genTestRegion(1, 1, 1)
+	other := genTestRegion(2, 1, 1)
+	kvWB, raftWB := new(WriteBatch), new(WriteBatch)
+	kvWB.Set(y.KeyWithTs([]byte("tb"), KvTS), []byte("value"))
+	kvWB.SetLock([]byte("tb"), []byte("lock"))
+	for _, r := range []*metapb.Region{region, other} {
+		id := r.Id
+		writeInitialApplyState(kvWB, id)
+		require.Nil(t, kvWB.SetMsg(y.KeyWithTs(RegionStateKey(id), KvTS), &rspb.RegionLocalState{Region: r}))
+		kvWB.Set(y.KeyWithTs(SnapshotRaftStateKey(id), KvTS), []byte("state"))
+		raftWB.Set(y.KeyWithTs(RaftStateKey(id), RaftTS), []byte("state"))
+		for i := uint64(1); i <= 10; i++ {
+			raftWB.Set(y.KeyWithTs(RaftLogKey(id, i), RaftTS), []byte("entry"))
+		}
+	}
+	require.Nil(t, engines.WriteKV(kvWB))
+	require.Nil(t, engines.WriteRaft(raftWB))
+
+	for i := 0; i < 2; i++ {
+		require.Nil(t, engines.DeleteRegion(region))
+		_, err := getValue(engines.kv.DB, []byte("tb"))
+		require.Equal(t, badger.ErrKeyNotFound, err)
+		require.Nil(t, engines.kv.LockStore.Get([]byte("tb"), nil))
+		for _, key := range [][]byte{ApplyStateKey(region.Id), SnapshotRaftStateKey(region.Id), RegionStateKey(region.Id)} {
+			_, err = getValue(engines.kv.DB, key)
+			require.Equal(t, badger.ErrKeyNotFound, err)
+		}
+		for _, key := range [][]byte{RaftStateKey(region.Id), RaftLogKey(region.Id, 1), RaftLogKey(region.Id, 10)} {
+			_, err = getValue(engines.raft, key)
+			require.Equal(t, badger.ErrKeyNotFound, err)
+		}
+	}
+
+	// The other region is not affected.
+	for _, key := range [][]byte{ApplyStateKey(other.Id), SnapshotRaftStateKey(other.Id), RegionStateKey(other.Id)} {
+		_, err := getValue(engines.kv.DB, key)
+		require.Nil(t, err)
+	}
+	for _, key := range [][]byte{RaftStateKey(other.Id), RaftLogKey(other.Id, 1), RaftLogKey(other.Id, 10)} {
+		_, err := getValue(engines.raft, key)
+		require.Nil(t, err)
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"encoding/binary"
+	"hash/crc64"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/dbreader"
+)
+
+var crc64Table = crc64.MakeTable(crc64.ECMA)
+
+// CheckRegionConsistency checks the apply state in the kv engine is consistent with the raft state
+// in the raft engine for the region, it's used to detect the divergence caused by a crash between
+// the writes of the two engines.
+func (en *Engines) CheckRegionConsistency(regionID uint64) error {
+	applyState, err := en.loadApplyState(regionID)
+	if err != nil {
+		return errors.Errorf("region %d failed to load apply state: %v", regionID, err)
+	}
+	val, err := getValue(en.raft, RaftStateKey(regionID))
+	if err != nil {
+		return errors.Errorf("region %d failed to load raft state: %v", regionID, err)
+	}
+	var raftState raftState
+	raftState.Unmarshal(val)
+
+	if applyState.truncatedIndex > applyState.appliedIndex {
+		return errors.Errorf("region %d truncated index %d > applied index %d",
+			regionID, applyState.truncatedIndex, applyState.appliedIndex)
+	}
+	if applyState.appliedIndex > raftState.lastIndex {
+		return errors.Errorf("region %d applied index %d > raft last index %d",
+			regionID, applyState.appliedIndex, raftState.lastIndex)
+	}
+	if applyState.appliedIndex > raftState.commit {
+		return errors.Errorf("region %d applied index %d > raft commit index %d",
+			regionID, applyState.appliedIndex, raftState.commit)
+	}
+	lastTerm := applyState.truncatedTerm
+	if raftState.lastIndex > applyState.truncatedIndex {
+		e := new(eraftpb.Entry)
+		if err = getMsg(en.raft, RaftLogKey(regionID, raftState.lastIndex), e); err != nil {
+			return errors.Errorf("region %d raft log at last index %d doesn't exist: %v",
+				regionID, raftState.lastIndex, err)
+		}
+		lastTerm = e.Term
+	}
+	if lastTerm < applyState.truncatedTerm {
+		return errors.Errorf("region %d raft last term %d < truncated term %d",
+			regionID, lastTerm, applyState.truncatedTerm)
+	}
+	if lastTerm > raftState.term {
+		return errors.Errorf("region %d raft last term %d > hard state term %d",
+			regionID, lastTerm, raftState.term)
+	}
+	return nil
+}
+
+// RegionDigest returns the CRC64 digest of the committed data in the range of the region, the locks are ignored.
+// The keys are folded in order with their values and user metas, the versions are not included because they are
+// assigned locally, so the replicas with the same data have the same digest.
+func (en *Engines) RegionDigest(region *metapb.Region) (uint64, error) {
+	startKey, endKey := RawStartKey(region), RawEndKey(region)
+	txn := en.kv.DB.NewTransaction(false)
+	reader := dbreader.NewDBReader(startKey, endKey, txn)
+	defer reader.Close()
+	var digest uint64
+	var lenBuf [binary.MaxVarintLen64]byte
+	fold := func(data []byte) {
+		n := binary.PutUvarint(lenBuf[:], uint64(len(data)))
+		digest = crc64.Update(digest, crc64Table, lenBuf[:n])
+		digest = crc64.Update(digest, crc64Table, data)
+	}
+	it := reader.GetIter()
+	for it.Seek(startKey); it.Valid(); it.Next() {
+		item := it.Item()
+		if exceedEndKey(item.Key(), endKey) {
+			break
+		}
+		if item.IsEmpty() {
+			continue
+		}
+		val, err := item.Value()
+		if err != nil {
+			return 0, errors.WithStack(err)
+		}
+		fold(item.Key())
+		fold(val)
+		fold(item.UserMeta())
+	}
+	return digest, nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"testing"
+
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegionDigest(t *testing.T) {
+	region := genTestRegion(1, 1, 1)
+	writeData := func(engines *Engines, val string) {
+		wb := new(WriteBatch)
+		wb.Set(y.KeyWithTs([]byte("tb"), KvTS), []byte("b"))
+		wb.Set(y.KeyWithTs([]byte("tc"), KvTS), []byte(val))
+		require.Nil(t, wb.WriteToKV(engines.kv))
+	}
+	engines1 := newTestEngines(t)
+	defer cleanUpTestEngineData(engines1)
+	engines2 := newTestEngines(t)
+	defer cleanUpTestEngineData(engines2)
+	// The versions are different on the replicas.
+	engines2.kv.StateTS = 100
+	writeData(engines1, "c")
+	writeData(engines2, "c")
+
+	digest1, err := engines1.RegionDigest(region)
+	require.Nil(t, err)
+	require.NotZero(t, digest1)
+	digest2, err := engines2.RegionDigest(region)
+	require.Nil(t, err)
+	require.Equal(t, digest1, digest2)
+
+	// The locks and the keys out of the region are ignored.
+	wb := new(WriteBatch)
+	wb.SetLock([]byte("td"), []byte("lock"))
+	wb.Set(y.KeyWithTs([]byte("u"), KvTS), []byte("u"))
+	require.Nil(t, wb.WriteToKV(engines2.kv))
+	digest2, err = engines2.RegionDigest(region)
+	require.Nil(t, err)
+	require.Equal(t, digest1, digest2)
+
+	writeData(engines2, "x")
+	digest2, err = engines2.RegionDigest(region)
+	require.Nil(t, err)
+	require.NotEqual(t, digest1, digest2)
+}
+
+func TestCheckRegionConsistency(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	cases := []struct {
+		apply   applyState
+		raft    raftState
+		logTerm uint64 // The term of the raft log at the last index, 0 means the log doesn't exist.
+		err     string
+	}{
+		{
+			apply:   applyState{appliedIndex: 10, truncatedIndex: 5, truncatedTerm: 2},
+			raft:    raftState{term: 3, commit: 10, lastIndex: 12},
+			logTerm: 3,
+		},
+		{
+			// All the logs are truncated, the last term is the truncated term.
+			apply: applyState{appliedIndex: 10, truncatedIndex: 10, truncatedTerm: 3},
+			raft:  raftState{term: 3, commit: 10, lastIndex: 10},
+		},
+		{
+			apply:   applyState{appliedIndex: 5, truncatedIndex: 6, truncatedTerm: 2},
+			raft:    raftState{term: 3, commit: 10, lastIndex: 10},
+			logTerm: 3,
+			err:     "truncated index 6 > applied index 5",
+		},
+		{
+			apply:   applyState{appliedIndex: 12, truncatedIndex: 5, truncatedTerm: 2},
+			raft:    raftState{term: 3, commit: 12, lastIndex: 10},
+			logTerm: 3,
+			err:     "applied index 12 > raft last index 10",
+		},
+		{
+			apply:   applyState{appliedIndex: 10, truncatedIndex: 5, truncatedTerm: 2},
+			raft:    raftState{term: 3, commit: 8, lastIndex: 12},
+			logTerm: 3,
+			err:     "applied index 10 > raft commit index 8",
+		},
+		{
+			apply: applyState{appliedIndex: 10, truncatedIndex: 5, truncatedTerm: 2},
+			raft:  raftState{term: 3, commit: 10, lastIndex: 12},
+			err:   "raft log at last index 12 doesn't exist",
+		},
+		{
+			apply:   applyState{appliedIndex: 10, truncatedIndex: 5, truncatedTerm: 4},
+			raft:    raftState{term: 4, commit: 10, lastIndex: 12},
+			logTerm: 3,
+			err:     "raft last term 3 < truncated term 4",
+		},
+		{
+			apply:   applyState{appliedIndex: 10, truncatedIndex: 5, truncatedTerm: 2},
+			raft:    raftState{term: 4, commit: 10, lastIndex: 12},
+			logTerm: 5,
+			err:     "raft last term 5 > hard state term 4",
+		},
+	}
+	for i, c := range cases {
+		regionID := uint64(i + 1)
+		kvWB := new(WriteBatch)
+		setApplyState(kvWB, regionID, c.apply)
+		require.Nil(t, engines.WriteKV(kvWB))
+		raftWB := new(WriteBatch)
+		raftWB.Set(y.KeyWithTs(RaftStateKey(regionID), RaftTS), c.raft.Marshal())
+		if c.logTerm > 0 {
+			entry := &eraftpb.Entry{Term: c.logTerm, Index: c.raft.lastIndex}
+			require.Nil(t, raftWB.SetMsg(y.KeyWithTs(RaftLogKey(regionID, c.raft.lastIndex), RaftTS), entry))
+		}
+		require.Nil(t, engines.WriteRaft(raftWB))
+
+		err := engines.CheckRegionConsistency(regionID)
+		if c.err == "" {
+			require.Nil(t, err, "case %d", i)
+			continue
+		}
+		require.NotNil(t, err, "case %d", i)
+		require.Contains(t, err.Error(), c.err, "case %d", i)
+	}
+
+	// The region without the apply state.
+	require.NotNil(t, engines.CheckRegionConsistency(100))
+}
@@ -0,0 +1,119 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"github.com/pingcap/badger"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/dbreader"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
+)
+
+// RegionReader iterates the latest committed value of every key in the range of a region at the read ts, the
+// deleted keys are skipped. The keys which only have locks are not iterated, the lock of the current key is
+// checked by Lock.
+type RegionReader struct {
+	reader *dbreader.DBReader
+	iter   *badger.Iterator
+	bundle *mvcc.DBBundle
+	endKey []byte
+	readTS uint64
+
+	lockBuf []byte
+	lock    *mvcc.Lock
+}
+
+// NewRegionReader creates a RegionReader of the region at readTS, it must be closed after use. The kv engine must be
+// opened with managed transactions.
+func (en *Engines) NewRegionReader(region *metapb.Region, readTS uint64) *RegionReader {
+	startKey, endKey := RawStartKey(region), RawEndKey(region)
+	txn := en.kv.DB.NewTransaction(false)
+	txn.SetReadTS(readTS)
+	reader := dbreader.NewDBReader(startKey, endKey, txn)
+	return &RegionReader{
+		reader: reader,
+		iter:   reader.GetIter(),
+		bundle: en.kv,
+		endKey: endKey,
+		readTS: readTS,
+	}
+}
+
+// Rewind moves the RegionReader to the first key of the region.
+func (r *RegionReader) Rewind() {
+	r.iter.Seek(r.reader.StartKey)
+	r.skipDeleted()
+}
+
+// Next moves the RegionReader to the next key.
+func (r *RegionReader) Next() {
+	r.iter.Next()
+	r.skipDeleted()
+}
+
+func (r *RegionReader) skipDeleted() {
+	for ; r.Valid() && r.iter.Item().IsEmpty(); r.iter.Next() {
+	}
+	r.lock = nil
+	if r.Valid() {
+		r.loadLock()
+	}
+}
+
+// loadLock loads the lock of the current key if it blocks the read at the read ts.
+func (r *RegionReader) loadLock() {
+	r.lockBuf = r.bundle.LockStore.Get(r.iter.Item().Key(), r.lockBuf[:0])
+	if len(r.lockBuf) == 0 {
+		return
+	}
+	lock := mvcc.DecodeLock(r.lockBuf)
+	if lock.StartTS > r.readTS || lock.Op == uint8(kvrpcpb.Op_Lock) || lock.Op == uint8(kvrpcpb.Op_PessimisticLock) {
+		return
+	}
+	r.lock = &lock
+}
+
+// Valid returns whether the RegionReader is positioned at a key in the region.
+func (r *RegionReader) Valid() bool {
+	return r.iter.Valid() && !exceedEndKey(r.iter.Item().Key(), r.endKey)
+}
+
+// Key returns the current key, it's only valid until the RegionReader moves.
+func (r *RegionReader) Key() []byte {
+	return r.iter.Item().Key()
+}
+
+// Value returns the committed value of the current key, it's only valid until the RegionReader moves.
+func (r *RegionReader) Value() ([]byte, error) {
+	return r.iter.Item().Value()
+}
+
+// CommitTS returns the commit ts of the current value.
+func (r *RegionReader) CommitTS() uint64 {
+	return r.iter.Item().Version()
+}
+
+// Lock returns the unresolved lock of the current key which blocks the read at the read ts, nil is returned if
+// the key is not locked. The value of a locked key is the latest committed one, it may be outdated once the lock
+// is resolved.
+func (r *RegionReader) Lock() *mvcc.Lock {
+	return r.lock
+}
+
+// Close releases the resources of the RegionReader.
+func (r *RegionReader) Close() {
+	r.reader.Close()
+	r.reader.GetTxn().Discard()
+}
@@ -0,0 +1,91 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"testing"
+
+	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegionReader(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	// The read ts is only supported by the managed DB like the kv engine of the server.
+	require.Nil(t, engines.kv.DB.Close())
+	kvOpts := badger.DefaultOptions
+	kvOpts.Dir = engines.kvPath
+	kvOpts.ValueDir = engines.kvPath
+	kvOpts.ManagedTxns = true
+	var err error
+	engines.kv.DB, err = badger.Open(kvOpts)
+	require.Nil(t, err)
+
+	newLock := func(key string, startTS uint64, op kvrpcpb.Op) []byte {
+		lock := &mvcc.Lock{
+			LockHdr: mvcc.LockHdr{StartTS: startTS, Op: uint8(op), PrimaryLen: uint16(len(key))},
+			Primary: []byte(key),
+		}
+		return lock.MarshalBinary()
+	}
+	wb := new(WriteBatch)
+	set := func(key string, commitTS uint64, val string) {
+		wb.SetWithUserMeta(y.KeyWithTs([]byte(key), commitTS), []byte(val), mvcc.NewDBUserMeta(commitTS-1, commitTS))
+	}
+	set("tb", 10, "b10")
+	set("tb", 20, "b20")
+	set("tc", 10, "c10")
+	// Deleted before the read ts.
+	set("tc", 15, "")
+	// Committed after the read ts.
+	set("td", 30, "d30")
+	set("te", 10, "e10")
+	wb.SetLock([]byte("te"), newLock("te", 22, kvrpcpb.Op_Put))
+	// The lock newer than the read ts doesn't block the read.
+	set("tf", 10, "f10")
+	wb.SetLock([]byte("tf"), newLock("tf", 30, kvrpcpb.Op_Put))
+	set("tg", 10, "g10")
+	wb.SetLock([]byte("tg"), newLock("tg", 22, kvrpcpb.Op_PessimisticLock))
+	// Only locked.
+	wb.SetLock([]byte("th"), newLock("th", 22, kvrpcpb.Op_Put))
+	set("u", 10, "u10")
+	require.Nil(t, engines.WriteKV(wb))
+
+	reader := engines.NewRegionReader(genTestRegion(1, 1, 1), 25)
+	defer reader.Close()
+	type result struct {
+		key, val string
+		commitTS uint64
+		locked   bool
+	}
+	var results []result
+	for reader.Rewind(); reader.Valid(); reader.Next() {
+		val, err := reader.Value()
+		require.Nil(t, err)
+		results = append(results, result{string(reader.Key()), string(val), reader.CommitTS(), reader.Lock() != nil})
+		if reader.Lock() != nil {
+			require.Equal(t, uint64(22), reader.Lock().StartTS)
+		}
+	}
+	require.Equal(t, []result{
+		{"tb", "b20", 20, false},
+		{"te", "e10", 10, true},
+		{"tf", "f10", 10, false},
+		{"tg", "g10", 10, false},
+	}, results)
+}
@@ -0,0 +1,68 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"os"
+
+	"github.com/pingcap/badger/table/sstable"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/metapb"
+)
+
+// RegionSize is the approximate size in bytes of the column families of a region.
+type RegionSize struct {
+	// Default is the size of the kv DB tables in the region. The default and write column families are stored
+	// together in the kv DB, so Default covers both.
+	Default uint64
+	// Write is always 0, the write records are counted in Default.
+	Write uint64
+	// Lock is the size of the keys and values in the lock store.
+	Lock uint64
+}
+
+// Total returns the size of all the column families.
+func (s RegionSize) Total() uint64 {
+	return s.Default + s.Write + s.Lock
+}
+
+// RegionApproximateSize estimates the size of the region from the key ranges and the file sizes of the kv DB
+// tables, the data is not read. A table inside the region counts in full and a table partially overlapping
+// the region counts in half, the memtables are not counted. The lock store is in memory, the locks in the
+// region are iterated to sum their sizes.
+func (en *Engines) RegionApproximateSize(region *metapb.Region) (RegionSize, error) {
+	var size RegionSize
+	startKey, endKey := RawStartKey(region), RawEndKey(region)
+	for _, tbl := range en.kv.DB.Tables() {
+		// The right key of the table is inclusive while the end key of the region is exclusive.
+		if bytes.Compare(tbl.Right, startKey) < 0 || exceedEndKey(tbl.Left, endKey) {
+			continue
+		}
+		fi, err := os.Stat(sstable.NewFilename(tbl.ID, en.kvPath))
+		if err != nil {
+			return size, errors.WithStack(err)
+		}
+		tblSize := uint64(fi.Size())
+		if bytes.Compare(tbl.Left, startKey) < 0 || exceedEndKey(tbl.Right, endKey) {
+			tblSize /= 2
+		}
+		size.Default += tblSize
+	}
+	it := en.kv.LockStore.NewIterator()
+	for it.Seek(startKey); it.Valid() && !exceedEndKey(it.Key(), endKey); it.Next() {
+		size.Lock += uint64(len(it.Key()) + len(it.Value()))
+	}
+	return size, nil
+}
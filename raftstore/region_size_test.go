@@ -0,0 +1,70 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/tidb/util/codec"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegionApproximateSize(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	wb := new(WriteBatch)
+	for i := 0; i < 1000; i++ {
+		wb.Set(y.KeyWithTs([]byte(fmt.Sprintf("tb%04d", i)), KvTS), make([]byte, 100))
+	}
+	wb.SetLock([]byte("tc"), []byte("lock"))
+	wb.SetLock([]byte("u"), []byte("lock"))
+	require.Nil(t, engines.WriteKV(wb))
+	// Reopen the kv DB to flush the memtable into a table.
+	require.Nil(t, engines.kv.DB.Close())
+	kvOpts := badger.DefaultOptions
+	kvOpts.Dir = engines.kvPath
+	kvOpts.ValueDir = engines.kvPath
+	var err error
+	engines.kv.DB, err = badger.Open(kvOpts)
+	require.Nil(t, err)
+	require.NotEmpty(t, engines.kv.DB.Tables())
+
+	size, err := engines.RegionApproximateSize(genTestRegion(1, 1, 1))
+	require.Nil(t, err)
+	require.True(t, size.Default > 1000*100, "%d", size.Default)
+	require.Equal(t, uint64(0), size.Write)
+	require.Equal(t, uint64(len("tclock")), size.Lock)
+	require.Equal(t, size.Default+size.Lock, size.Total())
+
+	// The table partially overlapping the region counts in half.
+	region := genTestRegion(1, 1, 1)
+	region.EndKey = codec.EncodeBytes(nil, []byte("tb0500"))
+	half, err := engines.RegionApproximateSize(region)
+	require.Nil(t, err)
+	require.Equal(t, size.Default/2, half.Default)
+	require.Equal(t, uint64(0), half.Lock)
+
+	region = &metapb.Region{
+		StartKey: codec.EncodeBytes(nil, []byte("tc")),
+		EndKey:   codec.EncodeBytes(nil, []byte("td")),
+		Peers:    region.Peers,
+	}
+	size, err = engines.RegionApproximateSize(region)
+	require.Nil(t, err)
+	require.Equal(t, RegionSize{Lock: uint64(len("tclock"))}, size)
+}
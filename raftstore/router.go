@@ -14,6 +14,7 @@
 package raftstore
 
 import (
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -32,6 +33,12 @@ type router struct {
 	peerSender  chan Msg
 	storeSender chan<- Msg
 	storeFsm    *storeFsm
+
+	// nonBlockingRaftMsg makes sendRaftMessage drop the message if the mailbox of the peer or the store sender
+	// is full.
+	nonBlockingRaftMsg bool
+	// peerMailboxSize is the max number of the messages pending in the mailbox of a peer in the non-blocking mode.
+	peerMailboxSize int64
 }
 
 func newRouter(storeSender chan<- Msg, storeFsm *storeFsm) *router {
@@ -76,23 +83,83 @@ func (pr *router) send(regionID uint64, msg Msg) error {
 	if p == nil || atomic.LoadUint32(&p.closed) == 1 {
 		return errPeerNotFound
 	}
+	atomic.AddInt64(&p.pendingMsgs, 1)
 	pr.peerSender <- msg
 	return nil
 }
 
+// trySend is send without blocking, errMailboxFull is returned if the mailbox of the peer is full, or the peer
+// sender shared by all the peers is full.
+func (pr *router) trySend(regionID uint64, msg Msg) error {
+	msg.RegionID = regionID
+	p := pr.get(regionID)
+	if p == nil || atomic.LoadUint32(&p.closed) == 1 {
+		return errPeerNotFound
+	}
+	if pending := atomic.AddInt64(&p.pendingMsgs, 1); pr.peerMailboxSize > 0 && pending > pr.peerMailboxSize {
+		atomic.AddInt64(&p.pendingMsgs, -1)
+		return errMailboxFull
+	}
+	select {
+	case pr.peerSender <- msg:
+		return nil
+	default:
+		atomic.AddInt64(&p.pendingMsgs, -1)
+		return errMailboxFull
+	}
+}
+
+// received is called when the message sent by send or trySend is received from the peer sender.
+func (pr *router) received(msg Msg) {
+	if p := pr.get(msg.RegionID); p != nil {
+		atomic.AddInt64(&p.pendingMsgs, -1)
+	}
+}
+
 func (pr *router) sendRaftCommand(cmd *MsgRaftCmd) error {
 	regionID := cmd.Request.RegionID()
 	return pr.send(regionID, NewPeerMsg(MsgTypeRaftCmd, regionID, cmd))
 }
 
+// sendRaftMessage routes the raft message to the peer, the message goes to the store if the peer doesn't exist.
+// ErrRaftMessage is returned if the message is malformed. In the non-blocking mode, the message is dropped if the
+// mailbox of the peer is full, raft resends it later, so the messages of a slow region don't fill the peer sender
+// shared by all the peers.
 func (pr *router) sendRaftMessage(msg *raft_serverpb.RaftMessage) error {
+	if msg.GetMessage() == nil {
+		return newRaftMessageError(msg, errors.New("empty raft message"))
+	}
+	if msg.GetToPeer() == nil || msg.GetFromPeer() == nil {
+		return newRaftMessageError(msg, errors.New("missing peer"))
+	}
 	regionID := msg.RegionId
-	if pr.send(regionID, NewPeerMsg(MsgTypeRaftMessage, regionID, msg)) != nil {
-		pr.sendStore(NewPeerMsg(MsgTypeStoreRaftMessage, regionID, msg))
+	if !pr.nonBlockingRaftMsg {
+		if pr.send(regionID, NewPeerMsg(MsgTypeRaftMessage, regionID, msg)) != nil {
+			pr.sendStore(NewPeerMsg(MsgTypeStoreRaftMessage, regionID, msg))
+		}
+		return nil
+	}
+	err := pr.trySend(regionID, NewPeerMsg(MsgTypeRaftMessage, regionID, msg))
+	if err == errMailboxFull {
+		raftMessagesDropped.WithLabelValues("peer", regionBucketLabel(regionID)).Inc()
+	} else if err == errPeerNotFound {
+		select {
+		case pr.storeSender <- NewPeerMsg(MsgTypeStoreRaftMessage, regionID, msg):
+		default:
+			raftMessagesDropped.WithLabelValues("store", regionBucketLabel(regionID)).Inc()
+		}
 	}
 	return nil
 }
 
+// regionBuckets is the number of the buckets the regions are hashed into for the metric labels.
+const regionBuckets = 16
+
+// regionBucketLabel returns the metric label of the bucket of the region, it bounds the number of the label values.
+func regionBucketLabel(regionID uint64) string {
+	return strconv.FormatUint(regionID%regionBuckets, 10)
+}
+
 func (pr *router) sendStore(msg Msg) {
 	pr.storeSender <- msg
 }
@@ -130,4 +197,7 @@ func (r *Router) SplitRegion(ctx *kvrpcpb.Context, keys [][]byte) ([]*metapb.Reg
 	return cb.resp.GetAdminResponse().GetSplits().GetRegions(), nil
 }
 
-var errPeerNotFound = errors.New("peer not found")
+var (
+	errPeerNotFound = errors.New("peer not found")
+	errMailboxFull  = errors.New("mailbox is full")
+)
@@ -0,0 +1,85 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"testing"
+
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRaftMessage(regionID uint64) *rspb.RaftMessage {
+	return &rspb.RaftMessage{
+		RegionId: regionID,
+		FromPeer: &metapb.Peer{Id: 2},
+		ToPeer:   &metapb.Peer{Id: 3},
+		Message:  &eraftpb.Message{MsgType: eraftpb.MessageType_MsgHeartbeat},
+	}
+}
+
+func TestSendRaftMessageNonBlocking(t *testing.T) {
+	storeSender := make(chan Msg, 1)
+	pr := newRouter(storeSender, nil)
+	pr.nonBlockingRaftMsg = true
+	pr.peerMailboxSize = 1
+	pr.peerSender = make(chan Msg, 2)
+	pr.peers.Store(uint64(1), &peerState{})
+	pr.peers.Store(uint64(2), &peerState{})
+	pr.peers.Store(uint64(3), &peerState{})
+
+	dropped := raftMessagesDropped.WithLabelValues("peer", "1")
+	before := testutil.ToFloat64(dropped)
+	require.Nil(t, pr.sendRaftMessage(newTestRaftMessage(1)))
+	// The mailbox of region 1 is full, its message is dropped instead of blocking.
+	require.Nil(t, pr.sendRaftMessage(newTestRaftMessage(1)))
+	require.Len(t, pr.peerSender, 1)
+	require.Equal(t, before+1, testutil.ToFloat64(dropped))
+	// The other regions are not affected by the full mailbox of region 1.
+	require.Nil(t, pr.sendRaftMessage(newTestRaftMessage(2)))
+	require.Len(t, pr.peerSender, 2)
+
+	// The mailbox has room again after the message is received.
+	pr.received(<-pr.peerSender)
+	require.Nil(t, pr.sendRaftMessage(newTestRaftMessage(1)))
+	require.Len(t, pr.peerSender, 2)
+	require.Equal(t, before+1, testutil.ToFloat64(dropped))
+
+	// The message is dropped too if the peer sender shared by all the peers is full.
+	dropped = raftMessagesDropped.WithLabelValues("peer", "3")
+	before = testutil.ToFloat64(dropped)
+	require.Nil(t, pr.sendRaftMessage(newTestRaftMessage(3)))
+	require.Equal(t, before+1, testutil.ToFloat64(dropped))
+	require.Zero(t, pr.get(3).pendingMsgs)
+
+	// The message of an unknown region goes to the store, it's dropped if the store sender is full too.
+	dropped = raftMessagesDropped.WithLabelValues("store", "4")
+	before = testutil.ToFloat64(dropped)
+	require.Nil(t, pr.sendRaftMessage(newTestRaftMessage(4)))
+	require.Nil(t, pr.sendRaftMessage(newTestRaftMessage(4)))
+	require.Len(t, storeSender, 1)
+	require.Equal(t, before+1, testutil.ToFloat64(dropped))
+	msg := <-storeSender
+	require.Equal(t, MsgTypeStoreRaftMessage, msg.Type)
+	require.Equal(t, uint64(4), msg.RegionID)
+}
+
+func TestRegionBucketLabel(t *testing.T) {
+	require.Equal(t, "1", regionBucketLabel(1))
+	require.Equal(t, "1", regionBucketLabel(regionBuckets+1))
+	require.Equal(t, "0", regionBucketLabel(regionBuckets))
+}
@@ -16,15 +16,19 @@ package raftstore
 import (
 	"context"
 	"encoding/binary"
+	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ngaut/unistore/config"
+	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/kvproto/pkg/tikvpb"
 	"github.com/pingcap/log"
 	"github.com/pingcap/tidb/store/mockstore/unistore/pd"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
 	"go.uber.org/zap"
 )
 
@@ -44,6 +48,47 @@ type RaftInnerServer struct {
 	snapWorker  *worker
 	lsDumper    *lockStoreDumper
 	raftCli     *RaftClient
+	started     int32
+
+	// ctx is the context of the pd rpcs and the snapshots being sent, Stop cancels it if the workers don't exit
+	// in time.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// wg is shared by the pd worker and the snap worker.
+	wg *sync.WaitGroup
+}
+
+// ServerStatus reports the running state of the RaftInnerServer.
+type ServerStatus struct {
+	Started            bool
+	BatchSystemRunning bool
+	// RaftConns is the number of the raft connections to the other stores, they're created when the first message to
+	// the store is sent. RaftConnsConnected is the number of the ones whose last send succeeded.
+	RaftConns          int
+	RaftConnsConnected int
+	RegionCount        int
+	PendingSnapTasks   int
+	LastDumpTime       time.Time
+	LastDumpVLogOffset uint64
+}
+
+// Status returns the current status of the RaftInnerServer, it's safe to be called concurrently.
+func (ris *RaftInnerServer) Status() ServerStatus {
+	var status ServerStatus
+	if atomic.LoadInt32(&ris.started) == 0 {
+		return status
+	}
+	status.Started = true
+	status.BatchSystemRunning = ris.batchSystem.isRunning()
+	status.RaftConns, status.RaftConnsConnected = ris.raftCli.connStats()
+	ris.router.peers.Range(func(_, _ interface{}) bool {
+		status.RegionCount++
+		return true
+	})
+	status.PendingSnapTasks = len(ris.snapWorker.sender)
+	status.LastDumpTime, status.LastDumpVLogOffset = ris.lsDumper.lastDump()
+	return status
 }
 
 // Raft implements the tikv.InnerServer Raft method.
@@ -54,7 +99,7 @@ func (ris *RaftInnerServer) Raft(stream tikvpb.Tikv_RaftServer) error {
 			return err
 		}
 		if err := ris.router.sendRaftMessage(msg); err != nil {
-			log.S().Error(err)
+			logRaftMessageError(err)
 		}
 	}
 }
@@ -68,30 +113,53 @@ func (ris *RaftInnerServer) BatchRaft(stream tikvpb.Tikv_BatchRaftServer) error
 		}
 		for _, msg := range msgs.GetMsgs() {
 			if err := ris.router.sendRaftMessage(msg); err != nil {
-				log.S().Error(err)
+				logRaftMessageError(err)
 			}
 		}
 	}
 }
 
+// snapWorkerBusyBackoffMs is the backoff hint returned when the snap worker queue is full, or too many snapshots are
+// being received.
+const snapWorkerBusyBackoffMs = 100
+
 // Snapshot implements the tikv.InnerServer Snapshot method.
 func (ris *RaftInnerServer) Snapshot(stream tikvpb.Tikv_SnapshotServer) error {
-	var err error
+	var (
+		result snapRecvResult
+		err    error
+	)
 	done := make(chan struct{})
-	ris.snapWorker.sender <- task{
+	t := task{
 		tp: taskTypeSnapRecv,
 		data: recvSnapTask{
 			stream: stream,
-			callback: func(e error) {
-				err = e
+			callback: func(res snapRecvResult, e error) {
+				result, err = res, e
 				close(done)
 			},
 		},
 	}
+	if !ris.snapWorker.trySend(t) {
+		return &ErrServerIsBusy{Reason: "snap worker queue is full", BackoffMs: snapWorkerBusyBackoffMs}
+	}
 	<-done
+	observeSnapRecv(result, err)
 	return err
 }
 
+// observeSnapRecv records the bytes received for a snapshot by the Snapshot handler and the time spent on it.
+func observeSnapRecv(result snapRecvResult, err error) {
+	label := "success"
+	if err != nil {
+		label = "fail"
+	}
+	snapshotRecvSize.WithLabelValues(label).Observe(float64(result.size))
+	snapshotRecvDuration.WithLabelValues(label).Observe(result.duration.Seconds())
+	log.Debug("snapshot handler finished", zap.Uint64("size", result.size),
+		zap.Duration("duration", result.duration), zap.Error(err))
+}
+
 // NewRaftInnerServer returns a new RaftInnerServer.
 func NewRaftInnerServer(globalConfig *config.Config, engines *Engines, raftConfig *Config) *RaftInnerServer {
 	return &RaftInnerServer{
@@ -103,9 +171,9 @@ func NewRaftInnerServer(globalConfig *config.Config, engines *Engines, raftConfi
 
 // Setup implements the tikv.InnerServer Setup method.
 func (ris *RaftInnerServer) Setup(pdClient pd.Client) {
-	var wg sync.WaitGroup
-	ris.pdWorker = newWorker("pd-worker", &wg)
-	ris.snapWorker = newWorker("snap-worker", &wg)
+	ris.wg = new(sync.WaitGroup)
+	ris.pdWorker = newWorker("pd-worker", ris.wg)
+	ris.snapWorker = newWorkerWithCapacity("snap-worker", int(ris.raftConfig.SnapWorkerQueueSize), ris.wg)
 
 	// TODO: create local reader
 	// TODO: create storage read pool
@@ -120,6 +188,8 @@ func (ris *RaftInnerServer) Setup(pdClient pd.Client) {
 	ris.batchSystem = batchSystem
 	ris.lsDumper = &lockStoreDumper{
 		stopCh:      make(chan struct{}),
+		triggerCh:   make(chan chan error),
+		applyWait:   5 * time.Second,
 		engines:     ris.engines,
 		fileNumDiff: 2,
 	}
@@ -144,24 +214,54 @@ func (ris *RaftInnerServer) SetPeerEventObserver(ob PeerEventObserver) {
 func (ris *RaftInnerServer) Start(pdClient pd.Client) error {
 	ris.node = NewNode(ris.batchSystem, &ris.storeMeta, ris.raftConfig, pdClient, ris.eventObserver)
 
+	ris.ctx, ris.cancel = context.WithCancel(context.Background())
 	raftClient := newRaftClient(ris.raftConfig, pdClient)
 	trans := NewServerTransport(raftClient, ris.snapWorker.sender, ris.router)
-	err := ris.node.Start(context.TODO(), ris.engines, trans, ris.snapManager, ris.pdWorker, ris.router)
+	err := ris.node.Start(ris.ctx, ris.engines, trans, ris.snapManager, ris.pdWorker, ris.router)
 	if err != nil {
 		return err
 	}
 	ris.raftCli = raftClient
-	snapRunner := newSnapRunner(ris.snapManager, ris.raftConfig, ris.router, pdClient)
+	snapRunner := newSnapRunner(ris.ctx, ris.engines, ris.snapManager, ris.raftConfig, ris.router, pdClient)
 	ris.snapWorker.start(snapRunner)
 	go ris.lsDumper.run()
+	atomic.StoreInt32(&ris.started, 1)
 	return nil
 }
 
-// Stop implements the tikv.InnerServer Stop method.
+// DumpLockStoreNow dumps the lock store immediately instead of waiting for the raft log to grow, and blocks until
+// the dump completes or fails. It's used to make a recent dump exist before a backup or a controlled shutdown, so
+// the recovery replays less raft log. The server must be started.
+func (ris *RaftInnerServer) DumpLockStoreNow() error {
+	if atomic.LoadInt32(&ris.started) == 0 {
+		return errors.New("raft inner server is not started")
+	}
+	return ris.lsDumper.dumpNow()
+}
+
+// workerStopTimeout is the max time Stop waits for the pd worker and the snap worker to finish their queued tasks.
+const workerStopTimeout = 10 * time.Second
+
+// Stop implements the tikv.InnerServer Stop method. The pd worker and the snap worker handle the queued tasks
+// before exit. If they don't exit in workerStopTimeout, the pd rpcs and the snapshots being sent are cancelled, the
+// engines are closed only after the workers exit.
 func (ris *RaftInnerServer) Stop() error {
+	atomic.StoreInt32(&ris.started, 0)
 	ris.snapWorker.stop()
+	// The pd worker is stopped by the batch system after the raft store is shut down, so the tasks sent
+	// by the peers during shutting down are still handled.
 	ris.node.stop()
+	if !waitTimeout(ris.wg, workerStopTimeout) {
+		log.Warn("pd worker and snap worker didn't exit in time, cancel the running tasks",
+			zap.Duration("timeout", workerStopTimeout),
+			zap.Int("pending pd tasks", len(ris.pdWorker.receiver)),
+			zap.Int("pending snap tasks", len(ris.snapWorker.receiver)))
+		ris.cancel()
+		ris.wg.Wait()
+	}
+	ris.cancel()
 	ris.raftCli.Stop()
+	close(ris.lsDumper.stopCh)
 	if err := ris.engines.raft.Close(); err != nil {
 		return err
 	}
@@ -171,35 +271,137 @@ func (ris *RaftInnerServer) Stop() error {
 // LockstoreFileName defines the lockstore file name.
 const LockstoreFileName = "lockstore.dump"
 
+// dumpLockStore dumps the lock store into dir. DumpToFile writes a temporary file and renames it into place
+// after it is synced, the directory is synced too so a crash never leaves a partially written dump.
+func dumpLockStore(bundle *mvcc.DBBundle, dir string, meta []byte) error {
+	if err := bundle.LockStore.DumpToFile(filepath.Join(dir, LockstoreFileName), meta); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// RemoveLockStoreTmpFile removes the temporary file left by an interrupted lock store dump in dir.
+func RemoveLockStoreTmpFile(dir string) error {
+	err := os.Remove(filepath.Join(dir, LockstoreFileName+tmpFileSuffix))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.WithStack(err)
+	}
+	return nil
+}
+
+var errLockStoreDumperStopped = errors.New("lock store dumper is stopped")
+
 type lockStoreDumper struct {
-	stopCh      chan struct{}
+	stopCh chan struct{}
+	// triggerCh receives the on-demand dump requests, the result is sent back to the request channel.
+	triggerCh chan chan error
+	// applyWait is the time to wait for the raft log before the dumped vlog offset to be applied.
+	applyWait   time.Duration
 	engines     *Engines
-	fileNumDiff uint64
+	fileNumDiff uint32
+	// vlogPosition returns the current raft vlog offset and file number, Engines.VLogPosition is used if it's nil.
+	vlogPosition func() (offset uint64, fileNum uint32)
+
+	mu           sync.Mutex
+	lastDumpTime time.Time
+}
+
+func (dumper *lockStoreDumper) lastDump() (time.Time, uint64) {
+	dumper.mu.Lock()
+	defer dumper.mu.Unlock()
+	return dumper.lastDumpTime, atomic.LoadUint64(&dumper.engines.lockStoreDumpOffset)
+}
+
+// lockStoreStats returns the number of locks and the total size of their keys and values. The lock store
+// is iterated without blocking the writers, so the size is approximate.
+func lockStoreStats(bundle *mvcc.DBBundle) (entries, size int) {
+	bundle.MemStoreMu.Lock()
+	entries = bundle.LockStore.Len()
+	bundle.MemStoreMu.Unlock()
+	it := bundle.LockStore.NewIterator()
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		size += len(it.Key()) + len(it.Value())
+	}
+	return entries, size
+}
+
+func updateLockStoreMetrics(bundle *mvcc.DBBundle) {
+	entries, size := lockStoreStats(bundle)
+	lockStoreEntries.Set(float64(entries))
+	lockStoreBytes.Set(float64(size))
+}
+
+func (dumper *lockStoreDumper) currentVLogPosition() (uint64, uint32) {
+	if dumper.vlogPosition != nil {
+		return dumper.vlogPosition()
+	}
+	return dumper.engines.VLogPosition()
+}
+
+// needDump returns the current vlog position and whether the raft log has grown by at least fileNumDiff vlog files
+// since lastFileNum, so the lock store should be dumped.
+func (dumper *lockStoreDumper) needDump(lastFileNum uint32) (vlogOffset uint64, fileNum uint32, ok bool) {
+	vlogOffset, fileNum = dumper.currentVLogPosition()
+	return vlogOffset, fileNum, fileNum-lastFileNum >= dumper.fileNumDiff
 }
 
 func (dumper *lockStoreDumper) run() {
 	ticker := time.NewTicker(time.Second * 10)
-	lastFileNum := dumper.engines.raft.GetVLogOffset() >> 32
+	_, lastFileNum := dumper.currentVLogPosition()
 	for {
 		select {
 		case <-ticker.C:
-			vlogOffset := dumper.engines.raft.GetVLogOffset()
-			currentFileNum := vlogOffset >> 32
-			if currentFileNum-lastFileNum >= dumper.fileNumDiff {
-				meta := make([]byte, 8)
-				binary.LittleEndian.PutUint64(meta, vlogOffset)
-				// Waiting for the raft log to be applied.
-				// TODO: it is possible that some log is not applied after sleep, find a better way to make sure this.
-				time.Sleep(5 * time.Second)
-				err := dumper.engines.kv.LockStore.DumpToFile(filepath.Join(dumper.engines.kvPath, LockstoreFileName), meta)
-				if err != nil {
+			updateLockStoreMetrics(dumper.engines.kv)
+			if vlogOffset, currentFileNum, ok := dumper.needDump(lastFileNum); ok {
+				if err := dumper.dump(vlogOffset); err != nil {
 					log.Error("dump lock store failed", zap.Error(err))
 					continue
 				}
 				lastFileNum = currentFileNum
 			}
+		case respCh := <-dumper.triggerCh:
+			vlogOffset, currentFileNum := dumper.currentVLogPosition()
+			err := dumper.dump(vlogOffset)
+			if err == nil {
+				lastFileNum = currentFileNum
+			}
+			respCh <- err
 		case <-dumper.stopCh:
 			return
 		}
 	}
 }
+
+// dump dumps the lock store with the vlog offset recorded, the locks written after the offset are restored from
+// the raft log on recovery.
+func (dumper *lockStoreDumper) dump(vlogOffset uint64) error {
+	meta := make([]byte, 8)
+	binary.LittleEndian.PutUint64(meta, vlogOffset)
+	// Waiting for the raft log to be applied.
+	// TODO: it is possible that some log is not applied after sleep, find a better way to make sure this.
+	time.Sleep(dumper.applyWait)
+	if err := dumpLockStore(dumper.engines.kv, dumper.engines.kvPath, meta); err != nil {
+		return err
+	}
+	dumper.mu.Lock()
+	dumper.lastDumpTime = time.Now()
+	atomic.StoreUint64(&dumper.engines.lockStoreDumpOffset, vlogOffset)
+	dumper.mu.Unlock()
+	return nil
+}
+
+// dumpNow asks the running dumper to dump the lock store immediately and waits for the result.
+func (dumper *lockStoreDumper) dumpNow() error {
+	respCh := make(chan error, 1)
+	select {
+	case dumper.triggerCh <- respCh:
+	case <-dumper.stopCh:
+		return errLockStoreDumperStopped
+	}
+	select {
+	case err := <-respCh:
+		return err
+	case <-dumper.stopCh:
+		return errLockStoreDumperStopped
+	}
+}
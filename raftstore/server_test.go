@@ -0,0 +1,190 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockStoreStats(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	wb := new(WriteBatch)
+	wb.SetLock([]byte("ta"), []byte("lock"))
+	wb.SetLock([]byte("tb"), []byte("lock"))
+	require.Nil(t, wb.WriteToKV(engines.kv))
+	entries, size := lockStoreStats(engines.kv)
+	require.Equal(t, 2, entries)
+	require.Equal(t, 12, size)
+}
+
+func TestLockStoreDumperNeedDump(t *testing.T) {
+	var offset uint64
+	dumper := &lockStoreDumper{
+		fileNumDiff: 2,
+		vlogPosition: func() (uint64, uint32) {
+			return offset, vlogFileNum(offset)
+		},
+	}
+	offset = 3<<32 | 100
+	_, fileNum, ok := dumper.needDump(2)
+	require.False(t, ok)
+	require.Equal(t, uint32(3), fileNum)
+	offset = 4<<32 | 8
+	vlogOffset, fileNum, ok := dumper.needDump(2)
+	require.True(t, ok)
+	require.Equal(t, offset, vlogOffset)
+	require.Equal(t, uint32(4), fileNum)
+}
+
+func TestVLogPosition(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	offset, fileNum := engines.VLogPosition()
+	require.Equal(t, engines.raft.GetVLogOffset(), offset)
+	require.Equal(t, uint32(offset>>32), fileNum)
+	require.Nil(t, engines.SyncRaftWAL())
+}
+
+func TestLockStoreDumperDumpNow(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	wb := new(WriteBatch)
+	wb.SetLock([]byte("ta"), []byte("lock"))
+	require.Nil(t, wb.WriteToKV(engines.kv))
+	dumper := &lockStoreDumper{
+		stopCh:       make(chan struct{}),
+		triggerCh:    make(chan chan error),
+		engines:      engines,
+		fileNumDiff:  2,
+		vlogPosition: engines.VLogPosition,
+	}
+	go dumper.run()
+	require.Nil(t, dumper.dumpNow())
+	_, err := os.Stat(filepath.Join(engines.kvPath, LockstoreFileName))
+	require.Nil(t, err)
+	dumpTime, dumpOffset := dumper.lastDump()
+	require.False(t, dumpTime.IsZero())
+	require.Equal(t, engines.raft.GetVLogOffset(), dumpOffset)
+
+	close(dumper.stopCh)
+	require.Equal(t, errLockStoreDumperStopped, dumper.dumpNow())
+}
+
+func TestServerStatus(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	router, batchSystem := createRaftBatchSystem(nil, NewDefaultConfig())
+	raftCli := newRaftClient(NewDefaultConfig(), nil)
+	raftCli.conns[connKey{storeID: 2}] = &raftConn{connected: 1}
+	raftCli.conns[connKey{storeID: 3}] = &raftConn{}
+	ris := &RaftInnerServer{
+		router:      router,
+		batchSystem: batchSystem,
+		snapWorker:  newWorker("snap-worker", nil),
+		lsDumper:    &lockStoreDumper{engines: engines},
+		raftCli:     raftCli,
+	}
+	require.Equal(t, ServerStatus{}, ris.Status())
+
+	ris.started = 1
+	status := ris.Status()
+	require.True(t, status.Started)
+	require.False(t, status.BatchSystemRunning)
+	require.Equal(t, 2, status.RaftConns)
+	require.Equal(t, 1, status.RaftConnsConnected)
+
+	batchSystem.running = 1
+	raftCli.conns[connKey{storeID: 3}].connected = 1
+	status = ris.Status()
+	require.True(t, status.BatchSystemRunning)
+	require.Equal(t, 2, status.RaftConnsConnected)
+}
+
+func TestObserveSnapRecv(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(snapshotRecvSize, snapshotRecvDuration)
+	samples := func() map[string]uint64 {
+		mfs, err := reg.Gather()
+		require.Nil(t, err)
+		m := make(map[string]uint64)
+		for _, mf := range mfs {
+			for _, metric := range mf.GetMetric() {
+				h := metric.GetHistogram()
+				m[mf.GetName()+"/"+metric.GetLabel()[0].GetValue()] = h.GetSampleCount()
+				m[mf.GetName()+"/"+metric.GetLabel()[0].GetValue()+"/sum"] = uint64(h.GetSampleSum())
+			}
+		}
+		return m
+	}
+	before := samples()
+	observeSnapRecv(snapRecvResult{size: 4096, duration: 2 * time.Second}, nil)
+	observeSnapRecv(snapRecvResult{size: 10, duration: time.Second}, errors.New("fail"))
+	after := samples()
+	for _, name := range []string{"unistore_raftstore_snapshot_recv_size_bytes", "unistore_raftstore_snapshot_recv_duration_seconds"} {
+		require.Equal(t, before[name+"/success"]+1, after[name+"/success"])
+		require.Equal(t, before[name+"/fail"]+1, after[name+"/fail"])
+	}
+	require.Equal(t, before["unistore_raftstore_snapshot_recv_size_bytes/success/sum"]+4096,
+		after["unistore_raftstore_snapshot_recv_size_bytes/success/sum"])
+	require.Equal(t, before["unistore_raftstore_snapshot_recv_duration_seconds/success/sum"]+2,
+		after["unistore_raftstore_snapshot_recv_duration_seconds/success/sum"])
+}
+
+func TestSnapshotServerIsBusy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	mgr := NewSnapManager(dir, nil)
+	require.Nil(t, mgr.init())
+	cfg := NewDefaultConfig()
+	cfg.ConcurrentRecvSnapLimit = 1
+	runner := newSnapRunner(context.Background(), nil, mgr, cfg, nil, nil)
+	wg := new(sync.WaitGroup)
+	ris := &RaftInnerServer{snapWorker: newWorkerWithCapacity("snap-worker", 1, wg)}
+	stream := &mockSnapshotServer{ctx: context.Background(), onDrained: func() {}}
+
+	// The snap worker queue is full.
+	ris.snapWorker.sender <- task{tp: taskTypeSnapRecv}
+	err = ris.Snapshot(stream)
+	busy, ok := err.(*ErrServerIsBusy)
+	require.True(t, ok, "%v", err)
+	require.Equal(t, "snap worker queue is full", busy.Reason)
+	<-ris.snapWorker.receiver
+
+	// The runner is full, the snapshot is rejected instead of queued in a goroutine.
+	require.True(t, tryAcquire(runner.recvSem))
+	ris.snapWorker.start(runner)
+	err = ris.Snapshot(stream)
+	busy, ok = err.(*ErrServerIsBusy)
+	require.True(t, ok, "%v", err)
+	require.Equal(t, uint64(snapWorkerBusyBackoffMs), busy.BackoffMs)
+	ris.snapWorker.stop()
+	wg.Wait()
+	<-runner.recvSem
+}
@@ -787,6 +787,7 @@ func (s *Snap) Apply(opts ApplyOptions) (ApplyResult, error) {
 		switch item.applySnapType {
 		case applySnapTypePut:
 			result.HasPut = true
+			observeKVVersion(item.key.Version)
 			if err := opts.Builder.Add(item.key, y.ValueStruct{
 				Value:    item.val,
 				UserMeta: item.userMeta,
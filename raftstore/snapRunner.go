@@ -17,10 +17,12 @@ import (
 	"bytes"
 	"context"
 	"io"
-	"sync/atomic"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
 	"github.com/pingcap/kvproto/pkg/raft_serverpb"
 	"github.com/pingcap/kvproto/pkg/tikvpb"
 	"github.com/pingcap/log"
@@ -28,48 +30,136 @@ import (
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
 )
 
 type snapRunner struct {
-	config         *Config
-	snapManager    *SnapManager
-	router         *router
-	sendingCount   int64
-	receivingCount int64
-	pdCli          pd.Client
+	// ctx is the context of the snapshots being sent, it's cancelled when the server stops.
+	ctx         context.Context
+	config      *Config
+	engines     *Engines
+	snapManager *SnapManager
+	router      *router
+	pdCli       pd.Client
+
+	// The semaphores limit the number of the snapshots being sent and received concurrently.
+	sendSem chan struct{}
+	recvSem chan struct{}
+	wg      sync.WaitGroup
 }
 
-func newSnapRunner(snapManager *SnapManager, config *Config, router *router, pdCli pd.Client) *snapRunner {
+func newSnapRunner(ctx context.Context, engines *Engines, snapManager *SnapManager, config *Config, router *router,
+	pdCli pd.Client) *snapRunner {
 	return &snapRunner{
+		ctx:         ctx,
 		config:      config,
+		engines:     engines,
 		snapManager: snapManager,
 		router:      router,
 		pdCli:       pdCli,
+		sendSem:     make(chan struct{}, config.ConcurrentSendSnapLimit),
+		recvSem:     make(chan struct{}, config.ConcurrentRecvSnapLimit),
 	}
 }
 
+// handle runs the snapshot tasks in separated goroutines, so the snapshots can be transferred concurrently. The
+// semaphore is acquired before the goroutine is started, the task beyond the limit is rejected without waiting.
 func (r *snapRunner) handle(t task) {
 	switch t.tp {
 	case taskTypeSnapSend:
-		r.send(t.data.(sendSnapTask))
+		st := t.data.(sendSnapTask)
+		if !tryAcquire(r.sendSem) {
+			log.Warn("too many sending snapshot tasks, drop send snap",
+				append(st.snapCtx.fields(), zap.Stringer("snap", st.msg))...)
+			st.callback(errors.New("too many sending snapshot tasks"))
+			return
+		}
+		r.run(r.sendSem, func() { r.send(st) })
 	case taskTypeSnapRecv:
-		r.recv(t.data.(recvSnapTask))
+		rt := t.data.(recvSnapTask)
+		if !tryAcquire(r.recvSem) {
+			log.Warn("too many recving snapshot tasks, ignore")
+			rt.callback(snapRecvResult{}, &ErrServerIsBusy{Reason: "too many receiving snapshot tasks",
+				BackoffMs: snapWorkerBusyBackoffMs})
+			return
+		}
+		r.run(r.recvSem, func() { r.recv(rt) })
 	}
 }
 
-func (r *snapRunner) send(t sendSnapTask) {
-	if n := atomic.LoadInt64(&r.sendingCount); n > int64(r.config.ConcurrentSendSnapLimit) {
-		log.Warn("too many sending snapshot tasks, drop send snap", zap.Uint64("to", t.storeID), zap.Stringer("snap", t.msg))
-		t.callback(errors.New("too many sending snapshot tasks"))
-		return
+// run runs f in a new goroutine and releases the acquired semaphore after f returns.
+func (r *snapRunner) run(sem chan struct{}, f func()) {
+	r.wg.Add(1)
+	go func() {
+		defer func() {
+			<-sem
+			r.wg.Done()
+		}()
+		f()
+	}()
+}
+
+// stop waits for the running snapshot tasks.
+func (r *snapRunner) stop() {
+	r.wg.Wait()
+}
+
+// tryAcquire acquires the semaphore without blocking, it returns false if the limit is reached.
+func tryAcquire(sem chan struct{}) bool {
+	select {
+	case sem <- struct{}{}:
+		return true
+	default:
+		return false
 	}
+}
 
-	atomic.AddInt64(&r.sendingCount, 1)
-	defer atomic.AddInt64(&r.sendingCount, -1)
-	t.callback(r.sendSnap(t.storeID, t.msg))
+func (r *snapRunner) send(t sendSnapTask) {
+	snapshotsInFlight.WithLabelValues("send").Inc()
+	defer snapshotsInFlight.WithLabelValues("send").Dec()
+	start := time.Now()
+	log.Info("start sending snapshot", t.snapCtx.fields()...)
+	err := r.sendSnap(t.storeID, t.msg)
+	t.snapCtx.finish("send", start, err)
+	t.callback(err)
 }
 
-const snapChunkLen = 1024 * 1024
+const (
+	minSnapChunkSize = 4 * KB
+	// The chunk must fit into a grpc message.
+	maxSnapChunkSize = 8 * MB
+	// snapChunkSizeKey is the grpc metadata key for the chunk size chosen by the sender.
+	snapChunkSizeKey = "snap-chunk-size"
+	// snapDeltaKey is the grpc metadata key set by the sender which accepts a delta snapshot in place of the full one.
+	snapDeltaKey = "snap-delta"
+	// snapDeltaBaseKey is the grpc header key for the applied index the receiver can catch up from by a delta snapshot.
+	snapDeltaBaseKey = "snap-delta-base"
+)
+
+func validateSnapChunkSize(size uint64) error {
+	if size < minSnapChunkSize || size > maxSnapChunkSize {
+		return errors.Errorf("snap chunk size %v should be in [%v, %v]", size, minSnapChunkSize, maxSnapChunkSize)
+	}
+	return nil
+}
+
+// recvSnapChunkSize returns the chunk size announced by the sender, the chunks from a sender doesn't
+// announce it are limited by maxSnapChunkSize.
+func recvSnapChunkSize(ctx context.Context) (uint64, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	vals := md.Get(snapChunkSizeKey)
+	if len(vals) == 0 {
+		return maxSnapChunkSize, nil
+	}
+	size, err := strconv.ParseUint(vals[0], 10, 64)
+	if err != nil {
+		return 0, errors.Errorf("invalid snap chunk size %q", vals[0])
+	}
+	if err = validateSnapChunkSize(size); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
 
 func (r *snapRunner) sendSnap(storeID uint64, msg *raft_serverpb.RaftMessage) error {
 	start := time.Now()
@@ -82,15 +172,13 @@ func (r *snapRunner) sendSnap(storeID uint64, msg *raft_serverpb.RaftMessage) er
 	r.snapManager.Register(snapKey, SnapEntrySending)
 	defer r.snapManager.Deregister(snapKey, SnapEntrySending)
 
-	snap, err := r.snapManager.GetSnapshotForSending(snapKey)
+	// The snapshot directory is validated by LoadSnapDir, a missing or corrupted snapshot fails here.
+	_, snap, err := r.snapManager.LoadSnapDir(snapKey)
 	if err != nil {
 		return err
 	}
-	if !snap.Exists() {
-		return errors.Errorf("missing snap file: %v", snap.Path())
-	}
 	// Send snap shot is a low frequent operation, we can afford resolving the store address every time.
-	addr, err := getStoreAddr(storeID, r.pdCli)
+	addr, err := getStoreAddr(r.ctx, storeID, r.pdCli)
 	if err != nil {
 		return err
 	}
@@ -104,8 +192,17 @@ func (r *snapRunner) sendSnap(storeID uint64, msg *raft_serverpb.RaftMessage) er
 	if err != nil {
 		return err
 	}
+	chunkSize := r.config.SnapChunkSize
+	if err = validateSnapChunkSize(chunkSize); err != nil {
+		return err
+	}
 	client := tikvpb.NewTikvClient(cc)
-	stream, err := client.Snapshot(context.TODO())
+	ctx := metadata.AppendToOutgoingContext(r.ctx, snapChunkSizeKey, strconv.FormatUint(chunkSize, 10))
+	deltaEnabled := r.config.MaxDeltaSnapshotEntries > 0
+	if deltaEnabled {
+		ctx = metadata.AppendToOutgoingContext(ctx, snapDeltaKey, "1")
+	}
+	stream, err := client.Snapshot(ctx)
 	if err != nil {
 		return err
 	}
@@ -113,8 +210,32 @@ func (r *snapRunner) sendSnap(storeID uint64, msg *raft_serverpb.RaftMessage) er
 	if err != nil {
 		return err
 	}
+	if deltaEnabled {
+		// The receiver replies the applied index of the region in the header, the delta snapshot from it is sent
+		// instead if it's available.
+		header, err := stream.Header()
+		if err != nil {
+			return err
+		}
+		appendMsg, err := r.deltaSnapMessage(msg, header, chunkSize)
+		if err != nil {
+			return err
+		}
+		if appendMsg != nil {
+			if err = stream.Send(&raft_serverpb.SnapshotChunk{Message: appendMsg}); err != nil {
+				return err
+			}
+			if _, err = stream.CloseAndRecv(); err != nil {
+				return err
+			}
+			log.Info("sent delta snapshot", zap.Uint64("region id", snapKey.RegionID), zap.Stringer("snap key", snapKey),
+				zap.Uint64("base index", appendMsg.Message.Index), zap.Int("entries", len(appendMsg.Message.Entries)),
+				zap.Duration("duration", time.Since(start)))
+			return nil
+		}
+	}
 
-	buf := make([]byte, snapChunkLen)
+	buf := make([]byte, chunkSize)
 	for remain := snap.TotalSize(); remain > 0; remain -= uint64(len(buf)) {
 		if remain < uint64(len(buf)) {
 			buf = buf[:remain]
@@ -137,77 +258,207 @@ func (r *snapRunner) sendSnap(storeID uint64, msg *raft_serverpb.RaftMessage) er
 	return nil
 }
 
+// deltaSnapMessage builds the delta snapshot from the base index in the receiver's header as an append message, nil
+// is returned if the receiver doesn't reply a base index, or the delta snapshot is unavailable or doesn't fit into a
+// chunk, the full snapshot is sent then.
+func (r *snapRunner) deltaSnapMessage(msg *raft_serverpb.RaftMessage, header metadata.MD,
+	chunkSize uint64) (*raft_serverpb.RaftMessage, error) {
+	vals := header.Get(snapDeltaBaseKey)
+	if len(vals) == 0 {
+		return nil, nil
+	}
+	base, err := strconv.ParseUint(vals[0], 10, 64)
+	if err != nil {
+		return nil, errors.Errorf("invalid delta snapshot base %q", vals[0])
+	}
+	delta, err := r.engines.BuildDeltaSnapshot(msg.GetRegionId(), base, r.config.MaxDeltaSnapshotEntries)
+	if err != nil {
+		if _, ok := err.(*ErrDeltaSnapshotUnavailable); ok {
+			log.Info("delta snapshot is unavailable, send the full snapshot", zap.Uint64("region id", msg.GetRegionId()),
+				zap.Uint64("base index", base))
+			return nil, nil
+		}
+		return nil, err
+	}
+	appendMsg := delta.appendMessage(msg)
+	if uint64(appendMsg.Size()) > chunkSize {
+		return nil, nil
+	}
+	return appendMsg, nil
+}
+
+// deltaSnapBase returns the applied index of the region which the receiver can catch up from by a delta snapshot.
+// The delta snapshot is appended by the running peer, it's not offered if the region has no peer running.
+func (r *snapRunner) deltaSnapBase(regionID uint64) (uint64, bool) {
+	if r.router.get(regionID) == nil {
+		return 0, false
+	}
+	state, err := r.engines.loadApplyState(regionID)
+	if err != nil {
+		return 0, false
+	}
+	return state.appliedIndex, true
+}
+
+// offerDeltaSnap replies the base index of the delta snapshot to the sender in the header and receives the next chunk,
+// it's the delta snapshot as an append message if the chunk carries a message, or the first chunk of the full snapshot.
+// nil is returned if the full snapshot is empty.
+func (r *snapRunner) offerDeltaSnap(stream tikvpb.Tikv_SnapshotServer,
+	head *raft_serverpb.RaftMessage) (*raft_serverpb.SnapshotChunk, error) {
+	header := metadata.MD{}
+	base, ok := r.deltaSnapBase(head.GetRegionId())
+	if ok {
+		header.Set(snapDeltaBaseKey, strconv.FormatUint(base, 10))
+	}
+	// The header is sent even if no base is offered, the sender waits for it.
+	if err := stream.SendHeader(header); err != nil {
+		return nil, err
+	}
+	chunk, err := stream.Recv()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if msg := chunk.GetMessage(); msg != nil {
+		if !ok {
+			return nil, errors.Errorf("region %d receive delta snapshot which is not offered", msg.GetRegionId())
+		}
+		if msg.GetRegionId() != head.GetRegionId() || msg.GetMessage().GetMsgType() != eraftpb.MessageType_MsgAppend ||
+			msg.GetMessage().GetIndex() != base {
+			return nil, errors.Errorf("region %d receive invalid delta snapshot %v", head.GetRegionId(), msg.GetMessage())
+		}
+	}
+	return chunk, nil
+}
+
 func (r *snapRunner) recv(t recvSnapTask) {
-	if n := atomic.LoadInt64(&r.receivingCount); n > int64(r.config.ConcurrentRecvSnapLimit) {
-		log.Warn("too many recving snapshot tasks, ignore")
-		t.callback(errors.New("too many recving snapshot tasks"))
+	// The task may be queued long enough for the sender to give up.
+	if err := t.stream.Context().Err(); err != nil {
+		t.callback(snapRecvResult{}, err)
 		return
 	}
-	atomic.AddInt64(&r.receivingCount, 1)
-	defer atomic.AddInt64(&r.receivingCount, -1)
-	msg, err := r.recvSnap(t.stream)
+	snapshotsInFlight.WithLabelValues("recv").Inc()
+	defer snapshotsInFlight.WithLabelValues("recv").Dec()
+	start := time.Now()
+	msg, size, err := r.recvSnap(t.stream, &t.snapCtx)
+	t.snapCtx.finish("recv", start, err)
+	result := snapRecvResult{size: size, duration: time.Since(start)}
 	if err == nil {
 		if err := r.router.sendRaftMessage(msg); err != nil {
-			log.S().Error(err)
+			logRaftMessageError(err)
 		}
 	}
-	t.callback(err)
+	t.callback(result, err)
 }
 
-func (r *snapRunner) recvSnap(stream tikvpb.Tikv_SnapshotServer) (*raft_serverpb.RaftMessage, error) {
+// recvSnap receives the snapshot from the stream, snapCtx is filled from the raft message in the first chunk.
+// The number of the snapshot data bytes received is returned along with the error.
+func (r *snapRunner) recvSnap(stream tikvpb.Tikv_SnapshotServer,
+	snapCtx *snapTaskContext) (*raft_serverpb.RaftMessage, uint64, error) {
+	ctx := stream.Context()
+	chunkSize, err := recvSnapChunkSize(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
 	head, err := stream.Recv()
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	if head.GetMessage() == nil {
-		return nil, errors.New("no raft message in the first chunk")
+		return nil, 0, errors.New("no raft message in the first chunk")
 	}
+	*snapCtx = newSnapTaskContext(head.GetMessage())
+	log.Info("start receiving snapshot", snapCtx.fields()...)
+	var size uint64
 	message := head.GetMessage().GetMessage()
 	snapKey, err := SnapKeyFromSnap(message.GetSnapshot())
 	if err != nil {
-		return nil, errors.Errorf("failed to create snap key: %v", err)
+		return nil, size, errors.Errorf("failed to create snap key: %v", err)
+	}
+
+	// pending is the first chunk of the full snapshot received by the delta snapshot negotiation.
+	var pending *raft_serverpb.SnapshotChunk
+	md, _ := metadata.FromIncomingContext(ctx)
+	if len(md.Get(snapDeltaKey)) > 0 {
+		pending, err = r.offerDeltaSnap(stream, head.GetMessage())
+		if err != nil {
+			return nil, size, err
+		}
+		if appendMsg := pending.GetMessage(); appendMsg != nil {
+			// The delta snapshot is sent to the peer in place of the snapshot message.
+			log.Info("received delta snapshot", zap.Stringer("snap key", snapKey),
+				zap.Uint64("base index", appendMsg.Message.Index), zap.Int("entries", len(appendMsg.Message.Entries)))
+			if err := stream.SendAndClose(&raft_serverpb.Done{}); err != nil {
+				return nil, size, err
+			}
+			return appendMsg, uint64(pending.Size()), nil
+		}
 	}
 
 	data := message.GetSnapshot().GetData()
 	snap, err := r.snapManager.GetSnapshotForReceiving(snapKey, data)
 	if err != nil {
-		return nil, errors.Errorf("%v failed to create snapshot file: %v", snapKey, err)
+		return nil, size, errors.Errorf("%v failed to create snapshot file: %v", snapKey, err)
 	}
 	if snap.Exists() {
 		log.Info("snapshot file already exists, skip receiving", zap.Stringer("snap key", snapKey), zap.String("file", snap.Path()))
 		if err := stream.SendAndClose(&raft_serverpb.Done{}); err != nil {
-			return nil, err
+			return nil, size, err
 		}
-		return head.GetMessage(), nil
+		return head.GetMessage(), size, nil
 	}
 	r.snapManager.Register(snapKey, SnapEntryReceiving)
 	defer r.snapManager.Deregister(snapKey, SnapEntryReceiving)
 
+	saved := false
+	defer func() {
+		// Clean up the partially received files.
+		if !saved {
+			snap.Delete()
+		}
+	}()
 	for {
-		chunk, err := stream.Recv()
-		if err != nil {
-			if err == io.EOF {
-				break
+		if err := ctx.Err(); err != nil {
+			return nil, size, err
+		}
+		chunk := pending
+		pending = nil
+		if chunk == nil {
+			chunk, err = stream.Recv()
+			if err != nil {
+				if err == io.EOF {
+					break
+				}
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					return nil, size, ctxErr
+				}
+				return nil, size, err
 			}
-			return nil, err
 		}
 		data := chunk.GetData()
 		if len(data) == 0 {
-			return nil, errors.Errorf("%v receive chunk with empty data", snapKey)
+			return nil, size, errors.Errorf("%v receive chunk with empty data", snapKey)
+		}
+		if uint64(len(data)) > chunkSize {
+			return nil, size, errors.Errorf("%v receive chunk of %v bytes exceeds the chunk size %v", snapKey, len(data), chunkSize)
 		}
 		_, err = bytes.NewReader(data).WriteTo(snap)
 		if err != nil {
-			return nil, errors.Errorf("%v failed to write snapshot file %v: %v", snapKey, snap.Path(), err)
+			return nil, size, errors.Errorf("%v failed to write snapshot file %v: %v", snapKey, snap.Path(), err)
 		}
+		size += uint64(len(data))
 	}
 
 	err = snap.Save()
 	if err != nil {
-		return nil, err
+		return nil, size, err
 	}
+	saved = true
 
 	if err := stream.SendAndClose(&raft_serverpb.Done{}); err != nil {
-		return nil, err
+		return nil, size, err
 	}
-	return head.GetMessage(), nil
+	return head.GetMessage(), size, nil
 }
@@ -0,0 +1,345 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"context"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+type mockSnapshotServer struct {
+	grpc.ServerStream
+	ctx    context.Context
+	chunks []*rspb.SnapshotChunk
+	// onDrained is called when all the chunks are received.
+	onDrained func()
+	// eof is set if the sender closes the stream after all the chunks, Recv returns io.EOF then.
+	eof    bool
+	header metadata.MD
+}
+
+func (s *mockSnapshotServer) SendHeader(md metadata.MD) error {
+	s.header = md
+	return nil
+}
+
+func (s *mockSnapshotServer) Context() context.Context {
+	return s.ctx
+}
+
+func (s *mockSnapshotServer) Recv() (*rspb.SnapshotChunk, error) {
+	if len(s.chunks) == 0 {
+		if s.eof {
+			return nil, io.EOF
+		}
+		s.onDrained()
+		return nil, errors.New("transport is closing")
+	}
+	chunk := s.chunks[0]
+	s.chunks = s.chunks[1:]
+	return chunk, nil
+}
+
+func (s *mockSnapshotServer) SendAndClose(*rspb.Done) error {
+	return nil
+}
+
+func newTestSnapHead(t *testing.T) *rspb.RaftMessage {
+	snapData := &rspb.RaftSnapshotData{
+		Region: genTestRegion(1, 1, 1),
+		Meta: &rspb.SnapshotMeta{CfFiles: []*rspb.SnapshotCFFile{
+			{Cf: CFDefault, Size_: 10},
+			{Cf: CFLock},
+			{Cf: CFWrite},
+		}},
+	}
+	data, err := snapData.Marshal()
+	require.Nil(t, err)
+	return &rspb.RaftMessage{
+		RegionId: 1,
+		Message: &eraftpb.Message{
+			MsgType: eraftpb.MessageType_MsgSnapshot,
+			Snapshot: &eraftpb.Snapshot{
+				Metadata: &eraftpb.SnapshotMetadata{Index: 1, Term: 1},
+				Data:     data,
+			},
+		},
+	}
+}
+
+func TestRecvSnapCancelled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	mgr := NewSnapManager(dir, nil)
+	require.Nil(t, mgr.init())
+
+	head := newTestSnapHead(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := &mockSnapshotServer{
+		ctx: ctx,
+		chunks: []*rspb.SnapshotChunk{
+			{Message: head},
+			{Data: make([]byte, 5)},
+		},
+		// The follower disconnects in the middle of the transfer.
+		onDrained: cancel,
+	}
+
+	runner := newSnapRunner(context.Background(), nil, mgr, NewDefaultConfig(), nil, nil)
+	var recvErr error
+	runner.recv(recvSnapTask{stream: stream, callback: func(_ snapRecvResult, err error) { recvErr = err }})
+	require.Equal(t, context.Canceled, recvErr)
+	fis, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	require.Len(t, fis, 0)
+
+	// The task queued after the cancellation is aborted without receiving.
+	stream.chunks = []*rspb.SnapshotChunk{{Message: head}}
+	runner.recv(recvSnapTask{stream: stream, callback: func(_ snapRecvResult, err error) { recvErr = err }})
+	require.Equal(t, context.Canceled, recvErr)
+	require.Len(t, stream.chunks, 1)
+}
+
+func TestRecvSnapChunkSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	mgr := NewSnapManager(dir, nil)
+	require.Nil(t, mgr.init())
+	runner := newSnapRunner(context.Background(), nil, mgr, NewDefaultConfig(), nil, nil)
+	head := newTestSnapHead(t)
+
+	recv := func(chunkSize string, data []byte) error {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(snapChunkSizeKey, chunkSize))
+		stream := &mockSnapshotServer{
+			ctx:       ctx,
+			chunks:    []*rspb.SnapshotChunk{{Message: head}, {Data: data}},
+			onDrained: func() {},
+		}
+		_, _, err := runner.recvSnap(stream, new(snapTaskContext))
+		return err
+	}
+	// The chunk size out of bounds is rejected before receiving.
+	require.NotNil(t, recv("1024", make([]byte, 5)))
+	require.NotNil(t, recv("abc", make([]byte, 5)))
+	// The chunk larger than the announced size is rejected.
+	err = recv("4096", make([]byte, 4097))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "exceeds the chunk size")
+}
+
+func TestSnapRunnerConcurrencyLimit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	mgr := NewSnapManager(dir, nil)
+	require.Nil(t, mgr.init())
+	cfg := NewDefaultConfig()
+	cfg.ConcurrentRecvSnapLimit = 1
+	runner := newSnapRunner(context.Background(), nil, mgr, cfg, nil, nil)
+
+	receiving, release := make(chan struct{}), make(chan struct{})
+	stream := &mockSnapshotServer{
+		ctx:    context.Background(),
+		chunks: []*rspb.SnapshotChunk{{Message: newTestSnapHead(t)}},
+		onDrained: func() {
+			close(receiving)
+			<-release
+		},
+	}
+	done := make(chan error, 1)
+	runner.handle(task{tp: taskTypeSnapRecv, data: recvSnapTask{stream: stream, callback: func(_ snapRecvResult, err error) { done <- err }}})
+	<-receiving
+
+	// The snapshot beyond the limit is rejected by handle without starting a goroutine while the first one is
+	// being received.
+	var recvErr error
+	runner.handle(task{tp: taskTypeSnapRecv, data: recvSnapTask{stream: &mockSnapshotServer{ctx: context.Background()},
+		callback: func(_ snapRecvResult, err error) { recvErr = err }}})
+	_, ok := recvErr.(*ErrServerIsBusy)
+	require.True(t, ok, "%v", recvErr)
+
+	close(release)
+	runner.stop()
+	require.NotNil(t, <-done)
+	require.True(t, tryAcquire(runner.recvSem))
+}
+
+func TestSnapTaskContext(t *testing.T) {
+	head := newTestSnapHead(t)
+	head.ToPeer = &metapb.Peer{Id: 3, StoreId: 2}
+	head.Message.Snapshot.Metadata = &eraftpb.SnapshotMetadata{Index: 10, Term: 5}
+	require.Equal(t, snapTaskContext{regionID: 1, toPeerID: 3, toStoreID: 2, index: 10, term: 5},
+		newSnapTaskContext(head))
+
+	dir, err := ioutil.TempDir("", "snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	mgr := NewSnapManager(dir, nil)
+	require.Nil(t, mgr.init())
+	runner := newSnapRunner(context.Background(), nil, mgr, NewDefaultConfig(), nil, nil)
+	stream := &mockSnapshotServer{
+		ctx:       context.Background(),
+		chunks:    []*rspb.SnapshotChunk{{Message: head}},
+		onDrained: func() {},
+	}
+	// The context is filled from the first chunk even if the transfer fails later.
+	var snapCtx snapTaskContext
+	_, _, err = runner.recvSnap(stream, &snapCtx)
+	require.NotNil(t, err)
+	require.Equal(t, newSnapTaskContext(head), snapCtx)
+}
+
+func TestRecvSnapResult(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	mgr := NewSnapManager(dir, nil)
+	require.Nil(t, mgr.init())
+	runner := newSnapRunner(context.Background(), nil, mgr, NewDefaultConfig(), nil, nil)
+	stream := &mockSnapshotServer{
+		ctx: context.Background(),
+		chunks: []*rspb.SnapshotChunk{
+			{Message: newTestSnapHead(t)},
+			{Data: make([]byte, 3)},
+			{Data: make([]byte, 4)},
+		},
+		onDrained: func() {},
+	}
+	// The bytes received before the transfer fails are reported.
+	var (
+		result  snapRecvResult
+		recvErr error
+	)
+	runner.recv(recvSnapTask{stream: stream, callback: func(res snapRecvResult, err error) {
+		result, recvErr = res, err
+	}})
+	require.NotNil(t, recvErr)
+	require.Equal(t, uint64(7), result.size)
+	require.True(t, result.duration > 0)
+
+	// The task aborted before receiving reports nothing.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stream.ctx, stream.chunks = ctx, []*rspb.SnapshotChunk{{Message: newTestSnapHead(t)}}
+	runner.recv(recvSnapTask{stream: stream, callback: func(res snapRecvResult, err error) {
+		result, recvErr = res, err
+	}})
+	require.Equal(t, context.Canceled, recvErr)
+	require.Equal(t, snapRecvResult{}, result)
+}
+
+func TestDeltaSnapMessage(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	require.Nil(t, engines.PutApplyState(1, 15, 10, 2))
+	writeTestRaftLogs(t, engines, 1, 11, 15, 3)
+	runner := newSnapRunner(context.Background(), engines, nil, NewDefaultConfig(), nil, nil)
+	head := newTestSnapHead(t)
+
+	// The full snapshot is sent if the receiver doesn't offer a base or the delta snapshot is unavailable.
+	for _, header := range []metadata.MD{{}, metadata.Pairs(snapDeltaBaseKey, "9")} {
+		appendMsg, err := runner.deltaSnapMessage(head, header, maxSnapChunkSize)
+		require.Nil(t, err)
+		require.Nil(t, appendMsg)
+	}
+	_, err := runner.deltaSnapMessage(head, metadata.Pairs(snapDeltaBaseKey, "x"), maxSnapChunkSize)
+	require.NotNil(t, err)
+
+	appendMsg, err := runner.deltaSnapMessage(head, metadata.Pairs(snapDeltaBaseKey, "12"), maxSnapChunkSize)
+	require.Nil(t, err)
+	require.Equal(t, eraftpb.MessageType_MsgAppend, appendMsg.GetMessage().GetMsgType())
+	require.Equal(t, uint64(12), appendMsg.GetMessage().GetIndex())
+	require.Len(t, appendMsg.GetMessage().GetEntries(), 3)
+	// The delta snapshot must fit into a chunk.
+	appendMsg, err = runner.deltaSnapMessage(head, metadata.Pairs(snapDeltaBaseKey, "12"), 16)
+	require.Nil(t, err)
+	require.Nil(t, appendMsg)
+}
+
+func TestRecvDeltaSnap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	mgr := NewSnapManager(dir, nil)
+	require.Nil(t, mgr.init())
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	require.Nil(t, engines.PutApplyState(1, 12, 10, 2))
+	pr := newRouter(nil, nil)
+	runner := newSnapRunner(context.Background(), engines, mgr, NewDefaultConfig(), pr, nil)
+
+	head := newTestSnapHead(t)
+	snapData := new(rspb.RaftSnapshotData)
+	require.Nil(t, snapData.Unmarshal(head.Message.Snapshot.Data))
+	snapData.Meta.CfFiles[0].Checksum = crc32.ChecksumIEEE(make([]byte, 10))
+	head.Message.Snapshot.Data, err = snapData.Marshal()
+	require.Nil(t, err)
+	delta := &DeltaSnapshot{RegionID: 1, BaseIndex: 12, BaseTerm: 3, Entries: []eraftpb.Entry{{Index: 13, Term: 3}}}
+	appendMsg := delta.appendMessage(head)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(snapDeltaKey, "1"))
+	recv := func(chunks ...*rspb.SnapshotChunk) (*mockSnapshotServer, *rspb.RaftMessage, error) {
+		stream := &mockSnapshotServer{
+			ctx:       ctx,
+			chunks:    append([]*rspb.SnapshotChunk{{Message: head}}, chunks...),
+			onDrained: func() {},
+			eof:       true,
+		}
+		var snapCtx snapTaskContext
+		msg, _, err := runner.recvSnap(stream, &snapCtx)
+		return stream, msg, err
+	}
+
+	// No base is offered if the peer isn't running, the delta snapshot is rejected.
+	stream, _, err := recv(&rspb.SnapshotChunk{Message: appendMsg})
+	require.NotNil(t, err)
+	require.NotNil(t, stream.header)
+	require.Len(t, stream.header.Get(snapDeltaBaseKey), 0)
+
+	pr.peers.Store(uint64(1), &peerState{})
+	stream, msg, err := recv(&rspb.SnapshotChunk{Message: appendMsg})
+	require.Nil(t, err)
+	require.Equal(t, []string{"12"}, stream.header.Get(snapDeltaBaseKey))
+	require.Equal(t, appendMsg, msg)
+	fis, err := ioutil.ReadDir(dir)
+	require.Nil(t, err)
+	require.Len(t, fis, 0)
+
+	// The delta snapshot must be based on the offered index.
+	delta.BaseIndex = 11
+	_, _, err = recv(&rspb.SnapshotChunk{Message: delta.appendMessage(head)})
+	require.NotNil(t, err)
+
+	// The sender falls back to the full snapshot.
+	_, msg, err = recv(&rspb.SnapshotChunk{Data: make([]byte, 10)})
+	require.Nil(t, err)
+	require.Equal(t, head, msg)
+	applying, err := mgr.GetSnapshotForApplying(SnapKey{RegionID: 1, Term: 1, Index: 1})
+	require.Nil(t, err)
+	require.Equal(t, uint64(10), applying.TotalSize())
+}
@@ -44,6 +44,8 @@ const (
 // snapApplier iteratos all the CFs and returns the entries to write to badger.
 type snapApplier struct {
 	lockCFData        []byte
+	lockCFFile        *os.File
+	lockCFIterator    *rocksdb.SstFileIterator
 	defaultCFFile     *os.File
 	defaultCFIterator *rocksdb.SstFileIterator
 	writeCFFile       *os.File
@@ -69,39 +71,98 @@ func newSnapApplier(cfs []*CFFile) (*snapApplier, error) {
 			return nil, errors.WithStack(err)
 		}
 	}
+	var defaultPath, writePath string
 	if cfs[defaultCFIdx].Size > 0 {
-		it.defaultCFFile, err = os.Open(cfs[defaultCFIdx].Path)
-		if err != nil {
-			return nil, errors.WithStack(err)
-		}
-		it.defaultCFIterator, err = rocksdb.NewSstFileIterator(it.defaultCFFile)
-		if err != nil {
-			return nil, errors.WithStack(err)
-		}
-		it.defaultCFIterator.SeekToFirst()
-		if !it.defaultCFIterator.Valid() {
-			return nil, it.defaultCFIterator.Err()
-		}
+		defaultPath = cfs[defaultCFIdx].Path
 	}
 	if cfs[writeCFIdx].Size > 0 {
-		it.writeCFFile, err = os.Open(cfs[writeCFIdx].Path)
+		writePath = cfs[writeCFIdx].Path
+	}
+	if err = it.openDataCFs(defaultPath, writePath); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+// newSnapSSTApplier creates a snapApplier reading the sst files exported by ExportCFs, the lock CF is an sst file
+// instead of a plain file. The path of a CF without any key is empty.
+func newSnapSSTApplier(defaultPath, writePath, lockPath string) (*snapApplier, error) {
+	it := new(snapApplier)
+	if err := it.openDataCFs(defaultPath, writePath); err != nil {
+		it.close()
+		return nil, err
+	}
+	if lockPath == "" {
+		return it, nil
+	}
+	var err error
+	it.lockCFFile, it.lockCFIterator, err = openSnapSST(lockPath)
+	if err != nil {
+		it.close()
+		return nil, err
+	}
+	it.lockCFIterator.SeekToFirst()
+	if err = it.setCurLockFromSST(); err != nil {
+		it.close()
+		return nil, err
+	}
+	return it, nil
+}
+
+func (ai *snapApplier) openDataCFs(defaultPath, writePath string) error {
+	var err error
+	if defaultPath != "" {
+		ai.defaultCFFile, ai.defaultCFIterator, err = openSnapSST(defaultPath)
 		if err != nil {
-			return nil, errors.WithStack(err)
+			return err
+		}
+		ai.defaultCFIterator.SeekToFirst()
+		if !ai.defaultCFIterator.Valid() {
+			return ai.defaultCFIterator.Err()
 		}
-		it.writeCFIterator, err = rocksdb.NewSstFileIterator(it.writeCFFile)
+	}
+	if writePath != "" {
+		ai.writeCFFile, ai.writeCFIterator, err = openSnapSST(writePath)
 		if err != nil {
-			return nil, errors.WithStack(err)
+			return err
 		}
-		it.writeCFIterator.SeekToFirst()
-		if !it.writeCFIterator.Valid() {
-			return nil, it.writeCFIterator.Err()
+		ai.writeCFIterator.SeekToFirst()
+		if !ai.writeCFIterator.Valid() {
+			return ai.writeCFIterator.Err()
 		}
-		it.curWriteKey, it.curWriteCommitTS, err = decodeRocksDBSSTKey(it.writeCFIterator.Key().UserKey)
+		ai.curWriteKey, ai.curWriteCommitTS, err = decodeRocksDBSSTKey(ai.writeCFIterator.Key().UserKey)
 		if err != nil {
-			return nil, errors.WithStack(err)
+			return errors.WithStack(err)
 		}
 	}
-	return it, nil
+	return nil
+}
+
+func openSnapSST(path string) (*os.File, *rocksdb.SstFileIterator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	it, err := rocksdb.NewSstFileIterator(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, errors.WithStack(err)
+	}
+	return f, it, nil
+}
+
+// setCurLockFromSST sets the current lock to the entry of the lock CF sst iterator.
+func (ai *snapApplier) setCurLockFromSST() error {
+	if !ai.lockCFIterator.Valid() {
+		ai.curLockKey = nil
+		return ai.lockCFIterator.Err()
+	}
+	key, err := decodeRocksDBSSTLockKey(ai.lockCFIterator.Key().UserKey)
+	if err != nil {
+		return err
+	}
+	ai.curLockKey, ai.curLockValue = key, y.SafeCopy(nil, ai.lockCFIterator.Value())
+	return nil
 }
 
 func (ai *snapApplier) next() (*applySnapItem, error) {
@@ -140,7 +201,10 @@ func (ai *snapApplier) nextLock() (*applySnapItem, error) {
 	mvccLock.Primary = lv.primary
 	mvccLock.Value = val
 	item.val = mvccLock.MarshalBinary()
-	if len(ai.lockCFData) > 1 {
+	if ai.lockCFIterator != nil {
+		ai.lockCFIterator.Next()
+		err = ai.setCurLockFromSST()
+	} else if len(ai.lockCFData) > 1 {
 		ai.curLockKey, ai.curLockValue, ai.lockCFData, err = readEntryFromPlainFile(ai.lockCFData)
 		if err != nil {
 			return nil, err
@@ -157,7 +221,7 @@ func (ai *snapApplier) popFullValue(key []byte, startTS uint64, shortVal []byte,
 
 func (ai *snapApplier) loadFullValueOpt(key []byte, startTS uint64, shortVal []byte, op byte, pop bool) ([]byte, error) {
 	if shortVal == nil && op == byte(kvrpcpb.Op_Put) {
-		if !ai.defaultCFIterator.Valid() {
+		if ai.defaultCFIterator == nil || !ai.defaultCFIterator.Valid() {
 			return nil, errors.WithStack(errInvalidSnapshot)
 		}
 		defKey, defStartTS, err := decodeRocksDBSSTKey(ai.defaultCFIterator.Key().UserKey)
@@ -220,6 +284,11 @@ func (ai *snapApplier) writeCFIteratorNext() error {
 }
 
 func (ai *snapApplier) close() {
+	if ai.lockCFFile != nil {
+		if err := ai.lockCFFile.Close(); err != nil {
+			log.S().Error(err)
+		}
+	}
 	if ai.writeCFFile != nil {
 		if err := ai.writeCFFile.Close(); err != nil {
 			log.S().Error(err)
@@ -240,7 +309,10 @@ func readEntryFromPlainFile(data []byte) (key, value, remain []byte, err error)
 	if len(key) == 0 {
 		return
 	}
-	key = key[1:]
+	key, err = decodeRocksDBSSTLockKey(key)
+	if err != nil {
+		return
+	}
 	data, value, err = codec.DecodeCompactBytes(data)
 	if err != nil {
 		return
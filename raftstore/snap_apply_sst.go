@@ -0,0 +1,258 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/dbreader"
+	"go.uber.org/zap"
+)
+
+// ApplySnapshotSSTs replaces the data of the region with the sst files of a received snapshot, and sets the region
+// state to normal with the applied and truncated index at index. The sst files are the ones exported by ExportCFs,
+// the CF of a file is recognized by the "_<cf>.sst" suffix, and the files of the same chunk share the prefix before
+// it. The keys and values are encoded like the snapshot files, they're decoded in the same way as applying a snapshot.
+// All the sst files are read before anything is written, and the old data is deleted in the same kv transaction
+// which writes the new data and the states, so a failure leaves the old region data intact.
+func (en *Engines) ApplySnapshotSSTs(region *metapb.Region, term, index uint64, ssts []string) error {
+	if err := en.checkWritable(); err != nil {
+		return err
+	}
+	chunks, err := groupSnapSSTs(ssts)
+	if err != nil {
+		return err
+	}
+	var items []*applySnapItem
+	for _, chunk := range chunks {
+		chunkItems, err := readSnapSSTs(chunk)
+		if err != nil {
+			return err
+		}
+		items = append(items, chunkItems...)
+	}
+
+	startKey, endKey := RawStartKey(region), RawEndKey(region)
+	txn := en.kv.DB.NewTransaction(false)
+	oldKeys := collectRangeKeys(txn, startKey, endKey, newRangeHint(startKey, endKey), nil)
+	txn.Discard()
+	oldLocks := collectLockRangeKeys(en.kv.LockStore.NewIterator(), startKey, endKey, nil)
+
+	// A key in the batch can only be written once, so the old keys overwritten by the snapshot are set at the
+	// version which shadows the old one if it's newer than the commit ts, instead of being deleted.
+	versions := make(map[string]uint64, len(oldKeys))
+	for _, key := range oldKeys {
+		versions[string(key.UserKey)] = key.Version + 1
+	}
+	wb := new(WriteBatch)
+	for _, key := range oldLocks {
+		wb.DeleteLock(key.UserKey)
+	}
+	var lastPutKey []byte
+	for _, item := range items {
+		switch item.applySnapType {
+		case applySnapTypePut:
+			// The versions of a key are ordered by the commit ts descending, only the latest one is kept.
+			if lastPutKey != nil && bytes.Equal(lastPutKey, item.key.UserKey) {
+				continue
+			}
+			lastPutKey = item.key.UserKey
+			key := item.key
+			if v, ok := versions[string(key.UserKey)]; ok {
+				if v > key.Version {
+					key.Version = v
+				}
+				delete(versions, string(key.UserKey))
+			}
+			wb.SetWithUserMeta(key, item.val, item.userMeta)
+		case applySnapTypeLock:
+			wb.SetLock(item.key.UserKey, item.val)
+		case applySnapTypeRollback:
+			wb.Rollback(item.key)
+		case applySnapTypeOpLock:
+			wb.SetOpLock(item.key, item.userMeta)
+		}
+	}
+	for _, key := range oldKeys {
+		if version, ok := versions[string(key.UserKey)]; ok {
+			wb.Delete(y.KeyWithTs(key.UserKey, version))
+		}
+	}
+	WritePeerState(wb, region, rspb.PeerState_Normal, nil)
+	setApplyState(wb, region.Id, applyState{
+		appliedIndex:   index,
+		truncatedIndex: index,
+		truncatedTerm:  term,
+	})
+	return en.WriteKV(wb)
+}
+
+// snapSSTChunk is the sst files of the CFs exported in the same chunk, the path of a CF without any key is empty.
+type snapSSTChunk struct {
+	defaultPath string
+	writePath   string
+	lockPath    string
+}
+
+// groupSnapSSTs groups the sst files by the chunk, the chunks are in the order of their first file.
+func groupSnapSSTs(ssts []string) ([]*snapSSTChunk, error) {
+	var chunks []*snapSSTChunk
+	byPrefix := make(map[string]*snapSSTChunk)
+	for _, path := range ssts {
+		var cf CFName
+		for _, name := range snapshotCFs {
+			if strings.HasSuffix(path, "_"+string(name)+sstFileSuffix) {
+				cf = name
+				break
+			}
+		}
+		if cf == "" {
+			return nil, errors.Errorf("unknown CF of the snapshot sst file %s", path)
+		}
+		prefix := strings.TrimSuffix(path, "_"+string(cf)+sstFileSuffix)
+		chunk, ok := byPrefix[prefix]
+		if !ok {
+			chunk = new(snapSSTChunk)
+			byPrefix[prefix] = chunk
+			chunks = append(chunks, chunk)
+		}
+		var cfPath *string
+		switch cf {
+		case CFDefault:
+			cfPath = &chunk.defaultPath
+		case CFWrite:
+			cfPath = &chunk.writePath
+		case CFLock:
+			cfPath = &chunk.lockPath
+		}
+		if *cfPath != "" {
+			return nil, errors.Errorf("duplicated %s CF sst files %s and %s", cf, *cfPath, path)
+		}
+		*cfPath = path
+	}
+	return chunks, nil
+}
+
+// readSnapSSTs reads all the entries in the sst files of the chunk.
+func readSnapSSTs(chunk *snapSSTChunk) ([]*applySnapItem, error) {
+	applier, err := newSnapSSTApplier(chunk.defaultPath, chunk.writePath, chunk.lockPath)
+	if err != nil {
+		return nil, err
+	}
+	defer applier.close()
+	var items []*applySnapItem
+	for {
+		item, err := applier.next()
+		if err != nil {
+			return nil, err
+		}
+		if item == nil {
+			return items, nil
+		}
+		items = append(items, item)
+	}
+}
+
+// StageAndSwapRegion replaces the data of the region with the keys in the sst files, and sets the region state to
+// normal. Unlike ApplySnapshotSSTs, the sst files are ingested into the staging keyspace of the region first, then the
+// old data and the locks of the region are deleted, and the staged keys are moved into place with the region state in
+// one kv transaction. The swap is atomic, so it's bounded by memory like ApplySnapshotSSTs: the transaction holding
+// two entries per staged key and one per old key or lock of the region is built in memory before it's written. The
+// regions too large for it should be applied by the region worker, which deletes the old range and ingests the
+// snapshot in separate steps. If anything fails, the staged keys are cleared and the old data is left intact. The sst
+// files only contain the committed data, the lock cf is not supported.
+func (en *Engines) StageAndSwapRegion(region *metapb.Region, ssts []string) error {
+	if err := en.checkWritable(); err != nil {
+		return err
+	}
+	stagingPrefix := RegionStagingPrefixKey(region.Id)
+	// Clear the keys left by a failed swap.
+	if err := en.clearStagedKeys(stagingPrefix); err != nil {
+		return err
+	}
+	err := en.stageAndSwap(region, stagingPrefix, ssts)
+	if err != nil {
+		if clearErr := en.clearStagedKeys(stagingPrefix); clearErr != nil {
+			log.Warn("failed to clear the staged keys", zap.Uint64("region id", region.Id), zap.Error(clearErr))
+		}
+	}
+	return err
+}
+
+func (en *Engines) stageAndSwap(region *metapb.Region, stagingPrefix []byte, ssts []string) error {
+	for _, path := range ssts {
+		if _, err := en.IngestSST(path, RewritePrefix(nil, stagingPrefix)); err != nil {
+			return err
+		}
+	}
+
+	startKey, endKey := RawStartKey(region), RawEndKey(region)
+	txn := en.kv.DB.NewTransaction(false)
+	defer txn.Discard()
+	oldKeys := collectRangeKeys(txn, startKey, endKey, newRangeHint(startKey, endKey), nil)
+	oldLocks := collectLockRangeKeys(en.kv.LockStore.NewIterator(), startKey, endKey, nil)
+
+	versions := make(map[string]uint64, len(oldKeys))
+	for _, key := range oldKeys {
+		versions[string(key.UserKey)] = key.Version + 1
+	}
+	wb := new(WriteBatch)
+	it := dbreader.NewIterator(txn, false, stagingPrefix, kv.Key(stagingPrefix).PrefixNext())
+	defer it.Close()
+	for it.Seek(stagingPrefix); it.ValidForPrefix(stagingPrefix); it.Next() {
+		item := it.Item()
+		if item.IsEmpty() {
+			continue
+		}
+		stagedKey := item.KeyCopy(nil)
+		key := stagedKey[len(stagingPrefix):]
+		if bytes.Compare(key, startKey) < 0 || exceedEndKey(key, endKey) {
+			return errors.Errorf("staged key %q is out of the range of region %d", key, region.Id)
+		}
+		val, err := item.ValueCopy(nil)
+		if err != nil {
+			return errors.WithStack(err)
+		}
+		// The old keys overwritten are set at the version shadowing the old one like ApplySnapshotSSTs.
+		version := uint64(KvTS)
+		if v, ok := versions[string(key)]; ok {
+			version = v
+			delete(versions, string(key))
+		}
+		wb.Set(y.KeyWithTs(key, version), val)
+		wb.Delete(y.KeyWithTs(stagedKey, KvTS))
+	}
+	for _, key := range oldKeys {
+		if version, ok := versions[string(key.UserKey)]; ok {
+			wb.Delete(y.KeyWithTs(key.UserKey, version))
+		}
+	}
+	for _, key := range oldLocks {
+		wb.DeleteLock(key.UserKey)
+	}
+	WritePeerState(wb, region, rspb.PeerState_Normal, nil)
+	return en.WriteKV(wb)
+}
+
+// clearStagedKeys deletes all the keys with the staging prefix.
+func (en *Engines) clearStagedKeys(stagingPrefix []byte) error {
+	return deleteRange(en.kv, stagingPrefix, kv.Key(stagingPrefix).PrefixNext(), 0, false, nil)
+}
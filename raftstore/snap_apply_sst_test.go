@@ -0,0 +1,192 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ngaut/unistore/rocksdb"
+	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/mvcc"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestSnapSST(t *testing.T, path string, kvs ...string) {
+	f, err := os.Create(path)
+	require.Nil(t, err)
+	w := rocksdb.NewSstFileWriter(f, rocksdb.NewDefaultBlockBasedTableOptions(bytes.Compare))
+	for i := 0; i < len(kvs); i += 2 {
+		require.Nil(t, w.Put([]byte(kvs[i]), []byte(kvs[i+1])))
+	}
+	require.Nil(t, w.Finish())
+	require.Nil(t, w.Close())
+}
+
+func TestApplySnapshotSSTs(t *testing.T) {
+	source := newTestEngines(t)
+	defer cleanUpTestEngineData(source)
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	dir, err := ioutil.TempDir("", "unistore-snap-sst")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// The long values are exported to the default CF.
+	longVal := bytes.Repeat([]byte("v"), shortValueMaxLen+1)
+	// Only the latest version of a key is applied.
+	wb := new(WriteBatch)
+	wb.SetWithUserMeta(y.KeyWithTs([]byte("ta"), 8), []byte("stale"), mvcc.NewDBUserMeta(7, 8))
+	require.Nil(t, source.WriteKV(wb))
+	wb = new(WriteBatch)
+	wb.SetWithUserMeta(y.KeyWithTs([]byte("ta"), 10), []byte("new"), mvcc.NewDBUserMeta(9, 10))
+	wb.SetWithUserMeta(y.KeyWithTs([]byte("tb"), 12), longVal, mvcc.NewDBUserMeta(11, 12))
+	require.Nil(t, source.WriteKV(wb))
+	snap := newTestExportSnapshot(source, 6)
+	newLock := &mvcc.Lock{LockHdr: mvcc.LockHdr{StartTS: 20, TTL: 3000, Op: uint8(kvrpcpb.Op_Put),
+		PrimaryLen: 2}, Primary: []byte("td"), Value: longVal}
+	snap.lockSnap.Put([]byte("td"), newLock.MarshalBinary())
+	exports, err := snap.ExportCFs(dir)
+	require.Nil(t, err)
+	require.Len(t, exports, 3)
+	ssts := make([]string, 0, len(exports))
+	for _, export := range exports {
+		ssts = append(ssts, export.Path)
+	}
+
+	region := genTestRegion(1, 1, 1)
+	wb = new(WriteBatch)
+	wb.Set(y.KeyWithTs([]byte("tb"), 15), []byte("old"))
+	wb.Set(y.KeyWithTs([]byte("tc"), KvTS), []byte("old"))
+	wb.SetLock([]byte("tc"), []byte("old lock"))
+	// The key out of the region should be kept.
+	wb.Set(y.KeyWithTs([]byte("u"), KvTS), []byte("old"))
+	require.Nil(t, engines.WriteKV(wb))
+
+	// A missing sst leaves the old data intact.
+	err = engines.ApplySnapshotSSTs(region, 5, 6, append([]string{filepath.Join(dir, "missing_write.sst")}, ssts...))
+	require.NotNil(t, err)
+	require.NotNil(t, engines.ApplySnapshotSSTs(region, 5, 6, []string{filepath.Join(dir, "unknown.sst")}))
+	val, err := getValue(engines.kv.DB, []byte("tb"))
+	require.Nil(t, err)
+	require.Equal(t, "old", string(val))
+	_, err = getValue(engines.kv.DB, []byte("ta"))
+	require.Equal(t, badger.ErrKeyNotFound, err)
+	require.Equal(t, "old lock", string(engines.kv.LockStore.Get([]byte("tc"), nil)))
+
+	require.Nil(t, engines.ApplySnapshotSSTs(region, 5, 6, ssts))
+	require.Nil(t, engines.kv.DB.View(func(txn *badger.Txn) error {
+		for key, expected := range map[string]struct {
+			val      []byte
+			commitTS uint64
+		}{"ta": {[]byte("new"), 10}, "tb": {longVal, 12}} {
+			item, err := txn.Get([]byte(key))
+			require.Nil(t, err)
+			val, err := item.Value()
+			require.Nil(t, err)
+			require.Equal(t, expected.val, val)
+			require.Equal(t, expected.commitTS, mvcc.DBUserMeta(item.UserMeta()).CommitTS())
+		}
+		return nil
+	}))
+	_, err = getValue(engines.kv.DB, []byte("tc"))
+	require.Equal(t, badger.ErrKeyNotFound, err)
+	require.Nil(t, engines.kv.LockStore.Get([]byte("tc"), nil))
+	lock := mvcc.DecodeLock(engines.kv.LockStore.Get([]byte("td"), nil))
+	require.Equal(t, newLock.StartTS, lock.StartTS)
+	require.Equal(t, newLock.Primary, lock.Primary)
+	require.Equal(t, newLock.Value, lock.Value)
+	_, err = getValue(engines.kv.DB, []byte("u"))
+	require.Nil(t, err)
+
+	state, err := getRegionLocalState(engines.kv.DB, region.Id)
+	require.Nil(t, err)
+	require.Equal(t, rspb.PeerState_Normal, state.State)
+	require.Equal(t, region.Id, state.Region.Id)
+	apply, err := getApplyState(engines.kv.DB, region.Id)
+	require.Nil(t, err)
+	require.Equal(t, applyState{appliedIndex: 6, truncatedIndex: 6, truncatedTerm: 5}, apply)
+}
+
+func TestStageAndSwapRegion(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	dir, err := ioutil.TempDir("", "unistore-snap-sst")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	region := genTestRegion(1, 1, 1)
+	wb := new(WriteBatch)
+	wb.Set(y.KeyWithTs([]byte("tb"), 5), []byte("old"))
+	wb.Set(y.KeyWithTs([]byte("tc"), KvTS), []byte("old"))
+	wb.SetLock([]byte("tc"), []byte("old lock"))
+	wb.Set(y.KeyWithTs([]byte("u"), KvTS), []byte("old"))
+	require.Nil(t, engines.WriteKV(wb))
+	checkOld := func() {
+		val, err := getValue(engines.kv.DB, []byte("tb"))
+		require.Nil(t, err)
+		require.Equal(t, "old", string(val))
+		_, err = getValue(engines.kv.DB, []byte("ta"))
+		require.Equal(t, badger.ErrKeyNotFound, err)
+		require.Equal(t, "old lock", string(engines.kv.LockStore.Get([]byte("tc"), nil)))
+	}
+	checkStagingCleared := func() {
+		stagingPrefix := RegionStagingPrefixKey(region.Id)
+		require.Nil(t, engines.kv.DB.View(func(txn *badger.Txn) error {
+			it := txn.NewIterator(badger.DefaultIteratorOptions)
+			defer it.Close()
+			for it.Seek(stagingPrefix); it.ValidForPrefix(stagingPrefix); it.Next() {
+				require.True(t, it.Item().IsEmpty(), "%q is not cleared", it.Item().Key())
+			}
+			return nil
+		}))
+	}
+
+	sst1 := filepath.Join(dir, "1.sst")
+	sst2 := filepath.Join(dir, "2.sst")
+	outOfRange := filepath.Join(dir, "3.sst")
+	writeTestSnapSST(t, sst1, "ta", "new")
+	writeTestSnapSST(t, sst2, "tb", "new")
+	writeTestSnapSST(t, outOfRange, "u", "new")
+	// The staged keys are cleared if the staging or the swap fails, the old data is intact.
+	require.NotNil(t, engines.StageAndSwapRegion(region, []string{sst1, filepath.Join(dir, "missing.sst")}))
+	checkOld()
+	checkStagingCleared()
+	require.NotNil(t, engines.StageAndSwapRegion(region, []string{sst1, outOfRange}))
+	checkOld()
+	checkStagingCleared()
+
+	require.Nil(t, engines.StageAndSwapRegion(region, []string{sst1, sst2}))
+	for _, key := range []string{"ta", "tb"} {
+		val, err := getValue(engines.kv.DB, []byte(key))
+		require.Nil(t, err)
+		require.Equal(t, "new", string(val))
+	}
+	_, err = getValue(engines.kv.DB, []byte("tc"))
+	require.Equal(t, badger.ErrKeyNotFound, err)
+	require.Nil(t, engines.kv.LockStore.Get([]byte("tc"), nil))
+	val, err := getValue(engines.kv.DB, []byte("u"))
+	require.Nil(t, err)
+	require.Equal(t, "old", string(val))
+	checkStagingCleared()
+	state, err := getRegionLocalState(engines.kv.DB, region.Id)
+	require.Nil(t, err)
+	require.Equal(t, rspb.PeerState_Normal, state.State)
+}
@@ -15,10 +15,13 @@ package raftstore
 
 import (
 	"bytes"
+	"fmt"
 	"math"
 	"os"
+	"path/filepath"
 
 	"github.com/ngaut/unistore/rocksdb"
+	"github.com/ngaut/unistore/util"
 	"github.com/pingcap/badger"
 	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
@@ -29,9 +32,13 @@ import (
 )
 
 func newSnapBuilder(cfFiles []*CFFile, snap *regionSnapshot, region *metapb.Region) (*snapBuilder, error) {
+	return newSnapRangeBuilder(cfFiles, snap, RawStartKey(region), RawEndKey(region))
+}
+
+// newSnapRangeBuilder creates a snapBuilder of the keys in [startKey, endKey) of the snapshot.
+func newSnapRangeBuilder(cfFiles []*CFFile, snap *regionSnapshot, startKey, endKey []byte) (*snapBuilder, error) {
 	b := new(snapBuilder)
-	b.cfFiles = cfFiles
-	b.endKey = RawEndKey(region)
+	b.endKey = endKey
 	b.extraEndKey = mvcc.EncodeExtraTxnStatusKey(b.endKey, 0)
 	b.txn = snap.txn
 	itOpt := badger.DefaultIteratorOptions
@@ -39,7 +46,6 @@ func newSnapBuilder(cfFiles []*CFFile, snap *regionSnapshot, region *metapb.Regi
 	b.dbIterator = b.txn.NewIterator(itOpt)
 	// extraIterator doesn't need to read all versions because startTS is encoded in the key.
 	b.extraIterator = b.txn.NewIterator(badger.DefaultIteratorOptions)
-	startKey := RawStartKey(region)
 
 	b.dbIterator.Seek(startKey)
 	if b.dbIterator.Valid() && !b.reachEnd(b.dbIterator.Item().Key()) {
@@ -55,20 +61,33 @@ func newSnapBuilder(cfFiles []*CFFile, snap *regionSnapshot, region *metapb.Regi
 	if b.lockIterator.Valid() && !b.reachEnd(b.lockIterator.Key()) {
 		b.curLockKey = b.lockIterator.Key()
 	}
-	lockCFFile := cfFiles[lockCFIdx].File
-	if lockCFFile == nil {
-		return nil, errors.New("lock CF file is nil")
+	if err := b.setCFFiles(cfFiles); err != nil {
+		b.close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// setCFFiles makes the following entries written to the cfFiles.
+func (b *snapBuilder) setCFFiles(cfFiles []*CFFile) error {
+	// The lock CF is written to a plain file for snapshot, or to an sst file for exporting.
+	lockCFWriter := cfFiles[lockCFIdx].File
+	lockCFSstWriter := cfFiles[lockCFIdx].SstWriter
+	if lockCFWriter == nil && lockCFSstWriter == nil {
+		return errors.New("lock CF file is nil")
 	}
-	b.lockCFWriter = cfFiles[lockCFIdx].File
 	if cfFiles[defaultCFIdx].SstWriter == nil {
-		return nil, errors.New("default CF SstWriter is nil")
+		return errors.New("default CF SstWriter is nil")
 	}
-	b.defaultCFWriter = cfFiles[defaultCFIdx].SstWriter
 	if cfFiles[writeCFIdx].SstWriter == nil {
-		return nil, errors.New("write CF SstWriter is nil")
+		return errors.New("write CF SstWriter is nil")
 	}
+	b.cfFiles = cfFiles
+	b.lockCFWriter = lockCFWriter
+	b.lockCFSstWriter = lockCFSstWriter
+	b.defaultCFWriter = cfFiles[defaultCFIdx].SstWriter
 	b.writeCFWriter = cfFiles[writeCFIdx].SstWriter
-	return b, nil
+	return nil
 }
 
 // snapBuilder builds snapshot files.
@@ -84,6 +103,7 @@ type snapBuilder struct {
 	curDBKey        []byte
 	curExtraKey     []byte
 	lockCFWriter    *os.File
+	lockCFSstWriter *rocksdb.SstFileWriter
 	defaultCFWriter *rocksdb.SstFileWriter
 	writeCFWriter   *rocksdb.SstFileWriter
 	cfFiles         []*CFFile
@@ -91,37 +111,75 @@ type snapBuilder struct {
 	buf2            []byte
 	kvCount         int
 	size            int
+	// maxKey is the largest key added, it's only tracked by buildChunk.
+	maxKey []byte
 }
 
 func (b *snapBuilder) build() error {
-	defer func() {
-		b.dbIterator.Close()
-		b.extraIterator.Close()
-		b.txn.Discard()
-	}()
+	defer b.close()
+	_, err := b.buildChunk(0)
+	return err
+}
+
+// close releases the iterators and the transaction of the snapshot.
+func (b *snapBuilder) close() {
+	b.dbIterator.Close()
+	b.extraIterator.Close()
+	b.txn.Discard()
+}
+
+// buildChunk adds the entries until about sizeLimit bytes are added, 0 means no limit. It stops before a key
+// greater than all the added ones, so the returned nextKey is the smallest key not added, the rest of the
+// range can be built from nextKey by another snapBuilder of the same snapshot. A nil nextKey means all the
+// entries are added.
+func (b *snapBuilder) buildChunk(sizeLimit int) (nextKey []byte, err error) {
+	startSize := b.size
 	for {
-		var err error
-		switch b.currentKeyType() {
-		case currentKeyDB:
-			if len(b.curDBKey) == 0 {
-				return nil
+		if sizeLimit > 0 && b.size-startSize >= sizeLimit {
+			if key := b.minCurrentKey(); len(key) > 0 && bytes.Compare(key, b.maxKey) > 0 {
+				return safeCopy(key), nil
 			}
+		}
+		keyType := b.currentKeyType()
+		var key []byte
+		switch keyType {
+		case currentKeyDB:
+			key = b.curDBKey
+		case currentKeyLock:
+			key = b.curLockKey
+		case currentKeyExtra:
+			key = b.curExtraKey
+		}
+		if len(key) == 0 {
+			return nil, nil
+		}
+		if sizeLimit > 0 && bytes.Compare(key, b.maxKey) > 0 {
+			b.maxKey = append(b.maxKey[:0], key...)
+		}
+		switch keyType {
+		case currentKeyDB:
 			err = b.addDBEntry()
 		case currentKeyLock:
-			if len(b.curLockKey) == 0 {
-				return nil
-			}
 			err = b.addLockEntry()
 		case currentKeyExtra:
-			if len(b.curExtraKey) == 0 {
-				return nil
-			}
 			err = b.addExtraEntry()
 		}
 		if err != nil {
-			return err
+			return nil, err
+		}
+	}
+}
+
+// minCurrentKey returns the smallest key of the entries not added, nil is returned if all the entries are added.
+// The entry to add next may not be the smallest one, the lock and the extra entries are not ordered with each other.
+func (b *snapBuilder) minCurrentKey() []byte {
+	var minKey []byte
+	for _, key := range [][]byte{b.curDBKey, b.curLockKey, b.curExtraKey} {
+		if len(key) > 0 && (len(minKey) == 0 || bytes.Compare(key, minKey) < 0) {
+			minKey = key
 		}
 	}
+	return minKey
 }
 
 const (
@@ -130,12 +188,15 @@ const (
 	currentKeyExtra
 )
 
+// currentKeyType returns the type of the smallest current key, the empty keys are skipped so the locks and the extra
+// entries after the last db key are still added. A lock goes before the db entries of the same key, its large value
+// is written to the default CF at the start ts, which is greater than the ones of the committed versions.
 func (b *snapBuilder) currentKeyType() (keyType int) {
 	curKey := b.curDBKey
-	if len(curKey) == 0 || (len(b.curLockKey) > 0 && bytes.Compare(b.curLockKey, curKey) < 0) {
-		keyType = currentKeyLock
+	if len(b.curLockKey) > 0 && (len(curKey) == 0 || bytes.Compare(b.curLockKey, curKey) <= 0) {
+		keyType, curKey = currentKeyLock, b.curLockKey
 	}
-	if len(curKey) == 0 || (len(b.curExtraKey) > 0 && bytes.Compare(b.curExtraKey, curKey) < 0) {
+	if len(b.curExtraKey) > 0 && (len(curKey) == 0 || bytes.Compare(b.curExtraKey, curKey) < 0) {
 		keyType = currentKeyExtra
 	}
 	return
@@ -169,20 +230,27 @@ func (b *snapBuilder) addLockEntry() error {
 		b.size += len(defaultCFKey) + len(l.Value)
 		b.kvCount++
 	}
-	b.buf = codec.EncodeCompactBytes(b.buf[:0], lockCFKey)
-	_, err := b.lockCFWriter.Write(b.buf)
-	if err != nil {
-		return err
-	}
-	b.size += len(b.buf)
 	b.buf2 = encodeLockCFValue(lockCFVal, b.buf2[:0])
-	b.buf = codec.EncodeCompactBytes(b.buf[:0], b.buf2)
-	_, err = b.lockCFWriter.Write(b.buf)
-	if err != nil {
-		return err
+	if b.lockCFSstWriter != nil {
+		if err := b.lockCFSstWriter.Put(lockCFKey, b.buf2); err != nil {
+			return err
+		}
+		b.size += len(lockCFKey) + len(b.buf2)
+	} else {
+		b.buf = codec.EncodeCompactBytes(b.buf[:0], lockCFKey)
+		_, err := b.lockCFWriter.Write(b.buf)
+		if err != nil {
+			return err
+		}
+		b.size += len(b.buf)
+		b.buf = codec.EncodeCompactBytes(b.buf[:0], b.buf2)
+		_, err = b.lockCFWriter.Write(b.buf)
+		if err != nil {
+			return err
+		}
+		b.size += len(b.buf)
 	}
 	b.cfFiles[lockCFIdx].KVCount++
-	b.size += len(b.buf)
 	b.kvCount++
 
 	b.lockIterator.Next()
@@ -273,3 +341,134 @@ func (b *snapBuilder) addSSTKey(key []byte, startTS, commitTS uint64, val []byte
 	b.kvCount++
 	return nil
 }
+
+// CFExport describes an sst file exported from a region snapshot.
+type CFExport struct {
+	CF      CFName
+	Path    string
+	KVCount int
+}
+
+type exportOptions struct {
+	targetFileSize int
+}
+
+// ExportOption configures how ExportCFs writes the sst files.
+type ExportOption func(opts *exportOptions)
+
+// TargetFileSize makes ExportCFs roll to a new set of sst files once about size bytes are written to the current
+// ones, so every file is bounded by about size bytes. The files are rolled only between two keys, all the
+// versions of a key are in the same file, and the files of a CF don't overlap with each other.
+func TargetFileSize(size int) ExportOption {
+	return func(opts *exportOptions) {
+		opts.targetFileSize = size
+	}
+}
+
+// ExportCFs writes the data of the region snapshot into one sst file per CF in dir, the CFs without any
+// key produce no file. With TargetFileSize, the data is written into multiple sst files per CF, the returned
+// files of a CF are ordered by key. The snapshot is released after exporting and can't be used anymore.
+func (rs *regionSnapshot) ExportCFs(dir string, opts ...ExportOption) ([]CFExport, error) {
+	var exportOpts exportOptions
+	for _, opt := range opts {
+		opt(&exportOpts)
+	}
+	if exportOpts.targetFileSize > 0 {
+		return rs.exportCFsRolling(dir, exportOpts.targetFileSize)
+	}
+	region := rs.regionState.Region
+	key := SnapKey{RegionID: region.Id, Term: rs.term, Index: rs.index}
+	cfFiles, err := createExportCFFiles(dir, key.String())
+	defer closeExportCFFiles(cfFiles)
+	if err != nil {
+		rs.txn.Discard()
+		return nil, err
+	}
+	builder, err := newSnapBuilder(cfFiles, rs, region)
+	if err != nil {
+		rs.txn.Discard()
+		return nil, err
+	}
+	if err = builder.build(); err != nil {
+		return nil, err
+	}
+	return finishExportCFFiles(cfFiles)
+}
+
+// exportCFsRolling exports the snapshot in chunks of about targetFileSize bytes, each chunk has its own files.
+func (rs *regionSnapshot) exportCFsRolling(dir string, targetFileSize int) ([]CFExport, error) {
+	var builder *snapBuilder
+	defer func() {
+		if builder != nil {
+			builder.close()
+		} else {
+			rs.txn.Discard()
+		}
+	}()
+	region := rs.regionState.Region
+	key := SnapKey{RegionID: region.Id, Term: rs.term, Index: rs.index}
+	startKey := RawStartKey(region)
+	var exports []CFExport
+	for chunk := 0; ; chunk++ {
+		chunkExports, nextKey, err := rs.exportChunk(&builder, dir, fmt.Sprintf("%s_%d", key, chunk), startKey,
+			targetFileSize)
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, chunkExports...)
+		if len(nextKey) == 0 {
+			return exports, nil
+		}
+	}
+}
+
+// createExportCFFiles creates the sst file of every CF named with the prefix in dir, the files created are
+// returned even if it fails, they must be closed by closeExportCFFiles.
+func createExportCFFiles(dir, prefix string) ([]*CFFile, error) {
+	cfFiles := make([]*CFFile, 0, len(snapshotCFs))
+	for _, cf := range snapshotCFs {
+		path := filepath.Join(dir, fmt.Sprintf("%s_%s%s", prefix, cf, sstFileSuffix))
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			return cfFiles, errors.WithStack(err)
+		}
+		opts := rocksdb.NewDefaultBlockBasedTableOptions(bytes.Compare)
+		cfFiles = append(cfFiles, &CFFile{CF: cf, Path: path, SstWriter: rocksdb.NewSstFileWriter(file, opts)})
+	}
+	return cfFiles, nil
+}
+
+// finishExportCFFiles finishes the sst files and returns the exports of the non-empty ones, the empty files are
+// removed.
+func finishExportCFFiles(cfFiles []*CFFile) ([]CFExport, error) {
+	exports := make([]CFExport, 0, len(cfFiles))
+	for _, cfFile := range cfFiles {
+		if cfFile.KVCount > 0 {
+			if err := cfFile.SstWriter.Finish(); err != nil {
+				return nil, err
+			}
+		}
+		err := cfFile.SstWriter.Close()
+		cfFile.SstWriter = nil
+		if err != nil {
+			return nil, errors.WithStack(err)
+		}
+		if cfFile.KVCount == 0 {
+			if _, err = util.DeleteFileIfExists(cfFile.Path); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		exports = append(exports, CFExport{CF: cfFile.CF, Path: cfFile.Path, KVCount: cfFile.KVCount})
+	}
+	return exports, nil
+}
+
+// closeExportCFFiles closes the sst files not finished by finishExportCFFiles.
+func closeExportCFFiles(cfFiles []*CFFile) {
+	for _, cfFile := range cfFiles {
+		if cfFile.SstWriter != nil {
+			_ = cfFile.SstWriter.Close()
+		}
+	}
+}
@@ -55,6 +55,18 @@ func decodeRocksDBSSTKey(k []byte) (key []byte, ts uint64, err error) {
 	return key, ts, nil
 }
 
+// decodeRocksDBSSTLockKey decodes the key of the lock CF, which has no ts suffix.
+func decodeRocksDBSSTLockKey(k []byte) ([]byte, error) {
+	if len(k) == 0 || k[0] != rocksDBSSTKeyDataPrefix {
+		return nil, errors.WithStack(errBadKeyPrefix)
+	}
+	_, key, err := codec.DecodeBytes(k[1:], nil)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return key, nil
+}
+
 func encodeRocksDBSSTKey(k []byte, ts *uint64) []byte {
 	const encGroupSize = 8
 	encodedKeySize := (len(k)/encGroupSize + 1) * (encGroupSize + 1)
@@ -0,0 +1,170 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"math"
+
+	"github.com/pingcap/badger"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/zhangjinpeng1987/raft"
+)
+
+// DeltaSnapshot contains the raft logs of a region after a base applied index, a follower which has applied
+// the logs up to the base index can catch up with it instead of a full snapshot. The snap runner negotiates it with
+// the receiver of a raft snapshot, the running follower appends it as the logs replicated by the leader.
+// ApplyDeltaSnapshot brings an offline follower up to date before the follower starts.
+type DeltaSnapshot struct {
+	RegionID  uint64
+	BaseIndex uint64
+	// BaseTerm is the term of the log at the base index.
+	BaseTerm uint64
+	Entries  []eraftpb.Entry
+}
+
+// Index returns the index the follower catches up to after applying the delta snapshot.
+func (d *DeltaSnapshot) Index() uint64 {
+	if len(d.Entries) == 0 {
+		return d.BaseIndex
+	}
+	return d.Entries[len(d.Entries)-1].Index
+}
+
+// canUseDeltaSnapshot returns whether a follower applied to baseIdx can catch up with a delta snapshot, the raft
+// logs after baseIdx must not be truncated and the number of them must not exceed maxEntries.
+func canUseDeltaSnapshot(baseIdx uint64, state applyState, maxEntries uint64) bool {
+	return maxEntries > 0 && baseIdx >= state.truncatedIndex && baseIdx <= state.appliedIndex &&
+		state.appliedIndex-baseIdx <= maxEntries
+}
+
+// BuildDeltaSnapshot builds the delta snapshot of the region from baseIdx to the applied index, baseIdx is the
+// applied index of the follower. ErrDeltaSnapshotUnavailable is returned if the follower is too far behind, the
+// caller should fall back to a full snapshot.
+func (en *Engines) BuildDeltaSnapshot(regionID, baseIdx, maxEntries uint64) (*DeltaSnapshot, error) {
+	state, err := en.loadTruncatedState(regionID)
+	if err != nil {
+		return nil, err
+	}
+	if !canUseDeltaSnapshot(baseIdx, state, maxEntries) {
+		return nil, &ErrDeltaSnapshotUnavailable{RegionID: regionID, BaseIndex: baseIdx}
+	}
+	delta := &DeltaSnapshot{RegionID: regionID, BaseIndex: baseIdx, BaseTerm: state.truncatedTerm}
+	if baseIdx > state.truncatedIndex {
+		entry, err := getRaftEntry(en.raft, regionID, baseIdx)
+		if err != nil {
+			return nil, &ErrDeltaSnapshotUnavailable{RegionID: regionID, BaseIndex: baseIdx}
+		}
+		delta.BaseTerm = entry.Term
+	}
+	if baseIdx == state.appliedIndex {
+		return delta, nil
+	}
+	entries, _, err := fetchEntriesTo(en.raft, regionID, baseIdx+1, state.appliedIndex+1, math.MaxUint64, nil)
+	if err == raft.ErrUnavailable {
+		return nil, &ErrDeltaSnapshotUnavailable{RegionID: regionID, BaseIndex: baseIdx}
+	}
+	if err != nil {
+		return nil, err
+	}
+	// The logs may be compacted concurrently and leave a gap.
+	if uint64(len(entries)) != state.appliedIndex-baseIdx {
+		return nil, &ErrDeltaSnapshotUnavailable{RegionID: regionID, BaseIndex: baseIdx}
+	}
+	delta.Entries = entries
+	return delta, nil
+}
+
+// ApplyDeltaSnapshot appends the raft logs of the delta snapshot to the region and marks them committed, the
+// conflicting logs after the base index are replaced. The logs are applied by the peer like the ones replicated
+// by the leader. The applied index of the region must be the base index of the delta snapshot, it must be called
+// when the peer of the region is not running.
+func (en *Engines) ApplyDeltaSnapshot(delta *DeltaSnapshot) error {
+	regionID := delta.RegionID
+	for i := range delta.Entries {
+		if delta.Entries[i].Index != delta.BaseIndex+uint64(i)+1 {
+			return errors.Errorf("region %d delta snapshot entry %d is not continuous", regionID, delta.Entries[i].Index)
+		}
+	}
+	applyState, err := en.loadApplyState(regionID)
+	if err != nil {
+		return err
+	}
+	if applyState.appliedIndex != delta.BaseIndex {
+		return errors.Errorf("region %d applied index %d doesn't match the delta snapshot base index %d",
+			regionID, applyState.appliedIndex, delta.BaseIndex)
+	}
+	if len(delta.Entries) == 0 {
+		return nil
+	}
+	val, err := getValue(en.raft, RaftStateKey(regionID))
+	if err == badger.ErrKeyNotFound {
+		return &ErrRegionNotFound{RegionID: regionID}
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	var state raftState
+	state.Unmarshal(val)
+
+	raftWB := new(WriteBatch)
+	for i := range delta.Entries {
+		entry := &delta.Entries[i]
+		if err = raftWB.SetMsg(y.KeyWithTs(RaftLogKey(regionID, entry.Index), RaftTS), entry); err != nil {
+			return err
+		}
+	}
+	last := delta.Entries[len(delta.Entries)-1]
+	for i := last.Index + 1; i <= state.lastIndex; i++ {
+		raftWB.Delete(y.KeyWithTs(RaftLogKey(regionID, i), RaftTS))
+	}
+	state.lastIndex = last.Index
+	if state.commit < last.Index {
+		state.commit = last.Index
+	}
+	if state.term < last.Term {
+		state.term = last.Term
+		state.vote = 0
+	}
+	raftWB.Set(y.KeyWithTs(RaftStateKey(regionID), RaftTS), state.Marshal())
+	return en.WriteRaft(raftWB)
+}
+
+// appendMessage converts the delta snapshot to an append message in place of the raft snapshot message msg, the
+// follower which has the log at the base index appends the entries and commits them.
+func (d *DeltaSnapshot) appendMessage(msg *raft_serverpb.RaftMessage) *raft_serverpb.RaftMessage {
+	entries := make([]*eraftpb.Entry, len(d.Entries))
+	for i := range d.Entries {
+		entries[i] = &d.Entries[i]
+	}
+	raftMsg := msg.GetMessage()
+	return &raft_serverpb.RaftMessage{
+		RegionId:    msg.RegionId,
+		FromPeer:    msg.FromPeer,
+		ToPeer:      msg.ToPeer,
+		RegionEpoch: msg.RegionEpoch,
+		Message: &eraftpb.Message{
+			MsgType: eraftpb.MessageType_MsgAppend,
+			From:    raftMsg.GetFrom(),
+			To:      raftMsg.GetTo(),
+			Term:    raftMsg.GetTerm(),
+			LogTerm: d.BaseTerm,
+			Index:   d.BaseIndex,
+			Entries: entries,
+			Commit:  d.Index(),
+		},
+	}
+}
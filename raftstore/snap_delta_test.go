@@ -0,0 +1,106 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"testing"
+
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/kvproto/pkg/eraftpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestRaftLogs(t *testing.T, engines *Engines, regionID, low, high, term uint64) {
+	raftWB := new(WriteBatch)
+	for i := low; i <= high; i++ {
+		entry := &eraftpb.Entry{Index: i, Term: term, Data: []byte{byte(term)}}
+		require.Nil(t, raftWB.SetMsg(y.KeyWithTs(RaftLogKey(regionID, i), RaftTS), entry))
+	}
+	require.Nil(t, engines.WriteRaft(raftWB))
+}
+
+func TestDeltaSnapshot(t *testing.T) {
+	leader := newTestEngines(t)
+	defer cleanUpTestEngineData(leader)
+	follower := newTestEngines(t)
+	defer cleanUpTestEngineData(follower)
+
+	require.Nil(t, leader.PutApplyState(1, 15, 10, 2))
+	writeTestRaftLogs(t, leader, 1, 11, 15, 3)
+
+	// The logs before the truncated index are unavailable, the followers too far behind need a full snapshot.
+	for _, c := range []struct{ base, maxEntries uint64 }{{9, 100}, {12, 2}, {12, 0}, {16, 100}} {
+		_, err := leader.BuildDeltaSnapshot(1, c.base, c.maxEntries)
+		_, ok := err.(*ErrDeltaSnapshotUnavailable)
+		require.True(t, ok, "%v", err)
+	}
+	delta, err := leader.BuildDeltaSnapshot(1, 15, 100)
+	require.Nil(t, err)
+	require.Len(t, delta.Entries, 0)
+	require.Equal(t, uint64(15), delta.Index())
+
+	delta, err = leader.BuildDeltaSnapshot(1, 12, 100)
+	require.Nil(t, err)
+	require.Equal(t, uint64(12), delta.BaseIndex)
+	require.Equal(t, uint64(3), delta.BaseTerm)
+	require.Len(t, delta.Entries, 3)
+	require.Equal(t, uint64(15), delta.Index())
+	// The base term is the truncated term if the base is the truncated index.
+	truncated, err := leader.BuildDeltaSnapshot(1, 10, 100)
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), truncated.BaseTerm)
+
+	// The delta snapshot is sent to the follower as an append message in place of the snapshot message.
+	snapMsg := &rspb.RaftMessage{
+		RegionId: 1,
+		ToPeer:   &metapb.Peer{Id: 3},
+		Message:  &eraftpb.Message{MsgType: eraftpb.MessageType_MsgSnapshot, From: 2, To: 3, Term: 4},
+	}
+	appendMsg := delta.appendMessage(snapMsg).GetMessage()
+	require.Equal(t, eraftpb.MessageType_MsgAppend, appendMsg.MsgType)
+	require.Equal(t, uint64(3), appendMsg.To)
+	require.Equal(t, uint64(4), appendMsg.Term)
+	require.Equal(t, uint64(3), appendMsg.LogTerm)
+	require.Equal(t, uint64(12), appendMsg.Index)
+	require.Equal(t, uint64(15), appendMsg.Commit)
+	require.Len(t, appendMsg.Entries, 3)
+	require.Equal(t, uint64(13), appendMsg.Entries[0].Index)
+
+	// The delta can't be applied if the follower isn't applied to the base index.
+	require.Nil(t, follower.PutApplyState(1, 13, 10, 2))
+	require.NotNil(t, follower.ApplyDeltaSnapshot(delta))
+	// The follower has applied to 12 and has stale logs which are never committed.
+	require.Nil(t, follower.PutApplyState(1, 12, 10, 2))
+	writeTestRaftLogs(t, follower, 1, 11, 12, 3)
+	writeTestRaftLogs(t, follower, 1, 13, 17, 2)
+	raftWB := new(WriteBatch)
+	raftWB.Set(y.KeyWithTs(RaftStateKey(1), RaftTS), raftState{term: 2, vote: 2, commit: 12, lastIndex: 17}.Marshal())
+	require.Nil(t, follower.WriteRaft(raftWB))
+
+	require.Nil(t, follower.ApplyDeltaSnapshot(delta))
+	val, err := getValue(follower.raft, RaftStateKey(1))
+	require.Nil(t, err)
+	var state raftState
+	state.Unmarshal(val)
+	require.Equal(t, raftState{term: 3, commit: 15, lastIndex: 15}, state)
+	for i := uint64(13); i <= 15; i++ {
+		entry, err := getRaftEntry(follower.raft, 1, i)
+		require.Nil(t, err)
+		require.Equal(t, uint64(3), entry.Term)
+	}
+	_, err = getRaftEntry(follower.raft, 1, 16)
+	require.NotNil(t, err)
+}
@@ -0,0 +1,265 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/log"
+)
+
+const (
+	snapDirPrefix        = "dir" // Name prefix for the snapshot directory.
+	snapManifestFileName = "MANIFEST"
+	snapManifestHdrSize  = 16
+)
+
+// SnapManifest describes a snapshot persisted in a directory.
+type SnapManifest struct {
+	Key    SnapKey
+	Region *metapb.Region
+	Meta   *rspb.SnapshotMeta
+}
+
+// Marshal encodes the manifest as term, index, the snapshot data and a trailing crc32 checksum.
+func (m *SnapManifest) Marshal() ([]byte, error) {
+	data := &rspb.RaftSnapshotData{
+		Region:  m.Region,
+		Version: snapshotVersion,
+		Meta:    m.Meta,
+	}
+	bin, err := data.Marshal()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	buf := make([]byte, snapManifestHdrSize, snapManifestHdrSize+len(bin)+4)
+	binary.LittleEndian.PutUint64(buf, m.Key.Term)
+	binary.LittleEndian.PutUint64(buf[8:], m.Key.Index)
+	buf = append(buf, bin...)
+	var checksum [4]byte
+	binary.LittleEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(buf))
+	return append(buf, checksum[:]...), nil
+}
+
+// Unmarshal decodes the manifest and checks its checksum.
+func (m *SnapManifest) Unmarshal(buf []byte) error {
+	if len(buf) < snapManifestHdrSize+4 {
+		return errors.Errorf("invalid snapshot manifest length %d", len(buf))
+	}
+	body, checksum := buf[:len(buf)-4], binary.LittleEndian.Uint32(buf[len(buf)-4:])
+	if actual := crc32.ChecksumIEEE(body); actual != checksum {
+		return errors.Errorf("snapshot manifest checksum mismatch, real checksum %d, expected %d", actual, checksum)
+	}
+	data := new(rspb.RaftSnapshotData)
+	if err := data.Unmarshal(body[snapManifestHdrSize:]); err != nil {
+		return errors.WithStack(err)
+	}
+	if data.Region == nil || data.Meta == nil {
+		return errors.New("snapshot manifest misses region or meta")
+	}
+	m.Key = SnapKey{
+		RegionID: data.Region.Id,
+		Term:     binary.LittleEndian.Uint64(body),
+		Index:    binary.LittleEndian.Uint64(body[8:]),
+	}
+	m.Region = data.Region
+	m.Meta = data.Meta
+	return nil
+}
+
+func (sm *SnapManager) snapDirPath(key SnapKey) string {
+	return filepath.Join(sm.base, fmt.Sprintf("%s_%s", snapDirPrefix, key))
+}
+
+// BuildSnapDir builds the snapshot of the region into a temporary directory, writes the manifest
+// and then renames the directory into place, so a half-written directory is never visible.
+// The raft snapshots generated by the region worker are built here, the snap runner sends them by LoadSnapDir.
+// The received snapshots still use the per CF files in the base directory.
+func (sm *SnapManager) BuildSnapDir(key SnapKey, dbSnap *regionSnapshot, region *metapb.Region) (*SnapManifest, error) {
+	dir := sm.snapDirPath(key)
+	if sm.GetTotalSnapSize() > sm.MaxTotalSize {
+		if err := sm.deleteOldIdleSnaps(); err != nil {
+			return nil, err
+		}
+	}
+	if manifest, _, err := sm.LoadSnapDir(key); err == nil {
+		return manifest, nil
+	} else if !os.IsNotExist(errors.Cause(err)) {
+		log.S().Warnf("[region %d] snapshot dir %s is corrupted, will rebuild: %v", region.Id, dir, err)
+		if err = sm.DeleteSnapDir(key); err != nil {
+			return nil, err
+		}
+	}
+	tmpDir := dir + tmpFileSuffix
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err := os.MkdirAll(tmpDir, 0700); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	manifest, size, err := sm.buildSnapInDir(tmpDir, key, dbSnap, region)
+	if err != nil {
+		if rmErr := os.RemoveAll(tmpDir); rmErr != nil {
+			log.S().Warnf("failed to remove %s: %v", tmpDir, rmErr)
+		}
+		return nil, err
+	}
+	if err = os.Rename(tmpDir, dir); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err = syncDir(sm.base); err != nil {
+		return nil, err
+	}
+	atomic.AddInt64(sm.snapSize, int64(size))
+	return manifest, nil
+}
+
+func (sm *SnapManager) buildSnapInDir(dir string, key SnapKey, dbSnap *regionSnapshot, region *metapb.Region) (*SnapManifest, uint64, error) {
+	// The size is tracked locally and only added to the manager after the directory is renamed.
+	snap, err := NewSnapForBuilding(dir, key, new(int64), sm, sm.limiter)
+	if err != nil {
+		return nil, 0, err
+	}
+	snapData := &rspb.RaftSnapshotData{Region: region}
+	if err = snap.Build(dbSnap, region, snapData, new(SnapStatistics), sm); err != nil {
+		return nil, 0, err
+	}
+	manifest := &SnapManifest{Key: key, Region: region, Meta: snapData.Meta}
+	bin, err := manifest.Marshal()
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, snapManifestFileName), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	_, err = f.Write(bin)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, 0, errors.WithStack(err)
+	}
+	if err = syncDir(dir); err != nil {
+		return nil, 0, err
+	}
+	return manifest, snap.TotalSize(), nil
+}
+
+// dirSnap is a snapshot loaded from a snapshot directory, deleting it removes the whole directory.
+type dirSnap struct {
+	*Snap
+	sm *SnapManager
+}
+
+// Delete implements the Snapshot Delete method.
+func (s *dirSnap) Delete() {
+	if err := s.sm.DeleteSnapDir(s.key); err != nil {
+		log.S().Errorf("failed to delete snapshot dir of %s: %v", s.key, err)
+	}
+}
+
+// LoadSnapDir loads the snapshot directory built by BuildSnapDir. The manifest and all the CF files
+// are validated before the snapshot is returned.
+func (sm *SnapManager) LoadSnapDir(key SnapKey) (*SnapManifest, Snapshot, error) {
+	dir := sm.snapDirPath(key)
+	buf, err := ioutil.ReadFile(filepath.Join(dir, snapManifestFileName))
+	if err != nil {
+		return nil, nil, errors.WithStack(err)
+	}
+	manifest := new(SnapManifest)
+	if err = manifest.Unmarshal(buf); err != nil {
+		return nil, nil, err
+	}
+	if manifest.Key != key {
+		return nil, nil, errors.Errorf("snapshot manifest key %s mismatch, expected %s", manifest.Key, key)
+	}
+	if manifest.Region.RegionEpoch == nil {
+		return nil, nil, errors.Errorf("snapshot manifest of %s misses region epoch", key)
+	}
+	snap, err := NewSnapForSending(dir, key, new(int64), sm)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !snap.Exists() {
+		return nil, nil, errors.Errorf("snapshot of %s not exists in %s", key, dir)
+	}
+	if err = snap.setSnapshotMeta(manifest.Meta); err != nil {
+		return nil, nil, err
+	}
+	for _, cfFile := range snap.CFFiles {
+		if cfFile.Size == 0 {
+			continue
+		}
+		if err = checkFileSizeAndChecksum(cfFile.Path, cfFile.Size, cfFile.Checksum); err != nil {
+			return nil, nil, err
+		}
+	}
+	return manifest, &dirSnap{Snap: snap, sm: sm}, nil
+}
+
+// DeleteSnapDir deletes the snapshot directory of the key.
+func (sm *SnapManager) DeleteSnapDir(key SnapKey) error {
+	dir := sm.snapDirPath(key)
+	size, err := getDirSize(dir)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return nil
+		}
+		return err
+	}
+	if err = os.RemoveAll(dir); err != nil {
+		return errors.WithStack(err)
+	}
+	atomic.AddInt64(sm.snapSize, -int64(size))
+	return nil
+}
+
+func getDirSize(dir string) (uint64, error) {
+	fis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return 0, errors.WithStack(err)
+	}
+	var size uint64
+	for _, fi := range fis {
+		if !fi.IsDir() && filepath.Ext(fi.Name()) == sstFileSuffix {
+			size += uint64(fi.Size())
+		}
+	}
+	return size, nil
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	err = f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return errors.WithStack(err)
+}
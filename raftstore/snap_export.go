@@ -0,0 +1,231 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/ngaut/unistore/util"
+	"github.com/pingcap/errors"
+	"github.com/pingcap/log"
+	"github.com/pingcap/tidb/util/codec"
+	"go.uber.org/zap"
+)
+
+// exportManifestFileName is the file recording the progress of ExportCFsResumable in the export dir.
+const exportManifestFileName = "EXPORT_MANIFEST"
+
+// exportManifest records the progress of a resumable export. The term, the index and the epoch identify the
+// snapshot, the progress is only resumed by a snapshot of the same view.
+type exportManifest struct {
+	regionID uint64
+	term     uint64
+	index    uint64
+	confVer  uint64
+	version  uint64
+	// chunks is the number of the exported chunks, the files of a chunk are named by its sequence number.
+	chunks uint64
+	done   bool
+	// nextKey is the key the next chunk starts from.
+	nextKey []byte
+	exports []CFExport
+}
+
+func newExportManifest(rs *regionSnapshot) *exportManifest {
+	region := rs.regionState.Region
+	return &exportManifest{
+		regionID: region.Id,
+		term:     rs.term,
+		index:    rs.index,
+		confVer:  region.GetRegionEpoch().GetConfVer(),
+		version:  region.GetRegionEpoch().GetVersion(),
+	}
+}
+
+// matches returns whether the manifest is generated from a snapshot of the same view as rs.
+func (m *exportManifest) matches(rs *regionSnapshot) bool {
+	other := newExportManifest(rs)
+	return m.regionID == other.regionID && m.term == other.term && m.index == other.index &&
+		m.confVer == other.confVer && m.version == other.version
+}
+
+func (m *exportManifest) marshal() []byte {
+	var buf []byte
+	for _, v := range []uint64{m.regionID, m.term, m.index, m.confVer, m.version, m.chunks} {
+		buf = codec.EncodeUvarint(buf, v)
+	}
+	if m.done {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	buf = codec.EncodeCompactBytes(buf, m.nextKey)
+	buf = codec.EncodeUvarint(buf, uint64(len(m.exports)))
+	for _, export := range m.exports {
+		buf = codec.EncodeCompactBytes(buf, []byte(export.CF))
+		// Only the file name is recorded, the export dir may be moved.
+		buf = codec.EncodeCompactBytes(buf, []byte(filepath.Base(export.Path)))
+		buf = codec.EncodeUvarint(buf, uint64(export.KVCount))
+	}
+	return buf
+}
+
+func (m *exportManifest) unmarshal(data []byte, dir string) (err error) {
+	for _, v := range []*uint64{&m.regionID, &m.term, &m.index, &m.confVer, &m.version, &m.chunks} {
+		if data, *v, err = codec.DecodeUvarint(data); err != nil {
+			return err
+		}
+	}
+	if len(data) == 0 {
+		return errors.New("invalid export manifest")
+	}
+	m.done = data[0] == 1
+	if data, m.nextKey, err = codec.DecodeCompactBytes(data[1:]); err != nil {
+		return err
+	}
+	var numExports uint64
+	if data, numExports, err = codec.DecodeUvarint(data); err != nil {
+		return err
+	}
+	m.exports = make([]CFExport, 0, numExports)
+	for i := uint64(0); i < numExports; i++ {
+		var cf, name []byte
+		var kvCount uint64
+		if data, cf, err = codec.DecodeCompactBytes(data); err != nil {
+			return err
+		}
+		if data, name, err = codec.DecodeCompactBytes(data); err != nil {
+			return err
+		}
+		if data, kvCount, err = codec.DecodeUvarint(data); err != nil {
+			return err
+		}
+		m.exports = append(m.exports, CFExport{CF: string(cf), Path: filepath.Join(dir, string(name)), KVCount: int(kvCount)})
+	}
+	return nil
+}
+
+// loadExportManifest loads the manifest in dir, nil is returned if there is no manifest.
+func loadExportManifest(dir string) (*exportManifest, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, exportManifestFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	m := new(exportManifest)
+	if err = m.unmarshal(data, dir); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *exportManifest) save(dir string) error {
+	path := filepath.Join(dir, exportManifestFileName)
+	if err := ioutil.WriteFile(path+tmpFileSuffix, m.marshal(), 0600); err != nil {
+		return errors.WithStack(err)
+	}
+	if err := os.Rename(path+tmpFileSuffix, path); err != nil {
+		return errors.WithStack(err)
+	}
+	return syncDir(dir)
+}
+
+// ExportCFsResumable writes the data of the region snapshot into dir like ExportCFs, but in chunks of about
+// chunkSize bytes, every chunk has one sst file per CF. The progress is recorded in a manifest in dir after
+// every chunk, so if the export fails, the retry with a snapshot of the same term, index and epoch continues
+// from the last completed chunk. The snapshot of the same term and index has the same data, because the data
+// only changes by applying raft logs. If the snapshot doesn't match the manifest, the exported files are removed
+// and it starts over. The snapshot is released after exporting and can't be used anymore.
+func (rs *regionSnapshot) ExportCFsResumable(dir string, chunkSize int) ([]CFExport, error) {
+	var builder *snapBuilder
+	defer func() {
+		if builder != nil {
+			builder.close()
+		} else {
+			rs.txn.Discard()
+		}
+	}()
+	region := rs.regionState.Region
+	m, err := loadExportManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	if m != nil && !m.matches(rs) {
+		log.Info("snapshot changed, restart exporting", zap.Uint64("region id", region.Id),
+			zap.Uint64("term", rs.term), zap.Uint64("index", rs.index), zap.Uint64("exported index", m.index))
+		for _, export := range m.exports {
+			if _, err = util.DeleteFileIfExists(export.Path); err != nil {
+				return nil, err
+			}
+		}
+		m = nil
+	}
+	if m == nil {
+		m = newExportManifest(rs)
+	} else if m.done {
+		return m.exports, nil
+	} else {
+		log.Info("resume exporting snapshot", zap.Uint64("region id", region.Id),
+			zap.Uint64("chunks", m.chunks), zap.Binary("next key", m.nextKey))
+	}
+	startKey := RawStartKey(region)
+	if len(m.nextKey) > 0 {
+		startKey = m.nextKey
+	}
+	key := SnapKey{RegionID: region.Id, Term: rs.term, Index: rs.index}
+	for !m.done {
+		exports, nextKey, err := rs.exportChunk(&builder, dir, fmt.Sprintf("%s_%d", key, m.chunks), startKey, chunkSize)
+		if err != nil {
+			return nil, err
+		}
+		m.exports = append(m.exports, exports...)
+		m.chunks++
+		m.nextKey = nextKey
+		m.done = len(nextKey) == 0
+		if err = m.save(dir); err != nil {
+			return nil, err
+		}
+	}
+	return m.exports, nil
+}
+
+// exportChunk exports a chunk into the files named with the prefix, the builder is created from startKey at the
+// first chunk and reused by the following ones.
+func (rs *regionSnapshot) exportChunk(builder **snapBuilder, dir, prefix string, startKey []byte,
+	chunkSize int) ([]CFExport, []byte, error) {
+	cfFiles, err := createExportCFFiles(dir, prefix)
+	defer closeExportCFFiles(cfFiles)
+	if err != nil {
+		return nil, nil, err
+	}
+	if *builder == nil {
+		*builder, err = newSnapRangeBuilder(cfFiles, rs, startKey, RawEndKey(rs.regionState.Region))
+	} else {
+		err = (*builder).setCFFiles(cfFiles)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	nextKey, err := (*builder).buildChunk(chunkSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	exports, err := finishExportCFFiles(cfFiles)
+	return exports, nextKey, err
+}
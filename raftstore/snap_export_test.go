@@ -0,0 +1,159 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ngaut/unistore/rocksdb"
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/tidb/store/mockstore/unistore/lockstore"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestExportSnapshot(engines *Engines, index uint64) *regionSnapshot {
+	return &regionSnapshot{
+		regionState: &raft_serverpb.RegionLocalState{Region: genTestRegion(1, 1, 1)},
+		txn:         engines.kv.DB.NewTransaction(false),
+		lockSnap:    lockstore.NewMemStore(4096),
+		term:        5,
+		index:       index,
+	}
+}
+
+func countExportedKeys(t *testing.T, exports []CFExport) int {
+	var count int
+	for _, export := range exports {
+		require.Equal(t, CFWrite, export.CF)
+		f, err := os.Open(export.Path)
+		require.Nil(t, err)
+		it, err := rocksdb.NewSstFileIterator(f)
+		require.Nil(t, err)
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			count++
+		}
+		require.Nil(t, it.Err())
+		require.Nil(t, f.Close())
+	}
+	return count
+}
+
+func TestExportCFsResumable(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	dir, err := ioutil.TempDir("", "unistore-export")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	numKeys := 200
+	wb := new(WriteBatch)
+	for i := 0; i < numKeys; i++ {
+		wb.Set(y.KeyWithTs([]byte(fmt.Sprintf("tb%03d", i)), 10), make([]byte, 32))
+	}
+	require.Nil(t, engines.WriteKV(wb))
+
+	// Fail the third chunk by occupying the path of its write CF file.
+	key := SnapKey{RegionID: 1, Term: 5, Index: 6}
+	blocker := filepath.Join(dir, fmt.Sprintf("%s_%d_%s%s", key, 2, CFWrite, sstFileSuffix))
+	require.Nil(t, os.Mkdir(blocker, 0700))
+	_, err = newTestExportSnapshot(engines, 6).ExportCFsResumable(dir, 1024)
+	require.NotNil(t, err)
+	m, err := loadExportManifest(dir)
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), m.chunks)
+	require.False(t, m.done)
+	exported := countExportedKeys(t, m.exports)
+	require.True(t, exported > 0 && exported < numKeys)
+	require.Nil(t, os.Remove(blocker))
+
+	exports, err := newTestExportSnapshot(engines, 6).ExportCFsResumable(dir, 1024)
+	require.Nil(t, err)
+	require.Equal(t, m.exports, exports[:len(m.exports)])
+	require.Equal(t, numKeys, countExportedKeys(t, exports))
+	m, err = loadExportManifest(dir)
+	require.Nil(t, err)
+	require.True(t, m.done)
+	require.True(t, m.chunks > 3)
+
+	// A finished export is returned directly.
+	again, err := newTestExportSnapshot(engines, 6).ExportCFsResumable(dir, 1024)
+	require.Nil(t, err)
+	require.Equal(t, exports, again)
+
+	// A snapshot of another index starts over.
+	exports, err = newTestExportSnapshot(engines, 7).ExportCFsResumable(dir, 0)
+	require.Nil(t, err)
+	require.Len(t, exports, 1)
+	require.Equal(t, numKeys, exports[0].KVCount)
+	for _, export := range again {
+		_, err = os.Stat(export.Path)
+		require.True(t, os.IsNotExist(err))
+	}
+}
+
+func TestExportCFsTargetFileSize(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+	dir, err := ioutil.TempDir("", "unistore-export")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	// Every key has two versions, the long values are written to the default CF.
+	numKeys := 200
+	for _, version := range []uint64{10, 20} {
+		wb := new(WriteBatch)
+		for i := 0; i < numKeys; i++ {
+			wb.Set(y.KeyWithTs([]byte(fmt.Sprintf("tb%03d", i)), version), make([]byte, shortValueMaxLen+1))
+		}
+		require.Nil(t, engines.WriteKV(wb))
+	}
+
+	exports, err := newTestExportSnapshot(engines, 6).ExportCFs(dir, TargetFileSize(4096))
+	require.Nil(t, err)
+	files := make(map[CFName][]CFExport)
+	for _, export := range exports {
+		files[export.CF] = append(files[export.CF], export)
+	}
+	require.Len(t, files[CFLock], 0)
+	for _, cf := range []CFName{CFDefault, CFWrite} {
+		require.True(t, len(files[cf]) > 1)
+		var count int
+		var lastKey []byte
+		for _, export := range files[cf] {
+			f, err := os.Open(export.Path)
+			require.Nil(t, err)
+			it, err := rocksdb.NewSstFileIterator(f)
+			require.Nil(t, err)
+			it.SeekToFirst()
+			require.True(t, it.Valid())
+			// The versions of a key are not split into two files.
+			firstKey, _, err := decodeRocksDBSSTKey(it.Key().UserKey)
+			require.Nil(t, err)
+			require.True(t, string(firstKey) > string(lastKey), "%s overlaps with the previous file", export.Path)
+			for ; it.Valid(); it.Next() {
+				lastKey, _, err = decodeRocksDBSSTKey(it.Key().UserKey)
+				require.Nil(t, err)
+				count++
+			}
+			require.Nil(t, it.Err())
+			require.Nil(t, f.Close())
+		}
+		require.Equal(t, 2*numKeys, count)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"bytes"
+
+	"github.com/pingcap/badger"
+	"github.com/pingcap/tidb/store/mockstore/unistore/lockstore"
+	"github.com/pingcap/tidb/store/mockstore/unistore/tikv/dbreader"
+)
+
+// SnapshotIterator iterates the committed data and the locks in the region of a regionSnapshot ordered by key.
+// The committed data is the latest version of each key, the deleted keys are skipped. If a key has both a lock
+// and committed data, the lock comes first.
+type SnapshotIterator struct {
+	dataIter *badger.Iterator
+	lockIter *lockstore.Iterator
+	startKey []byte
+	endKey   []byte
+	isLock   bool
+}
+
+// NewIterator creates a SnapshotIterator over the snapshot, the locks are read from the lock store snapshot
+// captured with the regionSnapshot. It must be closed before the snapshot is released.
+func (rs *regionSnapshot) NewIterator() *SnapshotIterator {
+	region := rs.regionState.Region
+	startKey, endKey := RawStartKey(region), RawEndKey(region)
+	return &SnapshotIterator{
+		dataIter: dbreader.NewIterator(rs.txn, false, startKey, endKey),
+		lockIter: rs.lockSnap.NewIterator(),
+		startKey: startKey,
+		endKey:   endKey,
+	}
+}
+
+// Rewind moves the SnapshotIterator to the first key of the region.
+func (it *SnapshotIterator) Rewind() {
+	it.dataIter.Seek(it.startKey)
+	it.lockIter.Seek(it.startKey)
+	it.pick()
+}
+
+// Next moves the SnapshotIterator to the next entry.
+func (it *SnapshotIterator) Next() {
+	if it.isLock {
+		it.lockIter.Next()
+	} else {
+		it.dataIter.Next()
+	}
+	it.pick()
+}
+
+func (it *SnapshotIterator) pick() {
+	for it.dataValid() && it.dataIter.Item().IsEmpty() {
+		it.dataIter.Next()
+	}
+	switch {
+	case !it.lockValid():
+		it.isLock = false
+	case !it.dataValid():
+		it.isLock = true
+	default:
+		it.isLock = bytes.Compare(it.lockIter.Key(), it.dataIter.Item().Key()) <= 0
+	}
+}
+
+func (it *SnapshotIterator) dataValid() bool {
+	return it.dataIter.Valid() && !exceedEndKey(it.dataIter.Item().Key(), it.endKey)
+}
+
+func (it *SnapshotIterator) lockValid() bool {
+	return it.lockIter.Valid() && !exceedEndKey(it.lockIter.Key(), it.endKey)
+}
+
+// Valid returns whether the SnapshotIterator is positioned at an entry in the region.
+func (it *SnapshotIterator) Valid() bool {
+	return it.dataValid() || it.lockValid()
+}
+
+// IsLock returns whether the current entry is a lock, otherwise it's committed data.
+func (it *SnapshotIterator) IsLock() bool {
+	return it.isLock
+}
+
+// Key returns the key of the current entry, it's only valid until the SnapshotIterator moves.
+func (it *SnapshotIterator) Key() []byte {
+	if it.isLock {
+		return it.lockIter.Key()
+	}
+	return it.dataIter.Item().Key()
+}
+
+// Value returns the value of the current entry, it's the encoded lock for a lock entry. The value is only valid
+// until the SnapshotIterator moves.
+func (it *SnapshotIterator) Value() ([]byte, error) {
+	if it.isLock {
+		return it.lockIter.Value(), nil
+	}
+	return it.dataIter.Item().Value()
+}
+
+// CommitTS returns the commit ts of the committed data, 0 is returned for a lock entry.
+func (it *SnapshotIterator) CommitTS() uint64 {
+	if it.isLock {
+		return 0
+	}
+	return it.dataIter.Item().Version()
+}
+
+// Close releases the data iterator, the snapshot is not released.
+func (it *SnapshotIterator) Close() {
+	it.dataIter.Close()
+}
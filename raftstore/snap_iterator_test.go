@@ -0,0 +1,70 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package raftstore
+
+import (
+	"testing"
+
+	"github.com/pingcap/badger/y"
+	"github.com/pingcap/kvproto/pkg/raft_serverpb"
+	"github.com/pingcap/tidb/store/mockstore/unistore/lockstore"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotIterator(t *testing.T) {
+	engines := newTestEngines(t)
+	defer cleanUpTestEngineData(engines)
+
+	wb := new(WriteBatch)
+	wb.Set(y.KeyWithTs([]byte("tb"), 10), []byte("b10"))
+	wb.Set(y.KeyWithTs([]byte("tb"), 20), []byte("b20"))
+	wb.Set(y.KeyWithTs([]byte("tc"), 10), []byte("c10"))
+	wb.Delete(y.KeyWithTs([]byte("tc"), 20))
+	wb.Set(y.KeyWithTs([]byte("td"), 10), []byte("d10"))
+	wb.Set(y.KeyWithTs([]byte("u"), 10), []byte("u10"))
+	require.Nil(t, engines.WriteKV(wb))
+
+	lockSnap := lockstore.NewMemStore(4096)
+	lockSnap.Put([]byte("ta"), []byte("lock-a"))
+	lockSnap.Put([]byte("td"), []byte("lock-d"))
+	lockSnap.Put([]byte("u"), []byte("lock-u"))
+	snap := &regionSnapshot{
+		regionState: &raft_serverpb.RegionLocalState{Region: genTestRegion(1, 1, 1)},
+		txn:         engines.kv.DB.NewTransaction(false),
+		lockSnap:    lockSnap,
+	}
+	defer snap.txn.Discard()
+
+	type entry struct {
+		key, val string
+		isLock   bool
+	}
+	var entries []entry
+	it := snap.NewIterator()
+	for it.Rewind(); it.Valid(); it.Next() {
+		val, err := it.Value()
+		require.Nil(t, err)
+		entries = append(entries, entry{string(it.Key()), string(val), it.IsLock()})
+		if it.IsLock() {
+			require.Equal(t, uint64(0), it.CommitTS())
+		}
+	}
+	it.Close()
+	require.Equal(t, []entry{
+		{"ta", "lock-a", true},
+		{"tb", "b20", false},
+		{"td", "lock-d", true},
+		{"td", "d10", false},
+	}, entries)
+}
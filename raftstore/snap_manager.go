@@ -25,6 +25,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/ngaut/unistore/util"
 	"github.com/pingcap/errors"
 	rspb "github.com/pingcap/kvproto/pkg/raft_serverpb"
 	"github.com/pingcap/log"
@@ -103,7 +104,25 @@ func (sm *SnapManager) init() error {
 		return errors.WithStack(err)
 	}
 	for _, fi := range fis {
-		if !fi.IsDir() {
+		if fi.IsDir() {
+			name := fi.Name()
+			if !strings.HasPrefix(name, snapDirPrefix) {
+				continue
+			}
+			// A snapshot directory with tmp suffix was not completely written, never use it.
+			if strings.HasSuffix(name, tmpFileSuffix) {
+				err = os.RemoveAll(filepath.Join(sm.base, name))
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				continue
+			}
+			size, err := getDirSize(filepath.Join(sm.base, name))
+			if err != nil {
+				return err
+			}
+			atomic.AddInt64(sm.snapSize, int64(size))
+		} else {
 			name := fi.Name()
 			if strings.HasSuffix(name, tmpFileSuffix) {
 				err = os.Remove(filepath.Join(sm.base, name))
@@ -126,17 +145,22 @@ func (sm *SnapManager) ListIdleSnap() ([]SnapKeyWithSending, error) {
 	}
 	results := make([]SnapKeyWithSending, 0, len(fis))
 	for _, fi := range fis {
-		if fi.IsDir() {
-			continue
-		}
 		name := fi.Name()
-		if !strings.HasSuffix(name, metaFileSuffix) {
-			continue
-		}
-		name = name[:len(name)-len(metaFileSuffix)]
 		var key SnapKeyWithSending
-		if strings.HasPrefix(name, snapGenPrefix) {
+		if fi.IsDir() {
+			// The snapshot directories are built for sending.
+			if !strings.HasPrefix(name, snapDirPrefix) || strings.HasSuffix(name, tmpFileSuffix) {
+				continue
+			}
 			key.IsSending = true
+		} else {
+			if !strings.HasSuffix(name, metaFileSuffix) {
+				continue
+			}
+			name = name[:len(name)-len(metaFileSuffix)]
+			if strings.HasPrefix(name, snapGenPrefix) {
+				key.IsSending = true
+			}
 		}
 		numberStrs := strings.Split(name, "_")
 		if len(numberStrs) != 4 {
@@ -243,8 +267,13 @@ func (sm *SnapManager) deleteOldIdleSnaps() error {
 	return nil
 }
 
-// GetSnapshotForSending gets the snapshot for sending with the given snapshot key.
+// GetSnapshotForSending gets the snapshot for sending with the given snapshot key, the snapshot directory is
+// preferred if it exists.
 func (sm *SnapManager) GetSnapshotForSending(snapKey SnapKey) (Snapshot, error) {
+	if util.DirExists(sm.snapDirPath(snapKey)) {
+		_, snap, err := sm.LoadSnapDir(snapKey)
+		return snap, err
+	}
 	return NewSnapForSending(sm.base, snapKey, sm.snapSize, sm)
 }
 
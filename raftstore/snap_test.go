@@ -14,11 +14,14 @@
 package raftstore
 
 import (
+	"bytes"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"testing"
 
+	"github.com/ngaut/unistore/config"
+	"github.com/ngaut/unistore/util"
 	"github.com/pingcap/badger"
 	"github.com/pingcap/badger/y"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
@@ -157,6 +160,212 @@ func TestSnapDisplayPath(t *testing.T) {
 	assert.NotEqual(t, displayPath, "")
 }
 
+func TestSnapManifest(t *testing.T) {
+	manifest := &SnapManifest{
+		Key:    SnapKey{RegionID: 1, Term: 2, Index: 3},
+		Region: genTestRegion(1, 1, 1),
+		Meta:   &rspb.SnapshotMeta{CfFiles: []*rspb.SnapshotCFFile{{Cf: CFDefault, Size_: 10, Checksum: 20}}},
+	}
+	bin, err := manifest.Marshal()
+	require.Nil(t, err)
+	decoded := new(SnapManifest)
+	require.Nil(t, decoded.Unmarshal(bin))
+	assert.Equal(t, manifest.Key, decoded.Key)
+	assert.Equal(t, manifest.Region.RegionEpoch, decoded.Region.RegionEpoch)
+	assert.Equal(t, manifest.Meta.CfFiles[0].Checksum, decoded.Meta.CfFiles[0].Checksum)
+
+	bin[0]++
+	assert.NotNil(t, decoded.Unmarshal(bin))
+	assert.NotNil(t, decoded.Unmarshal(bin[:8]))
+}
+
+func TestSnapMgrRemoveTmpDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	mgr := NewSnapManager(dir, nil)
+	tmpDir := mgr.snapDirPath(SnapKey{1, 1, 1}) + tmpFileSuffix
+	require.Nil(t, os.MkdirAll(tmpDir, 0700))
+	require.Nil(t, mgr.init())
+	assert.False(t, util.DirExists(tmpDir))
+	_, _, err = mgr.LoadSnapDir(SnapKey{1, 1, 1})
+	assert.NotNil(t, err)
+}
+
+func TestSnapDirRoundTrip(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(srcDir)
+	source := newEnginesWithKVDb(t, openDBBundle(t, srcDir))
+	defer os.RemoveAll(source.raftPath)
+	require.Nil(t, source.kv.DB.Update(func(txn *badger.Txn) error {
+		return txn.SetEntry(&badger.Entry{
+			Key:      y.KeyWithTs([]byte("tb"), 10),
+			Value:    []byte("b"),
+			UserMeta: mvcc.NewDBUserMeta(9, 10),
+		})
+	}))
+	snap := newTestExportSnapshot(source, 6)
+	defer snap.txn.Discard()
+
+	snapDir, err := ioutil.TempDir("", "snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(snapDir)
+	mgr := NewSnapManager(snapDir, nil)
+	require.Nil(t, mgr.init())
+	key := SnapKey{RegionID: 1, Term: snap.term, Index: snap.index}
+	manifest, err := mgr.BuildSnapDir(key, snap, snap.regionState.Region)
+	require.Nil(t, err)
+	require.True(t, util.DirExists(mgr.snapDirPath(key)))
+	size := mgr.GetTotalSnapSize()
+	require.NotZero(t, size)
+
+	// Building again reuses the directory.
+	rebuilt, err := mgr.BuildSnapDir(key, snap, snap.regionState.Region)
+	require.Nil(t, err)
+	require.Equal(t, manifest.Meta, rebuilt.Meta)
+	require.Equal(t, size, mgr.GetTotalSnapSize())
+
+	loaded, sending, err := mgr.LoadSnapDir(key)
+	require.Nil(t, err)
+	require.Equal(t, key, loaded.Key)
+	require.Equal(t, snap.regionState.Region.RegionEpoch, loaded.Region.RegionEpoch)
+	require.Equal(t, manifest.Meta, loaded.Meta)
+	require.Equal(t, size, sending.TotalSize())
+	idleSnaps, err := mgr.ListIdleSnap()
+	require.Nil(t, err)
+	require.Equal(t, []SnapKeyWithSending{{SnapKey: key, IsSending: true}}, idleSnaps)
+
+	// The snapshot loaded from the directory is received as the per CF files.
+	data, err := (&rspb.RaftSnapshotData{Region: loaded.Region, Meta: loaded.Meta}).Marshal()
+	require.Nil(t, err)
+	receiving, err := mgr.GetSnapshotForReceiving(key, data)
+	require.Nil(t, err)
+	require.Nil(t, copySnapshot(receiving, sending))
+	require.Equal(t, size*2, mgr.GetTotalSnapSize())
+
+	// Deleting the sending snapshot removes the whole directory.
+	gen, err := mgr.GetSnapshotForSending(key)
+	require.Nil(t, err)
+	require.True(t, mgr.DeleteSnapshot(key, gen, false))
+	require.False(t, util.DirExists(mgr.snapDirPath(key)))
+	require.Equal(t, size, mgr.GetTotalSnapSize())
+	_, _, err = mgr.LoadSnapDir(key)
+	require.NotNil(t, err)
+	require.Nil(t, mgr.DeleteSnapDir(key))
+	idleSnaps, err = mgr.ListIdleSnap()
+	require.Nil(t, err)
+	require.Equal(t, []SnapKeyWithSending{{SnapKey: key}}, idleSnaps)
+}
+
+func TestSnapBuildApplyInterleavedLocks(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(srcDir)
+	source := newEnginesWithKVDb(t, openDBBundle(t, srcDir))
+	defer os.RemoveAll(source.raftPath)
+
+	// The long values are written to the default CF, a lock and the committed versions of the same key have their
+	// default CF entries at different ts, so the lock must be added first.
+	longVal := bytes.Repeat([]byte("v"), shortValueMaxLen+1)
+	type data struct {
+		key               string
+		val               []byte
+		startTS, commitTS uint64
+	}
+	datas := []data{
+		{"tb", longVal, 9, 10},
+		{"td", []byte("d"), 11, 12},
+		{"te", []byte("e"), 13, 14},
+	}
+	require.Nil(t, source.kv.DB.Update(func(txn *badger.Txn) error {
+		for _, d := range datas {
+			require.Nil(t, txn.SetEntry(&badger.Entry{
+				Key:      y.KeyWithTs([]byte(d.key), d.commitTS),
+				Value:    d.val,
+				UserMeta: mvcc.NewDBUserMeta(d.startTS, d.commitTS),
+			}))
+		}
+		return nil
+	}))
+	locks := map[string]*mvcc.Lock{}
+	for key, val := range map[string][]byte{"tb": longVal, "tc": []byte("c"), "te": longVal} {
+		locks[key] = &mvcc.Lock{
+			LockHdr: mvcc.LockHdr{StartTS: 20, TTL: 3000, Op: uint8(kvrpcpb.Op_Put), PrimaryLen: 2},
+			Primary: []byte("tb"),
+			Value:   val,
+		}
+	}
+	snap := newTestExportSnapshot(source, 6)
+	defer snap.txn.Discard()
+	for key, lock := range locks {
+		snap.lockSnap.Put([]byte(key), lock.MarshalBinary())
+	}
+
+	// Build the snapshot, the lock CF is written to a plain file.
+	snapDir, err := ioutil.TempDir("", "snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(snapDir)
+	mgr := NewSnapManager(snapDir, nil)
+	key := SnapKey{RegionID: 1, Term: snap.term, Index: snap.index}
+	snapshot, err := createAndInitSnapshot(snap, key, mgr)
+	require.Nil(t, err)
+	sending, err := mgr.GetSnapshotForSending(key)
+	require.Nil(t, err)
+	receiving, err := mgr.GetSnapshotForReceiving(key, snapshot.Data)
+	require.Nil(t, err)
+	require.Nil(t, copySnapshot(receiving, sending))
+
+	dstDir, err := ioutil.TempDir("", "snapshot")
+	require.Nil(t, err)
+	defer os.RemoveAll(dstDir)
+	target := openDBBundle(t, dstDir)
+	applying, err := mgr.GetSnapshotForApplying(key)
+	require.Nil(t, err)
+	sstFile, err := ioutil.TempFile(dstDir, "ingest_*.sst")
+	require.Nil(t, err)
+	builder := target.DB.NewExternalTableBuilder(sstFile, config.ParseCompression(""), nil)
+	builder.SetIsManaged()
+	status := JobStatusRunning
+	wb := new(WriteBatch)
+	result, err := applying.Apply(ApplyOptions{
+		DBBundle: target,
+		Region:   snap.regionState.Region,
+		Abort:    &status,
+		Builder:  builder,
+		WB:       wb,
+	})
+	require.Nil(t, err)
+	require.True(t, result.HasPut)
+	_, err = builder.Finish()
+	require.Nil(t, err)
+	_, err = target.DB.IngestExternalFiles([]badger.ExternalTableSpec{{Filename: sstFile.Name()}})
+	require.Nil(t, err)
+
+	require.Nil(t, target.DB.View(func(txn *badger.Txn) error {
+		for _, d := range datas {
+			item, err := txn.Get([]byte(d.key))
+			require.Nil(t, err, d.key)
+			val, err := item.Value()
+			require.Nil(t, err)
+			require.Equal(t, d.val, val, d.key)
+			meta := mvcc.DBUserMeta(item.UserMeta())
+			require.Equal(t, d.startTS, meta.StartTS(), d.key)
+			require.Equal(t, d.commitTS, meta.CommitTS(), d.key)
+		}
+		_, err := txn.Get([]byte("tc"))
+		require.Equal(t, badger.ErrKeyNotFound, err)
+		return nil
+	}))
+	require.Equal(t, len(locks), target.LockStore.Len())
+	for key, expected := range locks {
+		lock := mvcc.DecodeLock(target.LockStore.Get([]byte(key), nil))
+		require.Equal(t, expected.StartTS, lock.StartTS, key)
+		require.Equal(t, expected.Primary, lock.Primary, key)
+		require.Equal(t, expected.Value, lock.Value, key)
+	}
+}
+
 /* TODO reopen these tests when incompatibilities solved
 func TestSnapFile(t *testing.T) {
 	doTestSnapFile(t, true)
@@ -42,6 +42,24 @@ func (s applyState) String() string {
 	return fmt.Sprintf("{appliedIndex:%d, truncatedIndex:%d, truncatedTerm:%d}", s.appliedIndex, s.truncatedIndex, s.truncatedTerm)
 }
 
+// raftTruncatedState is the truncated state written in the raft engine by TruncateRaftLog.
+type raftTruncatedState struct {
+	index uint64
+	term  uint64
+}
+
+func (s raftTruncatedState) Marshal() []byte {
+	bin := make([]byte, 16)
+	binary.LittleEndian.PutUint64(bin, s.index)
+	binary.LittleEndian.PutUint64(bin[8:], s.term)
+	return bin
+}
+
+func (s *raftTruncatedState) Unmarshal(data []byte) {
+	s.index = binary.LittleEndian.Uint64(data)
+	s.term = binary.LittleEndian.Uint64(data[8:])
+}
+
 type raftState struct {
 	term      uint64
 	vote      uint64
@@ -26,11 +26,19 @@ import (
 )
 
 func newTestEngines(t *testing.T) *Engines {
+	kvPath, err := ioutil.TempDir("", "unistore_kv")
+	require.Nil(t, err)
+	raftPath, err := ioutil.TempDir("", "unistore_raft")
+	require.Nil(t, err)
+	return openTestEngines(t, kvPath, raftPath)
+}
+
+func openTestEngines(t *testing.T, kvPath, raftPath string) *Engines {
 	engines := new(Engines)
 	engines.kv = new(mvcc.DBBundle)
+	engines.kvPath = kvPath
+	engines.raftPath = raftPath
 	var err error
-	engines.kvPath, err = ioutil.TempDir("", "unistore_kv")
-	require.Nil(t, err)
 	kvOpts := badger.DefaultOptions
 	kvOpts.Dir = engines.kvPath
 	kvOpts.ValueDir = engines.kvPath
@@ -38,8 +46,6 @@ func newTestEngines(t *testing.T) *Engines {
 	engines.kv.DB, err = badger.Open(kvOpts)
 	engines.kv.LockStore = lockstore.NewMemStore(16 * 1024)
 	require.Nil(t, err)
-	engines.raftPath, err = ioutil.TempDir("", "unistore_raft")
-	require.Nil(t, err)
 	raftOpts := badger.DefaultOptions
 	raftOpts.Dir = engines.raftPath
 	raftOpts.ValueDir = engines.raftPath
@@ -49,6 +55,13 @@ func newTestEngines(t *testing.T) *Engines {
 	return engines
 }
 
+// reopenTestEngines closes the engines and opens them again, the lock store is not recovered.
+func reopenTestEngines(t *testing.T, engines *Engines) *Engines {
+	require.Nil(t, engines.kv.DB.Close())
+	require.Nil(t, engines.raft.Close())
+	return openTestEngines(t, engines.kvPath, engines.raftPath)
+}
+
 func newTestPeerStorage(t *testing.T) *PeerStorage {
 	engines := newTestEngines(t)
 	err := BootstrapStore(engines, 1, 1)
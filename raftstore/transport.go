@@ -62,6 +62,7 @@ func (t *ServerTransport) SendSnapshotSock(msg *raft_serverpb.RaftMessage) {
 		data: sendSnapTask{
 			storeID:  msg.GetToPeer().GetStoreId(),
 			msg:      msg,
+			snapCtx:  newSnapTaskContext(msg),
 			callback: callback,
 		},
 	}
@@ -28,6 +28,7 @@ import (
 	"github.com/pingcap/badger"
 	"github.com/pingcap/badger/table/sstable"
 	"github.com/pingcap/badger/y"
+	"github.com/pingcap/errors"
 	"github.com/pingcap/kvproto/pkg/eraftpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
 	"github.com/pingcap/kvproto/pkg/pdpb"
@@ -161,12 +162,67 @@ type flowStats struct {
 type sendSnapTask struct {
 	storeID  uint64
 	msg      *rspb.RaftMessage
+	snapCtx  snapTaskContext
 	callback func(error)
 }
 
 type recvSnapTask struct {
-	stream   tikvpb.Tikv_SnapshotServer
-	callback func(error)
+	stream tikvpb.Tikv_SnapshotServer
+	// snapCtx is filled from the first chunk of the stream once it's received.
+	snapCtx  snapTaskContext
+	callback func(snapRecvResult, error)
+}
+
+// snapRecvResult is the result of a recv snap task reported to the callback, the bytes received so far and the time
+// spent are reported even if the transfer fails.
+type snapRecvResult struct {
+	size     uint64
+	duration time.Duration
+}
+
+// snapTaskContext identifies the snapshot transferred by a snap task in the logs.
+type snapTaskContext struct {
+	regionID  uint64
+	toPeerID  uint64
+	toStoreID uint64
+	index     uint64
+	term      uint64
+}
+
+func newSnapTaskContext(msg *rspb.RaftMessage) snapTaskContext {
+	meta := msg.GetMessage().GetSnapshot().GetMetadata()
+	return snapTaskContext{
+		regionID:  msg.GetRegionId(),
+		toPeerID:  msg.GetToPeer().GetId(),
+		toStoreID: msg.GetToPeer().GetStoreId(),
+		index:     meta.GetIndex(),
+		term:      meta.GetTerm(),
+	}
+}
+
+func (c snapTaskContext) fields() []zap.Field {
+	return []zap.Field{
+		zap.Uint64("region id", c.regionID),
+		zap.Uint64("to peer", c.toPeerID),
+		zap.Uint64("to store", c.toStoreID),
+		zap.Uint64("snap index", c.index),
+		zap.Uint64("snap term", c.term),
+	}
+}
+
+// finish logs the result of the snapshot transfer started at start and records its duration, tp is "send" or
+// "recv".
+func (c snapTaskContext) finish(tp string, start time.Time, err error) {
+	duration := time.Since(start)
+	fields := append(c.fields(), zap.String("type", tp), zap.Duration("duration", duration))
+	result := "success"
+	if err != nil {
+		result = "fail"
+		log.Warn("snapshot transfer failed", append(fields, zap.Error(err))...)
+	} else {
+		log.Info("snapshot transfer finished", fields...)
+	}
+	snapshotTransferDuration.WithLabelValues(tp, result).Observe(duration.Seconds())
 }
 
 type worker struct {
@@ -184,6 +240,11 @@ type starter interface {
 	start()
 }
 
+// stopper is implemented by the handlers which need to clean up before the worker exits.
+type stopper interface {
+	stop()
+}
+
 func (w *worker) start(handler taskHandler) {
 	w.wg.Add(1)
 	go func() {
@@ -193,7 +254,11 @@ func (w *worker) start(handler taskHandler) {
 		}
 		for {
 			task := <-w.receiver
+			workerPendingTasks.WithLabelValues(w.name).Set(float64(len(w.receiver)))
 			if task.tp == taskTypeStop {
+				if s, ok := handler.(stopper); ok {
+					s.stop()
+				}
 				return
 			}
 			handler.handle(task)
@@ -205,10 +270,40 @@ func (w *worker) stop() {
 	w.sender <- task{tp: taskTypeStop}
 }
 
+// waitTimeout waits for the wait group at most timeout, it returns false if the wait group is not done in time.
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// trySend sends the task without blocking, it returns false if the queue is full.
+func (w *worker) trySend(t task) bool {
+	select {
+	case w.sender <- t:
+		workerPendingTasks.WithLabelValues(w.name).Set(float64(len(w.sender)))
+		return true
+	default:
+		return false
+	}
+}
+
 const defaultWorkerCapacity = 128
 
 func newWorker(name string, wg *sync.WaitGroup) *worker {
-	ch := make(chan task, defaultWorkerCapacity)
+	return newWorkerWithCapacity(name, defaultWorkerCapacity, wg)
+}
+
+func newWorkerWithCapacity(name string, capacity int, wg *sync.WaitGroup) *worker {
+	ch := make(chan task, capacity)
 	return &worker{
 		sender:   (chan<- task)(ch),
 		receiver: (<-chan task)(ch),
@@ -605,6 +700,8 @@ type snapContext struct {
 	engiens             *Engines
 	wb                  *WriteBatch
 	batchSize           uint64
+	delRangeBatchSize   int
+	delRangeReverse     bool
 	mgr                 *SnapManager
 	cleanStalePeerDelay time.Duration
 	pendingDeleteRanges *pendingDeleteRanges
@@ -617,10 +714,20 @@ func (snapCtx *snapContext) handleGen(regionID, redoIdx uint64, notifier chan<-
 	}
 }
 
+// maxGenSnapRetries is the max number of retries when the region epoch is changed during generating snapshot.
+const maxGenSnapRetries = 3
+
 // generateSnap generates the snapshots of the Region
 func (snapCtx *snapContext) generateSnap(regionID, redoIdx uint64, notifier chan<- *eraftpb.Snapshot) error {
 	// do we need to check leader here?
 	snap, err := doSnapshot(snapCtx.engiens, snapCtx.mgr, regionID, redoIdx)
+	for i := 0; i < maxGenSnapRetries && err != nil; i++ {
+		if _, ok := errors.Cause(err).(*ErrRegionEpochChanged); !ok {
+			break
+		}
+		log.Info("region epoch changed during generating snapshot, retry", zap.Uint64("region id", regionID), zap.Error(err))
+		snap, err = doSnapshot(snapCtx.engiens, snapCtx.mgr, regionID, redoIdx)
+	}
 	if err != nil {
 		return err
 	}
@@ -636,7 +743,8 @@ func (snapCtx *snapContext) cleanUpOriginData(regionState *rspb.RegionLocalState
 		return err
 	}
 	snapCtx.cleanUpOverlapRanges(startKey, endKey)
-	if err := deleteRange(snapCtx.engiens.kv, startKey, endKey); err != nil {
+	if err := deleteRange(snapCtx.engiens.kv, startKey, endKey, snapCtx.delRangeBatchSize, snapCtx.delRangeReverse,
+		snapCtx.engiens.newDeleteRangeProgress()); err != nil {
 		return err
 	}
 	return checkAbort(status)
@@ -747,7 +855,8 @@ func (snapCtx *snapContext) cleanUpRange(regionID uint64, startKey, endKey []byt
 			return
 		}
 	}
-	if err := deleteRange(snapCtx.engiens.kv, startKey, endKey); err != nil {
+	if err := deleteRange(snapCtx.engiens.kv, startKey, endKey, snapCtx.delRangeBatchSize, snapCtx.delRangeReverse,
+		snapCtx.engiens.newDeleteRangeProgress()); err != nil {
 		log.Error("failed to delete data in range", zap.Uint64("region id", regionID), zap.String("start key",
 			hex.EncodeToString(startKey)), zap.String("end key", hex.EncodeToString(endKey)), zap.Error(err))
 	} else {
@@ -945,20 +1054,11 @@ func (r *raftLogGCTaskHandler) gcRaftLog(raftDb *badger.DB, regionID, startIdx,
 	// Find the raft log idx range needed to be gc.
 	firstIdx := startIdx
 	if firstIdx == 0 {
-		firstIdx = endIdx
-		err := raftDb.View(func(txn *badger.Txn) error {
-			startKey := RaftLogKey(regionID, 0)
-			ite := txn.NewIterator(badger.DefaultIteratorOptions)
-			defer ite.Close()
-			if ite.Seek(startKey); ite.Valid() {
-				var err error
-				if firstIdx, err = RaftLogIndex(ite.Item().Key()); err != nil {
-					return err
-				}
-			}
-			return nil
-		})
-		if err != nil {
+		var err error
+		firstIdx, err = firstRaftLogIndex(raftDb, regionID)
+		if _, ok := err.(*ErrRegionNotFound); ok {
+			firstIdx = endIdx
+		} else if err != nil {
 			return 0, err
 		}
 	}
@@ -391,3 +391,26 @@ func raftLogMustExist(t *testing.T, db *badger.DB, regionID, startIdx, endIdx ui
 		}
 	}
 }
+
+func TestWaitTimeout(t *testing.T) {
+	wg := new(sync.WaitGroup)
+	w := newWorker("test-worker", wg)
+	handled := make(chan struct{})
+	w.start(&testTaskHandler{fn: func(task) {
+		<-handled
+	}})
+	w.sender <- task{tp: taskTypeRaftLogGC}
+	w.stop()
+	// The worker is blocked by the queued task.
+	assert.False(t, waitTimeout(wg, 10*time.Millisecond))
+	close(handled)
+	assert.True(t, waitTimeout(wg, time.Second))
+}
+
+type testTaskHandler struct {
+	fn func(t task)
+}
+
+func (h *testTaskHandler) handle(t task) {
+	h.fn(t)
+}
@@ -23,6 +23,7 @@
 package rocksdb
 
 import (
+	"encoding/binary"
 	"math"
 	"os"
 
@@ -33,6 +34,8 @@ import (
 const (
 	propsBlockHandleKey = "rocksdb.properties"
 	bloomBlockHandleKey = "fullfilter.rocksdb.BuiltinBloomFilter"
+	// partitionedBloomBlockHandleKey is the name of the top-level index of the partitioned filter.
+	partitionedBloomBlockHandleKey = "partitionedfilter.rocksdb.BuiltinBloomFilter"
 )
 
 // BlockBasedTableBuilder is used in building a block-based table.
@@ -70,7 +73,7 @@ func NewBlockBasedTableBuilder(f *os.File, opts *BlockBasedTableOptions) *BlockB
 		writer:                  w,
 		comparator:              opts.Comparator,
 		dataBlockBuilder:        newBlockBuilder(opts.BlockRestartInterval),
-		indexBlockBuilder:       newIndexBlockBuilder(opts.IndexBlockRestartInterval),
+		indexBlockBuilder:       newIndexBlockBuilder(opts.IndexBlockRestartInterval, opts.IndexValueDeltaEncoding),
 		filterBuilder:           newFullFilterBlockBuilder(opts),
 		opts:                    opts,
 		blockSizeDeviationLimit: blockSizeDeviationLimit,
@@ -99,6 +102,9 @@ func (b *BlockBasedTableBuilder) Add(key, value []byte) error {
 	b.filterBuilder.Add(extractUserKey(key))
 
 	b.dataBlockBuilder.Add(key, value)
+	if b.props.NumEntries == 0 {
+		b.props.SmallestKey = append([]byte(nil), extractUserKey(key)...)
+	}
 	b.props.NumEntries++
 	b.props.RawKeySize += uint64(len(key))
 	b.props.RawValueSize += uint64(len(value))
@@ -215,6 +221,9 @@ func (b *BlockBasedTableBuilder) writePropsBlock(metaIndexBuilder *metaIndexBuil
 		f(propsBuilder)
 	}
 	propsBuilder.AddUint64(propColumnFamilyID, p.ColumnFamilyID)
+	if p.ComparatorName != "" {
+		propsBuilder.AddString(propComparator, p.ComparatorName)
+	}
 	propsBuilder.AddString(propCompression, p.CompressionName)
 	propsBuilder.AddUint64(propCreationTime, p.CreationTime)
 	propsBuilder.AddUint64(propDataSize, p.DataSize)
@@ -223,9 +232,20 @@ func (b *BlockBasedTableBuilder) writePropsBlock(metaIndexBuilder *metaIndexBuil
 		propsBuilder.AddUint64(propFilterSize, p.FilterSize)
 	}
 	propsBuilder.AddUint64(propFixedKeyLength, 0)
-	propsBuilder.AddUint64(propFormatVersion, 2)
+	if b.opts.IndexValueDeltaEncoding {
+		propsBuilder.AddUint64(propFormatVersion, 4)
+	} else {
+		propsBuilder.AddUint64(propFormatVersion, 2)
+	}
 	propsBuilder.AddUint64(propIndexKeyIsUserKey, 0)
 	propsBuilder.AddUint64(propIndexSize, p.IndexSize)
+	if b.opts.IndexValueDeltaEncoding {
+		propsBuilder.AddUint64(propIndexValueIsDeltaEncoded, 1)
+	}
+	if p.NumEntries > 0 {
+		propsBuilder.Add(propSmallestKey, p.SmallestKey)
+		propsBuilder.Add(propLargestKey, p.LargestKey)
+	}
 	propsBuilder.AddUint64(propNumDataBlocks, p.NumDataBlocks)
 	propsBuilder.AddUint64(propNumEntries, p.NumEntries)
 	propsBuilder.AddUint64(propOldestKeyTime, p.OldestKeyTime)
@@ -248,12 +268,16 @@ func (b *BlockBasedTableBuilder) setupProperties() {
 	p := &b.props
 	p.ColumnFamilyID = math.MaxInt32
 	p.ColumnFamilyName = ""
+	p.ComparatorName = b.opts.ComparatorName
 	p.FilterPolicyName = "rocksdb.BuiltinBloomFilter"
 	p.IndexSize = uint64(b.indexBlockBuilder.IndexSize() + blockTrailerSize)
 	p.CompressionName = b.opts.CompressionType.String()
 	p.CreationTime = b.opts.CreationTime
 	p.OldestKeyTime = b.opts.OldestKeyTime
 	p.PrefixExtractorName = b.opts.PrefixExtractorName
+	if p.NumEntries > 0 {
+		p.LargestKey = extractUserKey(b.lastKey)
+	}
 }
 
 func (b *BlockBasedTableBuilder) writeBlock(blockContents []byte, handle *blockHandle, isDataBlock bool) error {
@@ -321,20 +345,32 @@ func (b *BlockBasedTableBuilder) shouldFlush(key, value []byte) bool {
 	return newEstimatedSz > b.opts.BlockSize && currSz > b.blockSizeDeviationLimit
 }
 
-// Note: now assume format_version == 2
+// Note: now assume format_version == 2, or format_version == 4 with internal index keys if the index
+// values are delta encoded.
 type indexBlockBuilder struct {
 	blockBuilder blockBuilder
 	indexSize    int
+
+	valueDeltaEncoded bool
+	lastHandle        blockHandle
 }
 
-func newIndexBlockBuilder(restartInterval int) *indexBlockBuilder {
+func newIndexBlockBuilder(restartInterval int, valueDeltaEncoded bool) *indexBlockBuilder {
 	b := new(indexBlockBuilder)
 	b.blockBuilder.Init(restartInterval)
+	b.valueDeltaEncoded = valueDeltaEncoded
 	return b
 }
 
 func (b *indexBlockBuilder) AddIndexEntry(lastKey []byte, handle *blockHandle) {
-	b.blockBuilder.Add(lastKey, handle.Encode())
+	if !b.valueDeltaEncoded {
+		b.blockBuilder.Add(lastKey, handle.Encode())
+		return
+	}
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutVarint(buf[:], int64(handle.Size)-int64(b.lastHandle.Size))
+	b.blockBuilder.AddDeltaValue(lastKey, handle.Encode(), buf[:n])
+	b.lastHandle = *handle
 }
 
 func (b *indexBlockBuilder) IndexSize() int {
@@ -57,18 +57,7 @@ func (b *blockBuilder) Reset() {
 }
 
 func (b *blockBuilder) Add(key, value []byte) {
-	y.Assert(b.counter <= b.restartInterval)
-	var prefixLen uint32
-	if b.counter >= b.restartInterval {
-		// Restart compression
-		b.restarts = append(b.restarts, uint32(len(b.buf)))
-		b.counter = 0
-		b.lastKey = y.SafeCopy(b.lastKey, key)
-	} else {
-		prefixLen = uint32(differenceOffset(key, b.lastKey))
-		b.lastKey = y.SafeCopy(b.lastKey, key)
-	}
-
+	prefixLen := b.nextPrefixLen(key)
 	currSz := len(b.buf)
 
 	b.buf = appendVarint32(b.buf, prefixLen)
@@ -82,6 +71,43 @@ func (b *blockBuilder) Add(key, value []byte) {
 	b.estimate += len(b.buf) - currSz
 }
 
+// AddDeltaValue adds an entry without the value length, the value must be self-delimiting. deltaValue is
+// written instead of value if the key shares prefix with the previous one, so the reader can tell which
+// one is used by the shared length.
+func (b *blockBuilder) AddDeltaValue(key, value, deltaValue []byte) {
+	prefixLen := b.nextPrefixLen(key)
+	currSz := len(b.buf)
+
+	b.buf = appendVarint32(b.buf, prefixLen)
+	b.buf = appendVarint32(b.buf, uint32(len(key))-prefixLen)
+
+	b.buf = append(b.buf, key[prefixLen:]...)
+	if prefixLen != 0 {
+		b.buf = append(b.buf, deltaValue...)
+	} else {
+		b.buf = append(b.buf, value...)
+	}
+
+	b.counter++
+	b.estimate += len(b.buf) - currSz
+}
+
+// nextPrefixLen returns the length of the prefix shared with the previous key, a new restart point is
+// started if the restart interval is reached.
+func (b *blockBuilder) nextPrefixLen(key []byte) uint32 {
+	y.Assert(b.counter <= b.restartInterval)
+	var prefixLen uint32
+	if b.counter >= b.restartInterval {
+		// Restart compression
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+		b.counter = 0
+	} else {
+		prefixLen = uint32(differenceOffset(key, b.lastKey))
+	}
+	b.lastKey = y.SafeCopy(b.lastKey, key)
+	return prefixLen
+}
+
 func (b *blockBuilder) Empty() bool {
 	return len(b.buf) == 0
 }
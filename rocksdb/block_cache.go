@@ -0,0 +1,87 @@
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package rocksdb
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// BlockCache is an LRU cache of decompressed data blocks keyed by block offset.
+// It must only be shared by the iterators of the same sst file.
+type BlockCache struct {
+	mu       sync.Mutex
+	capacity int
+	size     int
+	lru      *list.List
+	blocks   map[uint64]*list.Element
+
+	hits   uint64
+	misses uint64
+}
+
+type cachedBlock struct {
+	offset uint64
+	data   []byte
+}
+
+// NewBlockCache creates a BlockCache holding at most capacity bytes of blocks.
+func NewBlockCache(capacity int) *BlockCache {
+	return &BlockCache{
+		capacity: capacity,
+		lru:      list.New(),
+		blocks:   make(map[uint64]*list.Element),
+	}
+}
+
+func (c *BlockCache) get(offset uint64) ([]byte, bool) {
+	c.mu.Lock()
+	elem, ok := c.blocks[offset]
+	if ok {
+		c.lru.MoveToFront(elem)
+	}
+	c.mu.Unlock()
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	return elem.Value.(*cachedBlock).data, true
+}
+
+// put adds the block into the cache, the data must not be modified after that.
+func (c *BlockCache) put(offset uint64, data []byte) {
+	if len(data) > c.capacity {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.blocks[offset]; ok {
+		return
+	}
+	c.blocks[offset] = c.lru.PushFront(&cachedBlock{offset: offset, data: data})
+	c.size += len(data)
+	for c.size > c.capacity {
+		oldest := c.lru.Back()
+		block := c.lru.Remove(oldest).(*cachedBlock)
+		delete(c.blocks, block.offset)
+		c.size -= len(block.data)
+	}
+}
+
+// Stats returns the hit and miss count of the cache.
+func (c *BlockCache) Stats() (hits, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
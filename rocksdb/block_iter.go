@@ -13,6 +13,8 @@
 
 package rocksdb
 
+import "encoding/binary"
+
 type blockIterator struct {
 	data    []byte
 	cursor  int
@@ -20,6 +22,17 @@ type blockIterator struct {
 
 	keyBuf   []byte
 	valueBuf []byte
+
+	// valueDeltaEncoded is set for the index blocks written with format_version >= 4. The entries don't
+	// have the value length, and the entries sharing key prefix with the previous one only store the size
+	// delta of the block handle, the offset follows the previous block. The decoded values are always full
+	// encoded block handles.
+	valueDeltaEncoded bool
+	handle            blockHandle
+
+	// restarts is the restart point array of the block, each restart point is the offset of an entry which
+	// doesn't share key prefix with the previous one. It's empty if the iterator is not created by Reset.
+	restarts []byte
 }
 
 func newBlockIterator(block []byte) *blockIterator {
@@ -33,8 +46,101 @@ func (it *blockIterator) SeekToFirst() {
 	it.Next()
 }
 
+// Rewind moves the cursor before the first entry, the following Next lands on the first entry.
 func (it *blockIterator) Rewind() {
 	it.cursor = 0
+	it.invalid = false
+	it.keyBuf = it.keyBuf[:0]
+	it.handle = blockHandle{}
+}
+
+// Seek moves the iterator to the first entry whose key is not less than target according to cmp, the
+// iterator is invalid if there is no such entry. The restart point is found by binary search, then the
+// entries after it are scanned.
+func (it *blockIterator) Seek(target []byte, cmp func(a, b []byte) int) {
+	// Find the last restart point whose key is less than target, the entries before it are all less than target.
+	left, right := 0, len(it.restarts)/4-1
+	for left < right {
+		mid := (left + right + 1) / 2
+		key, ok := it.restartKey(mid)
+		if !ok {
+			it.invalid = true
+			return
+		}
+		if cmp(key, target) < 0 {
+			left = mid
+		} else {
+			right = mid - 1
+		}
+	}
+	it.Rewind()
+	if len(it.restarts) > 0 {
+		it.cursor = it.restartPoint(left)
+	}
+	for it.Next(); it.Valid() && cmp(it.Key(), target) < 0; it.Next() {
+	}
+}
+
+// seekToEntryEnd moves the iterator to the entry ending at the offset end, so the following Next lands on the
+// entry starting at end. The entries are decoded from the last restart point before end. It returns false if
+// no entry ends at end.
+func (it *blockIterator) seekToEntryEnd(end int) bool {
+	if end <= 0 || end > len(it.data) {
+		return false
+	}
+	it.Rewind()
+	for i := len(it.restarts)/4 - 1; i >= 0; i-- {
+		if p := it.restartPoint(i); p < end {
+			it.cursor = p
+			break
+		}
+	}
+	for it.cursor < end {
+		it.Next()
+		if !it.Valid() {
+			return false
+		}
+	}
+	return it.cursor == end
+}
+
+func (it *blockIterator) restartPoint(i int) int {
+	return int(rocksEndian.Uint32(it.restarts[i*4:]))
+}
+
+// restartKey decodes the key at the restart point without moving the iterator, the key is stored in full.
+func (it *blockIterator) restartKey(i int) ([]byte, bool) {
+	off := it.restartPoint(i)
+	if off >= len(it.data) {
+		return nil, false
+	}
+	data := it.data[off:]
+	prefixLen, n1 := decodeVarint32(data)
+	if n1 <= 0 || prefixLen != 0 {
+		return nil, false
+	}
+	if n1 >= len(data) {
+		return nil, false
+	}
+	keyLen, n2 := decodeVarint32(data[n1:])
+	if n2 <= 0 {
+		return nil, false
+	}
+	pos := n1 + n2
+	if !it.valueDeltaEncoded {
+		if pos >= len(data) {
+			return nil, false
+		}
+		_, n3 := decodeVarint32(data[pos:])
+		if n3 <= 0 {
+			return nil, false
+		}
+		pos += n3
+	}
+	if pos+int(keyLen) > len(data) {
+		return nil, false
+	}
+	return data[pos : pos+int(keyLen)], true
 }
 
 func (it *blockIterator) Next() {
@@ -58,19 +164,70 @@ func (it *blockIterator) Next() {
 	}
 	it.cursor += n
 
+	if it.valueDeltaEncoded {
+		if !it.nextKey(prefixLen, keyLen) {
+			return
+		}
+		it.nextDeltaHandle(prefixLen)
+		return
+	}
+
 	if valueLen, n = decodeVarint32(it.currData()); n <= 0 {
 		it.invalid = true
 		return
 	}
 	it.cursor += n
 
-	it.keyBuf = append(it.keyBuf[:prefixLen], it.currData()[:keyLen]...)
-	it.cursor += int(keyLen)
+	if !it.nextKey(prefixLen, keyLen) {
+		return
+	}
 
+	if int(valueLen) > len(it.currData()) {
+		it.invalid = true
+		return
+	}
 	it.valueBuf = append(it.valueBuf[:0], it.currData()[:valueLen]...)
 	it.cursor += int(valueLen)
 }
 
+// nextKey rebuilds the key at the cursor from the prefix shared with the previous key and the unshared part.
+// The shared prefix can't be longer than the previous key, the key buffer is cut to the previous key only, so
+// the stale bytes left in its capacity by longer keys must never be carried over.
+func (it *blockIterator) nextKey(prefixLen, keyLen uint32) bool {
+	if int(prefixLen) > len(it.keyBuf) || int(keyLen) > len(it.currData()) {
+		it.invalid = true
+		return false
+	}
+	it.keyBuf = append(it.keyBuf[:prefixLen], it.currData()[:keyLen]...)
+	it.cursor += int(keyLen)
+	return true
+}
+
+// nextDeltaHandle decodes the block handle at the cursor, the value is delta encoded only if the key
+// shares prefix with the previous one.
+func (it *blockIterator) nextDeltaHandle(prefixLen uint32) {
+	if prefixLen == 0 {
+		n := it.handle.Decode(it.currData())
+		if n <= 0 {
+			it.invalid = true
+			return
+		}
+		it.cursor += n
+	} else {
+		delta, n := binary.Varint(it.currData())
+		if n <= 0 {
+			it.invalid = true
+			return
+		}
+		it.cursor += n
+		it.handle.Offset += it.handle.Size + blockTrailerSize
+		it.handle.Size = uint64(int64(it.handle.Size) + delta)
+	}
+	var buf [2 * binary.MaxVarintLen64]byte
+	n := it.handle.EncodeTo(buf[:])
+	it.valueBuf = append(it.valueBuf[:0], buf[:n]...)
+}
+
 func (it *blockIterator) Key() []byte {
 	return it.keyBuf
 }
@@ -89,10 +246,12 @@ func (it *blockIterator) Reset(block []byte) {
 	data := block[:len(block)-restartsSz]
 
 	it.data = data
+	it.restarts = block[len(data) : len(block)-4]
 	it.cursor = 0
 	it.invalid = false
 	it.keyBuf = it.keyBuf[:0]
 	it.valueBuf = it.valueBuf[:0]
+	it.handle = blockHandle{}
 }
 
 func (it *blockIterator) currData() []byte {
@@ -14,8 +14,12 @@
 package rocksdb
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
 	"sort"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -41,6 +45,22 @@ func TestBlockReadWrite(t *testing.T) {
 		require.Equal(t, expected, value)
 		i++
 	}
+	require.Equal(t, len(nums), i)
+
+	// The exhausted iterator is valid again after SeekToFirst.
+	iter.SeekToFirst()
+	require.True(t, iter.Valid())
+	require.Equal(t, nums[0], decodeKey(iter.Key()))
+
+	// The block has only one entry.
+	builder = newBlockBuilder(16)
+	builder.Add(encodeKey(nums[0]), []byte(nums[0]))
+	iter = newBlockIterator(builder.Finish())
+	iter.SeekToFirst()
+	require.True(t, iter.Valid())
+	require.Equal(t, nums[0], decodeKey(iter.Key()))
+	iter.Next()
+	require.False(t, iter.Valid())
 }
 
 func encodeKey(key string) []byte {
@@ -63,3 +83,317 @@ func sortedNumbers(size int) []string {
 	})
 	return nums
 }
+
+func TestRocksHash(t *testing.T) {
+	// The test vectors are from LevelDB, RocksDB sign-extends the trailing bytes so the vectors
+	// with trailing bytes >= 0x80 are different.
+	seed := uint32(0xbc9f1d34)
+	require.Equal(t, seed, rocksHash(nil, seed))
+	require.Equal(t, uint32(0xef1345c4), rocksHash([]byte{0x62}, seed))
+	require.Equal(t, uint32(0xed21633a), rocksHash([]byte{0xe1, 0x80, 0xb9, 0x32}, seed))
+	// The trailing bytes after the 4-byte words are hashed.
+	require.NotEqual(t, rocksHash([]byte("aaaab"), seed), rocksHash([]byte("aaaac"), seed))
+}
+
+func TestInternalKeyEncodeDecode(t *testing.T) {
+	for _, ikey := range []InternalKey{
+		MakeInternalKey([]byte("key"), 0, TypeValue),
+		MakeInternalKey([]byte("key"), 100, TypeDeletion),
+		MakeInternalKey([]byte{}, MaxSequenceNumber, TypeMerge),
+	} {
+		encoded := ikey.Encode()
+		require.Len(t, encoded, len(ikey.UserKey)+8)
+		require.Equal(t, ikey.UserKey, extractUserKey(encoded))
+		var decoded InternalKey
+		require.Nil(t, decoded.Decode(encoded))
+		require.Equal(t, 0, Compare(ikey, decoded))
+		require.Equal(t, ikey.SequenceNumber, decoded.SequenceNumber)
+		require.Equal(t, ikey.ValueType, decoded.ValueType)
+	}
+	// The trailer is packed as seq<<8 | type in little endian.
+	ikey := MakeInternalKey([]byte("k"), 1, TypeValue)
+	encoded := ikey.Encode()
+	require.Equal(t, []byte{'k', 1, 1, 0, 0, 0, 0, 0, 0}, encoded)
+}
+
+func TestInternalKeyValueType(t *testing.T) {
+	encode := func(seq uint64, tp ValueType) []byte {
+		ikey := MakeInternalKey([]byte("k"), seq, tp)
+		return ikey.Encode()
+	}
+	var ikey InternalKey
+	require.Nil(t, ikey.Decode(encode(5, TypeValue)))
+	require.True(t, ikey.IsValue())
+	require.False(t, ikey.IsDeletion())
+	require.Equal(t, uint64(5), ikey.Sequence())
+	for _, tp := range []ValueType{TypeDeletion, TypeSingleDeletion} {
+		require.Nil(t, ikey.Decode(encode(6, tp)))
+		require.True(t, ikey.IsDeletion())
+		require.False(t, ikey.IsValue())
+	}
+	require.Nil(t, ikey.Decode(encode(7, TypeMerge)))
+	require.False(t, ikey.IsDeletion())
+	require.False(t, ikey.IsValue())
+
+	// The unknown value type is reported but the key is still decoded.
+	require.Equal(t, ErrUnknownValueType, ikey.Decode(encode(8, ValueType(0x42))))
+	require.Equal(t, []byte("k"), ikey.UserKey)
+	require.Equal(t, uint64(8), ikey.Sequence())
+	require.Equal(t, ErrCorruptedBlock, ikey.Decode([]byte("short")))
+}
+
+func TestInternalKeysSort(t *testing.T) {
+	key := func(userKey string, seq uint64, tp ValueType) InternalKey {
+		return MakeInternalKey([]byte(userKey), seq, tp)
+	}
+	for _, c := range []struct {
+		name   string
+		sorted InternalKeys
+	}{
+		{
+			name:   "user key",
+			sorted: InternalKeys{key("", 1, TypeValue), key("a", 1, TypeValue), key("ab", 1, TypeValue), key("b", 1, TypeValue)},
+		},
+		{
+			name:   "user key before sequence",
+			sorted: InternalKeys{key("a", 1, TypeValue), key("b", 100, TypeValue), key("c", 0, TypeValue)},
+		},
+		{
+			name:   "descending sequence",
+			sorted: InternalKeys{key("a", MaxSequenceNumber, TypeValue), key("a", 100, TypeValue), key("a", 0, TypeValue)},
+		},
+		{
+			name:   "descending type",
+			sorted: InternalKeys{key("a", 5, TypeMerge), key("a", 5, TypeValue), key("a", 5, TypeDeletion)},
+		},
+		{
+			name:   "sequence before type",
+			sorted: InternalKeys{key("a", 6, TypeDeletion), key("a", 5, TypeMerge), key("a", 5, TypeValue), key("a", 4, TypeMerge)},
+		},
+	} {
+		keys := make(InternalKeys, len(c.sorted))
+		for i := range c.sorted {
+			keys[i] = c.sorted[len(c.sorted)-1-i]
+		}
+		sort.Sort(keys)
+		require.Equal(t, c.sorted, keys, c.name)
+		for i := 1; i < len(keys); i++ {
+			require.Equal(t, -1, Compare(keys[i-1], keys[i]), c.name)
+			require.Equal(t, +1, Compare(keys[i], keys[i-1]), c.name)
+		}
+	}
+	require.Equal(t, 0, Compare(key("a", 5, TypeValue), key("a", 5, TypeValue)))
+}
+
+func TestPartitionedFilter(t *testing.T) {
+	nums := sortedNumbers(1000)
+	var partitions [][]byte
+	index := newBlockBuilder(1)
+	var offset uint64
+	for i := 0; i < len(nums); i += 300 {
+		end := i + 300
+		if end > len(nums) {
+			end = len(nums)
+		}
+		builder := fullFilterBitsBuilder{bitsPerKey: 10, numProbes: 6}
+		for _, num := range nums[i:end] {
+			builder.AddKey([]byte(num))
+		}
+		partition := builder.Finish()
+		handle := blockHandle{Offset: offset, Size: uint64(len(partition))}
+		index.Add(encodeKey(nums[end-1]), handle.Encode())
+		partitions = append(partitions, partition)
+		offset += uint64(len(partition))
+	}
+	var reads int
+	read := func(handle blockHandle) ([]byte, error) {
+		reads++
+		var off uint64
+		for _, partition := range partitions {
+			if off == handle.Offset {
+				return partition, nil
+			}
+			off += uint64(len(partition))
+		}
+		return nil, ErrCorruptedBlock
+	}
+
+	indexData := index.Finish()
+	r := newPartitionedFilterReader(indexData, false, false, read)
+	for _, num := range nums {
+		require.True(t, r.MayMatch([]byte(num)), num)
+	}
+	// The partition is only read once for the ordered lookups.
+	require.Equal(t, len(partitions), reads)
+
+	var falsePositives int
+	for i := len(nums); i < 2*len(nums); i++ {
+		if r.MayMatch([]byte(strconv.Itoa(i))) {
+			falsePositives++
+		}
+	}
+	require.True(t, falsePositives < len(nums)/10, falsePositives)
+
+	// A partition can't be read matches everything.
+	partitions = nil
+	r = newPartitionedFilterReader(indexData, false, false, read)
+	require.True(t, r.MayMatch([]byte("1000")))
+}
+
+func TestFindFilterBlock(t *testing.T) {
+	builder := fullFilterBitsBuilder{bitsPerKey: 10, numProbes: 6}
+	builder.AddKey([]byte("a"))
+	filter := builder.Finish()
+	read := func(handle blockHandle) ([]byte, error) {
+		if handle.Offset != 1 {
+			return nil, ErrCorruptedBlock
+		}
+		return filter, nil
+	}
+	newMetaIndex := func(names ...string) []byte {
+		b := newMetaIndexBuilder()
+		for i, name := range names {
+			b.AddHandle(name, &blockHandle{Offset: uint64(i), Size: uint64(len(filter))})
+		}
+		return b.Finish()
+	}
+
+	// The block of the known policy is picked whichever name variant is present.
+	for _, name := range []string{bloomBlockHandleKey, "fullfilter.rocksdb.internal.LegacyBloomFilter"} {
+		data, err := findFilterBlock(newMetaIndex("filter.rocksdb.BuiltinBloomFilter", name), fullFilterBlockPrefix, read)
+		require.Nil(t, err)
+		require.Equal(t, filter, data)
+	}
+	// The filter of an unknown policy is not used.
+	data, err := findFilterBlock(newMetaIndex("fullfilter.custom.Filter"), fullFilterBlockPrefix, read)
+	require.Nil(t, err)
+	require.Nil(t, data)
+	data, err = findFilterBlock(newMetaIndex(bloomBlockHandleKey), partitionedFilterBlockPrefix, read)
+	require.Nil(t, err)
+	require.Nil(t, data)
+
+	// The filter in a newer format matches everything.
+	newFormat := append([]byte(nil), filter...)
+	newFormat[len(newFormat)-5] = newFilterImplMarker
+	r := newFullFilterBitsReader(newFormat)
+	require.True(t, r.MayMatch([]byte("absent")))
+	require.True(t, newFullFilterBitsReader(filter).MayMatch([]byte("a")))
+}
+
+func TestBlockIteratorSeek(t *testing.T) {
+	nums := sortedNumbers(1000)
+	for _, restartInterval := range []int{1, 3, 16} {
+		builder := newBlockBuilder(restartInterval)
+		for _, num := range nums {
+			builder.Add([]byte(num+"0"), []byte(num))
+		}
+		iter := newBlockIterator(builder.Finish())
+		for i, num := range nums {
+			iter.Seek([]byte(num+"0"), bytes.Compare)
+			require.True(t, iter.Valid())
+			require.Equal(t, num, string(iter.Value()))
+			// The target between two keys lands on the next one.
+			iter.Seek([]byte(num+"00"), bytes.Compare)
+			if i == len(nums)-1 {
+				require.False(t, iter.Valid())
+				continue
+			}
+			require.True(t, iter.Valid())
+			require.Equal(t, nums[i+1], string(iter.Value()))
+		}
+		iter.Seek(nil, bytes.Compare)
+		require.True(t, iter.Valid())
+		require.Equal(t, nums[0], string(iter.Value()))
+		iter.Seek([]byte("a"), bytes.Compare)
+		require.False(t, iter.Valid())
+		// The iterator can move forward after Seek.
+		iter.Seek([]byte(nums[500]+"0"), bytes.Compare)
+		iter.Next()
+		require.Equal(t, nums[501], string(iter.Value()))
+	}
+
+	// The delta encoded values are decoded from the restart points.
+	builder := newBlockBuilder(4)
+	var handles []blockHandle
+	var lastHandle blockHandle
+	for i, num := range nums {
+		handle := blockHandle{Offset: lastHandle.Offset + lastHandle.Size + blockTrailerSize, Size: uint64(100 + i)}
+		if i == 0 {
+			handle.Offset = 0
+		}
+		delta := make([]byte, binary.MaxVarintLen64)
+		delta = delta[:binary.PutVarint(delta, int64(handle.Size)-int64(lastHandle.Size))]
+		builder.AddDeltaValue(encodeKey(num), handle.Encode(), delta)
+		handles = append(handles, handle)
+		lastHandle = handle
+	}
+	iter := newBlockIterator(builder.Finish())
+	iter.valueDeltaEncoded = true
+	cmp := Comparator(bytes.Compare).CompareInternalKey
+	for i, num := range nums {
+		iter.Seek(encodeKey(num), cmp)
+		require.True(t, iter.Valid())
+		var handle blockHandle
+		handle.Decode(iter.Value())
+		require.Equal(t, handles[i], handle)
+	}
+}
+
+func TestBlockIteratorPrefixRestarts(t *testing.T) {
+	// The keys share long prefixes of varying lengths, so the shared length changes across the restart points.
+	longPrefix := strings.Repeat("k", 300)
+	var keys []string
+	for i := 0; i < 200; i++ {
+		key := longPrefix[:100+i%7*30] + fmt.Sprintf("%05d", i)
+		if i%5 == 0 {
+			key += strings.Repeat("x", 200)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, restartInterval := range []int{1, 2, 3, 7, 16, 64, 1000} {
+		builder := newBlockBuilder(restartInterval)
+		for _, key := range keys {
+			builder.Add([]byte(key), []byte(key[len(key)-5:]))
+		}
+		iter := newBlockIterator(builder.Finish())
+		var i int
+		for iter.SeekToFirst(); iter.Valid(); iter.Next() {
+			require.Equal(t, keys[i], string(iter.Key()), "restart interval %d", restartInterval)
+			i++
+		}
+		require.Equal(t, len(keys), i)
+		// Seek lands on restart points after the longer keys are decoded, the stale prefix must not be reused.
+		for j := len(keys) - 1; j >= 0; j-- {
+			iter.Seek([]byte(keys[j]), bytes.Compare)
+			require.True(t, iter.Valid())
+			require.Equal(t, keys[j], string(iter.Key()), "restart interval %d", restartInterval)
+			require.Equal(t, keys[j][len(keys[j])-5:], string(iter.Value()))
+		}
+	}
+}
+
+func TestBlockIteratorCorruptedPrefix(t *testing.T) {
+	builder := newBlockBuilder(16)
+	builder.Add([]byte("aaaaaaaa"), []byte("1"))
+	builder.Add([]byte("aaaaaaab"), []byte("2"))
+	block := builder.Finish()
+	iter := newBlockIterator(block)
+	iter.SeekToFirst()
+	iter.Next()
+	require.Equal(t, "aaaaaaab", string(iter.Key()))
+
+	// The first entry claims a shared prefix, it can't be rebuilt from the stale key left by the last iteration.
+	corrupted := append([]byte{}, block...)
+	corrupted[0] = 4
+	iter.Reset(corrupted)
+	iter.SeekToFirst()
+	require.False(t, iter.Valid())
+
+	// The unshared key length exceeds the block data.
+	corrupted = append([]byte{}, block...)
+	corrupted[1] = 100
+	iter.Reset(corrupted)
+	iter.SeekToFirst()
+	require.False(t, iter.Valid())
+}
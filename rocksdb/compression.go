@@ -25,6 +25,7 @@ package rocksdb
 import (
 	"math"
 
+	"github.com/golang/snappy"
 	"github.com/pierrec/lz4"
 	"github.com/pingcap/errors"
 )
@@ -72,7 +73,7 @@ func CompressBlock(tp CompressionType, input, dst []byte) ([]byte, bool) {
 	case CompressionNone:
 		return input, false
 	case CompressionSnappy:
-		panic("unsupported")
+		compressed = snappy.Encode(dst[:cap(dst)], input)
 	case CompressionZstd:
 		panic("unsupported")
 	}
@@ -98,6 +99,14 @@ func lz4Decompress(input, dst []byte) ([]byte, error) {
 	return dst, err
 }
 
+func snappyDecompress(input, dst []byte) ([]byte, error) {
+	out, err := snappy.Decode(dst[:cap(dst)], input)
+	if err != nil {
+		return input, ErrDecompress
+	}
+	return out, nil
+}
+
 // DecompressBlock decompresses input into dst.  If you have a buffer to use, you can pass it to
 // prevent allocation.  If it is too small, or if nil is passed, a new buffer
 // will be allocated and returned.
@@ -108,7 +117,7 @@ func DecompressBlock(tp CompressionType, input, dst []byte) ([]byte, error) {
 	case CompressionNone:
 		return input, nil
 	case CompressionSnappy:
-		panic("unsupported")
+		return snappyDecompress(input, dst)
 	case CompressionZstd:
 		panic("unsupported")
 	default:
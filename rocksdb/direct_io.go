@@ -0,0 +1,68 @@
+//  Copyright (c) 2011-present, Facebook, Inc.  All rights reserved.
+//  This source code is licensed under both the GPLv2 (found in the
+//  COPYING file in the root directory) and Apache 2.0 License
+//  (found in the LICENSE.Apache file in the root directory).
+//
+// Copyright (c) 2011 The LevelDB Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file. See the AUTHORS file for names of contributors.
+
+// Copyright 2019-present PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+
+package rocksdb
+
+import (
+	"io"
+	"os"
+
+	"github.com/ncw/directio"
+)
+
+// openForRead opens the file read-only, the direct IO flags of the platform are used if directIO is set. It falls
+// back to the buffered IO if the platform or the file system doesn't support direct IO, the returned bool tells
+// whether direct IO is used.
+func openForRead(path string, directIO bool) (*os.File, bool, error) {
+	if directIO {
+		if f, err := directio.OpenFile(path, os.O_RDONLY, 0); err == nil {
+			return f, true, nil
+		}
+	}
+	f, err := os.Open(path)
+	return f, false, err
+}
+
+// alignedReaderAt reads the file opened with direct IO, the offsets, the sizes and the buffers of the reads
+// are aligned to the block size required by direct IO.
+type alignedReaderAt struct {
+	f   *os.File
+	buf []byte
+}
+
+func (r *alignedReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	align := int64(directio.BlockSize)
+	start := off &^ (align - 1)
+	end := (off + int64(len(p)) + align - 1) &^ (align - 1)
+	size := int(end - start)
+	if cap(r.buf) < size {
+		r.buf = directio.AlignedBlock(size)
+	}
+	buf := r.buf[:size]
+	n, err := r.f.ReadAt(buf, start)
+	skip := int(off - start)
+	if n-skip >= len(p) {
+		copy(p, buf[skip:])
+		return len(p), nil
+	}
+	if n <= skip {
+		n = 0
+	} else {
+		n = copy(p, buf[skip:n])
+	}
+	if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
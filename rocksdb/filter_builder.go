@@ -160,3 +160,113 @@ func (b *fullFilterBitsBuilder) addHash(hash uint32, buf []byte, totalBits, numL
 func bloomHash(key []byte) uint32 {
 	return rocksHash(key, 0xbc9f1d34)
 }
+
+// newFilterImplMarker is the leading metadata byte of the full filters not in the legacy bloom filter format.
+const newFilterImplMarker = 0xff
+
+// fullFilterBitsReader reads the filter built by fullFilterBitsBuilder.
+type fullFilterBitsReader struct {
+	data      []byte
+	numProbes int
+	numLines  uint32
+}
+
+func newFullFilterBitsReader(contents []byte) *fullFilterBitsReader {
+	r := new(fullFilterBitsReader)
+	if len(contents) < 5 {
+		return r
+	}
+	totalBytes := len(contents) - 5
+	// The filters of the newer implementations, e.g. the fast local bloom filter, start the metadata with a -1
+	// marker in place of the number of probes, they're not supported and treated as matching everything.
+	if contents[totalBytes] == newFilterImplMarker {
+		return r
+	}
+	r.data = contents[:totalBytes]
+	r.numProbes = int(contents[totalBytes])
+	r.numLines = rocksEndian.Uint32(contents[totalBytes+1:])
+	return r
+}
+
+// MayMatch returns false if the key is definitely not added to the filter.
+func (r *fullFilterBitsReader) MayMatch(key []byte) bool {
+	// Treat the corrupted filter as matching everything.
+	if r.numLines == 0 || r.numProbes == 0 || uint32(len(r.data)) != r.numLines*cacheLineSize {
+		return true
+	}
+	hash := bloomHash(key)
+	delta := (hash >> 17) | (hash << 15)
+	base := (hash % r.numLines) * (cacheLineSize * 8)
+	for i := 0; i < r.numProbes; i++ {
+		bitpos := base + (hash % (cacheLineSize * 8))
+		if r.data[bitpos/8]&(1<<(bitpos%8)) == 0 {
+			return false
+		}
+		hash += delta
+	}
+	return true
+}
+
+// partitionedFilterReader reads the two-level filter, the top-level index maps the last key of each partition
+// to the handle of the partition, every partition is a full filter.
+type partitionedFilterReader struct {
+	index             []byte
+	keyIsUserKey      bool
+	valueDeltaEncoded bool
+	read              func(blockHandle) ([]byte, error)
+
+	// The last read partition is kept since the lookups are usually ordered.
+	lastHandle blockHandle
+	last       *fullFilterBitsReader
+}
+
+func newPartitionedFilterReader(index []byte, keyIsUserKey, valueDeltaEncoded bool,
+	read func(blockHandle) ([]byte, error)) *partitionedFilterReader {
+	return &partitionedFilterReader{
+		index:             index,
+		keyIsUserKey:      keyIsUserKey,
+		valueDeltaEncoded: valueDeltaEncoded,
+		read:              read,
+	}
+}
+
+// MayMatch returns false if the key is definitely not added to the filter. The key matches if the partition
+// can't be read.
+func (r *partitionedFilterReader) MayMatch(key []byte) bool {
+	handle, ok := r.partitionHandle(key)
+	if !ok {
+		return true
+	}
+	if r.last == nil || r.lastHandle != handle {
+		data, err := r.read(handle)
+		if err != nil {
+			return true
+		}
+		r.lastHandle, r.last = handle, newFullFilterBitsReader(data)
+	}
+	return r.last.MayMatch(key)
+}
+
+// partitionHandle finds the first partition whose last user key is not less than the key. The last partition is used if the key is larger
+// than all the index keys like RocksDB does, the prefix of the key may be in it.
+func (r *partitionedFilterReader) partitionHandle(key []byte) (blockHandle, bool) {
+	bi := blockIterator{data: r.index, valueDeltaEncoded: r.valueDeltaEncoded}
+	var handle blockHandle
+	found := false
+	for !bi.end() {
+		bi.Next()
+		if !bi.Valid() {
+			return handle, false
+		}
+		handle.Decode(bi.Value())
+		found = true
+		indexKey := bi.Key()
+		if !r.keyIsUserKey {
+			indexKey = extractUserKey(indexKey)
+		}
+		if bytes.Compare(indexKey, key) >= 0 {
+			break
+		}
+	}
+	return handle, found
+}
@@ -74,6 +74,10 @@ type BlockBasedTableOptions struct {
 	CreationTime              uint64
 	OldestKeyTime             uint64
 
+	// IndexValueDeltaEncoding delta encodes the block handles in the index block like format_version 4,
+	// the handles are only delta encoded if IndexBlockRestartInterval is greater than 1.
+	IndexValueDeltaEncoding bool
+
 	PropsInjectors []PropsInjector
 
 	BloomBitsPerKey   int
@@ -83,10 +87,12 @@ type BlockBasedTableOptions struct {
 	PrefixExtractorName string
 	PrefixExtractor     SliceTransform
 
-	Comparator   Comparator
-	BufferSize   int
-	BytesPerSync int
-	RateLimiter  *rate.Limiter
+	Comparator Comparator
+	// ComparatorName is recorded in the properties of the file, it must be the name of Comparator.
+	ComparatorName string
+	BufferSize     int
+	BytesPerSync   int
+	RateLimiter    *rate.Limiter
 }
 
 // NewDefaultBlockBasedTableOptions creates a default BlockBasedTableOptions object.
@@ -110,9 +116,10 @@ func NewDefaultBlockBasedTableOptions(cmp Comparator) *BlockBasedTableOptions {
 		PrefixExtractorName: "",
 		PrefixExtractor:     nil,
 
-		Comparator:   cmp,
-		BufferSize:   1 * 1024 * 1024,
-		BytesPerSync: 0,
-		RateLimiter:  nil,
+		Comparator:     cmp,
+		ComparatorName: BytewiseComparatorName,
+		BufferSize:     1 * 1024 * 1024,
+		BytesPerSync:   0,
+		RateLimiter:    nil,
 	}
 }
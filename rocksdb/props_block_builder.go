@@ -30,22 +30,26 @@ import (
 )
 
 const (
-	propColumnFamilyID      = "rocksdb.column.family.id"
-	propCompression         = "rocksdb.compression"
-	propCreationTime        = "rocksdb.creation.time"
-	propDataSize            = "rocksdb.data.size"
-	propFilterPolicy        = "rocksdb.filter.policy"
-	propFilterSize          = "rocksdb.filter.size"
-	propFixedKeyLength      = "rocksdb.fixed.key.length"
-	propFormatVersion       = "rocksdb.format.version"
-	propIndexKeyIsUserKey   = "rocksdb.index.key.is.user.key"
-	propIndexSize           = "rocksdb.index.size"
-	propNumDataBlocks       = "rocksdb.num.data.blocks"
-	propNumEntries          = "rocksdb.num.entries"
-	propOldestKeyTime       = "rocksdb.oldest.key.time"
-	propPrefixExtractorName = "rocksdb.prefix.extractor.name"
-	propRawKeySize          = "rocksdb.raw.key.size"
-	propRawValueSize        = "rocksdb.raw.value.size"
+	propColumnFamilyID           = "rocksdb.column.family.id"
+	propComparator               = "rocksdb.comparator"
+	propCompression              = "rocksdb.compression"
+	propCreationTime             = "rocksdb.creation.time"
+	propDataSize                 = "rocksdb.data.size"
+	propFilterPolicy             = "rocksdb.filter.policy"
+	propFilterSize               = "rocksdb.filter.size"
+	propFixedKeyLength           = "rocksdb.fixed.key.length"
+	propFormatVersion            = "rocksdb.format.version"
+	propIndexKeyIsUserKey        = "rocksdb.index.key.is.user.key"
+	propIndexSize                = "rocksdb.index.size"
+	propIndexValueIsDeltaEncoded = "rocksdb.index.value.is.delta.encoded"
+	propLargestKey               = "rocksdb.largest.key"
+	propNumDataBlocks            = "rocksdb.num.data.blocks"
+	propNumEntries               = "rocksdb.num.entries"
+	propOldestKeyTime            = "rocksdb.oldest.key.time"
+	propPrefixExtractorName      = "rocksdb.prefix.extractor.name"
+	propRawKeySize               = "rocksdb.raw.key.size"
+	propRawValueSize             = "rocksdb.raw.value.size"
+	propSmallestKey              = "rocksdb.smallest.key"
 )
 
 // PropsInjector is a function of properties injector.
@@ -14,21 +14,41 @@
 package rocksdb
 
 import (
+	"bytes"
+	"encoding/binary"
+	"io"
 	"os"
+	"strings"
 
 	"github.com/pingcap/errors"
 )
 
 // Error
 var (
-	ErrChecksumMismatch    = errors.New("Checksum mismatch")
-	ErrMagicNumberMismatch = errors.New("Magic number mismatch")
-	errEnd                 = errors.New("reach end of block")
+	ErrChecksumMismatch     = errors.New("Checksum mismatch")
+	ErrMagicNumberMismatch  = errors.New("Magic number mismatch")
+	ErrUnsupportedByteOrder = errors.New("Unsupported byte order")
+	ErrIndexKeyMismatch     = errors.New("Index key mismatch with data block")
+	ErrCorruptedBlock       = errors.New("Corrupted block")
+	ErrKeyNotFound          = errors.New("Key not found")
+	ErrUnknownValueType     = errors.New("Unknown value type")
+	ErrInvalidPosition      = errors.New("Invalid position token")
+	errEnd                  = errors.New("reach end of block")
+)
+
+// The format versions using the footer with checksum type, format version 0 uses the legacy footer and magic number.
+const (
+	minFormatVersion = 1
+	maxFormatVersion = 5
 )
 
 // SstFileIterator is an iterator for an SST file.
 type SstFileIterator struct {
-	f              *os.File
+	f      *os.File
+	reader io.ReaderAt
+	// size is the size of the sst data read by reader, the footer is at the end of it.
+	size           int64
+	directIO       bool
 	indexBlockIter *blockIterator
 	dataBlockIter  *blockIterator
 	readBuf        []byte
@@ -36,26 +56,351 @@ type SstFileIterator struct {
 	invalid        bool
 	err            error
 	checksumType   ChecksumType
+	byteOrder      binary.ByteOrder
+	formatVersion  uint32
+	globalSeqNo    uint64
+	filter         *fullFilterBitsReader
+	partFilter     *partitionedFilterReader
+	// smallestKey and largestKey are the user key range in the properties, they're nil if the file doesn't
+	// have the properties.
+	smallestKey []byte
+	largestKey  []byte
+	// comparatorName is the comparator name in the properties, it's empty if the file doesn't record it.
+	comparatorName string
+
+	// strict mode checks the keys of each data block against the index entries.
+	strict       bool
+	checkIter    blockIterator
+	prevIndexKey []byte
+
+	blockCache *BlockCache
+
+	// readAhead is the number of the data blocks prefetched by one read when iterating forward, the blocks
+	// [raOffset, raOffset+len(raBuf)) of the file are buffered in raBuf. raIter peeks the following handles.
+	readAhead int
+	raBuf     []byte
+	raOffset  uint64
+	raIter    blockIterator
+
+	// seqFilter skips the keys whose sequence number is out of [minSeq, maxSeq].
+	seqFilter bool
+	minSeq    uint64
+	maxSeq    uint64
+	// putsOnly skips the keys whose type is not TypeValue.
+	putsOnly bool
+
+	// lowerBound and upperBound are the encoded internal keys of the range [lowerBound, upperBound) iterated by
+	// SeekToFirst and Next, nil means unbounded.
+	lowerBound []byte
+	upperBound []byte
 }
 
 // NewSstFileIterator returns a new SstFileIterator.
 func NewSstFileIterator(f *os.File) (*SstFileIterator, error) {
 	it := &SstFileIterator{
-		f:             f,
 		dataBlockIter: new(blockIterator),
 	}
+	if err := it.Reset(f); err != nil {
+		return nil, err
+	}
+
+	return it, nil
+}
 
-	if err := it.loadIndexBlock(); err != nil {
+// NewSstFileIteratorFromBytes returns a new SstFileIterator which reads the sst file content in data, no file
+// is involved. The data must not be modified while the iterator is used.
+func NewSstFileIteratorFromBytes(data []byte) (*SstFileIterator, error) {
+	it := &SstFileIterator{
+		dataBlockIter: new(blockIterator),
+	}
+	if err := it.resetReader(bytes.NewReader(data), int64(len(data))); err != nil {
 		return nil, err
 	}
+	return it, nil
+}
 
+// OpenSstFileIterator opens the sst file read-only and returns the iterator of it, the file is closed by Close.
+// If directIO is set, the file is opened with the direct IO flags of the platform so the reads don't go through
+// the page cache, the buffered IO is used if direct IO isn't supported.
+func OpenSstFileIterator(path string, directIO bool) (*SstFileIterator, error) {
+	f, direct, err := openForRead(path, directIO)
+	if err != nil {
+		return nil, err
+	}
+	it := &SstFileIterator{
+		dataBlockIter: new(blockIterator),
+		directIO:      direct,
+	}
+	if err = it.Reset(f); err != nil {
+		f.Close()
+		return nil, err
+	}
 	return it, nil
 }
 
-// SeekToFirst moves the iterator to the first key.
+// NewSstFileIteratorBounded returns a new SstFileIterator which only visits the keys in [start, end), the keys
+// are compared as internal keys. SeekToFirst moves the iterator to the first key not less than start, and Next
+// stops at end without loading the data blocks beyond it. An empty user key of start or end means unbounded.
+func NewSstFileIteratorBounded(f *os.File, start, end InternalKey) (*SstFileIterator, error) {
+	it, err := NewSstFileIterator(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(start.UserKey) > 0 {
+		it.lowerBound = start.Encode()
+	}
+	if len(end.UserKey) > 0 {
+		it.upperBound = end.Encode()
+	}
+	return it, nil
+}
+
+// DirectIO returns whether the reads of the iterator bypass the page cache.
+func (it *SstFileIterator) DirectIO() bool {
+	return it.directIO
+}
+
+// Close closes the file of the iterator, it's a no-op for the iterator created from bytes.
+func (it *SstFileIterator) Close() error {
+	if it.f == nil {
+		return nil
+	}
+	return it.f.Close()
+}
+
+// Reset rebinds the iterator to a new file, the buffers are reused. The strict mode, the direct IO and the block
+// cache settings are kept, the block cache must be reset by SetBlockCache if it's bound to the previous file.
+func (it *SstFileIterator) Reset(f *os.File) error {
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	it.f = f
+	var reader io.ReaderAt = f
+	if it.directIO {
+		reader = &alignedReaderAt{f: f}
+	}
+	return it.resetReader(reader, fi.Size())
+}
+
+// resetReader rebinds the iterator to the sst data of the size read by reader.
+func (it *SstFileIterator) resetReader(reader io.ReaderAt, size int64) error {
+	it.reader = reader
+	it.size = size
+	it.invalid = false
+	it.err = nil
+	it.checksumType = 0
+	it.globalSeqNo = 0
+	it.filter = nil
+	it.partFilter = nil
+	it.smallestKey = nil
+	it.largestKey = nil
+	it.comparatorName = ""
+	it.prevIndexKey = it.prevIndexKey[:0]
+	it.raBuf = it.raBuf[:0]
+
+	metaIndexHandle, indexHandle, err := it.getBlockHandles()
+	if err != nil {
+		return err
+	}
+	if err = it.loadIndexBlock(indexHandle); err != nil {
+		return err
+	}
+	return it.loadMetaBlocks(metaIndexHandle)
+}
+
+// BlockInfo describes a data block in the sst file.
+type BlockInfo struct {
+	// Separator is the index key of the block, it's not less than the last key of the block.
+	Separator InternalKey
+	Offset    uint64
+	Size      uint64
+}
+
+// BlockHandles returns the information of all the data blocks in order, the data blocks are not read.
+func (it *SstFileIterator) BlockHandles() ([]BlockInfo, error) {
+	// Use a separate iterator to keep the position of the index block iterator.
+	bi := blockIterator{data: it.indexBlockIter.data, valueDeltaEncoded: it.indexBlockIter.valueDeltaEncoded}
+	var infos []BlockInfo
+	for !bi.end() {
+		bi.Next()
+		if !bi.Valid() {
+			return nil, ErrCorruptedBlock
+		}
+		var info BlockInfo
+		if err := info.Separator.Decode(bi.Key()); err != nil {
+			return nil, err
+		}
+		var handle blockHandle
+		handle.Decode(bi.Value())
+		info.Offset, info.Size = handle.Offset, handle.Size
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// BlockHandle is the position of a block in the sst file, the size doesn't include the block trailer.
+type BlockHandle struct {
+	Offset uint64
+	Size   uint64
+}
+
+// MetaIndex returns the handles of the meta blocks keyed by the meta block names, e.g. "rocksdb.properties".
+func (it *SstFileIterator) MetaIndex() (map[string]BlockHandle, error) {
+	metaIndexHandle, _, err := it.getBlockHandles()
+	if err != nil {
+		return nil, err
+	}
+	data, err := it.readBlock(metaIndexHandle)
+	if err != nil {
+		return nil, err
+	}
+	handles := make(map[string]BlockHandle)
+	bi := newBlockIterator(data)
+	for !bi.end() {
+		bi.Next()
+		if !bi.Valid() {
+			return nil, ErrCorruptedBlock
+		}
+		var handle blockHandle
+		if handle.Decode(bi.Value()) != len(bi.Value()) {
+			return nil, ErrCorruptedBlock
+		}
+		handles[string(bi.Key())] = BlockHandle{Offset: handle.Offset, Size: handle.Size}
+	}
+	return handles, nil
+}
+
+// SmallestKey returns the smallest user key in the properties, nil is returned if the file doesn't record it.
+func (it *SstFileIterator) SmallestKey() []byte {
+	return it.smallestKey
+}
+
+// LargestKey returns the largest user key in the properties, nil is returned if the file doesn't record it.
+func (it *SstFileIterator) LargestKey() []byte {
+	return it.largestKey
+}
+
+// outOfRange returns whether the user key is out of the key range in the properties.
+func (it *SstFileIterator) outOfRange(userKey []byte) bool {
+	return it.smallestKey != nil &&
+		(bytes.Compare(userKey, it.smallestKey) < 0 || bytes.Compare(userKey, it.largestKey) > 0)
+}
+
+// MayContain returns false if the user key is definitely not in the file according to the full filter or
+// the partitioned filter.
+func (it *SstFileIterator) MayContain(userKey []byte) bool {
+	if it.partFilter != nil {
+		return it.partFilter.MayMatch(userKey)
+	}
+	return it.filter == nil || it.filter.MayMatch(userKey)
+}
+
+// Get returns the newest entry of the user key, ErrKeyNotFound is returned if the key is not in the file.
+// The data blocks are not read if the key is out of the key range in the properties or the filter tells the key
+// is absent. Get doesn't change the position of the iterator.
+func (it *SstFileIterator) Get(userKey []byte) (InternalKey, []byte, error) {
+	var ikey InternalKey
+	if it.outOfRange(userKey) || !it.MayContain(userKey) {
+		return ikey, nil, ErrKeyNotFound
+	}
+	bi := blockIterator{data: it.indexBlockIter.data, valueDeltaEncoded: it.indexBlockIter.valueDeltaEncoded}
+	var dataIter blockIterator
+	for !bi.end() {
+		bi.Next()
+		if !bi.Valid() {
+			return ikey, nil, ErrCorruptedBlock
+		}
+		// The index key is not less than the keys of the block.
+		if bytes.Compare(extractUserKey(bi.Key()), userKey) < 0 {
+			continue
+		}
+		var handle blockHandle
+		handle.Decode(bi.Value())
+		block, err := it.getDataBlock(handle)
+		if err != nil {
+			return ikey, nil, err
+		}
+		dataIter.Reset(block)
+		for !dataIter.end() {
+			dataIter.Next()
+			if !dataIter.Valid() {
+				return ikey, nil, ErrCorruptedBlock
+			}
+			cmp := bytes.Compare(extractUserKey(dataIter.Key()), userKey)
+			if cmp == 0 {
+				if err = ikey.Decode(dataIter.Key()); err != nil {
+					return ikey, nil, err
+				}
+				if it.globalSeqNo != 0 {
+					ikey.SequenceNumber = it.globalSeqNo
+				}
+				return ikey, dataIter.Value(), nil
+			}
+			if cmp > 0 {
+				return ikey, nil, ErrKeyNotFound
+			}
+		}
+	}
+	return ikey, nil, ErrKeyNotFound
+}
+
+// getDataBlock reads the data block without using the buffers of the iterator.
+func (it *SstFileIterator) getDataBlock(handle blockHandle) ([]byte, error) {
+	if it.blockCache != nil {
+		return it.readDataBlock(handle)
+	}
+	return it.readBlock(handle)
+}
+
+// SetStrict enables or disables the strict mode. In strict mode, each loaded data block is checked that its
+// keys are in the range of its index entry, ErrIndexKeyMismatch is returned by Err on violation.
+// It's disabled by default because every data block is scanned twice.
+func (it *SstFileIterator) SetStrict(strict bool) {
+	it.strict = strict
+}
+
+// SetBlockCache sets the cache of the decompressed data blocks, the cache can be shared by the iterators
+// of the same file.
+func (it *SstFileIterator) SetBlockCache(cache *BlockCache) {
+	it.blockCache = cache
+}
+
+// SetReadAhead makes the iterator read the next n contiguous data blocks in one read when it moves forward to
+// a data block which is not buffered, the blocks are still decompressed one by one. It saves the reads of the
+// sequential scans, but wastes the bandwidth of the point lookups, so it's disabled by default. n <= 1
+// disables it.
+func (it *SstFileIterator) SetReadAhead(n int) {
+	if n <= 1 {
+		n = 0
+	}
+	it.readAhead = n
+	it.raBuf = it.raBuf[:0]
+}
+
+// SetSeqNoRange makes the iterator only visit the keys whose sequence number is in [minSeq, maxSeq].
+func (it *SstFileIterator) SetSeqNoRange(minSeq, maxSeq uint64) {
+	it.seqFilter = true
+	it.minSeq = minSeq
+	it.maxSeq = maxSeq
+}
+
+// SetPutsOnly makes the iterator skip the deletion, single deletion and merge records, only the keys of
+// TypeValue are visited.
+func (it *SstFileIterator) SetPutsOnly(putsOnly bool) {
+	it.putsOnly = putsOnly
+}
+
+// SeekToFirst moves the iterator to the first key, or the first key not less than the lower bound of a bounded
+// iterator.
 func (it *SstFileIterator) SeekToFirst() {
+	if it.lowerBound != nil {
+		it.seekToLowerBound()
+		return
+	}
 	it.indexBlockIter.Rewind()
 	it.invalid = false
+	it.prevIndexKey = it.prevIndexKey[:0]
 	if err := it.loadNextDataBlk(); err != nil {
 		it.setErr(err)
 		return
@@ -63,9 +408,229 @@ func (it *SstFileIterator) SeekToFirst() {
 	it.Next()
 }
 
+// seekToLowerBound moves the iterator to the first key not less than the lower bound, only the data block which
+// may contain the key is read.
+func (it *SstFileIterator) seekToLowerBound() {
+	it.invalid = false
+	cmp := Comparator(bytes.Compare)
+	// The first key not less than the lower bound is in the first block whose index key is not less than it.
+	bi := blockIterator{data: it.indexBlockIter.data, valueDeltaEncoded: it.indexBlockIter.valueDeltaEncoded}
+	blk := -1
+	for i := 0; !bi.end(); i++ {
+		bi.Next()
+		if !bi.Valid() {
+			it.setErr(ErrCorruptedBlock)
+			return
+		}
+		if cmp.CompareInternalKey(bi.Key(), it.lowerBound) >= 0 {
+			blk = i
+			break
+		}
+	}
+	if blk < 0 {
+		it.invalid = true
+		return
+	}
+	if err := it.loadDataBlk(blk); err != nil {
+		it.setErr(err)
+		return
+	}
+	it.dataBlockIter.Seek(it.lowerBound, cmp.CompareInternalKey)
+	if !it.dataBlockIter.Valid() {
+		if !it.dataBlockIter.end() {
+			it.setErr(ErrCorruptedBlock)
+			return
+		}
+		// All the keys in the block are less than the lower bound, the first key of the next block is the one.
+		it.Next()
+		return
+	}
+	if it.exceedUpperBound() {
+		it.invalid = true
+		return
+	}
+	if (it.seqFilter || it.putsOnly) && it.skipCurrent() {
+		it.Next()
+	}
+}
+
+// exceedUpperBound returns whether the current key is not less than the upper bound.
+func (it *SstFileIterator) exceedUpperBound() bool {
+	return it.upperBound != nil && it.dataBlockIter.Valid() &&
+		Comparator(bytes.Compare).CompareInternalKey(it.dataBlockIter.Key(), it.upperBound) >= 0
+}
+
+// SeekForPrev moves the iterator to the last key not greater than target, the iterator is invalid if target is less
+// than the first key. The keys skipped by the sequence number range or the puts only mode are not visited.
+func (it *SstFileIterator) SeekForPrev(target InternalKey) {
+	it.invalid = false
+	// No block is read if target is less than the smallest key in the properties.
+	if it.smallestKey != nil && bytes.Compare(target.UserKey, it.smallestKey) < 0 {
+		it.invalid = true
+		return
+	}
+	targetKey := target.Encode()
+	cmp := Comparator(bytes.Compare)
+	// The target is in the first block whose index key is not less than it, or it's greater than all the keys.
+	bi := blockIterator{data: it.indexBlockIter.data, valueDeltaEncoded: it.indexBlockIter.valueDeltaEncoded}
+	targetBlk, numBlks := -1, 0
+	for !bi.end() {
+		bi.Next()
+		if !bi.Valid() {
+			it.setErr(ErrCorruptedBlock)
+			return
+		}
+		if targetBlk < 0 && cmp.CompareInternalKey(bi.Key(), targetKey) >= 0 {
+			targetBlk = numBlks
+		}
+		numBlks++
+	}
+	if targetBlk < 0 {
+		targetBlk = numBlks - 1
+	}
+	// Walk backward block by block in case all the keys not greater than target in the block are skipped.
+	for blk := targetBlk; blk >= 0; blk-- {
+		if err := it.loadDataBlk(blk); err != nil {
+			it.setErr(err)
+			return
+		}
+		pos, i := -1, 0
+		for !it.dataBlockIter.end() {
+			it.dataBlockIter.Next()
+			if !it.dataBlockIter.Valid() {
+				it.setErr(ErrCorruptedBlock)
+				return
+			}
+			if cmp.CompareInternalKey(it.dataBlockIter.Key(), targetKey) > 0 {
+				break
+			}
+			if !(it.seqFilter || it.putsOnly) || !it.skipCurrent() {
+				pos = i
+			}
+			i++
+		}
+		if pos >= 0 {
+			it.dataBlockIter.Rewind()
+			for i = 0; i <= pos; i++ {
+				it.dataBlockIter.Next()
+			}
+			return
+		}
+	}
+	it.invalid = true
+}
+
+// positionTokenLen is the length of the token returned by SavePosition, it's the offset and the size of the
+// current data block followed by the offset of the next entry in the block.
+const positionTokenLen = 24
+
+// SavePosition returns an opaque token of the current position, Resume with the token moves a new iterator of
+// the same file to the key following the current one. The iterator must be valid.
+func (it *SstFileIterator) SavePosition() ([]byte, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	if !it.Valid() {
+		return nil, errors.New("iterator is not valid")
+	}
+	var handle blockHandle
+	handle.Decode(it.indexBlockIter.Value())
+	token := make([]byte, positionTokenLen)
+	rocksEndian.PutUint64(token, handle.Offset)
+	rocksEndian.PutUint64(token[8:], handle.Size)
+	rocksEndian.PutUint64(token[16:], uint64(it.dataBlockIter.cursor))
+	return token, nil
+}
+
+// Resume moves the iterator to the key following the one current when the token is saved by SavePosition,
+// the same key the saved iterator would land on by Next. Only the data block of the position is read, the
+// index block is scanned to find it. ErrInvalidPosition is returned if the token doesn't match the file.
+func (it *SstFileIterator) Resume(token []byte) error {
+	if len(token) != positionTokenLen {
+		return ErrInvalidPosition
+	}
+	target := blockHandle{Offset: rocksEndian.Uint64(token), Size: rocksEndian.Uint64(token[8:])}
+	cursor := rocksEndian.Uint64(token[16:])
+	it.invalid = false
+	it.err = nil
+	bi := blockIterator{data: it.indexBlockIter.data, valueDeltaEncoded: it.indexBlockIter.valueDeltaEncoded}
+	blk := -1
+	for i := 0; !bi.end(); i++ {
+		bi.Next()
+		if !bi.Valid() {
+			return ErrCorruptedBlock
+		}
+		var handle blockHandle
+		handle.Decode(bi.Value())
+		if handle == target {
+			blk = i
+			break
+		}
+	}
+	if blk < 0 {
+		return ErrInvalidPosition
+	}
+	if err := it.loadDataBlk(blk); err != nil {
+		it.setErr(err)
+		return err
+	}
+	if cursor > uint64(len(it.dataBlockIter.data)) || !it.dataBlockIter.seekToEntryEnd(int(cursor)) {
+		it.invalid = true
+		return ErrInvalidPosition
+	}
+	it.Next()
+	return it.err
+}
+
+// loadDataBlk loads the data block at the index position blk, the following Next continues from the block.
+func (it *SstFileIterator) loadDataBlk(blk int) error {
+	it.indexBlockIter.Rewind()
+	it.prevIndexKey = it.prevIndexKey[:0]
+	for i := 0; i < blk; i++ {
+		it.indexBlockIter.Next()
+		it.prevIndexKey = append(it.prevIndexKey[:0], it.indexBlockIter.Key()...)
+	}
+	return it.loadNextDataBlk()
+}
+
 // Next moves the SstFileIterator to the next key.
 func (it *SstFileIterator) Next() {
+	it.next()
+	if !it.seqFilter && !it.putsOnly {
+		return
+	}
+	for it.Valid() && it.skipCurrent() {
+		it.next()
+	}
+}
+
+func (it *SstFileIterator) skipCurrent() bool {
+	seq, kind := it.trailer()
+	if it.putsOnly && kind != TypeValue {
+		return true
+	}
+	return it.seqFilter && (seq < it.minSeq || seq > it.maxSeq)
+}
+
+// trailer decodes the sequence number and the type of the current key without copying the user key.
+func (it *SstFileIterator) trailer() (uint64, ValueType) {
+	var ikey InternalKey
+	key := it.dataBlockIter.Key()
+	ikey.unpackSeqAndType(rocksEndian.Uint64(key[len(key)-8:]))
+	if it.globalSeqNo != 0 {
+		ikey.SequenceNumber = it.globalSeqNo
+	}
+	return ikey.SequenceNumber, ikey.ValueType
+}
+
+func (it *SstFileIterator) next() {
 	if it.dataBlockIter.end() {
+		// The index key is not less than the keys of the current block and less than the keys of the next one,
+		// so the next block is beyond the upper bound if the index key is.
+		if it.upperBound != nil && Comparator(bytes.Compare).CompareInternalKey(it.indexBlockIter.Key(), it.upperBound) >= 0 {
+			it.invalid = true
+			return
+		}
 		if err := it.loadNextDataBlk(); err != nil {
 			it.setErr(err)
 			return
@@ -73,20 +638,53 @@ func (it *SstFileIterator) Next() {
 	}
 
 	it.dataBlockIter.Next()
+	if it.exceedUpperBound() {
+		it.invalid = true
+	}
 }
 
-// Key returns the key associated with the current SstFileIterator
+// Key returns the key associated with the current SstFileIterator. If the key can't be decoded, the error is
+// returned by Err and the iterator becomes invalid.
 func (it *SstFileIterator) Key() InternalKey {
 	var ikey InternalKey
-	ikey.Decode(it.dataBlockIter.Key())
+	if err := ikey.Decode(it.dataBlockIter.Key()); err != nil {
+		it.setErr(err)
+	}
+	if it.globalSeqNo != 0 {
+		ikey.SequenceNumber = it.globalSeqNo
+	}
 	return ikey
 }
 
-// Value returns the value associated with the current SstFileIterator
+// Kind returns the value type of the current key.
+func (it *SstFileIterator) Kind() ValueType {
+	_, kind := it.trailer()
+	return kind
+}
+
+// GlobalSeqNo returns the global sequence number of the file, 0 means the file has no global sequence number
+// and the sequence numbers of the keys are used as is.
+func (it *SstFileIterator) GlobalSeqNo() uint64 {
+	return it.globalSeqNo
+}
+
+// FormatVersion returns the table format version recorded in the footer.
+func (it *SstFileIterator) FormatVersion() uint32 {
+	return it.formatVersion
+}
+
+// Value returns the value associated with the current SstFileIterator. The value is borrowed from the buffer of
+// the iterator, it's overwritten when the iterator moves, so it must not be retained after Next, the seeks or
+// Reset. Use ValueCopy to keep the value.
 func (it *SstFileIterator) Value() []byte {
 	return it.dataBlockIter.Value()
 }
 
+// ValueCopy returns a copy of the current value which is still valid after the iterator moves.
+func (it *SstFileIterator) ValueCopy() []byte {
+	return append([]byte(nil), it.dataBlockIter.Value()...)
+}
+
 // Valid returns whether the SstFileIterator is exhausted.
 func (it *SstFileIterator) Valid() bool {
 	return !it.invalid
@@ -97,6 +695,19 @@ func (it *SstFileIterator) Err() error {
 	return it.err
 }
 
+// All returns a function which iterates all the entries from the first one, it stops when yield returns false.
+// It can be used as a range-over-func iterator, the error is available from Err after the iteration finishes.
+// The key and the value are only valid until yield returns, the position of the SstFileIterator is moved.
+func (it *SstFileIterator) All() func(yield func(InternalKey, []byte) bool) {
+	return func(yield func(InternalKey, []byte) bool) {
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			if !yield(it.Key(), it.Value()) {
+				return
+			}
+		}
+	}
+}
+
 func (it *SstFileIterator) loadNextDataBlk() error {
 	var err error
 
@@ -107,16 +718,137 @@ func (it *SstFileIterator) loadNextDataBlk() error {
 	it.indexBlockIter.Next()
 	var handle blockHandle
 	handle.Decode(it.indexBlockIter.Value())
+	if it.readAhead > 0 {
+		if err = it.prefetch(handle); err != nil {
+			return err
+		}
+	}
 
-	it.checkReadBufSize(handle.Size + blockTrailerSize)
-	if _, err = it.f.ReadAt(it.readBuf, int64(handle.Offset)); err != nil {
+	block, err := it.readDataBlock(handle)
+	if err != nil {
 		return err
 	}
-	if it.dataBuf, err = it.decompressBlock(it.dataBuf, it.readBuf); err != nil {
+	if it.strict {
+		if err = it.checkDataBlock(block, it.indexBlockIter.Key()); err != nil {
+			return err
+		}
+	}
+	it.dataBlockIter.Reset(block)
+
+	return nil
+}
+
+func (it *SstFileIterator) readDataBlock(handle blockHandle) ([]byte, error) {
+	if it.blockCache != nil {
+		if block, ok := it.blockCache.get(handle.Offset); ok {
+			return block, nil
+		}
+	}
+	raw, err := it.readRawBlock(handle)
+	if err != nil {
+		return nil, err
+	}
+	if it.blockCache == nil {
+		block, err := it.decompressBlock(it.dataBuf, raw)
+		if err != nil {
+			return nil, err
+		}
+		// The uncompressed block is the raw data itself, it can't be reused as the decompression buffer because
+		// the raw data may be in the read-ahead buffer.
+		if CompressionType(raw[len(raw)-blockTrailerSize]) != CompressionNone {
+			it.dataBuf = block
+		}
+		return block, nil
+	}
+	// The cached block is shared, so it can't reuse the buffers of the iterator.
+	block, err := it.decompressBlock(nil, raw)
+	if err != nil {
+		return nil, err
+	}
+	block = append([]byte(nil), block...)
+	it.blockCache.put(handle.Offset, block)
+	return block, nil
+}
+
+// readRawBlock returns the raw block with the trailer, it's sliced from the read-ahead buffer if the block is
+// buffered, otherwise it's read into readBuf.
+func (it *SstFileIterator) readRawBlock(handle blockHandle) ([]byte, error) {
+	sz := handle.Size + blockTrailerSize
+	if it.buffered(handle) {
+		off := handle.Offset - it.raOffset
+		return it.raBuf[off : off+sz], nil
+	}
+	it.checkReadBufSize(sz)
+	if _, err := it.reader.ReadAt(it.readBuf, int64(handle.Offset)); err != nil {
+		return nil, err
+	}
+	return it.readBuf, nil
+}
+
+func (it *SstFileIterator) buffered(handle blockHandle) bool {
+	return handle.Offset >= it.raOffset && handle.Offset+handle.Size+blockTrailerSize <= it.raOffset+uint64(len(it.raBuf))
+}
+
+// prefetch reads the data block of the handle and the following data blocks adjacent to it in the file into the
+// read-ahead buffer, up to readAhead blocks. The index iterator is positioned at the handle and isn't moved.
+func (it *SstFileIterator) prefetch(handle blockHandle) error {
+	if it.buffered(handle) {
+		return nil
+	}
+	if it.blockCache != nil {
+		if _, ok := it.blockCache.get(handle.Offset); ok {
+			return nil
+		}
+	}
+	keyBuf, valueBuf := it.raIter.keyBuf, it.raIter.valueBuf
+	it.raIter = *it.indexBlockIter
+	it.raIter.keyBuf = append(keyBuf[:0], it.indexBlockIter.keyBuf...)
+	it.raIter.valueBuf = append(valueBuf[:0], it.indexBlockIter.valueBuf...)
+	end := handle.Offset + handle.Size + blockTrailerSize
+	for i := 1; i < it.readAhead && !it.raIter.end(); i++ {
+		it.raIter.Next()
+		if !it.raIter.Valid() {
+			break
+		}
+		var next blockHandle
+		next.Decode(it.raIter.Value())
+		if next.Offset != end {
+			break
+		}
+		end += next.Size + blockTrailerSize
+	}
+	sz := end - handle.Offset
+	if uint64(cap(it.raBuf)) < sz {
+		it.raBuf = make([]byte, sz)
+	}
+	it.raBuf = it.raBuf[:sz]
+	if _, err := it.reader.ReadAt(it.raBuf, int64(handle.Offset)); err != nil {
+		it.raBuf = it.raBuf[:0]
 		return err
 	}
-	it.dataBlockIter.Reset(it.dataBuf)
+	it.raOffset = handle.Offset
+	return nil
+}
 
+// checkDataBlock checks the first key of the block is greater than the previous index key and the last key
+// is not greater than the index key of the block.
+func (it *SstFileIterator) checkDataBlock(block, indexKey []byte) error {
+	cmp := Comparator(bytes.Compare)
+	it.checkIter.Reset(block)
+	it.checkIter.Next()
+	if !it.checkIter.Valid() {
+		return ErrIndexKeyMismatch
+	}
+	if len(it.prevIndexKey) > 0 && cmp.CompareInternalKey(it.checkIter.Key(), it.prevIndexKey) <= 0 {
+		return ErrIndexKeyMismatch
+	}
+	for !it.checkIter.end() {
+		it.checkIter.Next()
+	}
+	if !it.checkIter.Valid() || cmp.CompareInternalKey(it.checkIter.Key(), indexKey) > 0 {
+		return ErrIndexKeyMismatch
+	}
+	it.prevIndexKey = append(it.prevIndexKey[:0], indexKey...)
 	return nil
 }
 
@@ -139,7 +871,7 @@ func (it *SstFileIterator) decompressBlock(dst, raw []byte) ([]byte, error) {
 		crc := newCrc32()
 		crc.Write(raw[:trailerPos+1])
 		sum := crc.Sum32()
-		expected := unmaskCrc32(rocksEndian.Uint32(raw[trailerPos+1:]))
+		expected := unmaskCrc32(it.byteOrder.Uint32(raw[trailerPos+1:]))
 		if expected != sum {
 			return nil, ErrChecksumMismatch
 		}
@@ -150,67 +882,247 @@ func (it *SstFileIterator) decompressBlock(dst, raw []byte) ([]byte, error) {
 	return DecompressBlock(compressTp, blkData, dst)
 }
 
-func (it *SstFileIterator) getIndexBlockHandle() (blockHandle, error) {
-	var handle blockHandle
-
+func (it *SstFileIterator) getBlockHandles() (metaIndexHandle, indexHandle blockHandle, err error) {
 	footer, err := it.loadFooter()
 	if err != nil {
-		return handle, err
+		return
 	}
 
-	// Skip meta index handle
-	n := handle.Decode(footer[1:])
-	handle.Decode(footer[1+n:])
-	return handle, nil
+	n := metaIndexHandle.Decode(footer[1:])
+	indexHandle.Decode(footer[1+n:])
+	return
 }
 
 func (it *SstFileIterator) loadFooter() ([]byte, error) {
-	fi, err := it.f.Stat()
-	if err != nil {
-		return nil, err
+	off := it.size - footerEncodedLength
+	if off < 0 {
+		return nil, errors.Errorf("sst file size %d is smaller than the footer", it.size)
 	}
-
-	off := fi.Size() - footerEncodedLength
 	var footerBuf [footerEncodedLength]byte
-	if _, err = it.f.ReadAt(footerBuf[:], off); err != nil {
+	if _, err := it.reader.ReadAt(footerBuf[:], off); err != nil {
 		return nil, err
 	}
 
-	if !it.checkMagicNumber(footerBuf[:]) {
-		return nil, ErrMagicNumberMismatch
+	byteOrder, version, err := parseFooter(footerBuf[:])
+	if err != nil {
+		return nil, err
 	}
+	it.byteOrder = byteOrder
+	it.formatVersion = version
 	it.checksumType = ChecksumType(footerBuf[0])
 
 	return footerBuf[:], nil
 }
 
-func (it *SstFileIterator) checkMagicNumber(footer []byte) bool {
+// parseFooter derives the byte order of the fixed length integers from the magic number and validates the
+// format version and the checksum type in the footer. RocksDB always writes little-endian files, a magic
+// number in big-endian means the file is produced by an incompatible writer.
+func parseFooter(footer []byte) (binary.ByteOrder, uint32, error) {
 	pos := footerEncodedLength - 8
-	if rocksEndian.Uint32(footer[pos:]) != blockBasedTableMagicNumber&0xffffffff {
-		return false
+	var byteOrder binary.ByteOrder
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		if order.Uint32(footer[pos:]) == blockBasedTableMagicNumber&0xffffffff &&
+			order.Uint32(footer[pos+4:]) == blockBasedTableMagicNumber>>32 {
+			byteOrder = order
+			break
+		}
 	}
-	pos += 4
-	return rocksEndian.Uint32(footer[pos:]) == blockBasedTableMagicNumber>>32
+	if byteOrder == nil {
+		return nil, 0, ErrMagicNumberMismatch
+	}
+	if byteOrder != rocksEndian {
+		return nil, 0, ErrUnsupportedByteOrder
+	}
+	version := byteOrder.Uint32(footer[footerEncodedLength-12:])
+	if version < minFormatVersion || version > maxFormatVersion {
+		return nil, 0, errors.Errorf("unsupported format version %d", version)
+	}
+	// The xxHash checksum is not implemented yet, the blocks of such files can't be verified.
+	if tp := ChecksumType(footer[0]); tp >= ChecksumXXHash {
+		return nil, 0, errors.Errorf("unsupported checksum type %d", tp)
+	}
+	return byteOrder, version, nil
 }
 
-func (it *SstFileIterator) loadIndexBlock() error {
-	handle, err := it.getIndexBlockHandle()
+func (it *SstFileIterator) loadIndexBlock(handle blockHandle) error {
+	indexBlkData, err := it.readBlock(handle)
 	if err != nil {
 		return err
 	}
+	if it.indexBlockIter == nil {
+		it.indexBlockIter = newBlockIterator(indexBlkData)
+	} else {
+		it.indexBlockIter.Reset(indexBlkData)
+	}
 
-	indexBlkData := make([]byte, handle.Size+blockTrailerSize)
-	if _, err = it.f.ReadAt(indexBlkData, int64(handle.Offset)); err != nil {
+	return nil
+}
+
+// loadMetaBlocks loads the global sequence number, the index value format and the full filter from the meta blocks.
+func (it *SstFileIterator) loadMetaBlocks(metaIndexHandle blockHandle) error {
+	metaIndexData, err := it.readBlock(metaIndexHandle)
+	if err != nil {
 		return err
 	}
-	if indexBlkData, err = it.decompressBlock(nil, indexBlkData); err != nil {
+	propsData, err := findBlock(metaIndexData, propsBlockHandleKey, it.readBlock)
+	if err != nil {
+		return err
+	}
+	var prefixExtractorName string
+	var indexKeyIsUserKey bool
+	it.indexBlockIter.valueDeltaEncoded = false
+	if propsData != nil {
+		it.loadGlobalSeqNo(propsData)
+		if v := findProp(propsData, propIndexValueIsDeltaEncoded); v != nil {
+			it.indexBlockIter.valueDeltaEncoded = decodePropUint64(v) != 0
+		}
+		if v := findProp(propsData, propIndexKeyIsUserKey); v != nil {
+			indexKeyIsUserKey = decodePropUint64(v) != 0
+		}
+		prefixExtractorName = string(findProp(propsData, propPrefixExtractorName))
+		it.comparatorName = string(findProp(propsData, propComparator))
+		if !isBytewiseComparator(it.comparatorName) {
+			return errors.Errorf("unsupported comparator %q", it.comparatorName)
+		}
+		smallest, largest := findProp(propsData, propSmallestKey), findProp(propsData, propLargestKey)
+		if smallest != nil && largest != nil {
+			it.smallestKey = append([]byte(nil), smallest...)
+			it.largestKey = append([]byte(nil), largest...)
+		}
+	}
+	// The filter may only contain the key prefixes if the file is built with a prefix extractor,
+	// it can't be used to check the whole keys.
+	if prefixExtractorName != "" && prefixExtractorName != "nullptr" {
+		return nil
+	}
+	filterData, err := findFilterBlock(metaIndexData, fullFilterBlockPrefix, it.readBlock)
+	if err != nil {
 		return err
 	}
-	it.indexBlockIter = newBlockIterator(indexBlkData)
+	if filterData != nil {
+		it.filter = newFullFilterBitsReader(filterData)
+		return nil
+	}
+	// The partitions of the two-level filter are read on demand, the index of the filter shares the key and
+	// value format with the index of the data blocks.
+	filterIndexData, err := findFilterBlock(metaIndexData, partitionedFilterBlockPrefix, it.readBlock)
+	if err != nil || filterIndexData == nil {
+		return err
+	}
+	it.partFilter = newPartitionedFilterReader(filterIndexData, indexKeyIsUserKey,
+		it.indexBlockIter.valueDeltaEncoded, it.readBlock)
+	return nil
+}
+
+// The comparator names of the files ordered by bytewise user keys, the internal key comparator name is recorded
+// by some old versions of RocksDB.
+const (
+	BytewiseComparatorName    = "leveldb.BytewiseComparator"
+	internalKeyComparatorName = "rocksdb.InternalKeyComparator:" + BytewiseComparatorName
+)
+
+// isBytewiseComparator returns whether the keys are ordered by bytewise comparing the user keys, the files without
+// the comparator name are assumed to be.
+func isBytewiseComparator(name string) bool {
+	return name == "" || name == BytewiseComparatorName || name == internalKeyComparatorName
+}
+
+// ComparatorName returns the comparator name recorded in the properties of the file, it's empty if the file
+// doesn't record it. Only the files ordered by the bytewise comparator can be opened.
+func (it *SstFileIterator) ComparatorName() string {
+	return it.comparatorName
+}
+
+// loadGlobalSeqNo loads the global sequence number from the properties of the external sst file.
+func (it *SstFileIterator) loadGlobalSeqNo(propsData []byte) {
+	version := findProp(propsData, propExternalSstFileVersion)
+	seqNo := findProp(propsData, propGlobalSeqNo)
+	// The global sequence number is supported since version 2.
+	if version == nil || decodePropUint64(version) < 2 || seqNo == nil {
+		return
+	}
+	it.globalSeqNo = decodePropUint64(seqNo)
+}
+
+func (it *SstFileIterator) readBlock(handle blockHandle) ([]byte, error) {
+	data := make([]byte, handle.Size+blockTrailerSize)
+	if _, err := it.reader.ReadAt(data, int64(handle.Offset)); err != nil {
+		return nil, err
+	}
+	return it.decompressBlock(nil, data)
+}
 
+// findBlock reads the block with the given name in the meta index block, nil is returned if it doesn't exist.
+func findBlock(metaIndexData []byte, name string, read func(blockHandle) ([]byte, error)) ([]byte, error) {
+	value := findProp(metaIndexData, name)
+	if value == nil {
+		return nil, nil
+	}
+	var handle blockHandle
+	handle.Decode(value)
+	return read(handle)
+}
+
+// The names of the filter meta blocks are the filter type prefix followed by the name of the filter policy.
+const (
+	fullFilterBlockPrefix        = "fullfilter."
+	partitionedFilterBlockPrefix = "partitionedfilter."
+)
+
+// bloomFilterPolicyNames are the filter policy names in the filter block names written by different RocksDB
+// versions for the bloom filter that fullFilterBitsReader reads.
+var bloomFilterPolicyNames = map[string]bool{
+	"rocksdb.BuiltinBloomFilter":         true,
+	"rocksdb.internal.LegacyBloomFilter": true,
+}
+
+// findFilterBlock reads the filter block whose name has the prefix and a known bloom filter policy name, nil is
+// returned if there is no such block, so the filters of the unknown policies are not used.
+func findFilterBlock(metaIndexData []byte, prefix string, read func(blockHandle) ([]byte, error)) ([]byte, error) {
+	bi := newBlockIterator(metaIndexData)
+	for !bi.end() {
+		bi.Next()
+		if !bi.Valid() {
+			break
+		}
+		name := string(bi.Key())
+		if strings.HasPrefix(name, prefix) && bloomFilterPolicyNames[name[len(prefix):]] {
+			var handle blockHandle
+			handle.Decode(bi.Value())
+			return read(handle)
+		}
+	}
+	return nil, nil
+}
+
+// findProp returns the value of the given name in a block keyed by names, nil is returned if it doesn't exist.
+func findProp(data []byte, name string) []byte {
+	bi := newBlockIterator(data)
+	for !bi.end() {
+		bi.Next()
+		if !bi.Valid() {
+			break
+		}
+		if string(bi.Key()) == name {
+			return bi.Value()
+		}
+	}
 	return nil
 }
 
+// decodePropUint64 decodes the integer property. RocksDB encodes the external sst file properties in fixed
+// length while SstFileWriter encodes them as varint.
+func decodePropUint64(value []byte) uint64 {
+	switch len(value) {
+	case 4:
+		return uint64(rocksEndian.Uint32(value))
+	case 8:
+		return rocksEndian.Uint64(value)
+	}
+	v, _ := decodeVarint64(value)
+	return v
+}
+
 func (it *SstFileIterator) setErr(err error) {
 	if err != errEnd {
 		it.err = err
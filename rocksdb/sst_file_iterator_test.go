@@ -15,6 +15,9 @@ package rocksdb
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"testing"
@@ -49,6 +52,18 @@ func TestLz4Compression(t *testing.T) {
 	})
 }
 
+func TestSnappyCompression(t *testing.T) {
+	opts := NewDefaultBlockBasedTableOptions(bytes.Compare)
+	opts.CompressionType = CompressionSnappy
+
+	t.Run("small", func(t *testing.T) {
+		testSstReadWrite(t, smallTestSize, opts)
+	})
+	t.Run("large", func(t *testing.T) {
+		testSstReadWrite(t, largeTestSize, opts)
+	})
+}
+
 func TestBlockAlign(t *testing.T) {
 	opts := NewDefaultBlockBasedTableOptions(bytes.Compare)
 	opts.CompressionType = CompressionLz4
@@ -106,3 +121,1092 @@ func testSstReadWrite(t *testing.T, num int, opts *BlockBasedTableOptions) {
 		require.Nil(t, it.Err())
 	}
 }
+
+func TestSstAddInternalKey(t *testing.T) {
+	f, err := ioutil.TempFile("", "unistore-test.*.sst")
+	require.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	keys := []InternalKey{
+		{UserKey: []byte("a"), SequenceNumber: 3, ValueType: TypeValue},
+		{UserKey: []byte("b"), SequenceNumber: 2, ValueType: TypeDeletion},
+		{UserKey: []byte("c"), SequenceNumber: 1, ValueType: TypeMerge},
+	}
+	w := NewSstFileWriter(f, NewDefaultBlockBasedTableOptions(bytes.Compare))
+	for _, key := range keys {
+		require.Nil(t, w.Add(key, key.UserKey))
+	}
+	require.Equal(t, ErrKeyOrder, w.Add(keys[0], nil))
+	require.Nil(t, w.Finish())
+
+	it, err := NewSstFileIterator(f)
+	require.Nil(t, err)
+	var i int
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		require.Equal(t, keys[i], it.Key())
+		require.Equal(t, keys[i].UserKey, it.Value())
+		i++
+	}
+	require.Equal(t, len(keys), i)
+	require.Nil(t, it.Err())
+}
+
+func TestSstFileWriterKeyOrder(t *testing.T) {
+	f, err := ioutil.TempFile("", "unistore-test.*.sst")
+	require.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	w := NewSstFileWriter(f, NewDefaultBlockBasedTableOptions(bytes.Compare))
+	// A user key can be added with decreasing sequence numbers.
+	keys := []InternalKey{
+		MakeInternalKey([]byte("b"), 5, TypeValue),
+		MakeInternalKey([]byte("b"), 3, TypeDeletion),
+	}
+	for _, key := range keys {
+		require.Nil(t, w.Add(key, []byte("v")))
+	}
+	require.Equal(t, ErrKeyOrder, w.Add(MakeInternalKey([]byte("b"), 3, TypeDeletion), nil))
+	require.Equal(t, ErrKeyOrder, w.Add(MakeInternalKey([]byte("b"), 4, TypeValue), nil))
+	require.Equal(t, ErrKeyOrder, w.Add(MakeInternalKey([]byte("a"), 9, TypeValue), nil))
+	// The keys without sequence number must have increasing user keys.
+	require.Equal(t, ErrKeyOrder, w.Put([]byte("b"), []byte("v")))
+	require.Equal(t, ErrKeyOrder, w.Put([]byte("a"), []byte("v")))
+	require.Nil(t, w.Put([]byte("c"), []byte("v")))
+	require.Equal(t, ErrKeyOrder, w.Delete([]byte("c")))
+	keys = append(keys, MakeInternalKey([]byte("c"), 0, TypeValue))
+	require.Nil(t, w.Finish())
+
+	it, err := NewSstFileIterator(f)
+	require.Nil(t, err)
+	var i int
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		require.Equal(t, keys[i], it.Key())
+		i++
+	}
+	require.Nil(t, it.Err())
+	require.Equal(t, len(keys), i)
+}
+
+func TestBlockCache(t *testing.T) {
+	f, err := ioutil.TempFile("", "unistore-test.*.sst")
+	require.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	opts := NewDefaultBlockBasedTableOptions(bytes.Compare)
+	opts.CompressionType = CompressionLz4
+	nums := sortedNumbers(largeTestSize)
+	w := NewSstFileWriter(f, opts)
+	for _, num := range nums {
+		require.Nil(t, w.Put([]byte(num), []byte(num)))
+	}
+	require.Nil(t, w.Finish())
+
+	cache := NewBlockCache(64 << 20)
+	for n := 0; n < 2; n++ {
+		it, err := NewSstFileIterator(f)
+		require.Nil(t, err)
+		it.SetBlockCache(cache)
+		var i int
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			require.Equal(t, nums[i], string(it.Key().UserKey))
+			require.Equal(t, nums[i], string(it.Value()))
+			i++
+		}
+		require.Equal(t, len(nums), i)
+		require.Nil(t, it.Err())
+	}
+	hits, misses := cache.Stats()
+	require.True(t, misses > 1)
+	require.Equal(t, misses, hits)
+
+	cache = NewBlockCache(1)
+	it, err := NewSstFileIterator(f)
+	require.Nil(t, err)
+	it.SetBlockCache(cache)
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+	}
+	require.Nil(t, it.Err())
+	require.Equal(t, 0, cache.size)
+}
+
+func TestGlobalSeqNo(t *testing.T) {
+	f, err := ioutil.TempFile("", "unistore-test.*.sst")
+	require.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	// Build the file like RocksDB, which encodes the properties in fixed length.
+	opts := NewDefaultBlockBasedTableOptions(bytes.Compare)
+	opts.PropsInjectors = append(opts.PropsInjectors, func(builder *PropsBlockBuilder) {
+		var version [4]byte
+		var seqNo [8]byte
+		rocksEndian.PutUint32(version[:], 2)
+		rocksEndian.PutUint64(seqNo[:], 100)
+		builder.Add(propExternalSstFileVersion, version[:])
+		builder.Add(propGlobalSeqNo, seqNo[:])
+	})
+	b := NewBlockBasedTableBuilder(f, opts)
+	for _, key := range []string{"a", "b", "c"} {
+		ikey := InternalKey{UserKey: []byte(key), ValueType: TypeValue}
+		require.Nil(t, b.Add(ikey.Encode(), []byte(key)))
+	}
+	require.Nil(t, b.Finish())
+
+	it, err := NewSstFileIterator(f)
+	require.Nil(t, err)
+	require.Equal(t, uint64(100), it.GlobalSeqNo())
+	var i int
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		require.Equal(t, uint64(100), it.Key().SequenceNumber)
+		i++
+	}
+	require.Equal(t, 3, i)
+	require.Nil(t, it.Err())
+}
+
+func TestSstFileIteratorReset(t *testing.T) {
+	var files []*os.File
+	for i := 0; i < 2; i++ {
+		f, err := ioutil.TempFile("", "unistore-test.*.sst")
+		require.Nil(t, err)
+		defer func() {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}()
+		w := NewSstFileWriter(f, NewDefaultBlockBasedTableOptions(bytes.Compare))
+		for j := 0; j <= i; j++ {
+			key := []byte{byte('a' + i), byte('a' + j)}
+			require.Nil(t, w.Put(key, key))
+		}
+		require.Nil(t, w.Finish())
+		files = append(files, f)
+	}
+
+	it, err := NewSstFileIterator(files[0])
+	require.Nil(t, err)
+	for i, f := range files {
+		require.Nil(t, it.Reset(f))
+		var keys []string
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			keys = append(keys, string(it.Key().UserKey))
+		}
+		require.Nil(t, it.Err())
+		require.Len(t, keys, i+1)
+		require.Equal(t, byte('a'+i), keys[0][0])
+	}
+}
+
+func TestSeqNoRange(t *testing.T) {
+	f, err := ioutil.TempFile("", "unistore-test.*.sst")
+	require.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	opts := NewDefaultBlockBasedTableOptions(bytes.Compare)
+	opts.BlockSize = 128
+	nums := sortedNumbers(largeTestSize)
+	w := NewSstFileWriter(f, opts)
+	for i, num := range nums {
+		ikey := InternalKey{UserKey: []byte(num), SequenceNumber: uint64(i), ValueType: TypeValue}
+		require.Nil(t, w.Add(ikey, []byte(num)))
+	}
+	require.Nil(t, w.Finish())
+
+	it, err := NewSstFileIterator(f)
+	require.Nil(t, err)
+	// The range spans many data blocks and the keys in front of it are skipped.
+	minSeq, maxSeq := uint64(10000), uint64(20000)
+	it.SetSeqNoRange(minSeq, maxSeq)
+	seq := minSeq
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		require.Equal(t, seq, it.Key().SequenceNumber)
+		require.Equal(t, nums[seq], string(it.Value()))
+		seq++
+	}
+	require.Nil(t, it.Err())
+	require.Equal(t, maxSeq+1, seq)
+}
+
+func TestBlockHandles(t *testing.T) {
+	f, err := ioutil.TempFile("", "unistore-test.*.sst")
+	require.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	opts := NewDefaultBlockBasedTableOptions(bytes.Compare)
+	nums := sortedNumbers(largeTestSize)
+	w := NewSstFileWriter(f, opts)
+	for _, num := range nums {
+		require.Nil(t, w.Put([]byte(num), []byte(num)))
+	}
+	require.Nil(t, w.Finish())
+
+	it, err := NewSstFileIterator(f)
+	require.Nil(t, err)
+	infos, err := it.BlockHandles()
+	require.Nil(t, err)
+	require.True(t, len(infos) > 1)
+	var offset uint64
+	for i, info := range infos {
+		require.Equal(t, offset, info.Offset)
+		offset += info.Size + blockTrailerSize
+		if i > 0 {
+			require.True(t, Compare(infos[i-1].Separator, info.Separator) < 0)
+		}
+	}
+	require.Equal(t, nums[len(nums)-1], string(infos[len(infos)-1].Separator.UserKey))
+
+	// The iteration is not affected.
+	var i int
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		i++
+	}
+	require.Equal(t, len(nums), i)
+}
+
+func TestSstGet(t *testing.T) {
+	f, err := ioutil.TempFile("", "unistore-test.*.sst")
+	require.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	nums := sortedNumbers(largeTestSize)
+	w := NewSstFileWriter(f, NewDefaultBlockBasedTableOptions(bytes.Compare))
+	for i := 0; i < len(nums); i += 2 {
+		require.Nil(t, w.Put([]byte(nums[i]), []byte(nums[i])))
+	}
+	require.Nil(t, w.Finish())
+
+	it, err := NewSstFileIterator(f)
+	require.Nil(t, err)
+	require.NotNil(t, it.filter)
+	cache := NewBlockCache(64 << 20)
+	it.SetBlockCache(cache)
+	var falsePositive int
+	// Skip the last key which is absent and greater than all the keys.
+	nums = nums[:len(nums)-1]
+	for i, num := range nums {
+		ikey, value, err := it.Get([]byte(num))
+		if i%2 == 0 {
+			require.Nil(t, err)
+			require.Equal(t, num, string(ikey.UserKey))
+			require.Equal(t, num, string(value))
+			continue
+		}
+		require.Equal(t, ErrKeyNotFound, err)
+		if it.MayContain([]byte(num)) {
+			falsePositive++
+		}
+	}
+	// The absent keys filtered by the bloom filter don't read any data block.
+	hits, misses := cache.Stats()
+	require.Equal(t, uint64((len(nums)+1)/2+falsePositive), hits+misses)
+	require.True(t, falsePositive < len(nums)/20)
+}
+
+func TestPutsOnly(t *testing.T) {
+	f, err := ioutil.TempFile("", "unistore-test.*.sst")
+	require.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	opts := NewDefaultBlockBasedTableOptions(bytes.Compare)
+	opts.BlockSize = 128
+	nums := sortedNumbers(smallTestSize)
+	kinds := []ValueType{TypeValue, TypeDeletion, TypeMerge}
+	w := NewSstFileWriter(f, opts)
+	for i, num := range nums {
+		require.Nil(t, w.Add(InternalKey{UserKey: []byte(num), ValueType: kinds[i%len(kinds)]}, []byte(num)))
+	}
+	require.Nil(t, w.Finish())
+
+	it, err := NewSstFileIterator(f)
+	require.Nil(t, err)
+	var i int
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		require.Equal(t, kinds[i%len(kinds)], it.Kind())
+		i++
+	}
+	require.Equal(t, len(nums), i)
+
+	it.SetPutsOnly(true)
+	i = 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		require.Equal(t, TypeValue, it.Kind())
+		require.Equal(t, nums[i], string(it.Key().UserKey))
+		i += len(kinds)
+	}
+	require.Nil(t, it.Err())
+	require.Equal(t, (len(nums)+len(kinds)-1)/len(kinds)*len(kinds), i)
+}
+
+func TestSeekToFirstSingleEntryBlock(t *testing.T) {
+	for _, blockSize := range []int{1, 128} {
+		f, err := ioutil.TempFile("", "unistore-test.*.sst")
+		require.Nil(t, err)
+
+		opts := NewDefaultBlockBasedTableOptions(bytes.Compare)
+		opts.BlockSize = blockSize
+		nums := sortedNumbers(smallTestSize)
+		w := NewSstFileWriter(f, opts)
+		// The large value makes the first block have exactly one entry.
+		require.Nil(t, w.Put([]byte(nums[0]), bytes.Repeat([]byte{'v'}, 256)))
+		for _, num := range nums[1:] {
+			require.Nil(t, w.Put([]byte(num), []byte(num)))
+		}
+		require.Nil(t, w.Finish())
+
+		it, err := NewSstFileIterator(f)
+		require.Nil(t, err)
+		blocks, err := it.BlockHandles()
+		require.Nil(t, err)
+		require.True(t, len(blocks) > 1)
+		var i int
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			require.Equal(t, nums[i], string(it.Key().UserKey))
+			i++
+		}
+		require.Nil(t, it.Err())
+		require.Equal(t, len(nums), i)
+		// SeekToFirst again after the iterator is exhausted.
+		it.SeekToFirst()
+		require.True(t, it.Valid())
+		require.Equal(t, nums[0], string(it.Key().UserKey))
+
+		require.Nil(t, f.Close())
+		require.Nil(t, os.Remove(f.Name()))
+	}
+}
+
+func TestMetaIndex(t *testing.T) {
+	f, err := ioutil.TempFile("", "unistore-test.*.sst")
+	require.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	w := NewSstFileWriter(f, NewDefaultBlockBasedTableOptions(bytes.Compare))
+	for _, num := range sortedNumbers(smallTestSize) {
+		require.Nil(t, w.Put([]byte(num), []byte(num)))
+	}
+	require.Nil(t, w.Finish())
+
+	it, err := NewSstFileIterator(f)
+	require.Nil(t, err)
+	handles, err := it.MetaIndex()
+	require.Nil(t, err)
+	require.Len(t, handles, 2)
+	props, ok := handles[propsBlockHandleKey]
+	require.True(t, ok)
+	filter, ok := handles[bloomBlockHandleKey]
+	require.True(t, ok)
+	// The filter block is written before the properties block.
+	require.True(t, filter.Offset+filter.Size < props.Offset)
+	fi, err := f.Stat()
+	require.Nil(t, err)
+	require.True(t, props.Offset+props.Size < uint64(fi.Size()))
+}
+
+func TestIndexValueDeltaEncoding(t *testing.T) {
+	nums := sortedNumbers(largeTestSize)
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}
+	}()
+	writeSst := func(opts *BlockBasedTableOptions) *SstFileIterator {
+		f, err := ioutil.TempFile("", "unistore-test.*.sst")
+		require.Nil(t, err)
+		files = append(files, f)
+		w := NewSstFileWriter(f, opts)
+		for _, num := range nums {
+			require.Nil(t, w.Put([]byte(num), []byte(num)))
+		}
+		require.Nil(t, w.Finish())
+		it, err := NewSstFileIterator(f)
+		require.Nil(t, err)
+		return it
+	}
+
+	opts := NewDefaultBlockBasedTableOptions(bytes.Compare)
+	opts.IndexBlockRestartInterval = 16
+	opts.EnableIndexCompression = false
+	fullIt := writeSst(opts)
+	require.False(t, fullIt.indexBlockIter.valueDeltaEncoded)
+
+	opts = NewDefaultBlockBasedTableOptions(bytes.Compare)
+	opts.IndexBlockRestartInterval = 16
+	opts.EnableIndexCompression = false
+	opts.IndexValueDeltaEncoding = true
+	it := writeSst(opts)
+	require.True(t, it.indexBlockIter.valueDeltaEncoded)
+	// Only the restart entries have the full handles.
+	require.True(t, len(it.indexBlockIter.data) < len(fullIt.indexBlockIter.data))
+
+	expected, err := fullIt.BlockHandles()
+	require.Nil(t, err)
+	infos, err := it.BlockHandles()
+	require.Nil(t, err)
+	require.True(t, len(infos) > 16)
+	require.Equal(t, expected, infos)
+
+	for n := 0; n < 2; n++ {
+		var i int
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			require.Equal(t, nums[i], string(it.Key().UserKey))
+			require.Equal(t, nums[i], string(it.Value()))
+			i++
+		}
+		require.Nil(t, it.Err())
+		require.Equal(t, len(nums), i)
+	}
+	for i := 0; i < len(nums); i += 97 {
+		_, value, err := it.Get([]byte(nums[i]))
+		require.Nil(t, err)
+		require.Equal(t, nums[i], string(value))
+	}
+}
+
+func TestSstIteratorAll(t *testing.T) {
+	f, err := ioutil.TempFile("", "unistore-test.*.sst")
+	require.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	nums := sortedNumbers(largeTestSize)
+	w := NewSstFileWriter(f, NewDefaultBlockBasedTableOptions(bytes.Compare))
+	for _, num := range nums {
+		require.Nil(t, w.Put([]byte(num), []byte(num)))
+	}
+	require.Nil(t, w.Finish())
+
+	it, err := NewSstFileIterator(f)
+	require.Nil(t, err)
+	var i int
+	it.All()(func(key InternalKey, value []byte) bool {
+		require.Equal(t, nums[i], string(key.UserKey))
+		require.Equal(t, nums[i], string(value))
+		i++
+		return true
+	})
+	require.Nil(t, it.Err())
+	require.Equal(t, len(nums), i)
+
+	// Stop early, the iterator can be iterated again from the first entry.
+	i = 0
+	it.All()(func(key InternalKey, value []byte) bool {
+		i++
+		return i < 10
+	})
+	require.Equal(t, 10, i)
+	require.Equal(t, nums[9], string(it.Key().UserKey))
+	i = 0
+	it.All()(func(key InternalKey, value []byte) bool {
+		i++
+		return true
+	})
+	require.Equal(t, len(nums), i)
+}
+
+func TestParseFooter(t *testing.T) {
+	f, err := ioutil.TempFile("", "unistore-test.*.sst")
+	require.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	w := NewSstFileWriter(f, NewDefaultBlockBasedTableOptions(bytes.Compare))
+	require.Nil(t, w.Put([]byte("a"), []byte("a")))
+	require.Nil(t, w.Finish())
+	it, err := NewSstFileIterator(f)
+	require.Nil(t, err)
+	require.Equal(t, binary.LittleEndian, it.byteOrder)
+	require.Equal(t, uint32(2), it.FormatVersion())
+
+	fi, err := f.Stat()
+	require.Nil(t, err)
+	footer := make([]byte, footerEncodedLength)
+	_, err = f.ReadAt(footer, fi.Size()-footerEncodedLength)
+	require.Nil(t, err)
+
+	modify := func(fn func(footer []byte)) []byte {
+		buf := append([]byte{}, footer...)
+		fn(buf)
+		return buf
+	}
+	magicPos := footerEncodedLength - 8
+	versionPos := footerEncodedLength - 12
+	bigEndian := modify(func(buf []byte) {
+		binary.BigEndian.PutUint32(buf[versionPos:], 2)
+		binary.BigEndian.PutUint32(buf[magicPos:], blockBasedTableMagicNumber&0xffffffff)
+		binary.BigEndian.PutUint32(buf[magicPos+4:], blockBasedTableMagicNumber>>32)
+	})
+	_, _, err = parseFooter(bigEndian)
+	require.Equal(t, ErrUnsupportedByteOrder, err)
+	_, _, err = parseFooter(modify(func(buf []byte) { buf[magicPos] ^= 0xff }))
+	require.Equal(t, ErrMagicNumberMismatch, err)
+	for _, version := range []uint32{0, maxFormatVersion + 1} {
+		_, _, err = parseFooter(modify(func(buf []byte) { binary.LittleEndian.PutUint32(buf[versionPos:], version) }))
+		require.NotNil(t, err)
+	}
+	for _, tp := range []ChecksumType{ChecksumXXHash, ChecksumXXHash + 1} {
+		_, _, err = parseFooter(modify(func(buf []byte) { buf[0] = byte(tp) }))
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), "unsupported checksum type")
+	}
+
+	// The file is rejected when the iterator is created.
+	_, err = f.WriteAt(bigEndian, fi.Size()-footerEncodedLength)
+	require.Nil(t, err)
+	_, err = NewSstFileIterator(f)
+	require.Equal(t, ErrUnsupportedByteOrder, err)
+}
+
+func TestSeekForPrev(t *testing.T) {
+	f, err := ioutil.TempFile("", "unistore-test.*.sst")
+	require.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	// Only the even positions are written, the odd ones are used as the absent targets.
+	nums := sortedNumbers(largeTestSize)
+	w := NewSstFileWriter(f, NewDefaultBlockBasedTableOptions(bytes.Compare))
+	for i := 0; i < len(nums); i += 2 {
+		require.Nil(t, w.Put([]byte(nums[i]), []byte(nums[i])))
+	}
+	require.Nil(t, w.Finish())
+
+	it, err := NewSstFileIterator(f)
+	require.Nil(t, err)
+	it.SetStrict(true)
+	infos, err := it.BlockHandles()
+	require.Nil(t, err)
+	require.True(t, len(infos) > 1)
+
+	for i := 1; i < len(nums); i += 97 {
+		// The absent key lands on the previous one, the exact key lands on itself.
+		expected := nums[i-i%2]
+		it.SeekForPrev(MakeInternalKey([]byte(nums[i]), 0, TypeValue))
+		require.True(t, it.Valid())
+		require.Equal(t, expected, string(it.Key().UserKey))
+		require.Equal(t, expected, string(it.Value()))
+		it.SeekForPrev(MakeInternalKey([]byte(expected), 0, TypeValue))
+		require.True(t, it.Valid())
+		require.Equal(t, expected, string(it.Key().UserKey))
+		// The same user key with a greater sequence number is ordered before the key.
+		it.SeekForPrev(MakeInternalKey([]byte(expected), 1, TypeValue))
+		if i < 2 {
+			require.False(t, it.Valid())
+		} else {
+			require.Equal(t, nums[i-i%2-2], string(it.Key().UserKey))
+		}
+	}
+
+	// The separators are the last keys of the blocks, the next key is in the next block.
+	it.SeekForPrev(infos[0].Separator)
+	require.True(t, it.Valid())
+	require.Equal(t, infos[0].Separator.UserKey, it.Key().UserKey)
+	var count int
+	for ; it.Valid(); it.Next() {
+		count++
+	}
+	require.Nil(t, it.Err())
+	var firstBlockCount int
+	for it.SeekToFirst(); it.Valid() && Compare(it.Key(), infos[0].Separator) <= 0; it.Next() {
+		firstBlockCount++
+	}
+	require.Equal(t, (len(nums)+1)/2-firstBlockCount+1, count)
+
+	it.SeekForPrev(MakeInternalKey([]byte(""), 0, TypeValue))
+	require.False(t, it.Valid())
+	it.SeekForPrev(MakeInternalKey([]byte("a"), 0, TypeValue))
+	require.True(t, it.Valid())
+	require.Equal(t, nums[len(nums)-2], string(it.Key().UserKey))
+	require.Nil(t, it.Err())
+}
+
+func TestOpenSstFileIteratorDirectIO(t *testing.T) {
+	f, err := ioutil.TempFile("", "unistore-test.*.sst")
+	require.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	nums := sortedNumbers(largeTestSize)
+	w := NewSstFileWriter(f, NewDefaultBlockBasedTableOptions(bytes.Compare))
+	for _, num := range nums {
+		require.Nil(t, w.Put([]byte(num), []byte(num)))
+	}
+	require.Nil(t, w.Finish())
+
+	for _, directIO := range []bool{false, true} {
+		it, err := OpenSstFileIterator(f.Name(), directIO)
+		require.Nil(t, err)
+		// Direct IO falls back to buffered IO on the file systems don't support it.
+		if !directIO {
+			require.False(t, it.DirectIO())
+		}
+		var i int
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			require.Equal(t, nums[i], string(it.Key().UserKey))
+			require.Equal(t, nums[i], string(it.Value()))
+			i++
+		}
+		require.Nil(t, it.Err())
+		require.Equal(t, len(nums), i)
+		require.Nil(t, it.Close())
+	}
+}
+
+func TestAlignedReaderAt(t *testing.T) {
+	f, err := ioutil.TempFile("", "unistore-test.*")
+	require.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	_, err = f.Write(data)
+	require.Nil(t, err)
+
+	r := &alignedReaderAt{f: f}
+	for _, c := range []struct{ off, size int }{{0, 10}, {1, 4095}, {4095, 2}, {4096, 4096}, {5000, 5000}, {9999, 1}} {
+		buf := make([]byte, c.size)
+		n, err := r.ReadAt(buf, int64(c.off))
+		require.Nil(t, err)
+		require.Equal(t, c.size, n)
+		require.Equal(t, data[c.off:c.off+c.size], buf)
+	}
+	// Reading beyond the end of the file returns the available bytes.
+	buf := make([]byte, 10)
+	n, err := r.ReadAt(buf, 9995)
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+	require.Equal(t, 5, n)
+	require.Equal(t, data[9995:], buf[:n])
+	n, err = r.ReadAt(buf, 20000)
+	require.NotNil(t, err)
+	require.Equal(t, 0, n)
+}
+
+func TestSavePositionResume(t *testing.T) {
+	f, err := ioutil.TempFile("", "unistore-test.*.sst")
+	require.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	nums := sortedNumbers(largeTestSize)
+	opts := NewDefaultBlockBasedTableOptions(bytes.Compare)
+	opts.BlockRestartInterval = 4
+	w := NewSstFileWriter(f, opts)
+	for _, num := range nums {
+		require.Nil(t, w.Put([]byte(num), []byte(num)))
+	}
+	require.Nil(t, w.Finish())
+
+	it, err := NewSstFileIterator(f)
+	require.Nil(t, err)
+	infos, err := it.BlockHandles()
+	require.Nil(t, err)
+	require.True(t, len(infos) > 1)
+	resumed, err := NewSstFileIterator(f)
+	require.Nil(t, err)
+	resumed.SetStrict(true)
+
+	i := 0
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		// Check positions spread over the restart intervals, the end of the first block and the last key.
+		if i%7 == 0 || Compare(it.Key(), infos[0].Separator) == 0 || i == len(nums)-1 {
+			token, err := it.SavePosition()
+			require.Nil(t, err)
+			require.Nil(t, resumed.Resume(token))
+			if i == len(nums)-1 {
+				require.False(t, resumed.Valid())
+			} else {
+				require.True(t, resumed.Valid())
+				require.Equal(t, nums[i+1], string(resumed.Key().UserKey))
+				require.Equal(t, nums[i+1], string(resumed.Value()))
+				// The resumed iterator continues to the following keys.
+				resumed.Next()
+				if i+2 < len(nums) {
+					require.Equal(t, nums[i+2], string(resumed.Key().UserKey))
+				}
+			}
+		}
+		i++
+	}
+	require.Nil(t, it.Err())
+	require.Equal(t, len(nums), i)
+	_, err = it.SavePosition()
+	require.NotNil(t, err)
+
+	token := make([]byte, positionTokenLen)
+	require.Equal(t, ErrInvalidPosition, resumed.Resume(token[:8]))
+	rocksEndian.PutUint64(token, infos[0].Offset+1)
+	require.Equal(t, ErrInvalidPosition, resumed.Resume(token))
+	rocksEndian.PutUint64(token, infos[0].Offset)
+	rocksEndian.PutUint64(token[8:], infos[0].Size)
+	rocksEndian.PutUint64(token[16:], 1)
+	require.Equal(t, ErrInvalidPosition, resumed.Resume(token))
+}
+
+type countingReaderAt struct {
+	r     io.ReaderAt
+	reads int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.reads++
+	return c.r.ReadAt(p, off)
+}
+
+func TestSmallestLargestKey(t *testing.T) {
+	f, err := ioutil.TempFile("", "unistore-test.*.sst")
+	require.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	nums := sortedNumbers(largeTestSize)
+	w := NewSstFileWriter(f, NewDefaultBlockBasedTableOptions(bytes.Compare))
+	for _, num := range nums[1 : len(nums)-1] {
+		require.Nil(t, w.Put([]byte(num), []byte(num)))
+	}
+	require.Nil(t, w.Finish())
+
+	it, err := NewSstFileIterator(f)
+	require.Nil(t, err)
+	require.Equal(t, nums[1], string(it.SmallestKey()))
+	require.Equal(t, nums[len(nums)-2], string(it.LargestKey()))
+	counter := &countingReaderAt{r: it.reader}
+	it.reader = counter
+
+	// The keys out of the range are rejected without reading the blocks.
+	for _, key := range []string{nums[0], nums[len(nums)-1]} {
+		_, _, err = it.Get([]byte(key))
+		require.Equal(t, ErrKeyNotFound, err)
+	}
+	it.SeekForPrev(MakeInternalKey([]byte(nums[0]), 0, TypeValue))
+	require.False(t, it.Valid())
+	require.Equal(t, 0, counter.reads)
+
+	_, val, err := it.Get([]byte(nums[1]))
+	require.Nil(t, err)
+	require.Equal(t, nums[1], string(val))
+	it.SeekForPrev(MakeInternalKey([]byte(nums[len(nums)-1]), 0, TypeValue))
+	require.True(t, it.Valid())
+	require.Equal(t, nums[len(nums)-2], string(it.Key().UserKey))
+	require.True(t, counter.reads > 0)
+}
+
+func TestValueCopy(t *testing.T) {
+	f, err := ioutil.TempFile("", "unistore-test.*.sst")
+	require.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	nums := sortedNumbers(largeTestSize)
+	w := NewSstFileWriter(f, NewDefaultBlockBasedTableOptions(bytes.Compare))
+	for _, num := range nums {
+		require.Nil(t, w.Put([]byte(num), []byte(num)))
+	}
+	require.Nil(t, w.Finish())
+
+	it, err := NewSstFileIterator(f)
+	require.Nil(t, err)
+	infos, err := it.BlockHandles()
+	require.Nil(t, err)
+	require.True(t, len(infos) > 1)
+	// Hold the value of the last key in the first block and move into the next block.
+	it.SeekForPrev(infos[0].Separator)
+	require.True(t, it.Valid())
+	expected := string(it.Value())
+	copied := it.ValueCopy()
+	it.Next()
+	require.True(t, it.Valid())
+	require.NotEqual(t, expected, string(it.Value()))
+	require.Equal(t, expected, string(copied))
+	require.Nil(t, it.Err())
+}
+
+func TestNewSstFileIteratorBounded(t *testing.T) {
+	f, err := ioutil.TempFile("", "unistore-test.*.sst")
+	require.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	nums := sortedNumbers(largeTestSize)
+	w := NewSstFileWriter(f, NewDefaultBlockBasedTableOptions(bytes.Compare))
+	for _, num := range nums {
+		require.Nil(t, w.Put([]byte(num), []byte(num)))
+	}
+	require.Nil(t, w.Finish())
+
+	start, end := 1000, 2000
+	it, err := NewSstFileIteratorBounded(f,
+		MakeInternalKey([]byte(nums[start]), 0, TypeValue),
+		MakeInternalKey([]byte(nums[end]), MaxSequenceNumber, TypeValue))
+	require.Nil(t, err)
+	blocks, err := it.BlockHandles()
+	require.Nil(t, err)
+	// The blocks from the one of the first key to the one of the last key in the range should be read.
+	firstBlk, lastBlk := -1, -1
+	for i, blk := range blocks {
+		sep := string(blk.Separator.UserKey)
+		if firstBlk < 0 && sep >= nums[start] {
+			firstBlk = i
+		}
+		if lastBlk < 0 && sep >= nums[end-1] {
+			lastBlk = i
+		}
+	}
+	counter := &countingReaderAt{r: it.reader}
+	it.reader = counter
+
+	i := start
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		require.Equal(t, nums[i], string(it.Key().UserKey))
+		i++
+	}
+	require.Nil(t, it.Err())
+	require.Equal(t, end, i)
+	require.True(t, counter.reads >= lastBlk-firstBlk+1)
+	// At most the block following the last key is read, in case the separator of the last block is less than end.
+	require.True(t, counter.reads <= lastBlk-firstBlk+2, "%d blocks read", counter.reads)
+
+	// An empty end key means no upper bound.
+	it, err = NewSstFileIteratorBounded(f, MakeInternalKey([]byte(nums[len(nums)-10]), 0, TypeValue), InternalKey{})
+	require.Nil(t, err)
+	i = len(nums) - 10
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		require.Equal(t, nums[i], string(it.Key().UserKey))
+		i++
+	}
+	require.Nil(t, it.Err())
+	require.Equal(t, len(nums), i)
+}
+
+func TestNewSstFileIteratorFromBytes(t *testing.T) {
+	f, err := ioutil.TempFile("", "unistore-test.*.sst")
+	require.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+
+	nums := sortedNumbers(largeTestSize)
+	w := NewSstFileWriter(f, NewDefaultBlockBasedTableOptions(bytes.Compare))
+	for _, num := range nums {
+		require.Nil(t, w.Put([]byte(num), []byte(num)))
+	}
+	require.Nil(t, w.Finish())
+	data, err := ioutil.ReadFile(f.Name())
+	require.Nil(t, err)
+
+	it, err := NewSstFileIteratorFromBytes(data)
+	require.Nil(t, err)
+	var i int
+	for it.SeekToFirst(); it.Valid(); it.Next() {
+		require.Equal(t, nums[i], string(it.Key().UserKey))
+		require.Equal(t, nums[i], string(it.Value()))
+		i++
+	}
+	require.Nil(t, it.Err())
+	require.Equal(t, len(nums), i)
+	_, value, err := it.Get([]byte(nums[100]))
+	require.Nil(t, err)
+	require.Equal(t, nums[100], string(value))
+	require.Nil(t, it.Close())
+
+	// The footer is read from the end of the slice.
+	_, err = NewSstFileIteratorFromBytes(data[:len(data)-1])
+	require.NotNil(t, err)
+	_, err = NewSstFileIteratorFromBytes(data[:10])
+	require.NotNil(t, err)
+}
+
+func TestComparatorName(t *testing.T) {
+	writeSst := func(comparatorName string) []byte {
+		f, err := ioutil.TempFile("", "unistore-test.*.sst")
+		require.Nil(t, err)
+		defer func() {
+			_ = f.Close()
+			_ = os.Remove(f.Name())
+		}()
+		opts := NewDefaultBlockBasedTableOptions(bytes.Compare)
+		opts.ComparatorName = comparatorName
+		w := NewSstFileWriter(f, opts)
+		require.Nil(t, w.Put([]byte("a"), []byte("v")))
+		require.Nil(t, w.Finish())
+		data, err := ioutil.ReadFile(f.Name())
+		require.Nil(t, err)
+		return data
+	}
+
+	for _, name := range []string{BytewiseComparatorName, internalKeyComparatorName, ""} {
+		it, err := NewSstFileIteratorFromBytes(writeSst(name))
+		require.Nil(t, err)
+		require.Equal(t, name, it.ComparatorName())
+		it.SeekToFirst()
+		require.True(t, it.Valid())
+	}
+	// The files ordered by a custom comparator are rejected.
+	_, err := NewSstFileIteratorFromBytes(writeSst("rocksdb.ReverseBytewiseComparator"))
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "unsupported comparator")
+}
+
+func writeReadAheadTestSst(t testing.TB, tp CompressionType) *os.File {
+	f, err := ioutil.TempFile("", "unistore-test.*.sst")
+	require.Nil(t, err)
+	opts := NewDefaultBlockBasedTableOptions(bytes.Compare)
+	opts.CompressionType = tp
+	w := NewSstFileWriter(f, opts)
+	for _, num := range sortedNumbers(largeTestSize) {
+		require.Nil(t, w.Put([]byte(num), []byte(num)))
+	}
+	require.Nil(t, w.Finish())
+	return f
+}
+
+func TestSstFileIteratorReadAhead(t *testing.T) {
+	for _, tp := range []CompressionType{CompressionNone, CompressionLz4} {
+		f := writeReadAheadTestSst(t, tp)
+		it, err := NewSstFileIterator(f)
+		require.Nil(t, err)
+		infos, err := it.BlockHandles()
+		require.Nil(t, err)
+		require.True(t, len(infos) > 16)
+
+		counter := &countingReaderAt{r: it.reader}
+		it.reader = counter
+		it.SetReadAhead(8)
+		nums := sortedNumbers(largeTestSize)
+		var i int
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+			require.Equal(t, nums[i], string(it.Key().UserKey))
+			require.Equal(t, nums[i], string(it.Value()))
+			i++
+		}
+		require.Nil(t, it.Err())
+		require.Equal(t, len(nums), i)
+		require.Equal(t, (len(infos)+7)/8, counter.reads)
+
+		// The point lookups don't read ahead, and the seeks backward read the block again.
+		counter.reads = 0
+		_, val, err := it.Get([]byte(nums[0]))
+		require.Nil(t, err)
+		require.Equal(t, nums[0], string(val))
+		require.Equal(t, 1, counter.reads)
+		it.SeekToFirst()
+		require.True(t, it.Valid())
+		require.Equal(t, nums[0], string(it.Value()))
+		require.Equal(t, 2, counter.reads)
+
+		it.SetReadAhead(0)
+		counter.reads = 0
+		for it.SeekToFirst(); it.Valid(); it.Next() {
+		}
+		require.Nil(t, it.Err())
+		require.Equal(t, len(infos), counter.reads)
+		require.Nil(t, f.Close())
+		require.Nil(t, os.Remove(f.Name()))
+	}
+}
+
+func BenchmarkSstFileIteratorScan(b *testing.B) {
+	f := writeReadAheadTestSst(b, CompressionLz4)
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	for _, readAhead := range []int{0, 16} {
+		b.Run(fmt.Sprintf("readAhead=%d", readAhead), func(b *testing.B) {
+			it, err := NewSstFileIterator(f)
+			require.Nil(b, err)
+			counter := &countingReaderAt{r: it.reader}
+			it.reader = counter
+			it.SetReadAhead(readAhead)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				for it.SeekToFirst(); it.Valid(); it.Next() {
+				}
+			}
+			b.StopTimer()
+			require.Nil(b, it.Err())
+			b.ReportMetric(float64(counter.reads)/float64(b.N), "reads/op")
+		})
+	}
+}
+
+func TestSstFileIteratorKeyDecodeError(t *testing.T) {
+	f, err := ioutil.TempFile("", "unistore-test.*.sst")
+	require.Nil(t, err)
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(f.Name())
+	}()
+	opts := NewDefaultBlockBasedTableOptions(bytes.Compare)
+	opts.ChecksumType = ChecksumNone
+	opts.CompressionType = CompressionNone
+	w := NewSstFileWriter(f, opts)
+	require.Nil(t, w.Put([]byte("akey"), []byte("v1")))
+	require.Nil(t, w.Put([]byte("bkey"), []byte("v2")))
+	require.Nil(t, w.Finish())
+	data, err := ioutil.ReadFile(f.Name())
+	require.Nil(t, err)
+
+	// Replace the value type of the second key with an unknown one, the data block is before the index block.
+	key := MakeInternalKey([]byte("bkey"), 0, TypeValue)
+	pos := bytes.Index(data, key.Encode())
+	require.True(t, pos >= 0)
+	data[pos+len("bkey")] = 0x42
+
+	it, err := NewSstFileIteratorFromBytes(data)
+	require.Nil(t, err)
+	it.SeekToFirst()
+	require.True(t, it.Valid())
+	require.Equal(t, "akey", string(it.Key().UserKey))
+	require.Nil(t, it.Err())
+	it.Next()
+	require.True(t, it.Valid())
+	it.Key()
+	require.False(t, it.Valid())
+	require.Equal(t, ErrUnknownValueType, it.Err())
+}
@@ -54,8 +54,9 @@ const (
 
 // SstFileWriter is used to create sst files that can be added to database later.
 type SstFileWriter struct {
-	file       *os.File
-	builder    *BlockBasedTableBuilder
+	file    *os.File
+	builder *BlockBasedTableBuilder
+	// lastKey is the encoded internal key added last.
 	lastKey    []byte
 	comparator Comparator
 }
@@ -75,17 +76,25 @@ func NewSstFileWriter(f *os.File, opts *BlockBasedTableOptions) *SstFileWriter {
 
 // Put puts a key-value pair to SstFileWriter.
 func (w *SstFileWriter) Put(key, value []byte) error {
-	return w.add(key, value, TypeValue)
+	return w.add(InternalKey{UserKey: key, ValueType: TypeValue}, value, false)
 }
 
 // Merge merges a key-value pair.
 func (w *SstFileWriter) Merge(key, value []byte) error {
-	return w.add(key, value, TypeMerge)
+	return w.add(InternalKey{UserKey: key, ValueType: TypeMerge}, value, false)
 }
 
 // Delete deletes a key-value pair from SstFileWriter.
 func (w *SstFileWriter) Delete(key []byte) error {
-	return w.add(key, nil, TypeDeletion)
+	return w.add(InternalKey{UserKey: key, ValueType: TypeDeletion}, nil, false)
+}
+
+// Add adds an InternalKey and its value to SstFileWriter, the keys must be added in strictly increasing order of
+// the internal key comparator, so a user key can be added multiple times with decreasing sequence numbers.
+// ErrKeyOrder is returned if the key is not greater than the last added one. The sequence number of the key is
+// kept as is.
+func (w *SstFileWriter) Add(ikey InternalKey, value []byte) error {
+	return w.add(ikey, value, true)
 }
 
 // Finish finishes the SstFileWriter.
@@ -93,22 +102,26 @@ func (w *SstFileWriter) Finish() error {
 	return w.builder.Finish()
 }
 
-func (w *SstFileWriter) add(key, value []byte, tp ValueType) error {
-	if !tp.IsValue() {
+// add adds the key after checking its order, the keys added by Put, Merge and Delete have no sequence number, so
+// their user keys must be strictly increasing unless internalOrder is set.
+func (w *SstFileWriter) add(ikey InternalKey, value []byte, internalOrder bool) error {
+	if !ikey.ValueType.IsValue() {
 		return ErrNotSupportType
 	}
+	key := ikey.Encode()
 	if w.lastKey != nil {
-		if w.comparator(key, w.lastKey) <= 0 {
+		var cmp int
+		if internalOrder {
+			cmp = w.comparator.CompareInternalKey(key, w.lastKey)
+		} else {
+			cmp = w.comparator(ikey.UserKey, w.lastKey[:len(w.lastKey)-8])
+		}
+		if cmp <= 0 {
 			return ErrKeyOrder
 		}
 	}
 
-	ikey := InternalKey{
-		UserKey:        key,
-		SequenceNumber: 0,
-		ValueType:      tp,
-	}
-	if err := w.builder.Add(ikey.Encode(), value); err != nil {
+	if err := w.builder.Add(key, value); err != nil {
 		return err
 	}
 
@@ -22,7 +22,12 @@
 
 package rocksdb
 
-import "encoding/binary"
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/pingcap/badger/y"
+)
 
 // ValueType describes a type of a value.
 type ValueType uint8
@@ -34,11 +39,29 @@ const (
 	TypeMerge
 )
 
+// TypeSingleDeletion is the type of the deletion which deletes only the latest version of the key.
+const TypeSingleDeletion ValueType = 0x7
+
+// The value types only read from the sst files written by RocksDB.
+const (
+	TypeRangeDeletion ValueType = 0xF
+	TypeBlobIndex     ValueType = 0x11
+)
+
 // IsValue returns whether the ValueType is value type or not.
 func (vt ValueType) IsValue() bool {
 	return vt <= TypeMerge
 }
 
+// isKnown returns whether the ValueType can be stored in the sst.
+func (vt ValueType) isKnown() bool {
+	switch vt {
+	case TypeDeletion, TypeValue, TypeMerge, TypeSingleDeletion, TypeRangeDeletion, TypeBlobIndex:
+		return true
+	}
+	return false
+}
+
 // Comparator represents a compare function.
 type Comparator func(key1 []byte, key2 []byte) int
 
@@ -73,11 +96,15 @@ type TableProperties struct {
 	NumEntries          uint64
 	ColumnFamilyID      uint64
 	ColumnFamilyName    string
+	ComparatorName      string
 	CompressionName     string
 	FilterPolicyName    string
 	CreationTime        uint64
 	OldestKeyTime       uint64
 	PrefixExtractorName string
+	// SmallestKey and LargestKey are the user key range of the file, they're nil if the file is empty.
+	SmallestKey []byte
+	LargestKey  []byte
 }
 
 type blockHandle struct {
@@ -102,9 +129,16 @@ func (h blockHandle) EncodeTo(buf []byte) int {
 	return cursor + len(sz)
 }
 
+// Decode decodes the blockHandle and returns the number of bytes read, 0 is returned if buf is malformed.
 func (h *blockHandle) Decode(buf []byte) int {
 	off, n1 := decodeVarint64(buf)
+	if n1 <= 0 {
+		return 0
+	}
 	sz, n2 := decodeVarint64(buf[n1:])
+	if n2 <= 0 {
+		return 0
+	}
 	h.Offset = off
 	h.Size = sz
 	return n1 + n2
@@ -117,7 +151,17 @@ type InternalKey struct {
 	ValueType      ValueType
 }
 
-// Encode encodes the InternalKey.
+// MaxSequenceNumber is the largest sequence number can be packed into the InternalKey trailer.
+const MaxSequenceNumber = (1 << 56) - 1
+
+// MakeInternalKey creates an InternalKey, the seq must not be greater than MaxSequenceNumber.
+func MakeInternalKey(userKey []byte, seq uint64, kind ValueType) InternalKey {
+	y.Assert(seq <= MaxSequenceNumber)
+	return InternalKey{UserKey: userKey, SequenceNumber: seq, ValueType: kind}
+}
+
+// Encode encodes the InternalKey as the user key followed by the 8-byte trailer which packs the
+// sequence number and the value type, it's the same format stored in the sst.
 func (ikey *InternalKey) Encode() []byte {
 	buf := make([]byte, len(ikey.UserKey)+8)
 	copy(buf, ikey.UserKey)
@@ -125,14 +169,61 @@ func (ikey *InternalKey) Encode() []byte {
 	return buf
 }
 
-// Decode decodes the InternalKey.
-func (ikey *InternalKey) Decode(encoded []byte) {
+// Decode decodes the InternalKey. ErrCorruptedBlock is returned if the encoded key is shorter than the trailer,
+// ErrUnknownValueType is returned if the value type in the trailer is not known, the key is still decoded.
+func (ikey *InternalKey) Decode(encoded []byte) error {
 	ikey.UserKey = ikey.UserKey[:0]
 	userKeyLen := len(encoded) - 8
+	if userKeyLen < 0 {
+		return ErrCorruptedBlock
+	}
 	ikey.UserKey = append(ikey.UserKey, encoded[0:userKeyLen]...)
 	ikey.unpackSeqAndType(rocksEndian.Uint64(encoded[userKeyLen:]))
+	if !ikey.ValueType.isKnown() {
+		return ErrUnknownValueType
+	}
+	return nil
+}
+
+// IsDeletion returns whether the key is a deletion or a single deletion.
+func (ikey *InternalKey) IsDeletion() bool {
+	return ikey.ValueType == TypeDeletion || ikey.ValueType == TypeSingleDeletion
+}
+
+// IsValue returns whether the key is a put, unlike ValueType.IsValue the merges and deletions are excluded.
+func (ikey *InternalKey) IsValue() bool {
+	return ikey.ValueType == TypeValue
+}
+
+// Sequence returns the sequence number of the key.
+func (ikey *InternalKey) Sequence() uint64 {
+	return ikey.SequenceNumber
 }
 
+// Compare compares two InternalKeys in the same order as the keys stored in the sst:
+//    increasing user key (bytewise)
+//    decreasing sequence number
+//    decreasing type
+func Compare(a, b InternalKey) int {
+	if cmp := bytes.Compare(a.UserKey, b.UserKey); cmp != 0 {
+		return cmp
+	}
+	packA, packB := a.packSeqAndType(), b.packSeqAndType()
+	if packA > packB {
+		return -1
+	} else if packA < packB {
+		return +1
+	}
+	return 0
+}
+
+// InternalKeys implements sort.Interface to sort InternalKeys by Compare.
+type InternalKeys []InternalKey
+
+func (keys InternalKeys) Len() int           { return len(keys) }
+func (keys InternalKeys) Less(i, j int) bool { return Compare(keys[i], keys[j]) < 0 }
+func (keys InternalKeys) Swap(i, j int)      { keys[i], keys[j] = keys[j], keys[i] }
+
 func (ikey *InternalKey) packSeqAndType() uint64 {
 	return ikey.SequenceNumber<<8 | uint64(ikey.ValueType)
 }
@@ -147,7 +147,7 @@ func rocksHash(data []byte, seed uint32) uint32 {
 	h := seed ^ uint32(len(data)*m)
 
 	pos := 0
-	for ; pos+4 < len(data); pos += 4 {
+	for ; pos+4 <= len(data); pos += 4 {
 		w := rocksEndian.Uint32(data[pos : pos+4])
 		h += w
 		h *= m
@@ -157,13 +157,13 @@ func rocksHash(data []byte, seed uint32) uint32 {
 	// Pick up remaining bytes
 	remain := len(data) - pos
 	if remain == 3 {
-		h += uint32(int8(data[2])) << 16
+		h += uint32(int8(data[pos+2])) << 16
 	}
 	if remain >= 2 {
-		h += uint32(int8(data[1])) << 8
+		h += uint32(int8(data[pos+1])) << 8
 	}
 	if remain >= 1 {
-		h += uint32(int8(data[0]))
+		h += uint32(int8(data[pos]))
 		h *= m
 		h ^= h >> r
 	}
@@ -22,8 +22,27 @@ const (
 	subPathKV   = "kv"
 )
 
+type serverOptions struct {
+	kvCompactionFilterFactories []raftstore.CompactionFilterFactory
+}
+
+// Option configures the server created by New.
+type Option func(opts *serverOptions)
+
+// KVCompactionFilterFactories adds the compaction filter factories of the kv engine, the filters run after the MVCC
+// GC filter in order.
+func KVCompactionFilterFactories(factories ...raftstore.CompactionFilterFactory) Option {
+	return func(opts *serverOptions) {
+		opts.kvCompactionFilterFactories = append(opts.kvCompactionFilterFactories, factories...)
+	}
+}
+
 // New returns a new tikv.Server.
-func New(conf *config.Config, pdClient pd.Client) (*tikv.Server, error) {
+func New(conf *config.Config, pdClient pd.Client, opts ...Option) (*tikv.Server, error) {
+	var serverOpts serverOptions
+	for _, opt := range opts {
+		opt(&serverOpts)
+	}
 	physical, logical, err := pdClient.GetTS(context.Background())
 	if err != nil {
 		return nil, err
@@ -31,7 +50,9 @@ func New(conf *config.Config, pdClient pd.Client) (*tikv.Server, error) {
 	ts := uint64(physical)<<18 + uint64(logical)
 
 	safePoint := &tikv.SafePoint{}
-	db, err := createDB(subPathKV, safePoint, &conf.Engine)
+	kvFilters := append([]raftstore.CompactionFilterFactory{safePoint.CreateCompactionFilter},
+		serverOpts.kvCompactionFilterFactories...)
+	db, err := createDB(subPathKV, &conf.Engine, kvFilters...)
 	if err != nil {
 		return nil, err
 	}
@@ -76,10 +97,13 @@ func setupRaftServer(bundle *mvcc.DBBundle, safePoint *tikv.SafePoint, pdClient
 	raftConf.SnapPath = snapPath
 	setupRaftStoreConf(raftConf, conf)
 
-	raftDB, err := createDB(subPathRaft, nil, &conf.Engine)
+	raftDB, err := createDB(subPathRaft, &conf.Engine, raftstore.CreateRaftLogCompactionFilter)
 	if err != nil {
 		return nil, err
 	}
+	if err = raftstore.RemoveLockStoreTmpFile(kvPath); err != nil {
+		return nil, err
+	}
 	meta, err := bundle.LockStore.LoadFromFile(filepath.Join(kvPath, raftstore.LockstoreFileName))
 	if err != nil {
 		return nil, err
@@ -94,6 +118,7 @@ func setupRaftServer(bundle *mvcc.DBBundle, safePoint *tikv.SafePoint, pdClient
 	}
 
 	engines := raftstore.NewEngines(bundle, raftDB, kvPath, raftPath)
+	engines.SetMaxBatchEntries(raftstore.BadgerMaxBatchEntries(conf.Engine.MaxMemTableSize))
 
 	innerServer := raftstore.NewRaftInnerServer(conf, engines, raftConf)
 	innerServer.Setup(pdClient)
@@ -142,14 +167,14 @@ func setupRaftStoreConf(raftConf *raftstore.Config, conf *config.Config) {
 	raftConf.SplitCheck.RegionSplitKeys = uint64(conf.Coprocessor.RegionSplitKeys)
 }
 
-func createDB(subPath string, safePoint *tikv.SafePoint, conf *tidbconfig.Engine) (*badger.DB, error) {
+// createDB opens the engine in subPath, the compaction filters of the factories run in order.
+func createDB(subPath string, conf *tidbconfig.Engine, filters ...raftstore.CompactionFilterFactory) (*badger.DB, error) {
 	opts := badger.DefaultOptions
 	opts.NumCompactors = conf.NumCompactors
 	opts.ValueThreshold = conf.ValueThreshold
 	if subPath == subPathRaft {
 		// Do not need to write blob for raft engine because it will be deleted soon.
 		opts.ValueThreshold = 0
-		opts.CompactionFilterFactory = raftstore.CreateRaftLogCompactionFilter
 	} else {
 		opts.ManagedTxns = true
 	}
@@ -173,8 +198,8 @@ func createDB(subPath string, safePoint *tikv.SafePoint, conf *tidbconfig.Engine
 	opts.MaxBlockCacheSize = conf.BlockCacheSize
 	opts.MaxIndexCacheSize = conf.IndexCacheSize
 	opts.TableBuilderOptions.SuRFStartLevel = conf.SurfStartLevel
-	if safePoint != nil {
-		opts.CompactionFilterFactory = safePoint.CreateCompactionFilter
+	if len(filters) > 0 {
+		opts.CompactionFilterFactory = raftstore.ChainCompactionFilterFactories(filters...)
 	}
 	opts.CompactL0WhenClose = conf.CompactL0WhenClose
 	opts.VolatileMode = conf.VolatileMode